@@ -2,12 +2,16 @@ package assertsprocessor
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"go.uber.org/zap"
 	"io"
+	"math/rand"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -20,15 +24,106 @@ type restClient interface {
 	invoke(method string, api string, payload any) ([]byte, error)
 }
 
+// conditionalRestClient is implemented by the clients that can skip the download of an unchanged response
+type conditionalRestClient interface {
+	// GETs the api with If-None-Match: etag. Returns notModified true and no body if the response still
+	// has the etag, and the ETag of the response otherwise
+	invokeConditional(api string, etag string) (body []byte, newETag string, notModified bool, err error)
+}
+
+// apiResponse is a response of the Asserts API
+type apiResponse struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+}
+
+type AssertsRetryConfig struct {
+	// The attempts of an idempotent call, including the first one
+	MaxAttempts int `mapstructure:"max_attempts" json:"max_attempts"`
+	// The backoff doubles with every retry, up to the max backoff. A random jitter of up to the backoff is used
+	InitialBackoffMillis int `mapstructure:"initial_backoff_millis" json:"initial_backoff_millis"`
+	MaxBackoffSeconds    int `mapstructure:"max_backoff_seconds" json:"max_backoff_seconds"`
+	// The circuit breaker opens after these many consecutive failed calls. 0 disables the breaker
+	CircuitBreakerFailures    int `mapstructure:"circuit_breaker_failures" json:"circuit_breaker_failures"`
+	CircuitBreakerOpenSeconds int `mapstructure:"circuit_breaker_open_seconds" json:"circuit_breaker_open_seconds"`
+}
+
+func (rc *AssertsRetryConfig) validateAt(v *configValidator, path string) {
+	if rc.MaxAttempts < 1 {
+		v.addf(joinPath(path, "max_attempts"), "%d must be at least 1", rc.MaxAttempts)
+	}
+	for _, setting := range []struct {
+		name  string
+		value int
+	}{
+		{"initial_backoff_millis", rc.InitialBackoffMillis},
+		{"max_backoff_seconds", rc.MaxBackoffSeconds},
+		{"circuit_breaker_failures", rc.CircuitBreakerFailures},
+		{"circuit_breaker_open_seconds", rc.CircuitBreakerOpenSeconds},
+	} {
+		if setting.value < 0 {
+			v.addf(joinPath(path, setting.name), "%d must not be negative", setting.value)
+		}
+	}
+}
+
+// ApiError is returned when the Asserts API responds with a status other than 200
+type ApiError struct {
+	Api        string
+	StatusCode int
+	Body       string
+	// The delay asked for by the Retry-After header, zero when the header is not set
+	RetryAfter time.Duration
+}
+
+func (e *ApiError) Error() string {
+	return fmt.Sprintf("%s returned status %d: %s", e.Api, e.StatusCode, e.Body)
+}
+
+// The calls rejected because of the load on the server or of a failure in the server are worth retrying
+func (e *ApiError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError
+}
+
 type assertsClient struct {
-	config *Config
-	logger *zap.Logger
+	config  *Config
+	logger  *zap.Logger
+	client  *http.Client
+	breaker *circuitBreaker // nil when the circuit breaker is disabled
+	sleep   func(d time.Duration)
+}
+
+// The calls that do not change anything in Asserts are retried. The thresholds are queried with a POST
+func isIdempotent(method string, api string) bool {
+	return (method != http.MethodPost && method != http.MethodPatch) || api == latencyThresholdsApi
 }
 
 func (ac *assertsClient) invoke(method string, api string, payload any) ([]byte, error) {
-	client := &http.Client{
-		Timeout: time.Second * 5,
+	response, err := ac.call(method, api, payload, nil)
+	if response == nil {
+		return nil, err
 	}
+	return response.body, err
+}
+
+func (ac *assertsClient) invokeConditional(api string, etag string) ([]byte, string, bool, error) {
+	header := http.Header{}
+	if etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	response, err := ac.call(http.MethodGet, api, nil, header)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if response.statusCode == http.StatusNotModified {
+		return nil, etag, true, nil
+	}
+	return response.body, response.header.Get("ETag"), false, nil
+}
+
+// Makes the call with retries. The response is returned along with an ApiError as well
+func (ac *assertsClient) call(method string, api string, payload any, header http.Header) (*apiResponse, error) {
 	var requestBody = make([]byte, 0)
 	if http.MethodPost == method || http.MethodPut == method {
 		// Encode request payload
@@ -39,11 +134,90 @@ func (ac *assertsClient) invoke(method string, api string, payload any) ([]byte,
 			return nil, err
 		}
 		requestBody = buf.Bytes()
+		if ac.config.AssertsServer.Compression == CompressionGzip {
+			if requestBody, err = gzipBody(requestBody); err != nil {
+				ac.logger.Error("Request payload compression error", zap.Error(err))
+				return nil, err
+			}
+		}
+	}
+
+	if ac.breaker != nil && !ac.breaker.allow() {
+		ac.logger.Debug("Skipping call as the circuit breaker is open", zap.String("Api", api))
+		return nil, errCircuitOpen
+	}
+
+	maxAttempts := 1
+	if retry := ac.config.AssertsServerRetry; retry != nil && isIdempotent(method, api) {
+		maxAttempts = retry.MaxAttempts
+	}
+	var response *apiResponse
+	var err error
+	for attempt := 1; ; attempt++ {
+		response, err = ac.invokeOnce(method, api, requestBody, header)
+		backoff, retry := ac.shouldRetry(err, attempt, maxAttempts)
+		if !retry {
+			break
+		}
+		ac.logger.Info("Retrying",
+			zap.String("Api", api),
+			zap.Int("Attempt", attempt),
+			zap.Duration("Backoff", backoff),
+			zap.Error(err),
+		)
+		if ac.sleep != nil {
+			ac.sleep(backoff)
+		} else {
+			time.Sleep(backoff)
+		}
+	}
+
+	if ac.breaker != nil {
+		var apiError *ApiError
+		if err == nil {
+			ac.breaker.onSuccess()
+		} else if !errors.As(err, &apiError) {
+			ac.breaker.onFailure(0)
+		} else if apiError.retryable() {
+			ac.breaker.onFailure(apiError.RetryAfter)
+		} else {
+			// The server is up, though the call was rejected
+			ac.breaker.onSuccess()
+		}
 	}
+	return response, err
+}
 
+// Returns the backoff before the next attempt, and false if the call is not to be retried. A Retry-After
+// longer than the max backoff is not waited for, the circuit breaker pauses the calls instead
+func (ac *assertsClient) shouldRetry(err error, attempt int, maxAttempts int) (time.Duration, bool) {
+	if err == nil || attempt >= maxAttempts {
+		return 0, false
+	}
+	var apiError *ApiError
+	if errors.As(err, &apiError) && !apiError.retryable() {
+		return 0, false
+	}
+	retry := ac.config.AssertsServerRetry
+	maxBackoff := time.Duration(retry.MaxBackoffSeconds) * time.Second
+	if apiError != nil && apiError.RetryAfter > 0 {
+		return apiError.RetryAfter, apiError.RetryAfter <= maxBackoff
+	}
+	backoff := time.Duration(retry.InitialBackoffMillis) * time.Millisecond << (attempt - 1)
+	if backoff > maxBackoff || backoff <= 0 {
+		backoff = maxBackoff
+	}
+	if backoff <= 0 {
+		return 0, true
+	}
+	// Full jitter, so that the collectors do not retry in lockstep
+	return time.Duration(rand.Int63n(int64(backoff))) + 1, true
+}
+
+func (ac *assertsClient) invokeOnce(method string, api string, requestBody []byte, header http.Header) (*apiResponse, error) {
 	// Build request
-	assertsServer := *ac.config.AssertsServer
-	url := assertsServer["endpoint"] + api
+	assertsServer := ac.config.AssertsServer
+	url := assertsServer.Endpoint + api
 	req, err := http.NewRequest(method, url, bytes.NewReader(requestBody))
 	if err != nil {
 		ac.logger.Error("Error creating new http request", zap.Error(err))
@@ -52,19 +226,19 @@ func (ac *assertsClient) invoke(method string, api string, payload any) ([]byte,
 
 	ac.logger.Debug("Invoking", zap.String("Api", api))
 
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Accept", "application/json")
-	// Add authentication headers
-	if assertsServer["user"] != "" && assertsServer["password"] != "" {
-		req.Header.Add("Authorization", "Basic "+basicAuth(assertsServer["user"], assertsServer["password"]))
+	setAssertsHeaders(req, ac.config)
+	for name, values := range header {
+		req.Header[name] = values
 	}
-	if ac.config.AssertsTenant != "" {
-		req.Header.Add("X-Asserts-Tenant", ac.config.AssertsTenant)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if assertsServer.Compression == CompressionGzip && len(requestBody) > 0 {
+		req.Header.Set("Content-Encoding", CompressionGzip)
 	}
 
 	// Make the call
-	response, err := client.Do(req)
-	var responseBody []byte = nil
+	response, err := ac.client.Do(req)
+	var result *apiResponse = nil
 
 	// Handle response
 	if err != nil {
@@ -73,23 +247,38 @@ func (ac *assertsClient) invoke(method string, api string, payload any) ([]byte,
 			zap.Error(err),
 		)
 	} else {
-		responseBody, err = ac.readResponseBody(api, response.StatusCode, response.Body)
+		result = &apiResponse{statusCode: response.StatusCode, header: response.Header}
+		result.body, err = ac.readResponseBody(api, response.StatusCode, response.Body)
+		var apiError *ApiError
+		if errors.As(err, &apiError) {
+			apiError.RetryAfter = parseRetryAfter(response.Header.Get("Retry-After"), time.Now())
+		}
 	}
 
-	return responseBody, err
+	return result, err
+}
+
+// Sets the headers of the Asserts server config and the tenant on a request to the Asserts API
+func setAssertsHeaders(req *http.Request, config *Config) {
+	for name, value := range config.AssertsServer.Headers {
+		req.Header.Set(name, value)
+	}
+	if config.AssertsTenant != "" {
+		req.Header.Add("X-Asserts-Tenant", config.AssertsTenant)
+	}
 }
 
 func (ac *assertsClient) readResponseBody(api string, statusCode int, body io.ReadCloser) ([]byte, error) {
 	responseBody, err := io.ReadAll(body)
 	if err == nil {
-		if statusCode == 200 {
+		if statusCode == http.StatusOK || statusCode == http.StatusNotModified {
 			ac.logger.Debug("Got Response",
 				zap.String("Api", api),
 				zap.String("Body", string(responseBody)),
 			)
 		} else {
 			bodyString := string(responseBody)
-			err = errors.New(bodyString)
+			err = &ApiError{Api: api, StatusCode: statusCode, Body: bodyString}
 			ac.logger.Info("Un-expected response",
 				zap.String("Api", api),
 				zap.Int("Status code", statusCode),
@@ -107,6 +296,35 @@ func (ac *assertsClient) readResponseBody(api string, statusCode int, body io.Re
 	return responseBody, err
 }
 
+// Parses the Retry-After header, which is either a number of seconds or an HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+func gzipBody(body []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	writer := gzip.NewWriter(buf)
+	if _, err := writer.Write(body); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func basicAuth(username string, password string) string {
 	auth := username + ":" + password
 	return base64.StdEncoding.EncodeToString([]byte(auth))
@@ -116,9 +334,20 @@ var (
 	restClientFactory = createRestClient
 )
 
-func createRestClient(logger *zap.Logger, pConfig *Config) restClient {
-	return &assertsClient{
+func createRestClient(logger *zap.Logger, pConfig *Config) (restClient, error) {
+	httpClient, err := pConfig.AssertsServer.newHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	client := &assertsClient{
 		config: pConfig,
 		logger: logger,
+		client: httpClient,
+		sleep:  time.Sleep,
+	}
+	if retry := pConfig.AssertsServerRetry; retry != nil && retry.CircuitBreakerFailures > 0 {
+		client.breaker = newCircuitBreaker(retry.CircuitBreakerFailures,
+			time.Duration(retry.CircuitBreakerOpenSeconds)*time.Second)
 	}
+	return client, nil
 }
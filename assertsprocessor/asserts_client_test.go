@@ -1,13 +1,16 @@
 package assertsprocessor
 
 import (
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 	"io"
 	"math"
 	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 type (
@@ -52,11 +55,12 @@ func TestInvoke(t *testing.T) {
 	logger, _ := zap.NewProduction()
 	ac := assertsClient{
 		logger: logger,
+		client: http.DefaultClient,
 		config: &Config{
-			AssertsServer: &map[string]string{
-				"endpoint": "http://localhost:8031",
-				"user":     "asserts",
-				"password": "asserts",
+			AssertsServer: &AssertsServerConfig{
+				Endpoint: "http://localhost:8031",
+				User:     "asserts",
+				Password: "asserts",
 			},
 			AssertsTenant: "bootstrap",
 		},
@@ -71,11 +75,12 @@ func TestInvokeEncodingError(t *testing.T) {
 	logger, _ := zap.NewProduction()
 	ac := assertsClient{
 		logger: logger,
+		client: http.DefaultClient,
 		config: &Config{
-			AssertsServer: &map[string]string{
-				"endpoint": "http://localhost:8031",
-				"user":     "asserts",
-				"password": "asserts",
+			AssertsServer: &AssertsServerConfig{
+				Endpoint: "http://localhost:8031",
+				User:     "asserts",
+				Password: "asserts",
 			},
 			AssertsTenant: "bootstrap",
 		},
@@ -90,11 +95,12 @@ func TestInvokeInvalidSchema(t *testing.T) {
 	logger, _ := zap.NewProduction()
 	ac := assertsClient{
 		logger: logger,
+		client: http.DefaultClient,
 		config: &Config{
-			AssertsServer: &map[string]string{
-				"endpoint": "ht  tp://localhost:8031",
-				"user":     "asserts",
-				"password": "asserts",
+			AssertsServer: &AssertsServerConfig{
+				Endpoint: "ht  tp://localhost:8031",
+				User:     "asserts",
+				Password: "asserts",
 			},
 			AssertsTenant: "bootstrap",
 		},
@@ -155,3 +161,149 @@ func TestReadResponseBodyError(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Equal(t, 0, len(body))
 }
+
+// Returns a client of a server that responds with the statuses in turn, and the number of calls made
+func buildRetryingClient(statuses []int, header http.Header) (*assertsClient, *httptest.Server, *int, *[]time.Duration) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[calls]
+		calls++
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(http.StatusText(status)))
+	}))
+	var backoffs []time.Duration
+	ac := &assertsClient{
+		logger: logger,
+		client: http.DefaultClient,
+		config: &Config{
+			AssertsServer: &AssertsServerConfig{Endpoint: server.URL},
+			AssertsServerRetry: &AssertsRetryConfig{
+				MaxAttempts:          3,
+				InitialBackoffMillis: 100,
+				MaxBackoffSeconds:    30,
+			},
+		},
+		sleep: func(d time.Duration) { backoffs = append(backoffs, d) },
+	}
+	return ac, server, &calls, &backoffs
+}
+
+func TestInvokeRetriesServerErrors(t *testing.T) {
+	ac, server, calls, backoffs := buildRetryingClient([]int{503, 502, 200}, nil)
+	defer server.Close()
+
+	body, err := ac.invoke(http.MethodGet, configApi, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "OK", string(body))
+	assert.Equal(t, 3, *calls)
+	assert.Equal(t, 2, len(*backoffs))
+	assert.LessOrEqual(t, (*backoffs)[0], 100*time.Millisecond)
+	assert.LessOrEqual(t, (*backoffs)[1], 200*time.Millisecond)
+}
+
+func TestInvokeGivesUpAfterMaxAttempts(t *testing.T) {
+	ac, server, calls, _ := buildRetryingClient([]int{500, 500, 500, 200}, nil)
+	defer server.Close()
+
+	_, err := ac.invoke(http.MethodPost, latencyThresholdsApi, "junit")
+	assert.Equal(t, 3, *calls)
+	var apiError *ApiError
+	assert.True(t, errors.As(err, &apiError))
+	assert.Equal(t, 500, apiError.StatusCode)
+	assert.Equal(t, latencyThresholdsApi, apiError.Api)
+}
+
+func TestInvokeDoesNotRetryClientErrors(t *testing.T) {
+	ac, server, calls, _ := buildRetryingClient([]int{401, 200}, nil)
+	defer server.Close()
+
+	_, err := ac.invoke(http.MethodGet, configApi, nil)
+	assert.Equal(t, 1, *calls)
+	var apiError *ApiError
+	assert.True(t, errors.As(err, &apiError))
+	assert.Equal(t, 401, apiError.StatusCode)
+	assert.Equal(t, "Unauthorized", apiError.Body)
+}
+
+func TestInvokeDoesNotRetryNonIdempotentCalls(t *testing.T) {
+	ac, server, calls, _ := buildRetryingClient([]int{503, 200}, nil)
+	defer server.Close()
+
+	_, err := ac.invoke(http.MethodPost, configApi, "junit")
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, *calls)
+}
+
+func TestInvokeRespectsRetryAfter(t *testing.T) {
+	ac, server, calls, backoffs := buildRetryingClient([]int{429, 200}, http.Header{"Retry-After": {"2"}})
+	defer server.Close()
+
+	_, err := ac.invoke(http.MethodGet, configApi, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, *calls)
+	assert.Equal(t, []time.Duration{2 * time.Second}, *backoffs)
+
+	// A Retry-After longer than the max backoff is not waited for
+	ac, server, calls, backoffs = buildRetryingClient([]int{429, 200}, http.Header{"Retry-After": {"120"}})
+	defer server.Close()
+	ac.breaker = newCircuitBreaker(5, time.Minute)
+	_, err = ac.invoke(http.MethodGet, configApi, nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, *calls)
+	assert.Equal(t, 0, len(*backoffs))
+
+	// The circuit breaker pauses the calls until then
+	_, err = ac.invoke(http.MethodGet, configApi, nil)
+	assert.Equal(t, errCircuitOpen, err)
+	assert.Equal(t, 1, *calls)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 7, 1, 10, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, 30*time.Second, parseRetryAfter("30", now))
+	assert.Equal(t, time.Minute, parseRetryAfter("Sat, 01 Jul 2023 10:01:00 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+}
+
+// A config server that responds with 304 when the ETag of the request is that of the config
+func buildConfigServer(body *string, etag *string) (*httptest.Server, *int) {
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == *etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fetches++
+		w.Header().Set("ETag", *etag)
+		_, _ = w.Write([]byte(*body))
+	}))
+	return server, &fetches
+}
+
+func TestInvokeConditional(t *testing.T) {
+	body, etag := `{"capture_metrics": true}`, `"v1"`
+	server, fetches := buildConfigServer(&body, &etag)
+	defer server.Close()
+	ac := &assertsClient{
+		logger: logger,
+		client: http.DefaultClient,
+		config: &Config{AssertsServer: &AssertsServerConfig{Endpoint: server.URL}},
+	}
+
+	responseBody, newETag, notModified, err := ac.invokeConditional(configApi, "")
+	assert.Nil(t, err)
+	assert.False(t, notModified)
+	assert.Equal(t, body, string(responseBody))
+	assert.Equal(t, `"v1"`, newETag)
+
+	responseBody, newETag, notModified, err = ac.invokeConditional(configApi, `"v1"`)
+	assert.Nil(t, err)
+	assert.True(t, notModified)
+	assert.Nil(t, responseBody)
+	assert.Equal(t, `"v1"`, newETag)
+	assert.Equal(t, 1, *fetches)
+}
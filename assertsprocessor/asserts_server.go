@@ -0,0 +1,167 @@
+package assertsprocessor
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/config/confighttp"
+	"go.opentelemetry.io/collector/config/configtls"
+)
+
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+// The connection to the Asserts server. The client is built with the HTTP client settings of the collector
+type AssertsServerConfig struct {
+	Endpoint string `mapstructure:"endpoint" json:"endpoint"`
+	User     string `mapstructure:"user" json:"user"`
+	Password string `mapstructure:"password" json:"password"`
+	// Optional. TLS settings for an endpoint with a private CA or that requires a client certificate
+	TLS *TLSClientConfig `mapstructure:"tls" json:"tls"`
+	// Optional. The proxy of the requests. The HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables
+	// are used when not set
+	ProxyURL string `mapstructure:"proxy_url" json:"proxy_url"`
+	// Optional. Headers added to every request
+	Headers        map[string]string `mapstructure:"headers" json:"headers"`
+	TimeoutSeconds int               `mapstructure:"timeout_seconds" json:"timeout_seconds"`
+	// Optional. The compression of the request bodies, gzip or none
+	Compression string `mapstructure:"compression" json:"compression"`
+	// Optional. The idle connections kept open to the server
+	MaxIdleConns int `mapstructure:"max_idle_conns" json:"max_idle_conns"`
+	// Optional. Authentication other than basic auth with the user and password
+	Auth *AssertsAuthConfig `mapstructure:"auth" json:"auth"`
+}
+
+type TLSClientConfig struct {
+	// The CA certificates that verify the server certificate, in addition to the system certificates
+	CAFile string `mapstructure:"ca_file" json:"ca_file"`
+	// The client certificate and key, for the servers that require mutual TLS
+	CertFile           string `mapstructure:"cert_file" json:"cert_file"`
+	KeyFile            string `mapstructure:"key_file" json:"key_file"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify" json:"insecure_skip_verify"`
+	ServerName         string `mapstructure:"server_name_override" json:"server_name_override"`
+}
+
+func (sc *AssertsServerConfig) validateAt(v *configValidator, path string) {
+	if sc.ProxyURL != "" {
+		if _, err := url.Parse(sc.ProxyURL); err != nil {
+			v.addf(joinPath(path, "proxy_url"), "invalid proxy url %s: %v", sc.ProxyURL, err)
+		}
+	}
+	switch sc.Compression {
+	case "", CompressionNone, CompressionGzip:
+	default:
+		v.addf(joinPath(path, "compression"), "unknown compression %s, must be %s or %s",
+			sc.Compression, CompressionGzip, CompressionNone)
+	}
+	if sc.TimeoutSeconds < 0 {
+		v.addf(joinPath(path, "timeout_seconds"), "%d must not be negative", sc.TimeoutSeconds)
+	}
+	if sc.MaxIdleConns < 0 {
+		v.addf(joinPath(path, "max_idle_conns"), "%d must not be negative", sc.MaxIdleConns)
+	}
+	if sc.TLS != nil {
+		sc.TLS.validateAt(v, joinPath(path, "tls"))
+	}
+	if sc.Auth != nil {
+		sc.Auth.validateAt(v, joinPath(path, "auth"))
+	}
+}
+
+func (tc *TLSClientConfig) validateAt(v *configValidator, path string) {
+	if tc.CertFile != "" && tc.KeyFile == "" {
+		v.addf(joinPath(path, "key_file"), "not set, the cert_file and key_file must be set together")
+	}
+	if tc.CertFile == "" && tc.KeyFile != "" {
+		v.addf(joinPath(path, "cert_file"), "not set, the cert_file and key_file must be set together")
+	}
+}
+
+// Builds the client shared by all the calls to the server, so that the connections are pooled
+func (sc *AssertsServerConfig) newHTTPClient() (*http.Client, error) {
+	settings := confighttp.HTTPClientSettings{
+		Endpoint: sc.Endpoint,
+		Timeout:  sc.timeout(),
+		// No other round tripper is set, so the next one is the transport of the client
+		CustomRoundTripper: func(next http.RoundTripper) (http.RoundTripper, error) {
+			if transport, ok := next.(*http.Transport); ok {
+				if err := sc.configureTransport(transport); err != nil {
+					return nil, err
+				}
+			}
+			return sc.newAuthRoundTripper(next), nil
+		},
+	}
+	if sc.MaxIdleConns > 0 {
+		settings.MaxIdleConns = &sc.MaxIdleConns
+		settings.MaxIdleConnsPerHost = &sc.MaxIdleConns
+	}
+	if sc.TLS != nil {
+		settings.TLSSetting = sc.TLS.toTLSSetting()
+	}
+	// The auth extension, if any, is looked up once the processor is started
+	return settings.ToClient(nil, component.TelemetrySettings{})
+}
+
+// Sets the proxy and the CA file, which the collector HTTP client settings do not set the way the
+// processor does
+func (sc *AssertsServerConfig) configureTransport(transport *http.Transport) error {
+	if sc.ProxyURL != "" {
+		proxyURL, err := url.Parse(sc.ProxyURL)
+		if err != nil {
+			return err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if sc.TLS != nil {
+		return sc.TLS.trustCAFile(transport)
+	}
+	return nil
+}
+
+// Returns the timeout of each call, 5 seconds by default
+func (sc *AssertsServerConfig) timeout() time.Duration {
+	if sc.TimeoutSeconds > 0 {
+		return time.Duration(sc.TimeoutSeconds) * time.Second
+	}
+	return 5 * time.Second
+}
+
+func (tc *TLSClientConfig) toTLSSetting() configtls.TLSClientSetting {
+	return configtls.TLSClientSetting{
+		// The CA file is trusted by trustCAFile, as the collector would trust it instead of the system CAs
+		TLSSetting: configtls.TLSSetting{
+			CertFile: tc.CertFile,
+			KeyFile:  tc.KeyFile,
+		},
+		InsecureSkipVerify: tc.InsecureSkipVerify,
+		ServerName:         tc.ServerName,
+	}
+}
+
+// Trusts the certificates of the CA file along with the system certificates
+func (tc *TLSClientConfig) trustCAFile(transport *http.Transport) error {
+	if tc.CAFile == "" || transport.TLSClientConfig == nil {
+		return nil
+	}
+	pem, err := os.ReadFile(tc.CAFile)
+	if err != nil {
+		return fmt.Errorf("failed to read CA file %s: %w", tc.CAFile, err)
+	}
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		rootCAs = x509.NewCertPool()
+	}
+	if !rootCAs.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in CA file %s", tc.CAFile)
+	}
+	transport.TLSClientConfig.RootCAs = rootCAs
+	return nil
+}
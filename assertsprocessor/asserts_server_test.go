@@ -0,0 +1,131 @@
+package assertsprocessor
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssertsClientWithPrivateCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	// The server certificate is not trusted without its CA
+	rc, err := createRestClient(logger, &Config{AssertsServer: &AssertsServerConfig{Endpoint: server.URL}})
+	assert.Nil(t, err)
+	_, err = rc.invoke(http.MethodGet, configApi, nil)
+	assert.NotNil(t, err)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.Nil(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	}), 0600))
+	rc, err = createRestClient(logger, &Config{AssertsServer: &AssertsServerConfig{
+		Endpoint: server.URL,
+		TLS:      &TLSClientConfig{CAFile: caFile},
+	}})
+	assert.Nil(t, err)
+	body, err := rc.invoke(http.MethodGet, configApi, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, `{}`, string(body))
+
+	_, err = createRestClient(logger, &Config{AssertsServer: &AssertsServerConfig{
+		Endpoint: server.URL,
+		TLS:      &TLSClientConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+	}})
+	assert.NotNil(t, err)
+}
+
+func TestAssertsClientHeadersAndCompression(t *testing.T) {
+	var headers http.Header
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		reader, err := gzip.NewReader(r.Body)
+		assert.Nil(t, err)
+		body, _ = io.ReadAll(reader)
+		_, _ = w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	rc, err := createRestClient(logger, &Config{
+		AssertsServer: &AssertsServerConfig{
+			Endpoint:    server.URL,
+			User:        "asserts",
+			Password:    "asserts",
+			Headers:     map[string]string{"X-Scope": "platform"},
+			Compression: CompressionGzip,
+		},
+		AssertsTenant: "bootstrap",
+	})
+	assert.Nil(t, err)
+	_, err = rc.invoke(http.MethodPost, latencyThresholdsApi, []string{"api-server"})
+	assert.Nil(t, err)
+
+	assert.Equal(t, "[\"api-server\"]\n", string(body))
+	assert.Equal(t, "platform", headers.Get("X-Scope"))
+	assert.Equal(t, "gzip", headers.Get("Content-Encoding"))
+	assert.Equal(t, "application/json", headers.Get("Content-Type"))
+	assert.Equal(t, "bootstrap", headers.Get("X-Asserts-Tenant"))
+	assert.Equal(t, "Basic "+basicAuth("asserts", "asserts"), headers.Get("Authorization"))
+}
+
+func TestAssertsClientProxy(t *testing.T) {
+	var proxiedHost string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxiedHost = r.URL.Host
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer proxy.Close()
+
+	rc, err := createRestClient(logger, &Config{AssertsServer: &AssertsServerConfig{
+		Endpoint: "http://asserts.internal:8030",
+		ProxyURL: proxy.URL,
+	}})
+	assert.Nil(t, err)
+	_, err = rc.invoke(http.MethodGet, configApi, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "asserts.internal:8030", proxiedHost)
+}
+
+func TestTrustCAFileWithSystemCAs(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.Nil(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	}), 0600))
+
+	transport := &http.Transport{TLSClientConfig: &tls.Config{}}
+	assert.Nil(t, (&TLSClientConfig{CAFile: caFile}).trustCAFile(transport))
+	systemCAs, err := x509.SystemCertPool()
+	assert.Nil(t, err)
+	assert.True(t, systemCAs.AppendCertsFromPEM(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	})))
+	assert.True(t, systemCAs.Equal(transport.TLSClientConfig.RootCAs))
+
+	assert.NotNil(t, (&TLSClientConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")}).trustCAFile(transport))
+}
+
+func TestValidateAssertsServer(t *testing.T) {
+	assert.Nil(t, validateSection(&AssertsServerConfig{Endpoint: "http://localhost:8030"}))
+	assert.NotNil(t, validateSection(&AssertsServerConfig{Compression: "zstd"}))
+	assert.NotNil(t, validateSection(&AssertsServerConfig{TimeoutSeconds: -1}))
+	assert.NotNil(t, validateSection(&AssertsServerConfig{TLS: &TLSClientConfig{CertFile: "client.pem"}}))
+	assert.NotNil(t, validateSection(&AssertsServerConfig{ProxyURL: "http://proxy:3128\n"}))
+}
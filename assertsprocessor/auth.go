@@ -0,0 +1,335 @@
+package assertsprocessor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/collector/component"
+)
+
+const (
+	defaultAPIKeyHeader = "X-Api-Key"
+	// The token is refreshed this long before it expires
+	tokenExpiryMargin = 30 * time.Second
+)
+
+// The authentication of the calls to the Asserts server. At most one of the authenticator, oauth2, the
+// bearer token and the api key is used, failing which the user and password are used for basic auth
+type AssertsAuthConfig struct {
+	// The ID of a collector auth extension, e.g. oauth2client/asserts, so that the credentials are shared
+	// with the exporters
+	Authenticator string `mapstructure:"authenticator" json:"authenticator"`
+	// The token sent as Authorization: Bearer <token>. The file, such as a mounted Kubernetes secret, is
+	// read again when it changes
+	BearerToken     string `mapstructure:"bearer_token" json:"bearer_token"`
+	BearerTokenFile string `mapstructure:"bearer_token_file" json:"bearer_token_file"`
+	// The key sent in the api key header
+	APIKey       string `mapstructure:"api_key" json:"api_key"`
+	APIKeyFile   string `mapstructure:"api_key_file" json:"api_key_file"`
+	APIKeyHeader string `mapstructure:"api_key_header" json:"api_key_header"`
+	// The password of the basic auth user, read from a file instead of the password setting
+	PasswordFile string `mapstructure:"password_file" json:"password_file"`
+	// The OAuth2 client credentials flow
+	OAuth2 *OAuth2ClientCredentialsConfig `mapstructure:"oauth2" json:"oauth2"`
+}
+
+type OAuth2ClientCredentialsConfig struct {
+	TokenURL         string   `mapstructure:"token_url" json:"token_url"`
+	ClientID         string   `mapstructure:"client_id" json:"client_id"`
+	ClientSecret     string   `mapstructure:"client_secret" json:"client_secret"`
+	ClientSecretFile string   `mapstructure:"client_secret_file" json:"client_secret_file"`
+	Scopes           []string `mapstructure:"scopes" json:"scopes"`
+}
+
+func (ac *AssertsAuthConfig) validateAt(v *configValidator, path string) {
+	methods := 0
+	for _, configured := range []bool{
+		ac.Authenticator != "",
+		ac.BearerToken != "" || ac.BearerTokenFile != "",
+		ac.APIKey != "" || ac.APIKeyFile != "",
+		ac.OAuth2 != nil,
+	} {
+		if configured {
+			methods++
+		}
+	}
+	if methods > 1 {
+		v.addf(path, "at most one of authenticator, oauth2, bearer token and api key can be set")
+	}
+	if ac.Authenticator != "" {
+		var id component.ID
+		if err := id.UnmarshalText([]byte(ac.Authenticator)); err != nil {
+			v.add(joinPath(path, "authenticator"),
+				ValidationError{message: fmt.Sprintf("invalid authenticator %s: %v", ac.Authenticator, err), error: err})
+		}
+	}
+	if oauth2 := ac.OAuth2; oauth2 != nil {
+		oauth2Path := joinPath(path, "oauth2")
+		if oauth2.TokenURL == "" {
+			v.addf(joinPath(oauth2Path, "token_url"), "not set")
+		}
+		if oauth2.ClientID == "" {
+			v.addf(joinPath(oauth2Path, "client_id"), "not set")
+		}
+		if oauth2.ClientSecret == "" && oauth2.ClientSecretFile == "" {
+			v.addf(joinPath(oauth2Path, "client_secret"), "not set, nor client_secret_file")
+		}
+	}
+}
+
+// fileCredential is a credential set in the config or read from a file. The file is read again when its
+// modification time changes, so that rotated credentials are picked up
+type fileCredential struct {
+	value   string
+	path    string
+	modTime time.Time
+	mutex   sync.Mutex
+}
+
+func newFileCredential(value string, path string) *fileCredential {
+	return &fileCredential{value: value, path: path}
+}
+
+func (fc *fileCredential) get() (string, error) {
+	if fc.path == "" {
+		return fc.value, nil
+	}
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	info, err := os.Stat(fc.path)
+	if err != nil {
+		return "", err
+	}
+	if !info.ModTime().Equal(fc.modTime) {
+		content, err := os.ReadFile(fc.path)
+		if err != nil {
+			return "", err
+		}
+		fc.value, fc.modTime = strings.TrimSpace(string(content)), info.ModTime()
+	}
+	return fc.value, nil
+}
+
+// authRoundTripper sets the authentication headers of the requests to the Asserts server
+type authRoundTripper struct {
+	base      http.RoundTripper
+	authorize func(req *http.Request) error
+	// Called when the server rejects the credentials
+	onUnauthorized func()
+}
+
+func (rt *authRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The request is not to be modified by a RoundTripper
+	req = req.Clone(req.Context())
+	if err := rt.authorize(req); err != nil {
+		return nil, err
+	}
+	response, err := rt.base.RoundTrip(req)
+	if err == nil && response.StatusCode == http.StatusUnauthorized && rt.onUnauthorized != nil {
+		rt.onUnauthorized()
+	}
+	return response, err
+}
+
+// Wraps the transport with the configured authentication. Returns the transport as is when there is
+// nothing to authenticate with, or when a collector auth extension authenticates the requests instead
+func (sc *AssertsServerConfig) newAuthRoundTripper(base http.RoundTripper) http.RoundTripper {
+	auth := sc.Auth
+	if auth == nil {
+		auth = &AssertsAuthConfig{}
+	}
+	switch {
+	case auth.Authenticator != "":
+		return base
+	case auth.OAuth2 != nil:
+		tokens := &oauth2TokenSource{
+			config:       auth.OAuth2,
+			clientSecret: newFileCredential(auth.OAuth2.ClientSecret, auth.OAuth2.ClientSecretFile),
+			client:       &http.Client{Transport: base, Timeout: 30 * time.Second},
+			now:          time.Now,
+		}
+		return &authRoundTripper{
+			base: base,
+			authorize: func(req *http.Request) error {
+				token, err := tokens.token()
+				if err != nil {
+					return err
+				}
+				req.Header.Set("Authorization", "Bearer "+token)
+				return nil
+			},
+			onUnauthorized: tokens.invalidate,
+		}
+	case auth.BearerToken != "" || auth.BearerTokenFile != "":
+		token := newFileCredential(auth.BearerToken, auth.BearerTokenFile)
+		return &authRoundTripper{
+			base: base,
+			authorize: func(req *http.Request) error {
+				value, err := token.get()
+				if err != nil {
+					return err
+				}
+				req.Header.Set("Authorization", "Bearer "+value)
+				return nil
+			},
+		}
+	case auth.APIKey != "" || auth.APIKeyFile != "":
+		key := newFileCredential(auth.APIKey, auth.APIKeyFile)
+		header := auth.APIKeyHeader
+		if header == "" {
+			header = defaultAPIKeyHeader
+		}
+		return &authRoundTripper{
+			base: base,
+			authorize: func(req *http.Request) error {
+				value, err := key.get()
+				if err != nil {
+					return err
+				}
+				req.Header.Set(header, value)
+				return nil
+			},
+		}
+	case sc.User != "" && (sc.Password != "" || auth.PasswordFile != ""):
+		password := newFileCredential(sc.Password, auth.PasswordFile)
+		return &authRoundTripper{
+			base: base,
+			authorize: func(req *http.Request) error {
+				value, err := password.get()
+				if err != nil {
+					return err
+				}
+				req.Header.Set("Authorization", "Basic "+basicAuth(sc.User, value))
+				return nil
+			},
+		}
+	}
+	return base
+}
+
+// oauth2TokenSource fetches the access tokens of the client credentials flow, and caches a token until
+// shortly before it expires
+type oauth2TokenSource struct {
+	config       *OAuth2ClientCredentialsConfig
+	clientSecret *fileCredential
+	client       *http.Client
+	accessToken  string
+	expiry       time.Time
+	now          func() time.Time
+	mutex        sync.Mutex
+}
+
+type oauth2TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func (ts *oauth2TokenSource) token() (string, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	if ts.accessToken != "" && (ts.expiry.IsZero() || ts.now().Add(tokenExpiryMargin).Before(ts.expiry)) {
+		return ts.accessToken, nil
+	}
+	secret, err := ts.clientSecret.get()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {ts.config.ClientID},
+		"client_secret": {secret},
+	}
+	if len(ts.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(ts.config.Scopes, " "))
+	}
+	response, err := ts.client.PostForm(ts.config.TokenURL, form)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = response.Body.Close() }()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oauth2 token request returned status %d: %s", response.StatusCode, string(body))
+	}
+	var tokenResponse oauth2TokenResponse
+	if err = json.Unmarshal(body, &tokenResponse); err != nil {
+		return "", err
+	}
+	if tokenResponse.AccessToken == "" {
+		return "", errors.New("oauth2 token response has no access_token")
+	}
+	ts.accessToken = tokenResponse.AccessToken
+	ts.expiry = time.Time{}
+	if tokenResponse.ExpiresIn > 0 {
+		ts.expiry = ts.now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
+	}
+	return ts.accessToken, nil
+}
+
+// Forgets the cached token, so that a revoked token is replaced on the next call
+func (ts *oauth2TokenSource) invalidate() {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	ts.accessToken = ""
+}
+
+// clientAuthenticator is implemented by the client auth extensions of the collector
+type clientAuthenticator interface {
+	RoundTripper(base http.RoundTripper) (http.RoundTripper, error)
+}
+
+// Returns the ID of the collector auth extension that authenticates the calls to the Asserts API, if any
+func (config *Config) assertsAuthenticator() string {
+	if config.AssertsServer == nil || config.AssertsServer.Auth == nil {
+		return ""
+	}
+	return config.AssertsServer.Auth.Authenticator
+}
+
+// Authenticates the requests with the configured collector auth extension
+func (ac *assertsClient) startAuthenticator(host component.Host) error {
+	if ac.config == nil {
+		return nil
+	}
+	return startAuthenticator(host, ac.config, ac.client)
+}
+
+// Wraps the transport of the client with the round tripper of the configured collector auth extension
+func startAuthenticator(host component.Host, config *Config, client *http.Client) error {
+	authenticatorID := config.assertsAuthenticator()
+	if authenticatorID == "" {
+		return nil
+	}
+	var id component.ID
+	if err := id.UnmarshalText([]byte(authenticatorID)); err != nil {
+		return err
+	}
+	extension, found := host.GetExtensions()[id]
+	if !found {
+		return fmt.Errorf("auth extension %s not found", authenticatorID)
+	}
+	authenticator, ok := extension.(clientAuthenticator)
+	if !ok {
+		return fmt.Errorf("extension %s is not a client authenticator", authenticatorID)
+	}
+	roundTripper, err := authenticator.RoundTripper(client.Transport)
+	if err != nil {
+		return err
+	}
+	client.Transport = roundTripper
+	return nil
+}
@@ -0,0 +1,254 @@
+package assertsprocessor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/consumer/consumertest"
+)
+
+// A server that records the headers of the last request, and responds with the statuses in turn and
+// then with 200
+func buildAuthServer(statuses ...int) (*httptest.Server, *http.Header) {
+	var headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		if len(statuses) > 0 {
+			w.WriteHeader(statuses[0])
+			statuses = statuses[1:]
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	return server, &headers
+}
+
+func TestBearerTokenFileRotation(t *testing.T) {
+	server, headers := buildAuthServer()
+	defer server.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("token-1\n"), 0600))
+
+	rc, err := createRestClient(logger, &Config{AssertsServer: &AssertsServerConfig{
+		Endpoint: server.URL,
+		Auth:     &AssertsAuthConfig{BearerTokenFile: tokenFile},
+	}})
+	assert.Nil(t, err)
+	_, err = rc.invoke(http.MethodGet, configApi, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer token-1", headers.Get("Authorization"))
+
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("token-2\n"), 0600))
+	assert.Nil(t, os.Chtimes(tokenFile, time.Now(), time.Now().Add(time.Minute)))
+	_, err = rc.invoke(http.MethodGet, configApi, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer token-2", headers.Get("Authorization"))
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	server, headers := buildAuthServer()
+	defer server.Close()
+
+	rc, err := createRestClient(logger, &Config{AssertsServer: &AssertsServerConfig{
+		Endpoint: server.URL,
+		User:     "asserts",
+		Password: "asserts",
+		Auth:     &AssertsAuthConfig{APIKey: "secret", APIKeyHeader: "X-Asserts-Key"},
+	}})
+	assert.Nil(t, err)
+	_, err = rc.invoke(http.MethodGet, configApi, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", headers.Get("X-Asserts-Key"))
+	assert.Equal(t, "", headers.Get("Authorization"))
+}
+
+func TestBasicAuthPasswordFile(t *testing.T) {
+	server, headers := buildAuthServer()
+	defer server.Close()
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	assert.Nil(t, os.WriteFile(passwordFile, []byte("from-file"), 0600))
+
+	rc, err := createRestClient(logger, &Config{AssertsServer: &AssertsServerConfig{
+		Endpoint: server.URL,
+		User:     "asserts",
+		Auth:     &AssertsAuthConfig{PasswordFile: passwordFile},
+	}})
+	assert.Nil(t, err)
+	_, err = rc.invoke(http.MethodGet, configApi, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "Basic "+basicAuth("asserts", "from-file"), headers.Get("Authorization"))
+}
+
+func TestOAuth2ClientCredentials(t *testing.T) {
+	tokenRequests := 0
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests++
+		assert.Nil(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "collector", r.PostForm.Get("client_id"))
+		assert.Equal(t, "secret", r.PostForm.Get("client_secret"))
+		assert.Equal(t, "asserts.read asserts.write", r.PostForm.Get("scope"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token": "token-` + string(rune('0'+tokenRequests)) +
+			`", "token_type": "Bearer", "expires_in": 3600}`))
+	}))
+	defer tokenServer.Close()
+	// The server rejects the second call, as if the token were revoked
+	server, headers := buildAuthServer(http.StatusOK, http.StatusUnauthorized)
+	defer server.Close()
+
+	rc, err := createRestClient(logger, &Config{AssertsServer: &AssertsServerConfig{
+		Endpoint: server.URL,
+		Auth: &AssertsAuthConfig{OAuth2: &OAuth2ClientCredentialsConfig{
+			TokenURL:     tokenServer.URL,
+			ClientID:     "collector",
+			ClientSecret: "secret",
+			Scopes:       []string{"asserts.read", "asserts.write"},
+		}},
+	}})
+	assert.Nil(t, err)
+
+	_, err = rc.invoke(http.MethodGet, configApi, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer token-1", headers.Get("Authorization"))
+
+	// The cached token is used until it is rejected
+	_, err = rc.invoke(http.MethodGet, configApi, nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, "Bearer token-1", headers.Get("Authorization"))
+	assert.Equal(t, 1, tokenRequests)
+
+	_, err = rc.invoke(http.MethodGet, configApi, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer token-2", headers.Get("Authorization"))
+	assert.Equal(t, 2, tokenRequests)
+}
+
+func TestOAuth2TokenExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tokens := &oauth2TokenSource{accessToken: "token", expiry: now.Add(time.Minute), now: func() time.Time { return now }}
+	token, err := tokens.token()
+	assert.Nil(t, err)
+	assert.Equal(t, "token", token)
+
+	// Refreshed shortly before it expires
+	tokens.config = &OAuth2ClientCredentialsConfig{TokenURL: "http://localhost:1"}
+	tokens.clientSecret = newFileCredential("secret", "")
+	tokens.client = http.DefaultClient
+	now = now.Add(45 * time.Second)
+	_, err = tokens.token()
+	assert.NotNil(t, err)
+}
+
+type authExtension struct {
+	component.StartFunc
+	component.ShutdownFunc
+}
+
+func (ae *authExtension) RoundTripper(base http.RoundTripper) (http.RoundTripper, error) {
+	return &authRoundTripper{base: base, authorize: func(req *http.Request) error {
+		req.Header.Set("Authorization", "Bearer from-extension")
+		return nil
+	}}, nil
+}
+
+type extensionHost struct {
+	component.Host
+	extensions map[component.ID]component.Component
+}
+
+func (h *extensionHost) GetExtensions() map[component.ID]component.Component {
+	return h.extensions
+}
+
+func TestAuthenticatorExtension(t *testing.T) {
+	server, headers := buildAuthServer()
+	defer server.Close()
+
+	cfg := &Config{AssertsServer: &AssertsServerConfig{
+		Endpoint: server.URL,
+		Auth:     &AssertsAuthConfig{Authenticator: "oauth2client/asserts"},
+	}}
+	rc, err := createRestClient(logger, cfg)
+	assert.Nil(t, err)
+	client := rc.(*assertsClient)
+
+	host := &extensionHost{extensions: map[component.ID]component.Component{}}
+	assert.NotNil(t, client.startAuthenticator(host))
+
+	host.extensions[component.NewIDWithName("oauth2client", "asserts")] = &authExtension{}
+	assert.Nil(t, client.startAuthenticator(host))
+	_, err = rc.invoke(http.MethodGet, configApi, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer from-extension", headers.Get("Authorization"))
+}
+
+func TestConfigFetchWaitsForAuthenticator(t *testing.T) {
+	authorizations := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizations <- r.Header.Get("Authorization")
+		_, _ = w.Write([]byte(`{"sampling_latency_threshold_seconds": 0.75}`))
+	}))
+	defer server.Close()
+	restClientFactory = createRestClient
+
+	cfg := buildValidConfig()
+	cfg.PrometheusExporterPort = 9468
+	cfg.AssertsServer = &AssertsServerConfig{
+		Endpoint: server.URL,
+		Auth:     &AssertsAuthConfig{Authenticator: "oauth2client/asserts"},
+	}
+	p, err := newProcessor(logger, component.BuildInfo{}, context.Background(), cfg, consumertest.NewNop())
+	assert.Nil(t, err)
+	defer func() { _ = p.metricBuilder.stopExporter() }()
+	// Nothing is fetched before the auth extension is started
+	assert.Equal(t, 0, len(authorizations))
+	assert.Equal(t, activeConfigLocal, p.configRefresh.getActiveSource())
+
+	host := &extensionHost{extensions: map[component.ID]component.Component{
+		component.NewIDWithName("oauth2client", "asserts"): &authExtension{},
+	}}
+	assert.Nil(t, p.Start(context.Background(), host))
+	defer func() { _ = p.Shutdown(context.Background()) }()
+	select {
+	case authorization := <-authorizations:
+		assert.Equal(t, "Bearer from-extension", authorization)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "the config is not fetched once started")
+	}
+	assert.Eventually(t, func() bool {
+		return p.configRefresh.getActiveSource() == activeConfigAsserts
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestConfigStreamAuthenticator(t *testing.T) {
+	server, headers := buildAuthServer()
+	defer server.Close()
+
+	stream, _ := buildConfigStream(t, server.URL, ConfigDeliveryLongPoll)
+	stream.config.AssertsServer.Auth = &AssertsAuthConfig{Authenticator: "oauth2client/asserts"}
+	host := &extensionHost{extensions: map[component.ID]component.Component{
+		component.NewIDWithName("oauth2client", "asserts"): &authExtension{},
+	}}
+	assert.Nil(t, stream.startAuthenticator(host))
+	response, err := stream.client.Get(server.URL)
+	assert.Nil(t, err)
+	_ = response.Body.Close()
+	assert.Equal(t, "Bearer from-extension", headers.Get("Authorization"))
+}
+
+func TestValidateAssertsAuth(t *testing.T) {
+	assert.Nil(t, validateSection(&AssertsAuthConfig{BearerToken: "token"}))
+	assert.NotNil(t, validateSection(&AssertsAuthConfig{BearerToken: "token", APIKey: "key"}))
+	assert.NotNil(t, validateSection(&AssertsAuthConfig{Authenticator: "/asserts"}))
+	assert.NotNil(t, validateSection(&AssertsAuthConfig{OAuth2: &OAuth2ClientCredentialsConfig{TokenURL: "http://idp/token"}}))
+	assert.Nil(t, validateSection(&AssertsAuthConfig{OAuth2: &OAuth2ClientCredentialsConfig{
+		TokenURL: "http://idp/token", ClientID: "collector", ClientSecretFile: "/var/run/secrets/asserts/client-secret",
+	}}))
+}
@@ -0,0 +1,72 @@
+package assertsprocessor
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned without calling the Asserts API while the circuit breaker is open
+var errCircuitOpen = errors.New("asserts api circuit breaker is open")
+
+// circuitBreaker stops the calls to the Asserts API after consecutive failures, so that the config and
+// threshold polling pause while the API is down. Once the open period is over, a single trial call is let
+// through, which closes the breaker if it succeeds and opens it again otherwise
+type circuitBreaker struct {
+	failureThreshold int
+	openDuration     time.Duration
+	failures         int
+	openUntil        time.Time
+	trialInFlight    bool
+	now              func() time.Time
+	mutex            sync.Mutex
+}
+
+func newCircuitBreaker(failureThreshold int, openDuration time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		failureThreshold: failureThreshold,
+		openDuration:     openDuration,
+		now:              time.Now,
+	}
+}
+
+// Returns false if the call is not to be made
+func (cb *circuitBreaker) allow() bool {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if cb.openUntil.IsZero() {
+		return true
+	}
+	if cb.now().Before(cb.openUntil) || cb.trialInFlight {
+		return false
+	}
+	cb.trialInFlight = true
+	return true
+}
+
+func (cb *circuitBreaker) onSuccess() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	cb.failures = 0
+	cb.openUntil = time.Time{}
+	cb.trialInFlight = false
+}
+
+// Records a failed call. The breaker stays open for at least the retryAfter duration the server asked for
+func (cb *circuitBreaker) onFailure(retryAfter time.Duration) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	cb.failures++
+	cb.trialInFlight = false
+	if cb.failures < cb.failureThreshold && retryAfter <= 0 {
+		return
+	}
+	openDuration := cb.openDuration
+	if cb.failures < cb.failureThreshold || retryAfter > openDuration {
+		openDuration = retryAfter
+	}
+	cb.openUntil = cb.now().Add(openDuration)
+}
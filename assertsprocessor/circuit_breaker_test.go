@@ -0,0 +1,46 @@
+package assertsprocessor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(1000, 0)
+	breaker := newCircuitBreaker(2, time.Minute)
+	breaker.now = func() time.Time { return now }
+
+	assert.True(t, breaker.allow())
+	breaker.onFailure(0)
+	assert.True(t, breaker.allow())
+	breaker.onFailure(0)
+	assert.False(t, breaker.allow())
+
+	// A single trial call once the breaker has been open for a while
+	now = now.Add(time.Minute)
+	assert.True(t, breaker.allow())
+	assert.False(t, breaker.allow())
+	breaker.onFailure(0)
+	assert.False(t, breaker.allow())
+
+	now = now.Add(time.Minute)
+	assert.True(t, breaker.allow())
+	breaker.onSuccess()
+	assert.True(t, breaker.allow())
+	assert.True(t, breaker.allow())
+}
+
+func TestCircuitBreakerRetryAfter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	breaker := newCircuitBreaker(5, time.Minute)
+	breaker.now = func() time.Time { return now }
+
+	// The breaker opens for as long as the server asks for, even before the failure threshold
+	breaker.onFailure(2 * time.Minute)
+	now = now.Add(90 * time.Second)
+	assert.False(t, breaker.allow())
+	now = now.Add(30 * time.Second)
+	assert.True(t, breaker.allow())
+}
@@ -2,6 +2,8 @@ package assertsprocessor
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 )
 
 type SpanAttribute struct {
@@ -15,8 +17,16 @@ type SpanAttributeConfig struct {
 	Rules     []*CustomAttributeConfig `mapstructure:"rules" json:"rules"`
 }
 
+// Overrides the sampling limits for a service. Only the limits that are set are overridden
+type ServiceSamplingOverride struct {
+	LimitPerService                *int `mapstructure:"trace_rate_limit_per_service" json:"trace_rate_limit_per_service"`
+	LimitPerRequestPerService      *int `mapstructure:"trace_rate_limit_per_service_per_request" json:"trace_rate_limit_per_service_per_request"`
+	NormalSamplingFrequencyMinutes *int `mapstructure:"normal_trace_sampling_rate_minutes" json:"normal_trace_sampling_rate_minutes"`
+}
+
 type Config struct {
-	AssertsServer                  *map[string]string                             `mapstructure:"asserts_server" json:"asserts_server"`
+	AssertsServer                  *AssertsServerConfig                           `mapstructure:"asserts_server" json:"asserts_server"`
+	AssertsServerRetry             *AssertsRetryConfig                            `mapstructure:"asserts_server_retry" json:"asserts_server_retry"`
 	Env                            string                                         `mapstructure:"asserts_env" json:"asserts_env"`
 	Site                           string                                         `mapstructure:"asserts_site" json:"asserts_site"`
 	AssertsTenant                  string                                         `mapstructure:"asserts_tenant" json:"asserts_tenant"`
@@ -32,55 +42,209 @@ type Config struct {
 	LimitPerRequestPerService      int                                            `mapstructure:"trace_rate_limit_per_service_per_request" json:"trace_rate_limit_per_service_per_request"`
 	RequestContextCacheTTL         int                                            `mapstructure:"request_context_cache_ttl_minutes" json:"request_context_cache_ttl_minutes"`
 	NormalSamplingFrequencyMinutes int                                            `mapstructure:"normal_trace_sampling_rate_minutes" json:"normal_trace_sampling_rate_minutes"`
+	NormalSamplingProbability      float64                                        `mapstructure:"normal_trace_sampling_probability" json:"normal_trace_sampling_probability"`
 	PrometheusExporterPort         uint64                                         `mapstructure:"prometheus_exporter_port" json:"prometheus_exporter_port"`
 	TraceFlushFrequencySeconds     int                                            `mapstructure:"trace_flush_frequency_seconds" json:"trace_flush_frequency_seconds"`
+	TracePriorityWeights           *TracePriorityWeights                          `mapstructure:"trace_priority_weights" json:"trace_priority_weights"`
+	TraceQueueMemoryLimitMiB       int                                            `mapstructure:"trace_queue_memory_limit_mib" json:"trace_queue_memory_limit_mib"`
+	CollectorTraceRateLimit        *TraceRateLimit                                `mapstructure:"collector_trace_rate_limit" json:"collector_trace_rate_limit"`
+	TenantTraceRateLimit           *TraceRateLimit                                `mapstructure:"tenant_trace_rate_limit" json:"tenant_trace_rate_limit"`
+	ServiceOverrides               map[string]*ServiceSamplingOverride            `mapstructure:"service_overrides" json:"service_overrides"`
+	PeerSampling                   *PeerSamplingConfig                            `mapstructure:"peer_sampling" json:"peer_sampling"`
+	DecidedTracesCacheSize         int                                            `mapstructure:"decided_traces_cache_size" json:"decided_traces_cache_size"`
+	DecidedTracesTTLSeconds        int                                            `mapstructure:"decided_traces_ttl_seconds" json:"decided_traces_ttl_seconds"`
+	LatencyBaseline                *LatencyBaselineConfig                         `mapstructure:"latency_baseline" json:"latency_baseline"`
+	ErrorBaseline                  *ErrorBaselineConfig                           `mapstructure:"error_baseline" json:"error_baseline"`
+	ThresholdProvider              *ThresholdProviderConfig                       `mapstructure:"threshold_provider" json:"threshold_provider"`
+	EntityKeyTTLMinutes            int                                            `mapstructure:"entity_key_ttl_minutes" json:"entity_key_ttl_minutes"`
+	MaxEntitiesPerThresholdRequest int                                            `mapstructure:"latency_thresholds_max_entities_per_request" json:"latency_thresholds_max_entities_per_request"`
+	ConfigSource                   *ConfigSourceConfig                            `mapstructure:"config_source" json:"config_source"`
+	ConfigRefreshIntervalSeconds   int                                            `mapstructure:"config_refresh_interval_seconds" json:"config_refresh_interval_seconds"`
+	ConfigRefreshJitterSeconds     int                                            `mapstructure:"config_refresh_jitter_seconds" json:"config_refresh_jitter_seconds"`
+	ConfigCacheFile                string                                         `mapstructure:"config_cache_file" json:"config_cache_file"`
+	ConfigRefreshToken             string                                         `mapstructure:"config_refresh_token" json:"config_refresh_token"`
 }
 
 // Validate implements the component.ConfigValidator interface.
-// Checks for any invalid regexp
+// Reports all the invalid settings, each at its path
 func (config *Config) Validate() error {
+	v := &configValidator{}
 	if config.Env == "" {
-		return ValidationError{
-			message: fmt.Sprintf("Env property is not set"),
-		}
+		v.addf("asserts_env", "not set")
 	}
-	for targetAtt, byServiceKey := range config.CustomAttributeConfigs {
-		for serviceKey, configs := range byServiceKey {
-			for _, _config := range configs {
-				err := _config.validate(targetAtt, serviceKey)
-				if err != nil {
-					return err
-				}
+	for _, targetAtt := range sortedMapKeys(config.CustomAttributeConfigs) {
+		byServiceKey := config.CustomAttributeConfigs[targetAtt]
+		for _, serviceKey := range sortedMapKeys(byServiceKey) {
+			for i, _config := range byServiceKey[serviceKey] {
+				_config.validateAt(v, fmt.Sprintf("custom_attributes[%s][%s][%d]", targetAtt, serviceKey, i))
 			}
 		}
 	}
-	for _, spanAttribute := range config.SpanAttributes {
-		attrName := spanAttribute.AttributeName
-		for _, attrConfig := range spanAttribute.AttributeConfigs {
-			serviceKey := getKey(attrConfig)
-			for _, rule := range attrConfig.Rules {
-				err := rule.validate(attrName, serviceKey)
-				if err != nil {
-					return err
-				}
+	for i, spanAttribute := range config.SpanAttributes {
+		for j, attrConfig := range spanAttribute.AttributeConfigs {
+			for k, rule := range attrConfig.Rules {
+				rule.validateAt(v, fmt.Sprintf("span_attributes[%d].attr_configs[%d].rules[%d]", i, j, k))
 			}
 		}
 	}
 
-	if config.LimitPerService < config.LimitPerRequestPerService {
-		return ValidationError{
-			message: fmt.Sprintf("LimitPerService: %d < LimitPerRequestPerService: %d",
-				config.LimitPerService, config.LimitPerRequestPerService),
+	if config.DefaultLatencyThreshold < 0 {
+		v.addf("sampling_latency_threshold_seconds", "%v must not be negative", config.DefaultLatencyThreshold)
+	}
+	validateLatencyHistogramBuckets(v, config.LatencyHistogramBuckets)
+
+	config.collectSamplingLimits(v)
+	if config.RequestContextCacheTTL <= 0 {
+		v.addf("request_context_cache_ttl_minutes", "%d must be positive", config.RequestContextCacheTTL)
+	}
+	if config.NormalSamplingFrequencyMinutes < 0 {
+		v.addf("normal_trace_sampling_rate_minutes", "%d must not be negative", config.NormalSamplingFrequencyMinutes)
+	}
+	if config.NormalSamplingProbability < 0 || config.NormalSamplingProbability > 1 {
+		v.addf("normal_trace_sampling_probability", "%v must be between 0 and 1", config.NormalSamplingProbability)
+	}
+	if config.PrometheusExporterPort < 1 || config.PrometheusExporterPort > 65535 {
+		v.addf("prometheus_exporter_port", "%d must be between 1 and 65535", config.PrometheusExporterPort)
+	}
+	if config.TraceFlushFrequencySeconds <= 0 {
+		v.addf("trace_flush_frequency_seconds", "%d must be positive", config.TraceFlushFrequencySeconds)
+	}
+	if config.TraceQueueMemoryLimitMiB < 0 {
+		v.addf("trace_queue_memory_limit_mib", "%d must not be negative", config.TraceQueueMemoryLimitMiB)
+	}
+
+	if limit := config.CollectorTraceRateLimit; limit != nil && (limit.TracesPerSecond < 0 || limit.SpansPerSecond < 0) {
+		v.addf("collector_trace_rate_limit", "must not be negative: %+v", *limit)
+	}
+	if limit := config.TenantTraceRateLimit; limit != nil && (limit.TracesPerSecond < 0 || limit.SpansPerSecond < 0) {
+		v.addf("tenant_trace_rate_limit", "must not be negative: %+v", *limit)
+	}
+
+	if config.DecidedTracesCacheSize < 0 {
+		v.addf("decided_traces_cache_size", "%d must not be negative", config.DecidedTracesCacheSize)
+	}
+	if config.DecidedTracesTTLSeconds < 0 {
+		v.addf("decided_traces_ttl_seconds", "%d must not be negative", config.DecidedTracesTTLSeconds)
+	}
+	if config.EntityKeyTTLMinutes < 0 {
+		v.addf("entity_key_ttl_minutes", "%d must not be negative", config.EntityKeyTTLMinutes)
+	}
+	if config.MaxEntitiesPerThresholdRequest < 0 {
+		v.addf("latency_thresholds_max_entities_per_request", "%d must not be negative",
+			config.MaxEntitiesPerThresholdRequest)
+	}
+
+	if config.AssertsServer != nil {
+		config.AssertsServer.validateAt(v, "asserts_server")
+	}
+	if config.AssertsServerRetry != nil {
+		config.AssertsServerRetry.validateAt(v, "asserts_server_retry")
+	}
+
+	if config.ConfigRefreshIntervalSeconds < 0 {
+		v.addf("config_refresh_interval_seconds", "%d must not be negative", config.ConfigRefreshIntervalSeconds)
+	}
+	if config.ConfigRefreshJitterSeconds < 0 {
+		v.addf("config_refresh_jitter_seconds", "%d must not be negative", config.ConfigRefreshJitterSeconds)
+	}
+	if config.ConfigSource != nil {
+		config.ConfigSource.validateAt(v, "config_source")
+	}
+	if config.ThresholdProvider != nil {
+		config.ThresholdProvider.validateAt(v, "threshold_provider")
+	}
+	if config.ErrorBaseline != nil {
+		config.ErrorBaseline.validateAt(v, "error_baseline")
+	}
+	if config.LatencyBaseline != nil {
+		config.LatencyBaseline.validateAt(v, "latency_baseline")
+	}
+	if config.PeerSampling != nil {
+		config.PeerSampling.validateAt(v, "peer_sampling")
+	}
+
+	if weights := config.TracePriorityWeights; weights != nil {
+		if weights.Latency < 0 || weights.Segments < 0 || weights.Spans < 0 || weights.Errors < 0 || weights.Retries < 0 {
+			v.addf("trace_priority_weights", "must not be negative: %+v", *weights)
+		}
+	}
+	return v.result()
+}
+
+func validateLatencyHistogramBuckets(v *configValidator, buckets []float64) {
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			v.addf(fmt.Sprintf("latency_histogram_buckets[%d]", i), "%v must be greater than the previous bucket %v",
+				buckets[i], buckets[i-1])
 		}
 	}
-	return nil
 }
 
-type ValidationError struct {
-	message string
-	error
+// Checks the sampling limits and the limits of the service overrides
+func (config *Config) validateSamplingLimits() error {
+	v := &configValidator{}
+	config.collectSamplingLimits(v)
+	return v.result()
 }
 
-func (v ValidationError) Error() string {
-	return v.message
+func (config *Config) collectSamplingLimits(v *configValidator) {
+	if config.LimitPerService <= 0 {
+		v.addf("trace_rate_limit_per_service", "%d must be positive", config.LimitPerService)
+	}
+	if config.LimitPerRequestPerService <= 0 {
+		v.addf("trace_rate_limit_per_service_per_request", "%d must be positive", config.LimitPerRequestPerService)
+	}
+	// The limits that are not positive are reported without the comparison with each other
+	if config.LimitPerService > 0 && config.LimitPerRequestPerService > 0 &&
+		config.LimitPerService < config.LimitPerRequestPerService {
+		v.addf("trace_rate_limit_per_service", "%d < trace_rate_limit_per_service_per_request: %d",
+			config.LimitPerService, config.LimitPerRequestPerService)
+	}
+	config.collectServiceOverrides(v)
+}
+
+// Checks the keys of the service overrides and the limits that they set, along with the limits they keep
+func (config *Config) collectServiceOverrides(v *configValidator) {
+	for _, serviceKey := range sortedMapKeys(config.ServiceOverrides) {
+		path := fmt.Sprintf("service_overrides[%s]", serviceKey)
+		namespace, service, found := strings.Cut(serviceKey, "#")
+		if serviceKey == "" || (found && (namespace == "" || service == "")) {
+			v.addf(path, "the key must be namespace#service, or the service name of a service without a namespace")
+			continue
+		}
+		override := config.ServiceOverrides[serviceKey]
+		if override == nil {
+			continue
+		}
+		valid := true
+		if limit := override.LimitPerService; limit != nil && *limit <= 0 {
+			v.addf(path+".trace_rate_limit_per_service", "%d must be positive", *limit)
+			valid = false
+		}
+		if limit := override.LimitPerRequestPerService; limit != nil && *limit <= 0 {
+			v.addf(path+".trace_rate_limit_per_service_per_request", "%d must be positive", *limit)
+			valid = false
+		}
+		if frequency := override.NormalSamplingFrequencyMinutes; frequency != nil && *frequency < 0 {
+			v.addf(path+".normal_trace_sampling_rate_minutes", "%d must not be negative", *frequency)
+		}
+		limits := serviceSamplingLimits{
+			LimitPerService:           config.LimitPerService,
+			LimitPerRequestPerService: config.LimitPerRequestPerService,
+		}.override(override)
+		if valid && limits.LimitPerService < limits.LimitPerRequestPerService {
+			v.addf(path+".trace_rate_limit_per_service", "%d < trace_rate_limit_per_service_per_request: %d",
+				limits.LimitPerService, limits.LimitPerRequestPerService)
+		}
+	}
+}
+
+// The keys of a map in order, so that the problems are reported in the same order each time
+func sortedMapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
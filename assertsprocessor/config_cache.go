@@ -0,0 +1,121 @@
+package assertsprocessor
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// The sources of the config in use
+const (
+	activeConfigAsserts = "asserts"
+	activeConfigCache   = "cache"
+	activeConfigFile    = "file"
+	activeConfigLocal   = "local"
+	activeConfigOpAMP   = "opamp"
+)
+
+// Fetches the config at startup. When the Asserts API cannot be reached, the config last applied from
+// the Asserts API is read from the cache file instead, so that the request context rules and metric labels
+// stay those of the Asserts config. Returns nil if neither is available, and the collector config is used
+func (cr *configRefresh) fetchInitialConfig(rc restClient) *Config {
+	config, err := cr.fetchConfig(rc)
+	if err == nil && config != nil {
+		cr.setActiveConfig(activeConfigAsserts, cr.fetchedBody)
+		return config
+	}
+	if err != nil {
+		cr.logger.Warn("Error fetching the config at startup", zap.Error(err))
+		if config, body := cr.loadConfigCache(); config != nil {
+			cr.setActiveConfig(activeConfigCache, body)
+			return config
+		}
+	}
+	cr.setActiveConfig(activeConfigLocal, nil)
+	return nil
+}
+
+// Returns the config at startup when the config is fetched once the processor is started. The config
+// last applied from the Asserts API is read from the cache file meanwhile. Returns nil if there is no
+// cached config, and the collector config is used
+func (cr *configRefresh) loadInitialConfig() *Config {
+	if config, body := cr.loadConfigCache(); config != nil {
+		cr.setActiveConfig(activeConfigCache, body)
+		return config
+	}
+	cr.setActiveConfig(activeConfigLocal, nil)
+	return nil
+}
+
+// Returns the cached config merged over the collector config along with the cached body, or nil if there
+// is no valid cached config
+func (cr *configRefresh) loadConfigCache() (*Config, []byte) {
+	if cr.cacheFile == "" {
+		return nil, nil
+	}
+	body, err := os.ReadFile(cr.cacheFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			cr.logger.Error("Error reading the config cache file", zap.String("Path", cr.cacheFile), zap.Error(err))
+		}
+		return nil, nil
+	}
+	config, err := cr.parseConfig(body)
+	if err != nil {
+		cr.logger.Error("Ignoring invalid config cache file", zap.String("Path", cr.cacheFile), zap.Error(err))
+		return nil, nil
+	}
+	cr.logger.Info("Using the cached config as the Asserts API cannot be reached", zap.String("Path", cr.cacheFile))
+	return config, body
+}
+
+// Writes the config of the Asserts API to the cache file. The file is replaced with a rename, so that a
+// collector that stops while writing does not leave a partial config behind
+func (cr *configRefresh) saveConfigCache(body []byte) {
+	if cr.cacheFile == "" || body == nil {
+		return
+	}
+	temp, err := os.CreateTemp(filepath.Dir(cr.cacheFile), filepath.Base(cr.cacheFile)+".*.tmp")
+	if err == nil {
+		_, err = temp.Write(body)
+		if closeErr := temp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(temp.Name(), cr.cacheFile)
+		}
+		if err != nil {
+			_ = os.Remove(temp.Name())
+		}
+	}
+	if err != nil {
+		cr.logger.Error("Error writing the config cache file", zap.String("Path", cr.cacheFile), zap.Error(err))
+		return
+	}
+	cr.logger.Debug("Cached the config", zap.String("Path", cr.cacheFile))
+}
+
+// Records the source of the config in use, and the document of the source that the config is merged from
+func (cr *configRefresh) setActiveConfig(source string, body []byte) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	cr.activeBody = body
+	if source == cr.activeSource {
+		return
+	}
+	cr.logger.Info("Config source in use", zap.String("Source", source))
+	cr.activeSource = source
+	if cr.activeSourceGauge != nil {
+		cr.activeSourceGauge.Reset()
+		cr.activeSourceGauge.With(prometheus.Labels{"source": source}).Set(1)
+	}
+}
+
+func (cr *configRefresh) getActiveSource() string {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	return cr.activeSource
+}
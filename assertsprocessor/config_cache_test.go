@@ -0,0 +1,99 @@
+package assertsprocessor
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func buildCachingConfigRefresh(t *testing.T, cacheFile string) *configRefresh {
+	localSettings, err := settingsOf(buildValidConfig())
+	assert.Nil(t, err)
+	return &configRefresh{logger: logger, localSettings: localSettings, cacheFile: cacheFile}
+}
+
+func TestFetchInitialConfigFromCache(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "asserts-config.json")
+
+	cr := buildCachingConfigRefresh(t, cacheFile)
+	config := cr.fetchInitialConfig(&mockRestClient{
+		expectedData: []byte(`{"sampling_latency_threshold_seconds": 0.75, "attributes_as_metric_labels": ["rpc.system"]}`),
+	})
+	assert.Equal(t, 0.75, config.DefaultLatencyThreshold)
+	assert.Equal(t, activeConfigAsserts, cr.getActiveSource())
+	cr.saveConfigCache(cr.fetchedBody)
+
+	// The Asserts API is down at the next startup
+	cr = buildCachingConfigRefresh(t, cacheFile)
+	config = cr.fetchInitialConfig(&mockRestClient{expectedErr: errors.New("connection refused")})
+	assert.NotNil(t, config)
+	assert.Equal(t, 0.75, config.DefaultLatencyThreshold)
+	assert.Equal(t, []string{"rpc.system"}, config.CaptureAttributesInMetric)
+	assert.Equal(t, 100, config.LimitPerService)
+	assert.Equal(t, activeConfigCache, cr.getActiveSource())
+}
+
+func TestFetchInitialConfigWithoutCache(t *testing.T) {
+	cr := buildCachingConfigRefresh(t, filepath.Join(t.TempDir(), "asserts-config.json"))
+	assert.Nil(t, cr.fetchInitialConfig(&mockRestClient{expectedErr: errors.New("connection refused")}))
+	assert.Equal(t, activeConfigLocal, cr.getActiveSource())
+
+	// Caching is disabled
+	cr = buildCachingConfigRefresh(t, "")
+	cr.saveConfigCache([]byte(`{}`))
+	assert.Nil(t, cr.fetchInitialConfig(&mockRestClient{expectedErr: errors.New("connection refused")}))
+	assert.Equal(t, activeConfigLocal, cr.getActiveSource())
+}
+
+func TestLoadInitialConfigFromCache(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "asserts-config.json")
+	cr := buildCachingConfigRefresh(t, cacheFile)
+	assert.Nil(t, cr.loadInitialConfig())
+	assert.Equal(t, activeConfigLocal, cr.getActiveSource())
+
+	cr.saveConfigCache([]byte(`{"sampling_latency_threshold_seconds": 0.75}`))
+	config := cr.loadInitialConfig()
+	assert.NotNil(t, config)
+	assert.Equal(t, 0.75, config.DefaultLatencyThreshold)
+	assert.Equal(t, activeConfigCache, cr.getActiveSource())
+}
+
+func TestLoadInvalidConfigCache(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "asserts-config.json")
+	assert.Nil(t, os.WriteFile(cacheFile, []byte(`{"sampling_latency_threshold_seconds": `), 0600))
+
+	cr := buildCachingConfigRefresh(t, cacheFile)
+	config, _ := cr.loadConfigCache()
+	assert.Nil(t, config)
+}
+
+func TestFetchAndUpdateConfigCachesAppliedConfig(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "asserts-config.json")
+	listener := &mockConfigListener{expectedIsUpdated: true, expectedPrepareErr: errors.New("invalid")}
+	cr := buildCachingConfigRefresh(t, cacheFile)
+	cr.config = &Config{DefaultLatencyThreshold: 0.5}
+	cr.configListeners = []configListener{listener}
+	cr.setActiveConfig(activeConfigCache, nil)
+	assert.Nil(t, cr.registerMetrics(&metrics{prometheusRegistry: prometheus.NewRegistry()}))
+	body := `{"sampling_latency_threshold_seconds": 0.75}`
+
+	// A rejected config is not cached
+	cr.fetchAndUpdateConfig(&mockRestClient{expectedData: []byte(body)})
+	_, err := os.Stat(cacheFile)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cr.activeSourceGauge.WithLabelValues(activeConfigCache)))
+
+	listener.expectedPrepareErr = nil
+	cr.fetchAndUpdateConfig(&mockRestClient{expectedData: []byte(body)})
+	cached, err := os.ReadFile(cacheFile)
+	assert.Nil(t, err)
+	assert.Equal(t, body, string(cached))
+	assert.Equal(t, activeConfigAsserts, cr.getActiveSource())
+	assert.Equal(t, float64(1), testutil.ToFloat64(cr.activeSourceGauge.WithLabelValues(activeConfigAsserts)))
+	assert.Equal(t, float64(0), testutil.ToFloat64(cr.activeSourceGauge.WithLabelValues(activeConfigCache)))
+}
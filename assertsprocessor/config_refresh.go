@@ -1,84 +1,492 @@
 package assertsprocessor
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/tilinna/clock"
 	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	"math/rand"
+	"net"
 	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// configListener applies the config updates to a component. An update is applied in two phases, so that
+// either all the components apply it or none does. First every listener with changes checks that it can
+// apply the new config, and then every listener applies it. If applying fails, the listeners that
+// already applied the update roll it back
 type configListener interface {
 	isUpdated(currConfig *Config, newConfig *Config) bool
+	// Returns an error if the new config cannot be applied. Must not change the component
+	prepareUpdate(newConfig *Config) error
+	// Applies the new config. Leaves the component unchanged if it returns an error
 	onUpdate(newConfig *Config) error
+	// Restores the config in use before the last onUpdate
+	rollbackUpdate()
 }
 
+// The settings that are only read when the processor is created. A config update that changes them is
+// applied without the changes, which are logged, so that the config in use is the one in effect
+var restartOnlySettings = map[string]bool{
+	"asserts_env": true, "asserts_site": true, "prometheus_exporter_port": true,
+	"trace_queue_memory_limit_mib": true, "collector_trace_rate_limit": true,
+	"tenant_trace_rate_limit": true, "peer_sampling": true,
+	"decided_traces_cache_size": true, "decided_traces_ttl_seconds": true, "latency_baseline": true,
+	"error_baseline": true, "threshold_provider": true, "entity_key_ttl_minutes": true,
+	"latency_thresholds_max_entities_per_request": true, "config_refresh_interval_seconds": true,
+	"config_refresh_jitter_seconds": true,
+}
+
+// The on-demand refreshes are at least this far apart
+const minOnDemandRefreshInterval = 10 * time.Second
+
+const (
+	configUpdateApplied    = "applied"
+	configUpdateRejected   = "rejected"
+	configUpdateRolledBack = "rolled_back"
+)
+
+// The settings of the collector config that the config of the Asserts API cannot change
+var localOnlySettings = []string{"asserts_server", "asserts_server_retry", "asserts_tenant", "config_source",
+	"config_cache_file", "config_refresh_token"}
+
 type configRefresh struct {
 	config           *Config
 	logger           *zap.Logger
 	configSyncTicker *clock.Ticker
-	stop             chan bool
-	restClient       restClient
-	configListeners  []configListener
+	// Each periodic fetch is delayed by a random duration of up to the jitter, so that the collectors
+	// started together do not call the Asserts API together
+	jitter time.Duration
+	// Triggers a refresh without waiting for the next tick
+	refreshNow chan struct{}
+	// The token of the on-demand refresh requests, which are only accepted from the loopback addresses
+	// when not set
+	refreshToken string
+	// The time of the last on-demand refresh accepted
+	lastOnDemandRefresh time.Time
+	stop                chan bool
+	restClient          restClient
+	// Set when a collector auth extension authenticates the calls to the Asserts API. The extension is only
+	// available once the processor is started, so the config is fetched first thing once started
+	fetchOnStart bool
+	// The ETag and version of the config last applied, so that the unchanged config is skipped
+	etag          string
+	remoteVersion string
+	// The ETag, version and body of the config last fetched, applied or not
+	fetchedETag    string
+	fetchedVersion string
+	fetchedBody    []byte
+	// The file of the config last applied from the Asserts API, empty if the config is not cached
+	cacheFile string
+	// Where the config in use comes from: asserts, cache, file, opamp or local
+	activeSource      string
+	activeSourceGauge *prometheus.GaugeVec
+	// The config document of the source in use, nil for the collector config
+	activeBody []byte
+	// The collector config, which the settings of the Asserts API config replace
+	localSettings configSettings
+	// Set when the config is read from a local file instead of the Asserts API
+	fileSource *fileConfigSource
+	// Set when the config is received from an OpAMP server instead of the Asserts API
+	opamp *opampAgent
+	// Set when the Asserts API notifies the collector of the config changes, which are polled for otherwise
+	stream          *configStream
+	configListeners []configListener
+	// The version of the config in use, incremented by each update applied
+	version uint64
+	// The number of config updates by result, when registered with the metrics
+	updateCount *prometheus.CounterVec
+	mutex       sync.Mutex
 }
 
 func (cr *configRefresh) stopUpdates() {
+	if cr.opamp != nil {
+		cr.opamp.stop()
+		return
+	}
+	if cr.stream != nil {
+		cr.stream.stop()
+	}
+	if cr.fileSource != nil {
+		cr.fileSource.close()
+	}
 	go func() { cr.stop <- true }()
 }
 
 func (cr *configRefresh) startUpdates() {
-	endPoint := (*(*cr.config).AssertsServer)["endpoint"]
-	if endPoint != "" {
-		go func() {
-			for {
-				select {
-				case <-cr.stop:
+	if cr.opamp != nil {
+		// The OpAMP server delivers the updates instead
+		if err := cr.opamp.start(); err != nil {
+			cr.logger.Error("Error starting the OpAMP client", zap.Error(err))
+		}
+		return
+	}
+	if cr.fileSource == nil && (cr.config.AssertsServer == nil || cr.config.AssertsServer.Endpoint == "") {
+		return
+	}
+	if cr.stream != nil {
+		cr.stream.start()
+	}
+	if cr.fileSource != nil {
+		if err := cr.fileSource.watch(cr.requestRefresh); err != nil {
+			cr.logger.Warn("Cannot watch the config file, it is polled instead",
+				zap.String("Path", cr.fileSource.path), zap.Error(err))
+		}
+	}
+	go func() {
+		if cr.fetchOnStart {
+			cr.refresh()
+		}
+		for {
+			select {
+			case <-cr.stop:
+				cr.logger.Info("Stopping collector config updates")
+				return
+			case <-cr.refreshNow:
+				cr.logger.Info("Refreshing collector config on demand")
+				cr.refresh()
+			case <-cr.configSyncTicker.C:
+				if cr.stream != nil && cr.stream.isConnected() {
+					// The stream requests a refresh for each change instead
+					continue
+				}
+				if !cr.waitJitter() {
 					cr.logger.Info("Stopping collector config updates")
 					return
-				case <-cr.configSyncTicker.C:
-					cr.logger.Info("Fetching collector config")
-					cr.fetchAndUpdateConfig(cr.restClient)
 				}
+				cr.refresh()
 			}
-		}()
+		}
+	}()
+}
+
+// Waits for a random delay of up to the jitter. Returns false if the updates are stopped meanwhile
+func (cr *configRefresh) waitJitter() bool {
+	if cr.jitter <= 0 || cr.fileSource != nil {
+		return true
+	}
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(cr.jitter))))
+	defer timer.Stop()
+	select {
+	case <-cr.stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (cr *configRefresh) refresh() {
+	if cr.fileSource != nil {
+		cr.readAndUpdateConfig()
+	} else {
+		cr.logger.Info("Fetching collector config")
+		cr.fetchAndUpdateConfig(cr.restClient)
+	}
+}
+
+// Requests a refresh of the config. A request made while another is pending is merged with it
+func (cr *configRefresh) requestRefresh() {
+	select {
+	case cr.refreshNow <- struct{}{}:
+	default:
+	}
+}
+
+// Handles POST requests for a refresh of the config. The requests must have the refresh token, or come
+// from the loopback address when there is no token, and are rejected within the minimum interval of the
+// last refresh requested
+func (cr *configRefresh) refreshHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !cr.authorizeRequest(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if !cr.allowOnDemandRefresh(time.Now()) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(minOnDemandRefreshInterval.Seconds())))
+			http.Error(w, "too many refresh requests", http.StatusTooManyRequests)
+			return
+		}
+		cr.requestRefresh()
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
+
+// Accepts the requests with the config_refresh_token, or the requests from the loopback addresses when the
+// token is not set. The refresh and the diagnostics endpoints are authorized alike
+func (cr *configRefresh) authorizeRequest(r *http.Request) bool {
+	if cr.refreshToken != "" {
+		expected := "Bearer " + cr.refreshToken
+		return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) == 1
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (cr *configRefresh) allowOnDemandRefresh(now time.Time) bool {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	if !cr.lastOnDemandRefresh.IsZero() && now.Sub(cr.lastOnDemandRefresh) < minOnDemandRefreshInterval {
+		return false
+	}
+	cr.lastOnDemandRefresh = now
+	return true
+}
+
+func (cr *configRefresh) readAndUpdateConfig() {
+	latestConfig, err := cr.fileSource.readIfChanged()
+	if err != nil {
+		cr.logger.Error("Error reading config file, the current config is kept",
+			zap.String("Path", cr.fileSource.path), zap.Error(err))
+		return
+	}
+	if latestConfig != nil {
+		cr.logConfig(latestConfig)
+		if cr.updateConfig(latestConfig) == nil {
+			cr.setActiveConfig(activeConfigFile, cr.fileSource.content)
+		}
 	}
 }
 
 func (cr *configRefresh) fetchAndUpdateConfig(rc restClient) {
 	latestConfig, err := cr.fetchConfig(rc)
-	if err == nil {
-		cr.updateConfig(latestConfig)
+	if err == nil && latestConfig != nil && cr.updateConfig(latestConfig) == nil {
+		// A config that is not applied is fetched in full again
+		cr.etag, cr.remoteVersion = cr.fetchedETag, cr.fetchedVersion
+		cr.setActiveConfig(activeConfigAsserts, cr.fetchedBody)
+		cr.saveConfigCache(cr.fetchedBody)
 	}
 }
 
+// Returns the config of the Asserts API merged over the collector config, or nil if the ETag or version
+// of the config are those of the config last applied
 func (cr *configRefresh) fetchConfig(rc restClient) (*Config, error) {
-	var config = &Config{}
-	body, err := rc.invoke(http.MethodGet, configApi, nil)
-	if err == nil {
-		err = json.Unmarshal(body, config)
-		if err == nil {
-			cr.logConfig(config)
-		} else {
-			cr.logger.Error("Error unmarshalling config", zap.Error(err))
+	var body []byte
+	var etag string
+	var err error
+	if conditional, ok := rc.(conditionalRestClient); ok {
+		var notModified bool
+		body, etag, notModified, err = conditional.invokeConditional(configApi, cr.etag)
+		if err == nil && notModified {
+			cr.logger.Debug("Config not modified", zap.String("ETag", etag))
+			return nil, nil
 		}
+	} else {
+		body, err = rc.invoke(http.MethodGet, configApi, nil)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	return config, err
+	version := configVersion(body)
+	if version != "" && version == cr.remoteVersion {
+		cr.logger.Debug("Config version not changed", zap.String("Version", version))
+		cr.etag = etag
+		return nil, nil
+	}
+	config, err := cr.parseConfig(body)
+	if err != nil {
+		return nil, err
+	}
+	cr.fetchedETag, cr.fetchedVersion, cr.fetchedBody = etag, version, body
+	cr.logConfig(config)
+	return config, nil
+}
+
+// Returns the config of the Asserts API merged over the collector config
+func (cr *configRefresh) parseConfig(body []byte) (*Config, error) {
+	var settings map[string]interface{}
+	if err := json.Unmarshal(body, &settings); err != nil {
+		cr.logger.Error("Error unmarshalling config", zap.Error(err))
+		return nil, err
+	}
+	return cr.mergeRemoteSettings(settings)
+}
+
+// Applies a YAML or JSON config document of a remote source other than the Asserts API, which is merged
+// over the collector config as the config of the Asserts API is
+func (cr *configRefresh) applyRemoteDocument(source string, body []byte) error {
+	var settings map[string]interface{}
+	if err := yaml.Unmarshal(body, &settings); err != nil {
+		return err
+	}
+	config, err := cr.mergeRemoteSettings(settings)
+	if err != nil {
+		return err
+	}
+	cr.logConfig(config)
+	if err = cr.updateConfig(config); err != nil {
+		return err
+	}
+	cr.setActiveConfig(source, body)
+	return nil
 }
 
-func (cr *configRefresh) updateConfig(latestConfig *Config) {
-	err := error(nil)
+// Returns the remote settings merged over the collector config, with the settings they do not set kept from
+// the config in use. Returns an error listing the invalid settings, if any
+func (cr *configRefresh) mergeRemoteSettings(settings map[string]interface{}) (*Config, error) {
+	for _, key := range localOnlySettings {
+		delete(settings, key)
+	}
+	config, err := cr.localSettings.merge(settings)
+	if err != nil {
+		cr.logger.Error("Error unmarshalling config", zap.Error(err))
+		return nil, err
+	}
+	cr.mutex.Lock()
+	currConfig := cr.config
+	cr.mutex.Unlock()
+	if currConfig != nil {
+		keepUnsetSettings(currConfig, config)
+	}
+	if err = config.Validate(); err != nil {
+		cr.logger.Error("Invalid config", zap.Error(err))
+		return nil, err
+	}
+	return config, nil
+}
+
+// The buckets, limits and frequencies that the new config does not set keep their current values, as the
+// listeners keep them when they apply the config
+func keepUnsetSettings(currConfig *Config, newConfig *Config) {
+	if len(newConfig.LatencyHistogramBuckets) == 0 {
+		newConfig.LatencyHistogramBuckets = currConfig.LatencyHistogramBuckets
+	}
+	samplerSettingsOf(currConfig).update(newConfig).applyTo(newConfig)
+}
+
+// Returns the version the Asserts API set in the config, if any
+func configVersion(body []byte) string {
+	var versioned struct {
+		Version json.RawMessage `json:"version"`
+	}
+	if err := json.Unmarshal(body, &versioned); err != nil {
+		return ""
+	}
+	return strings.Trim(string(versioned.Version), `"`)
+}
+
+// Applies the config to the listeners. Returns an error if the config is rejected or rolled back
+func (cr *configRefresh) updateConfig(latestConfig *Config) error {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	if cr.config != nil {
+		cr.keepRestartOnlySettings(cr.config, latestConfig)
+	}
+	updated := make([]configListener, 0)
 	for _, listener := range cr.configListeners {
 		if listener.isUpdated(cr.config, latestConfig) {
-			err = listener.onUpdate(latestConfig)
+			updated = append(updated, listener)
 		}
 	}
-	if err == nil {
-		// The config updates are accepted only when all the listeners consume the config updates without
-		// error. This could potentially leave different components with different versions of the config
+	if len(updated) == 0 {
 		cr.config = latestConfig
+		return nil
+	}
+
+	for _, listener := range updated {
+		if err := listener.prepareUpdate(latestConfig); err != nil {
+			cr.logger.Error("Rejected config update, the current config is kept",
+				zap.Uint64("Version", cr.version), zap.Error(err))
+			cr.recordUpdate(configUpdateRejected)
+			return err
+		}
+	}
+
+	for i, listener := range updated {
+		if err := listener.onUpdate(latestConfig); err != nil {
+			cr.logger.Error("Error applying config update, rolling back",
+				zap.Uint64("Version", cr.version), zap.Error(err))
+			// In the reverse order of the update
+			for j := i - 1; j >= 0; j-- {
+				updated[j].rollbackUpdate()
+			}
+			cr.recordUpdate(configUpdateRolledBack)
+			return err
+		}
+	}
+	cr.config = latestConfig
+	cr.version++
+	cr.logger.Info("Applied config update", zap.Uint64("Version", cr.version))
+	cr.recordUpdate(configUpdateApplied)
+	return nil
+}
+
+// Sets the restart only settings of the new config back to their values in the current config
+func (cr *configRefresh) keepRestartOnlySettings(currConfig *Config, newConfig *Config) {
+	currValue, newValue := reflect.ValueOf(currConfig).Elem(), reflect.ValueOf(newConfig).Elem()
+	for i := 0; i < currValue.NumField(); i++ {
+		name, _, _ := strings.Cut(currValue.Type().Field(i).Tag.Get("json"), ",")
+		if !restartOnlySettings[name] || reflect.DeepEqual(currValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			continue
+		}
+		cr.logger.Warn("The setting is read at startup only, the change is ignored until the collector is restarted",
+			zap.String("Setting", name))
+		newValue.Field(i).Set(currValue.Field(i))
+	}
+}
+
+func (cr *configRefresh) recordUpdate(result string) {
+	if cr.updateCount != nil {
+		cr.updateCount.With(prometheus.Labels{"result": result}).Inc()
+	}
+}
+
+func (cr *configRefresh) getVersion() uint64 {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	return cr.version
+}
+
+// Registers the config version and source gauges and the config update counter
+func (cr *configRefresh) registerMetrics(m *metrics) error {
+	cr.updateCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "asserts",
+		Subsystem: "config",
+		Name:      "updates_total",
+		Help:      "The config updates, by result: applied, rejected or rolled_back",
+	}, []string{"result"})
+	if err := m.registerCollector(cr.updateCount); err != nil {
+		return err
+	}
+	err := m.registerCollector(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "asserts",
+		Subsystem: "config",
+		Name:      "version",
+		Help:      "The version of the config in use, incremented by each update applied",
+	}, func() float64 { return float64(cr.getVersion()) }))
+	if err != nil {
+		return err
+	}
+	cr.mutex.Lock()
+	cr.activeSourceGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "asserts",
+		Subsystem: "config",
+		Name:      "source",
+		Help:      "Set to 1 for the source of the config in use: asserts, cache, file, opamp or local",
+	}, []string{"source"})
+	if cr.activeSource != "" {
+		cr.activeSourceGauge.With(prometheus.Labels{"source": cr.activeSource}).Set(1)
 	}
+	cr.mutex.Unlock()
+	return m.registerCollector(cr.activeSourceGauge)
 }
 
 func (cr *configRefresh) logConfig(config *Config) {
-	cr.logger.Debug("Got config", zap.Any("config", config))
+	cr.logger.Debug("Got config", zap.Uint64("Current version", cr.getVersion()), zap.Any("config", config))
 }
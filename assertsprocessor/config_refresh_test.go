@@ -3,18 +3,24 @@ package assertsprocessor
 import (
 	"context"
 	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/tilinna/clock"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 )
 
 type (
 	mockConfigListener struct {
-		expectedIsUpdated bool
-		expectedOnUpdate  bool
-		expectedErr       error
+		expectedIsUpdated  bool
+		expectedPrepare    bool
+		expectedOnUpdate   bool
+		expectedRollback   bool
+		expectedPrepareErr error
+		expectedErr        error
 	}
 )
 
@@ -22,11 +28,27 @@ func (mcl *mockConfigListener) isUpdated(currConfig *Config, newConfig *Config)
 	return mcl.expectedIsUpdated
 }
 
+func (mcl *mockConfigListener) prepareUpdate(newConfig *Config) error {
+	mcl.expectedPrepare = true
+	return mcl.expectedPrepareErr
+}
+
 func (mcl *mockConfigListener) onUpdate(newConfig *Config) error {
 	mcl.expectedOnUpdate = true
 	return mcl.expectedErr
 }
 
+func (mcl *mockConfigListener) rollbackUpdate() {
+	mcl.expectedRollback = true
+}
+
+// The settings of a valid collector config, which the fetched configs are merged over
+func buildValidLocalSettings(t *testing.T) configSettings {
+	localSettings, err := settingsOf(buildValidConfig())
+	assert.Nil(t, err)
+	return localSettings
+}
+
 func TestFetchConfig(t *testing.T) {
 	mockClient := &mockRestClient{
 		expectedData: []byte(`{
@@ -98,6 +120,7 @@ func TestFetchConfig(t *testing.T) {
 	ctx := context.Background()
 	cr := configRefresh{
 		logger:           logger,
+		localSettings:    buildValidLocalSettings(t),
 		config:           &config,
 		configSyncTicker: clock.FromContext(ctx).NewTicker(10 * time.Millisecond),
 		restClient:       mockClient,
@@ -147,6 +170,59 @@ func TestFetchConfigUnmarshalError(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
+func TestFetchConfigMergesLocalSettings(t *testing.T) {
+	local := buildValidConfig()
+	local.AssertsServer = &AssertsServerConfig{Endpoint: "http://localhost:8030"}
+	localSettings, err := settingsOf(local)
+	assert.Nil(t, err)
+	cr := configRefresh{logger: logger, localSettings: localSettings}
+
+	config, err := cr.fetchConfig(&mockRestClient{
+		expectedData: []byte(`{
+			"trace_rate_limit_per_service": 20,
+			"asserts_server": {"endpoint": "http://asserts-api:8030"}
+		}`),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 20, config.LimitPerService)
+	// The settings the Asserts API does not set are those of the collector config
+	assert.True(t, config.SampleTraces)
+	assert.Equal(t, 30, config.TraceFlushFrequencySeconds)
+	assert.Equal(t, "dev", config.Env)
+	// The connection to the Asserts API is not changed by its config
+	assert.Equal(t, "http://localhost:8030", config.AssertsServer.Endpoint)
+}
+
+func TestFetchConfigInvalid(t *testing.T) {
+	cr := configRefresh{logger: logger, config: buildValidConfig(), localSettings: buildValidLocalSettings(t)}
+
+	_, err := cr.fetchConfig(&mockRestClient{
+		expectedData: []byte(`{
+			"normal_trace_sampling_probability": 2,
+			"span_attributes": [{"attr_name": "asserts.request.context", "attr_configs": [{"rules": [
+				{"source_attributes": ["http.url"], "regex": "+"}
+			]}]}]
+		}`),
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, "span_attributes[0].attr_configs[0].rules[0].regex: invalid regex +: "+
+		"error parsing regexp: missing argument to repetition operator: `+`; "+
+		"normal_trace_sampling_probability: 2 must be between 0 and 1", err.Error())
+}
+
+func TestFetchConfigKeepsUnsetSettings(t *testing.T) {
+	currConfig := buildValidConfig()
+	currConfig.LimitPerService = 50
+	cr := configRefresh{logger: logger, config: currConfig, localSettings: buildValidLocalSettings(t)}
+
+	config, err := cr.fetchConfig(&mockRestClient{
+		expectedData: []byte(`{"trace_rate_limit_per_service": 0, "latency_histogram_buckets": []}`),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 50, config.LimitPerService)
+	assert.Equal(t, currConfig.LatencyHistogramBuckets, config.LatencyHistogramBuckets)
+}
+
 func TestUpdateConfig(t *testing.T) {
 	currConfig := &Config{
 		CaptureMetrics: false,
@@ -171,6 +247,30 @@ func TestUpdateConfig(t *testing.T) {
 	assert.True(t, cr.config.CaptureMetrics)
 }
 
+func TestUpdateConfigKeepsRestartOnlySettings(t *testing.T) {
+	currConfig := &Config{
+		DefaultLatencyThreshold: 0.5,
+		EntityKeyTTLMinutes:     60,
+		ThresholdProvider:       &ThresholdProviderConfig{Type: ThresholdProviderFile, Path: "thresholds.yaml"},
+	}
+	newConfig := &Config{
+		DefaultLatencyThreshold: 0.75,
+		EntityKeyTTLMinutes:     10,
+		ErrorBaseline:           &ErrorBaselineConfig{Tolerance: 2},
+	}
+	cr := configRefresh{
+		logger:          logger,
+		config:          currConfig,
+		configListeners: []configListener{&mockConfigListener{expectedIsUpdated: true}},
+	}
+
+	assert.Nil(t, cr.updateConfig(newConfig))
+	assert.Equal(t, 0.75, cr.config.DefaultLatencyThreshold)
+	assert.Equal(t, 60, cr.config.EntityKeyTTLMinutes)
+	assert.Equal(t, currConfig.ThresholdProvider, cr.config.ThresholdProvider)
+	assert.Nil(t, cr.config.ErrorBaseline)
+}
+
 func TestUpdateConfigNoChange(t *testing.T) {
 	currConfig := &Config{
 		CaptureMetrics: true,
@@ -236,6 +336,7 @@ func TestFetchAndUpdateConfig(t *testing.T) {
 
 	cr := configRefresh{
 		logger:          logger,
+		localSettings:   buildValidLocalSettings(t),
 		config:          currConfig,
 		configListeners: []configListener{listener},
 	}
@@ -245,3 +346,237 @@ func TestFetchAndUpdateConfig(t *testing.T) {
 	assert.True(t, listener.expectedOnUpdate)
 	assert.Equal(t, 0.51, cr.config.DefaultLatencyThreshold)
 }
+
+func TestUpdateConfigPrepareError(t *testing.T) {
+	first := &mockConfigListener{expectedIsUpdated: true}
+	second := &mockConfigListener{expectedIsUpdated: true, expectedPrepareErr: errors.New("invalid config")}
+	cr := configRefresh{
+		logger:          logger,
+		config:          &Config{DefaultLatencyThreshold: 0.5},
+		configListeners: []configListener{first, second},
+	}
+	assert.Nil(t, cr.registerMetrics(&metrics{prometheusRegistry: prometheus.NewRegistry()}))
+
+	cr.updateConfig(&Config{DefaultLatencyThreshold: 0.75})
+	assert.True(t, first.expectedPrepare)
+	assert.True(t, second.expectedPrepare)
+	// No listener applies the update
+	assert.False(t, first.expectedOnUpdate)
+	assert.False(t, second.expectedOnUpdate)
+	assert.Equal(t, 0.5, cr.config.DefaultLatencyThreshold)
+	assert.Equal(t, uint64(0), cr.getVersion())
+	assert.Equal(t, float64(1), testutil.ToFloat64(cr.updateCount.WithLabelValues(configUpdateRejected)))
+}
+
+func TestUpdateConfigRollback(t *testing.T) {
+	first := &mockConfigListener{expectedIsUpdated: true}
+	unchanged := &mockConfigListener{expectedIsUpdated: false}
+	failing := &mockConfigListener{expectedIsUpdated: true, expectedErr: errors.New("update failed")}
+	last := &mockConfigListener{expectedIsUpdated: true}
+	cr := configRefresh{
+		logger:          logger,
+		config:          &Config{DefaultLatencyThreshold: 0.5},
+		configListeners: []configListener{first, unchanged, failing, last},
+	}
+	assert.Nil(t, cr.registerMetrics(&metrics{prometheusRegistry: prometheus.NewRegistry()}))
+
+	cr.updateConfig(&Config{DefaultLatencyThreshold: 0.75})
+	assert.True(t, first.expectedOnUpdate)
+	assert.True(t, first.expectedRollback)
+	assert.False(t, unchanged.expectedPrepare)
+	assert.False(t, unchanged.expectedRollback)
+	// The listener that failed left its config unchanged
+	assert.False(t, failing.expectedRollback)
+	assert.False(t, last.expectedOnUpdate)
+	assert.False(t, last.expectedRollback)
+	assert.Equal(t, 0.5, cr.config.DefaultLatencyThreshold)
+	assert.Equal(t, uint64(0), cr.getVersion())
+	assert.Equal(t, float64(1), testutil.ToFloat64(cr.updateCount.WithLabelValues(configUpdateRolledBack)))
+}
+
+func TestUpdateConfigVersion(t *testing.T) {
+	listener := &mockConfigListener{expectedIsUpdated: true}
+	cr := configRefresh{
+		logger:          logger,
+		config:          &Config{DefaultLatencyThreshold: 0.5},
+		configListeners: []configListener{listener},
+	}
+	registry := prometheus.NewRegistry()
+	assert.Nil(t, cr.registerMetrics(&metrics{prometheusRegistry: registry}))
+
+	cr.updateConfig(&Config{DefaultLatencyThreshold: 0.75})
+	cr.updateConfig(&Config{DefaultLatencyThreshold: 1})
+	listener.expectedIsUpdated = false
+	cr.updateConfig(&Config{DefaultLatencyThreshold: 1})
+	assert.Equal(t, uint64(2), cr.getVersion())
+	assert.Equal(t, float64(2), testutil.ToFloat64(cr.updateCount.WithLabelValues(configUpdateApplied)))
+
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+	versions := 0
+	for _, family := range families {
+		if family.GetName() == "asserts_config_version" {
+			versions++
+			assert.Equal(t, float64(2), family.GetMetric()[0].GetGauge().GetValue())
+		}
+	}
+	assert.Equal(t, 1, versions)
+}
+
+func TestFetchAndUpdateConfigNotModified(t *testing.T) {
+	body, etag := `{"sampling_latency_threshold_seconds": 0.75}`, `"v1"`
+	server, fetches := buildConfigServer(&body, &etag)
+	defer server.Close()
+	rc, err := createRestClient(logger, &Config{AssertsServer: &AssertsServerConfig{Endpoint: server.URL}})
+	assert.Nil(t, err)
+
+	listener := &mockConfigListener{expectedIsUpdated: true}
+	cr := configRefresh{
+		logger:          logger,
+		localSettings:   buildValidLocalSettings(t),
+		config:          &Config{DefaultLatencyThreshold: 0.5},
+		configListeners: []configListener{listener},
+	}
+	cr.fetchAndUpdateConfig(rc)
+	assert.Equal(t, 0.75, cr.config.DefaultLatencyThreshold)
+	assert.Equal(t, `"v1"`, cr.etag)
+
+	listener.expectedOnUpdate = false
+	cr.fetchAndUpdateConfig(rc)
+	assert.False(t, listener.expectedOnUpdate)
+	assert.Equal(t, 1, *fetches)
+
+	body, etag = `{"sampling_latency_threshold_seconds": 1}`, `"v2"`
+	cr.fetchAndUpdateConfig(rc)
+	assert.True(t, listener.expectedOnUpdate)
+	assert.Equal(t, float64(1), cr.config.DefaultLatencyThreshold)
+	assert.Equal(t, 2, *fetches)
+}
+
+func TestFetchAndUpdateConfigVersion(t *testing.T) {
+	mockClient := &mockRestClient{expectedData: []byte(`{"version": 7, "sampling_latency_threshold_seconds": 0.75}`)}
+	listener := &mockConfigListener{expectedIsUpdated: true}
+	cr := configRefresh{
+		logger:          logger,
+		localSettings:   buildValidLocalSettings(t),
+		config:          &Config{DefaultLatencyThreshold: 0.5},
+		configListeners: []configListener{listener},
+	}
+	cr.fetchAndUpdateConfig(mockClient)
+	assert.True(t, listener.expectedOnUpdate)
+	assert.Equal(t, "7", cr.remoteVersion)
+
+	// The same version is not unmarshalled or applied again
+	listener.expectedOnUpdate = false
+	cr.fetchAndUpdateConfig(mockClient)
+	assert.False(t, listener.expectedOnUpdate)
+
+	mockClient.expectedData = []byte(`{"version": "8", "sampling_latency_threshold_seconds": 1}`)
+	cr.fetchAndUpdateConfig(mockClient)
+	assert.True(t, listener.expectedOnUpdate)
+	assert.Equal(t, "8", cr.remoteVersion)
+}
+
+func TestFetchAndUpdateConfigRetriesRejectedVersion(t *testing.T) {
+	mockClient := &mockRestClient{expectedData: []byte(`{"version": 7, "sampling_latency_threshold_seconds": 0.75}`)}
+	listener := &mockConfigListener{expectedIsUpdated: true, expectedPrepareErr: errors.New("invalid config")}
+	cr := configRefresh{
+		logger:          logger,
+		localSettings:   buildValidLocalSettings(t),
+		config:          &Config{DefaultLatencyThreshold: 0.5},
+		configListeners: []configListener{listener},
+	}
+	cr.fetchAndUpdateConfig(mockClient)
+	assert.Equal(t, "", cr.remoteVersion)
+
+	listener.expectedPrepare = false
+	cr.fetchAndUpdateConfig(mockClient)
+	assert.True(t, listener.expectedPrepare)
+}
+
+func TestRequestRefresh(t *testing.T) {
+	mockClient := &mockRestClient{expectedData: []byte(`{"sampling_latency_threshold_seconds": 0.75}`)}
+	cr := configRefresh{
+		logger:           logger,
+		localSettings:    buildValidLocalSettings(t),
+		config:           &Config{AssertsServer: &AssertsServerConfig{Endpoint: "http://localhost:8030"}},
+		configSyncTicker: clock.FromContext(context.Background()).NewTicker(time.Hour),
+		refreshNow:       make(chan struct{}, 1),
+		stop:             make(chan bool),
+		restClient:       mockClient,
+		configListeners:  []configListener{&mockConfigListener{expectedIsUpdated: true}},
+	}
+	cr.startUpdates()
+	defer cr.stopUpdates()
+
+	recorder := httptest.NewRecorder()
+	cr.refreshHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/config/refresh", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	cr.refreshHandler().ServeHTTP(recorder, buildRefreshRequest("127.0.0.1:40000"))
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	assert.Eventually(t, func() bool { return cr.getVersion() == 1 }, time.Second, 10*time.Millisecond)
+
+	// Requests made while one is pending are merged
+	cr.requestRefresh()
+	cr.requestRefresh()
+	cr.requestRefresh()
+}
+
+func TestWaitJitter(t *testing.T) {
+	cr := configRefresh{logger: logger, stop: make(chan bool)}
+	assert.True(t, cr.waitJitter())
+
+	cr.jitter = time.Millisecond
+	assert.True(t, cr.waitJitter())
+
+	cr.jitter = time.Hour
+	cr.stopUpdates()
+	assert.False(t, cr.waitJitter())
+}
+
+func buildRefreshRequest(remoteAddr string) *http.Request {
+	request := httptest.NewRequest(http.MethodPost, "/config/refresh", nil)
+	request.RemoteAddr = remoteAddr
+	return request
+}
+
+func TestRefreshHandlerAuthorization(t *testing.T) {
+	cr := configRefresh{logger: logger, refreshNow: make(chan struct{}, 1)}
+
+	// Without a token, only the requests from the loopback address are accepted
+	recorder := httptest.NewRecorder()
+	cr.refreshHandler().ServeHTTP(recorder, buildRefreshRequest("10.0.0.5:40000"))
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	recorder = httptest.NewRecorder()
+	cr.refreshHandler().ServeHTTP(recorder, buildRefreshRequest("[::1]:40000"))
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+
+	// With a token, the requests must have it
+	cr = configRefresh{logger: logger, refreshNow: make(chan struct{}, 1), refreshToken: "secret"}
+	recorder = httptest.NewRecorder()
+	cr.refreshHandler().ServeHTTP(recorder, buildRefreshRequest("127.0.0.1:40000"))
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	request := buildRefreshRequest("10.0.0.5:40000")
+	request.Header.Set("Authorization", "Bearer secret")
+	recorder = httptest.NewRecorder()
+	cr.refreshHandler().ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+}
+
+func TestRefreshHandlerMinInterval(t *testing.T) {
+	cr := configRefresh{logger: logger, refreshNow: make(chan struct{}, 1)}
+	recorder := httptest.NewRecorder()
+	cr.refreshHandler().ServeHTTP(recorder, buildRefreshRequest("127.0.0.1:40000"))
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	cr.refreshHandler().ServeHTTP(recorder, buildRefreshRequest("127.0.0.1:40000"))
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	assert.Equal(t, "10", recorder.Header().Get("Retry-After"))
+
+	now := time.Now()
+	assert.True(t, cr.allowOnDemandRefresh(now.Add(minOnDemandRefreshInterval)))
+	assert.False(t, cr.allowOnDemandRefresh(now.Add(minOnDemandRefreshInterval+time.Second)))
+}
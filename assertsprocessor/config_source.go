@@ -0,0 +1,266 @@
+package assertsprocessor
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ConfigSourceAsserts = "asserts"
+	ConfigSourceFile    = "file"
+	ConfigSourceOpAMP   = "opamp"
+
+	defaultConfigFilePollInterval = 5 * time.Second
+)
+
+type ConfigSourceConfig struct {
+	// asserts, file or opamp. The config is fetched from the Asserts API by default
+	Type string `mapstructure:"type" json:"type"`
+	// The YAML or JSON config document of the file source, e.g. a mounted ConfigMap. The settings of the
+	// document replace the same top level settings of the collector config
+	Path                string `mapstructure:"path" json:"path"`
+	PollIntervalSeconds int    `mapstructure:"poll_interval_seconds" json:"poll_interval_seconds"`
+	// The OpAMP server of the opamp source, which delivers the config document as a remote config
+	OpAMP *OpAMPConfig `mapstructure:"opamp" json:"opamp"`
+	// How the asserts source learns of config changes: poll, or sse and long_poll for the Asserts API to
+	// notify the collector of each change, with polling while the stream is down. poll by default
+	Delivery string `mapstructure:"delivery" json:"delivery"`
+	// The delay before the failed stream is connected again, doubled after each failure up to the config
+	// refresh interval. 5 seconds by default
+	StreamRetrySeconds int `mapstructure:"stream_retry_seconds" json:"stream_retry_seconds"`
+	// The paths of the Asserts API of the sse and long_poll deliveries, under the endpoint of the asserts_server.
+	// /v1/config/otel-collector/events and /v1/config/otel-collector/changes by default
+	EventsPath  string `mapstructure:"events_path" json:"events_path"`
+	ChangesPath string `mapstructure:"changes_path" json:"changes_path"`
+}
+
+func (sc *ConfigSourceConfig) validateAt(v *configValidator, path string) {
+	switch sc.Type {
+	case "", ConfigSourceAsserts:
+	case ConfigSourceFile:
+		if sc.Path == "" {
+			v.addf(joinPath(path, "path"), "not set, it is required by the file source")
+		}
+	case ConfigSourceOpAMP:
+		if sc.OpAMP == nil {
+			v.addf(joinPath(path, "opamp"), "not set, it is required by the opamp source")
+		} else {
+			sc.OpAMP.validateAt(v, joinPath(path, "opamp"))
+		}
+	default:
+		v.addf(joinPath(path, "type"), "unknown type %s, must be %s, %s or %s",
+			sc.Type, ConfigSourceAsserts, ConfigSourceFile, ConfigSourceOpAMP)
+	}
+	if sc.PollIntervalSeconds < 0 {
+		v.addf(joinPath(path, "poll_interval_seconds"), "%d must not be negative", sc.PollIntervalSeconds)
+	}
+	switch sc.Delivery {
+	case "", ConfigDeliveryPoll:
+	case ConfigDeliverySSE, ConfigDeliveryLongPoll:
+		if sc.Type != "" && sc.Type != ConfigSourceAsserts {
+			v.addf(joinPath(path, "delivery"), "%s is only supported by the %s source",
+				sc.Delivery, ConfigSourceAsserts)
+		}
+	default:
+		v.addf(joinPath(path, "delivery"), "unknown delivery %s, must be %s, %s or %s",
+			sc.Delivery, ConfigDeliveryPoll, ConfigDeliverySSE, ConfigDeliveryLongPoll)
+	}
+	if sc.StreamRetrySeconds < 0 {
+		v.addf(joinPath(path, "stream_retry_seconds"), "%d must not be negative", sc.StreamRetrySeconds)
+	}
+	if sc.EventsPath != "" && !strings.HasPrefix(sc.EventsPath, "/") {
+		v.addf(joinPath(path, "events_path"), "%s must start with /", sc.EventsPath)
+	}
+	if sc.ChangesPath != "" && !strings.HasPrefix(sc.ChangesPath, "/") {
+		v.addf(joinPath(path, "changes_path"), "%s must start with /", sc.ChangesPath)
+	}
+}
+
+// Returns true if the Asserts API notifies the collector of the config changes
+func (config *Config) configStreamed() bool {
+	if config.ConfigSource == nil || config.configSourceType() != ConfigSourceAsserts {
+		return false
+	}
+	delivery := config.ConfigSource.Delivery
+	return delivery == ConfigDeliverySSE || delivery == ConfigDeliveryLongPoll
+}
+
+// Returns the type of the configured config source
+func (config *Config) configSourceType() string {
+	if config.ConfigSource == nil || config.ConfigSource.Type == "" {
+		return ConfigSourceAsserts
+	}
+	return config.ConfigSource.Type
+}
+
+// Returns how often the config is checked for updates
+func (config *Config) configSyncInterval() time.Duration {
+	if config.configSourceType() != ConfigSourceFile {
+		if config.ConfigRefreshIntervalSeconds > 0 {
+			return time.Duration(config.ConfigRefreshIntervalSeconds) * time.Second
+		}
+		return time.Minute
+	}
+	if config.ConfigSource.PollIntervalSeconds > 0 {
+		return time.Duration(config.ConfigSource.PollIntervalSeconds) * time.Second
+	}
+	return defaultConfigFilePollInterval
+}
+
+// fileConfigSource reads the config from a local file. The directory of the file is watched, so that the
+// symlink swaps of an updated ConfigMap volume are seen as well as the writes to the file. The file is
+// also polled, for the file systems that do not report the changes. An invalid file is reported and
+// skipped, and the config last read stays in use
+type fileConfigSource struct {
+	logger  *zap.Logger
+	path    string
+	watcher *fsnotify.Watcher
+	// The collector config, which the settings of the file replace
+	base    configSettings
+	modTime time.Time
+	content []byte
+}
+
+func newFileConfigSource(logger *zap.Logger, config *Config) (*fileConfigSource, error) {
+	base, err := settingsOf(config)
+	if err != nil {
+		return nil, err
+	}
+	return &fileConfigSource{
+		logger: logger,
+		path:   config.ConfigSource.Path,
+		base:   base,
+	}, nil
+}
+
+// Calls onChange for each change in the directory of the file, until the source is closed
+func (fs *fileConfigSource) watch(onChange func()) error {
+	watcher, err := watchFileDir(fs.logger, fs.path, onChange)
+	if err != nil {
+		return err
+	}
+	fs.watcher = watcher
+	return nil
+}
+
+// Calls onChange for each change in the directory of the file, until the watcher is closed. Any change
+// may be the file, as an update of a ConfigMap volume swaps a symlink rather than writing the file
+func watchFileDir(logger *zap.Logger, path string, onChange func()) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err = watcher.Add(filepath.Dir(path)); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+	go func() {
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				onChange()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Warn("Error watching file", zap.String("Path", path), zap.Error(err))
+			}
+		}
+	}()
+	return watcher, nil
+}
+
+func (fs *fileConfigSource) close() {
+	if fs.watcher != nil {
+		_ = fs.watcher.Close()
+	}
+}
+
+// Returns the config of the file if the file changed since the last call, nil otherwise
+func (fs *fileConfigSource) readIfChanged() (*Config, error) {
+	info, err := os.Stat(fs.path)
+	if err != nil {
+		return nil, err
+	}
+	if fs.content != nil && info.ModTime().Equal(fs.modTime) {
+		return nil, nil
+	}
+	content, err := os.ReadFile(fs.path)
+	if err != nil {
+		return nil, err
+	}
+	if fs.content != nil && bytes.Equal(content, fs.content) {
+		fs.modTime = info.ModTime()
+		return nil, nil
+	}
+	config, err := fs.parse(content)
+	if err != nil {
+		return nil, err
+	}
+	fs.modTime, fs.content = info.ModTime(), content
+	fs.logger.Info("Read config file", zap.String("Path", fs.path))
+	return config, nil
+}
+
+func (fs *fileConfigSource) parse(content []byte) (*Config, error) {
+	// YAML is a superset of JSON, so both are read as YAML
+	var settings map[string]interface{}
+	if err := yaml.Unmarshal(content, &settings); err != nil {
+		return nil, err
+	}
+	config, err := fs.base.merge(settings)
+	if err != nil {
+		return nil, err
+	}
+	if err = config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// configSettings are the top level settings of a config by their key, as in the JSON of the config
+type configSettings map[string]interface{}
+
+func settingsOf(config *Config) (configSettings, error) {
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var settings configSettings
+	if err = json.Unmarshal(encoded, &settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// Returns the config with the settings in place of the same top level settings of the base. The
+// settings that are not set keep the value of the base, so that a partial config does not reset them
+func (base configSettings) merge(settings map[string]interface{}) (*Config, error) {
+	merged := make(map[string]interface{}, len(base)+len(settings))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range settings {
+		merged[key] = value
+	}
+	encoded, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err = json.Unmarshal(encoded, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
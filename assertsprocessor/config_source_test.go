@@ -0,0 +1,150 @@
+package assertsprocessor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func buildFileConfigSource(t *testing.T, content string) (*fileConfigSource, string) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0600))
+	config := buildValidConfig()
+	config.Site = "us-west-2"
+	config.DefaultLatencyThreshold = 0.5
+	config.LimitPerRequestPerService = 5
+	config.ConfigSource = &ConfigSourceConfig{Type: ConfigSourceFile, Path: path}
+	source, err := newFileConfigSource(logger, config)
+	assert.Nil(t, err)
+	return source, path
+}
+
+// Rewrites the file with a later modification time, as the file system may not tell the writes apart
+func rewriteConfigFile(t *testing.T, path string, content string, offset time.Duration) {
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0600))
+	assert.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(offset)))
+}
+
+func TestFileConfigSourceMergesSettings(t *testing.T) {
+	source, _ := buildFileConfigSource(t, `
+capture_metrics: true
+sampling_latency_threshold_seconds: 0.75
+attributes_as_metric_labels: ["rpc.system"]
+`)
+	config, err := source.readIfChanged()
+	assert.Nil(t, err)
+	assert.NotNil(t, config)
+	assert.True(t, config.CaptureMetrics)
+	assert.Equal(t, 0.75, config.DefaultLatencyThreshold)
+	assert.Equal(t, []string{"rpc.system"}, config.CaptureAttributesInMetric)
+	// The settings not in the file are those of the collector config
+	assert.Equal(t, "dev", config.Env)
+	assert.Equal(t, "us-west-2", config.Site)
+	assert.Equal(t, 100, config.LimitPerService)
+	assert.Equal(t, ConfigSourceFile, config.configSourceType())
+}
+
+func TestFileConfigSourceReadsJSON(t *testing.T) {
+	source, _ := buildFileConfigSource(t, `{"ignore_client_errors": true, "trace_rate_limit_per_service": 20}`)
+	config, err := source.readIfChanged()
+	assert.Nil(t, err)
+	assert.True(t, config.IgnoreClientErrors)
+	assert.Equal(t, 20, config.LimitPerService)
+}
+
+func TestFileConfigSourceReadIfChanged(t *testing.T) {
+	source, path := buildFileConfigSource(t, `sampling_latency_threshold_seconds: 0.75`)
+	config, err := source.readIfChanged()
+	assert.Nil(t, err)
+	assert.NotNil(t, config)
+
+	config, err = source.readIfChanged()
+	assert.Nil(t, err)
+	assert.Nil(t, config)
+
+	// Touched without a change
+	rewriteConfigFile(t, path, `sampling_latency_threshold_seconds: 0.75`, time.Minute)
+	config, err = source.readIfChanged()
+	assert.Nil(t, err)
+	assert.Nil(t, config)
+
+	rewriteConfigFile(t, path, `sampling_latency_threshold_seconds: 1.5`, 2*time.Minute)
+	config, err = source.readIfChanged()
+	assert.Nil(t, err)
+	assert.Equal(t, 1.5, config.DefaultLatencyThreshold)
+}
+
+func TestFileConfigSourceInvalidFile(t *testing.T) {
+	source, path := buildFileConfigSource(t, `sampling_latency_threshold_seconds: 0.75`)
+	_, err := source.readIfChanged()
+	assert.Nil(t, err)
+
+	rewriteConfigFile(t, path, `normal_trace_sampling_probability: 2`, time.Minute)
+	config, err := source.readIfChanged()
+	assert.NotNil(t, err)
+	assert.Nil(t, config)
+
+	rewriteConfigFile(t, path, `sampling_latency_threshold_seconds: [`, 2*time.Minute)
+	_, err = source.readIfChanged()
+	assert.NotNil(t, err)
+
+	assert.Nil(t, os.Remove(path))
+	_, err = source.readIfChanged()
+	assert.NotNil(t, err)
+}
+
+func TestFileConfigSourceWatch(t *testing.T) {
+	source, path := buildFileConfigSource(t, `sampling_latency_threshold_seconds: 0.75`)
+	changes := make(chan struct{}, 10)
+	assert.Nil(t, source.watch(func() { changes <- struct{}{} }))
+	defer source.close()
+
+	assert.Nil(t, os.WriteFile(path, []byte(`sampling_latency_threshold_seconds: 1`), 0600))
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "the change of the config file is not seen")
+	}
+}
+
+func TestReadAndUpdateConfig(t *testing.T) {
+	source, path := buildFileConfigSource(t, `sampling_latency_threshold_seconds: 0.75`)
+	listener := &mockConfigListener{expectedIsUpdated: true}
+	cr := configRefresh{
+		logger:          logger,
+		config:          &Config{DefaultLatencyThreshold: 0.5},
+		fileSource:      source,
+		configListeners: []configListener{listener},
+	}
+
+	cr.readAndUpdateConfig()
+	assert.True(t, listener.expectedOnUpdate)
+	assert.Equal(t, 0.75, cr.config.DefaultLatencyThreshold)
+
+	// An invalid file does not reach the listeners
+	listener.expectedOnUpdate = false
+	rewriteConfigFile(t, path, `trace_rate_limit_per_service: 1`, time.Minute)
+	cr.readAndUpdateConfig()
+	assert.False(t, listener.expectedOnUpdate)
+	assert.Equal(t, 0.75, cr.config.DefaultLatencyThreshold)
+}
+
+func TestValidateConfigSource(t *testing.T) {
+	assert.Nil(t, validateSection(&ConfigSourceConfig{}))
+	assert.Nil(t, validateSection(&ConfigSourceConfig{Type: ConfigSourceFile, Path: "/etc/asserts/config.yaml"}))
+	assert.NotNil(t, validateSection(&ConfigSourceConfig{Type: ConfigSourceFile}))
+	assert.NotNil(t, validateSection(&ConfigSourceConfig{Type: "consul"}))
+	assert.NotNil(t, validateSection(&ConfigSourceConfig{Type: ConfigSourceFile, Path: "config.yaml", PollIntervalSeconds: -1}))
+}
+
+func TestConfigSyncInterval(t *testing.T) {
+	assert.Equal(t, time.Minute, (&Config{}).configSyncInterval())
+	assert.Equal(t, 2*time.Minute, (&Config{ConfigRefreshIntervalSeconds: 120}).configSyncInterval())
+	assert.Equal(t, defaultConfigFilePollInterval,
+		(&Config{ConfigSource: &ConfigSourceConfig{Type: ConfigSourceFile}}).configSyncInterval())
+	assert.Equal(t, 30*time.Second,
+		(&Config{ConfigSource: &ConfigSourceConfig{Type: ConfigSourceFile, PollIntervalSeconds: 30}}).configSyncInterval())
+}
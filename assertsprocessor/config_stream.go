@@ -0,0 +1,280 @@
+package assertsprocessor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/collector/component"
+	"go.uber.org/zap"
+)
+
+const (
+	ConfigDeliveryPoll     = "poll"
+	ConfigDeliverySSE      = "sse"
+	ConfigDeliveryLongPoll = "long_poll"
+
+	defaultConfigEventsApi  = configApi + "/events"
+	defaultConfigChangesApi = configApi + "/changes"
+
+	defaultConfigStreamRetry = 5 * time.Second
+	// How long the Asserts API holds a long-poll request without a change
+	configLongPollWait = 55 * time.Second
+	// The event stream is reconnected when the Asserts API sends nothing for this long, heartbeats included
+	configStreamIdleTimeout = 2 * time.Minute
+)
+
+// A new config version announced by the Asserts API
+type configChange struct {
+	Version string `json:"version"`
+}
+
+// configStream is notified by the Asserts API of each new config version, over server-sent events or
+// long-poll requests, and requests a refresh of the config for each. The periodic refresh is skipped while
+// the stream is connected, and resumes when the stream fails until it is connected again
+type configStream struct {
+	logger   *zap.Logger
+	config   *Config
+	delivery string
+	// The path of the events or of the changes, by the delivery
+	api string
+	// The client of the stream, without the timeout of the other calls
+	client *http.Client
+	retry  time.Duration
+	// The longest delay before reconnecting, as the periodic refresh covers for the stream meanwhile
+	maxRetry time.Duration
+	// The version of the last notification, so that a refresh is requested once per version
+	lastVersion string
+	connected   atomic.Bool
+	// Requests a refresh of the config
+	onChange func()
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// Authenticates the stream with the collector auth extension of the other calls to the Asserts API
+func (cs *configStream) startAuthenticator(host component.Host) error {
+	return startAuthenticator(host, cs.config, cs.client)
+}
+
+func newConfigStream(logger *zap.Logger, config *Config, onChange func()) (*configStream, error) {
+	client, err := config.AssertsServer.newHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	// A stream is open for as long as the Asserts API keeps it open
+	client.Timeout = 0
+	retry := defaultConfigStreamRetry
+	if config.ConfigSource.StreamRetrySeconds > 0 {
+		retry = time.Duration(config.ConfigSource.StreamRetrySeconds) * time.Second
+	}
+	api := defaultConfigEventsApi
+	if config.ConfigSource.EventsPath != "" {
+		api = config.ConfigSource.EventsPath
+	}
+	if config.ConfigSource.Delivery == ConfigDeliveryLongPoll {
+		api = defaultConfigChangesApi
+		if config.ConfigSource.ChangesPath != "" {
+			api = config.ConfigSource.ChangesPath
+		}
+	}
+	return &configStream{
+		logger:   logger,
+		config:   config,
+		delivery: config.ConfigSource.Delivery,
+		api:      api,
+		client:   client,
+		retry:    retry,
+		maxRetry: config.configSyncInterval(),
+		onChange: onChange,
+	}, nil
+}
+
+func (cs *configStream) isConnected() bool {
+	return cs.connected.Load()
+}
+
+func (cs *configStream) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cs.cancel = cancel
+	cs.done = make(chan struct{})
+	go cs.run(ctx)
+}
+
+func (cs *configStream) stop() {
+	if cs.cancel != nil {
+		cs.cancel()
+		<-cs.done
+	}
+}
+
+// Connects until stopped. After a failure the delay before connecting again doubles, up to the max retry
+func (cs *configStream) run(ctx context.Context) {
+	defer close(cs.done)
+	delay := cs.retry
+	for {
+		var err error
+		if cs.delivery == ConfigDeliverySSE {
+			err = cs.receiveEvents(ctx)
+		} else {
+			err = cs.longPoll(ctx)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if cs.connected.Swap(false) {
+			delay = cs.retry
+		}
+		cs.logger.Warn("Config stream failed, polling for config updates until it is reconnected",
+			zap.String("Delivery", cs.delivery), zap.Duration("Retry in", delay), zap.Error(err))
+		if !sleepContext(ctx, time.Duration(rand.Int63n(int64(delay)/2))+delay/2) {
+			return
+		}
+		delay = cs.nextDelay(delay)
+	}
+}
+
+// Doubles the delay, up to the max retry
+func (cs *configStream) nextDelay(delay time.Duration) time.Duration {
+	if delay *= 2; delay > cs.maxRetry {
+		return cs.maxRetry
+	}
+	return delay
+}
+
+// Returns false if the context is done before the delay is over
+func sleepContext(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (cs *configStream) setConnected() {
+	if !cs.connected.Swap(true) {
+		cs.logger.Info("Config stream connected", zap.String("Delivery", cs.delivery))
+	}
+}
+
+// Reads the events of the stream until it fails. Each event has the JSON of a config change as its data.
+// The config is fetched on each connect, as the changes while the stream was down are not sent again
+func (cs *configStream) receiveEvents(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	response, err := cs.get(ctx, cs.api, "text/event-stream")
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	// Cancels the request when the stream is idle, as a dropped connection may not be noticed otherwise
+	idle := time.AfterFunc(configStreamIdleTimeout, cancel)
+	defer idle.Stop()
+	cs.setConnected()
+	cs.onChange()
+	scanner := bufio.NewScanner(response.Body)
+	data := make([]string, 0)
+	for scanner.Scan() {
+		idle.Reset(configStreamIdleTimeout)
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// The end of an event
+			if len(data) > 0 {
+				cs.notify([]byte(strings.Join(data, "\n")))
+				data = data[:0]
+			}
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// Polls for changes until a request fails. The Asserts API holds each request until the version
+// changes from the version sent, or responds with no content once the wait is over. The requests that
+// are answered sooner than the retry delay are spaced apart with a backoff, so that an Asserts API that
+// does not hold them is not polled in a tight loop
+func (cs *configStream) longPoll(ctx context.Context) error {
+	delay := cs.retry
+	for {
+		query := url.Values{}
+		query.Set("version", cs.lastVersion)
+		query.Set("wait_seconds", fmt.Sprint(int(configLongPollWait.Seconds())))
+		sent := time.Now()
+		requestCtx, cancel := context.WithTimeout(ctx, configLongPollWait+cs.config.AssertsServer.timeout())
+		response, err := cs.get(requestCtx, cs.api+"?"+query.Encode(), "application/json")
+		if err != nil {
+			cancel()
+			return err
+		}
+		body, err := io.ReadAll(response.Body)
+		_ = response.Body.Close()
+		cancel()
+		if err != nil {
+			return err
+		}
+		cs.setConnected()
+		if response.StatusCode == http.StatusOK {
+			cs.notify(body)
+		}
+		if wait := delay - time.Since(sent); wait > 0 {
+			if !sleepContext(ctx, wait) {
+				return ctx.Err()
+			}
+			delay = cs.nextDelay(delay)
+		} else {
+			delay = cs.retry
+		}
+	}
+}
+
+func (cs *configStream) get(ctx context.Context, api string, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cs.config.AssertsServer.Endpoint+api, nil)
+	if err != nil {
+		return nil, err
+	}
+	setAssertsHeaders(req, cs.config)
+	req.Header.Set("Accept", accept)
+	response, err := cs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch response.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotModified:
+		return response, nil
+	}
+	body, _ := io.ReadAll(response.Body)
+	_ = response.Body.Close()
+	return nil, &ApiError{Api: api, StatusCode: response.StatusCode, Body: string(body)}
+}
+
+// Requests a refresh for a new version. A change without a version always requests one
+func (cs *configStream) notify(data []byte) {
+	var change configChange
+	if err := json.Unmarshal(data, &change); err != nil {
+		cs.logger.Warn("Invalid config change", zap.String("Data", string(data)), zap.Error(err))
+		return
+	}
+	if change.Version != "" && change.Version == cs.lastVersion {
+		return
+	}
+	cs.lastVersion = change.Version
+	cs.logger.Info("Config changed", zap.String("Version", change.Version))
+	cs.onChange()
+}
@@ -0,0 +1,216 @@
+package assertsprocessor
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tilinna/clock"
+)
+
+func buildConfigStream(t *testing.T, endpoint string, delivery string) (*configStream, *atomic.Int32) {
+	config := buildValidConfig()
+	config.AssertsTenant = "acme"
+	config.AssertsServer = &AssertsServerConfig{Endpoint: endpoint}
+	config.ConfigSource = &ConfigSourceConfig{Delivery: delivery}
+	changes := &atomic.Int32{}
+	stream, err := newConfigStream(logger, config, func() { changes.Add(1) })
+	assert.Nil(t, err)
+	stream.retry = 10 * time.Millisecond
+	return stream, changes
+}
+
+func TestConfigStreamServerSentEvents(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, defaultConfigEventsApi, r.URL.Path)
+		assert.Equal(t, "text/event-stream", r.Header.Get("Accept"))
+		assert.Equal(t, "acme", r.Header.Get("X-Asserts-Tenant"))
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = fmt.Fprint(w, ": heartbeat\n\n")
+		_, _ = fmt.Fprint(w, "event: config\ndata: {\"version\": \"1\"}\n\n")
+		_, _ = fmt.Fprint(w, "data: {\"version\": \"1\"}\n\n")
+		_, _ = fmt.Fprint(w, "data: {\"version\":\n\n")
+		_, _ = fmt.Fprint(w, "data: {\"version\": \"2\"}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	// The config is fetched on connect, and for each new version
+	stream, changes := buildConfigStream(t, server.URL, ConfigDeliverySSE)
+	stream.start()
+	assert.Eventually(t, func() bool { return changes.Load() == 3 }, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, stream.isConnected())
+	stream.stop()
+	assert.Equal(t, int32(3), changes.Load())
+}
+
+func TestConfigStreamLongPoll(t *testing.T) {
+	var polls sync.Map
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, defaultConfigChangesApi, r.URL.Path)
+		assert.Equal(t, "55", r.URL.Query().Get("wait_seconds"))
+		version := r.URL.Query().Get("version")
+		count, _ := polls.LoadOrStore(version, &atomic.Int32{})
+		switch version {
+		case "":
+			_, _ = fmt.Fprint(w, `{"version": "1"}`)
+		case "1":
+			// The wait is over once without a change
+			if count.(*atomic.Int32).Add(1) == 1 {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			_, _ = fmt.Fprint(w, `{"version": "2"}`)
+		default:
+			<-r.Context().Done()
+		}
+	}))
+	defer server.Close()
+
+	stream, changes := buildConfigStream(t, server.URL, ConfigDeliveryLongPoll)
+	stream.start()
+	assert.Eventually(t, func() bool { return changes.Load() == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, stream.isConnected())
+	stream.stop()
+	assert.Equal(t, "2", stream.lastVersion)
+}
+
+func TestConfigStreamLongPollBackoff(t *testing.T) {
+	var requests atomic.Int32
+	// The server does not hold the requests
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/collector/changes", r.URL.Path)
+		requests.Add(1)
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer server.Close()
+
+	config := buildValidConfig()
+	config.AssertsServer = &AssertsServerConfig{Endpoint: server.URL}
+	config.ConfigSource = &ConfigSourceConfig{Delivery: ConfigDeliveryLongPoll, ChangesPath: "/v2/collector/changes"}
+	stream, err := newConfigStream(logger, config, func() {})
+	assert.Nil(t, err)
+	stream.retry = 20 * time.Millisecond
+	stream.start()
+	time.Sleep(200 * time.Millisecond)
+	stream.stop()
+	// Spaced 20, 40 and 80 milliseconds apart
+	assert.GreaterOrEqual(t, requests.Load(), int32(2))
+	assert.LessOrEqual(t, requests.Load(), int32(5))
+}
+
+func TestConfigStreamEventsPath(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/collector/events", r.URL.Path)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	config := buildValidConfig()
+	config.AssertsServer = &AssertsServerConfig{Endpoint: server.URL}
+	config.ConfigSource = &ConfigSourceConfig{Delivery: ConfigDeliverySSE, EventsPath: "/v2/collector/events"}
+	changes := &atomic.Int32{}
+	stream, err := newConfigStream(logger, config, func() { changes.Add(1) })
+	assert.Nil(t, err)
+	stream.start()
+	defer stream.stop()
+	assert.Eventually(t, func() bool { return changes.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, stream.isConnected())
+}
+
+func TestConfigStreamReconnects(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch requests.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			// The stream ends after an event
+			_, _ = fmt.Fprint(w, "data: {\"version\": \"1\"}\n\n")
+		default:
+			_, _ = fmt.Fprint(w, "data: {\"version\": \"2\"}\n\n")
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}
+	}))
+	defer server.Close()
+
+	stream, changes := buildConfigStream(t, server.URL, ConfigDeliverySSE)
+	assert.False(t, stream.isConnected())
+	stream.start()
+	defer stream.stop()
+	// The config is fetched on each of the two connects, and for each new version
+	assert.Eventually(t, func() bool { return changes.Load() == 4 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(3), requests.Load())
+	assert.True(t, stream.isConnected())
+}
+
+func TestConfigRefreshSkipsPollingWhileStreamConnected(t *testing.T) {
+	// The server holds the stream, which is set connected or not by the test
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	stream, _ := buildConfigStream(t, server.URL, ConfigDeliverySSE)
+	stream.connected.Store(true)
+	mockClock := clock.NewMock(time.Now())
+	cr := &configRefresh{
+		logger:           logger,
+		config:           buildValidConfig(),
+		localSettings:    buildValidLocalSettings(t),
+		configSyncTicker: mockClock.NewTicker(time.Minute),
+		refreshNow:       make(chan struct{}, 1),
+		stop:             make(chan bool),
+		restClient:       &mockRestClient{expectedData: []byte(`{"sampling_latency_threshold_seconds": 0.75}`)},
+		stream:           stream,
+	}
+	cr.config.AssertsServer = &AssertsServerConfig{Endpoint: "http://localhost:8030"}
+	cr.startUpdates()
+	defer cr.stopUpdates()
+
+	mockClock.Add(time.Minute)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 3.0, currentConfig(cr).DefaultLatencyThreshold)
+
+	// Polling resumes while the stream is down
+	stream.connected.Store(false)
+	mockClock.Add(time.Minute)
+	assert.Eventually(t, func() bool { return currentConfig(cr).DefaultLatencyThreshold == 0.75 },
+		5*time.Second, 10*time.Millisecond)
+}
+
+func TestValidateConfigDelivery(t *testing.T) {
+	source := &ConfigSourceConfig{Delivery: ConfigDeliverySSE}
+	assert.Nil(t, validateSection(source))
+	source.Delivery = ConfigDeliveryLongPoll
+	assert.Nil(t, validateSection(source))
+
+	source.Delivery = "websocket"
+	err := validateSection(source)
+	assert.NotNil(t, err)
+	assert.Equal(t, "delivery: unknown delivery websocket, must be poll, sse or long_poll", err.Error())
+
+	source = &ConfigSourceConfig{Type: ConfigSourceFile, Path: "/etc/otelcol/asserts.yaml", Delivery: ConfigDeliverySSE}
+	assert.NotNil(t, validateSection(source))
+
+	source = &ConfigSourceConfig{Delivery: ConfigDeliverySSE, StreamRetrySeconds: -1}
+	assert.NotNil(t, validateSection(source))
+
+	source = &ConfigSourceConfig{Delivery: ConfigDeliverySSE, EventsPath: "events"}
+	err = validateSection(source)
+	assert.NotNil(t, err)
+	assert.Equal(t, "events_path: events must start with /", err.Error())
+
+	config := buildValidConfig()
+	assert.False(t, config.configStreamed())
+	config.ConfigSource = &ConfigSourceConfig{Delivery: ConfigDeliveryLongPoll}
+	assert.True(t, config.configStreamed())
+	assert.Nil(t, config.Validate())
+}
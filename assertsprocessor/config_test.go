@@ -6,18 +6,27 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// Returns the default config, which is valid once the env is set
+func buildValidConfig() *Config {
+	config := createDefaultConfig().(*Config)
+	config.Env = "dev"
+	return config
+}
+
+func TestValidateDefaultConfig(t *testing.T) {
+	assert.Nil(t, buildValidConfig().Validate())
+}
+
 func TestValidateCustomAttributeConfigsNoError(t *testing.T) {
-	dto := Config{
-		Env: "dev",
-		CustomAttributeConfigs: map[string]map[string][]*CustomAttributeConfig{
-			"asserts.request.context": {
-				"default": {
-					{
-						SourceAttributes: []string{"attribute"},
-						SpanKinds:        []string{"Client"},
-						RegExp:           "(.+)",
-						Replacement:      "$1",
-					},
+	dto := buildValidConfig()
+	dto.CustomAttributeConfigs = map[string]map[string][]*CustomAttributeConfig{
+		"asserts.request.context": {
+			"default": {
+				{
+					SourceAttributes: []string{"attribute"},
+					SpanKinds:        []string{"Client"},
+					RegExp:           "(.+)",
+					Replacement:      "$1",
 				},
 			},
 		},
@@ -27,40 +36,37 @@ func TestValidateCustomAttributeConfigsNoError(t *testing.T) {
 }
 
 func TestValidateCustomAttributeConfigsError(t *testing.T) {
-	dto := Config{
-		Env: "dev",
-		CustomAttributeConfigs: map[string]map[string][]*CustomAttributeConfig{
-			"asserts.request.context": {
-				"default": {
-					{
-						SourceAttributes: []string{"attribute"},
-						SpanKinds:        []string{"Client"},
-						RegExp:           "+",
-						Replacement:      "$1",
-					},
+	dto := buildValidConfig()
+	dto.CustomAttributeConfigs = map[string]map[string][]*CustomAttributeConfig{
+		"asserts.request.context": {
+			"default": {
+				{
+					SourceAttributes: []string{"attribute"},
+					SpanKinds:        []string{"Client"},
+					RegExp:           "+",
+					Replacement:      "$1",
 				},
 			},
 		},
 	}
 	err := dto.Validate()
 	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "custom_attributes[asserts.request.context][default][0].regex: invalid regex +")
 }
 
 func TestValidateSpanAttributesNoError(t *testing.T) {
-	dto := Config{
-		Env: "dev",
-		SpanAttributes: []*SpanAttribute{
-			{
-				AttributeName: "asserts.request.context",
-				AttributeConfigs: []*SpanAttributeConfig{
-					{
-						Rules: []*CustomAttributeConfig{
-							{
-								SourceAttributes: []string{"attribute"},
-								SpanKinds:        []string{"Client"},
-								RegExp:           "(.+)",
-								Replacement:      "$1",
-							},
+	dto := buildValidConfig()
+	dto.SpanAttributes = []*SpanAttribute{
+		{
+			AttributeName: "asserts.request.context",
+			AttributeConfigs: []*SpanAttributeConfig{
+				{
+					Rules: []*CustomAttributeConfig{
+						{
+							SourceAttributes: []string{"attribute"},
+							SpanKinds:        []string{"Client"},
+							RegExp:           "(.+)",
+							Replacement:      "$1",
 						},
 					},
 				},
@@ -72,20 +78,18 @@ func TestValidateSpanAttributesNoError(t *testing.T) {
 }
 
 func TestValidateSpanAttributesError(t *testing.T) {
-	dto := Config{
-		Env: "dev",
-		SpanAttributes: []*SpanAttribute{
-			{
-				AttributeName: "asserts.request.context",
-				AttributeConfigs: []*SpanAttributeConfig{
-					{
-						Rules: []*CustomAttributeConfig{
-							{
-								SourceAttributes: []string{"attribute"},
-								SpanKinds:        []string{"Client"},
-								RegExp:           "+",
-								Replacement:      "$1",
-							},
+	dto := buildValidConfig()
+	dto.SpanAttributes = []*SpanAttribute{
+		{
+			AttributeName: "asserts.request.context",
+			AttributeConfigs: []*SpanAttributeConfig{
+				{
+					Rules: []*CustomAttributeConfig{
+						{
+							SourceAttributes: []string{"attribute"},
+							SpanKinds:        []string{"Client"},
+							RegExp:           "+",
+							Replacement:      "$1",
 						},
 					},
 				},
@@ -96,16 +100,19 @@ func TestValidateSpanAttributesError(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
-func TestEnvMissing(t *testing.T) {
-	dto := Config{
-		CustomAttributeConfigs: map[string]map[string][]*CustomAttributeConfig{
-			"asserts.request.context": {
-				"default": {
-					{
-						SourceAttributes: []string{"attribute"},
-						SpanKinds:        []string{"Client"},
-						RegExp:           "(.+)",
-						Replacement:      "$1",
+func TestValidateSpanAttributesErrorPaths(t *testing.T) {
+	dto := buildValidConfig()
+	dto.SpanAttributes = []*SpanAttribute{
+		{AttributeName: "asserts.error.type"},
+		{
+			AttributeName: "asserts.request.context",
+			AttributeConfigs: []*SpanAttributeConfig{
+				{
+					Rules: []*CustomAttributeConfig{
+						{SourceAttributes: []string{"http.url"}, RegExp: "(.+)"},
+						{SourceAttributes: []string{"http.url"}, RegExp: "(.+)"},
+						{SourceAttributes: []string{"http.url", ""}, SpanKinds: []string{"SERVER"}, RegExp: "+"},
+						{SourceAttributes: []string{"http.url"}, RegExp: "(.+)/(?P<id>.+)", Replacement: "$1/${id}/$3"},
 					},
 				},
 			},
@@ -113,28 +120,173 @@ func TestEnvMissing(t *testing.T) {
 	}
 	err := dto.Validate()
 	assert.NotNil(t, err)
-	assert.Equal(t, "Env property is not set", err.Error())
+	errs, ok := err.(ValidationErrors)
+	assert.True(t, ok)
+	paths := make([]string, 0)
+	for _, e := range errs {
+		paths = append(paths, e.path)
+	}
+	assert.Equal(t, []string{
+		"span_attributes[1].attr_configs[0].rules[2].source_attributes[1]",
+		"span_attributes[1].attr_configs[0].rules[2].span_kinds[0]",
+		"span_attributes[1].attr_configs[0].rules[2].regex",
+		"span_attributes[1].attr_configs[0].rules[3].value_expr",
+	}, paths)
 }
 
-func TestValidateLimits(t *testing.T) {
-	dto := Config{
-		Env: "dev",
-		CustomAttributeConfigs: map[string]map[string][]*CustomAttributeConfig{
-			"asserts.request.context": {
-				"default": {
-					{
-						SourceAttributes: []string{"attribute"},
-						SpanKinds:        []string{"Client"},
-						RegExp:           "(.+)",
-						Replacement:      "$1",
-					},
+func TestEnvMissing(t *testing.T) {
+	dto := buildValidConfig()
+	dto.Env = ""
+	dto.CustomAttributeConfigs = map[string]map[string][]*CustomAttributeConfig{
+		"asserts.request.context": {
+			"default": {
+				{
+					SourceAttributes: []string{"attribute"},
+					SpanKinds:        []string{"Client"},
+					RegExp:           "(.+)",
+					Replacement:      "$1",
 				},
 			},
 		},
-		LimitPerService:           1,
-		LimitPerRequestPerService: 2,
 	}
 	err := dto.Validate()
 	assert.NotNil(t, err)
-	assert.Equal(t, "LimitPerService: 1 < LimitPerRequestPerService: 2", err.Error())
+	assert.Equal(t, "asserts_env: not set", err.Error())
+}
+
+func TestValidateLimits(t *testing.T) {
+	dto := buildValidConfig()
+	dto.LimitPerService = 1
+	dto.LimitPerRequestPerService = 2
+	err := dto.Validate()
+	assert.NotNil(t, err)
+	assert.Equal(t, "trace_rate_limit_per_service: 1 < trace_rate_limit_per_service_per_request: 2", err.Error())
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	dto := buildValidConfig()
+	dto.Env = ""
+	dto.LatencyHistogramBuckets = []float64{0.1, 0.5, 0.25, 1}
+	dto.LimitPerService = 0
+	dto.RequestContextCacheTTL = 0
+	dto.PrometheusExporterPort = 70000
+	dto.TraceFlushFrequencySeconds = -1
+	err := dto.Validate()
+	assert.NotNil(t, err)
+	assert.Equal(t, "asserts_env: not set; "+
+		"latency_histogram_buckets[2]: 0.25 must be greater than the previous bucket 0.5; "+
+		"trace_rate_limit_per_service: 0 must be positive; "+
+		"request_context_cache_ttl_minutes: 0 must be positive; "+
+		"prometheus_exporter_port: 70000 must be between 1 and 65535; "+
+		"trace_flush_frequency_seconds: -1 must be positive", err.Error())
+}
+
+func TestValidateNegativeTracePriorityWeights(t *testing.T) {
+	dto := buildValidConfig()
+	dto.TracePriorityWeights = &TracePriorityWeights{
+		Latency: 1,
+		Errors:  -1,
+	}
+	err := dto.Validate()
+	assert.NotNil(t, err)
+}
+
+func TestValidateServiceOverrides(t *testing.T) {
+	limit := 1
+	dto := buildValidConfig()
+	dto.LimitPerService = 5
+	dto.LimitPerRequestPerService = 2
+	dto.ServiceOverrides = map[string]*ServiceSamplingOverride{
+		"platform#payment": {LimitPerService: &limit},
+	}
+	err := dto.Validate()
+	assert.NotNil(t, err)
+	assert.Equal(t, "service_overrides[platform#payment].trace_rate_limit_per_service: "+
+		"1 < trace_rate_limit_per_service_per_request: 2", err.Error())
+
+	dto.ServiceOverrides["platform#payment"].LimitPerRequestPerService = &limit
+	assert.Nil(t, dto.Validate())
+
+	// A limit that is not positive is reported without the comparison with the other limit
+	zero, negative := 0, -1
+	dto.ServiceOverrides["platform#payment"] = &ServiceSamplingOverride{
+		LimitPerService:                &zero,
+		NormalSamplingFrequencyMinutes: &negative,
+	}
+	err = dto.Validate()
+	assert.NotNil(t, err)
+	assert.Equal(t, "service_overrides[platform#payment].trace_rate_limit_per_service: 0 must be positive; "+
+		"service_overrides[platform#payment].normal_trace_sampling_rate_minutes: -1 must not be negative", err.Error())
+}
+
+func TestValidateServiceOverrideKeys(t *testing.T) {
+	limit := 10
+	dto := buildValidConfig()
+	dto.ServiceOverrides = map[string]*ServiceSamplingOverride{
+		"payment":   {LimitPerService: &limit},
+		"platform#": {LimitPerService: &limit},
+		"#payment":  {LimitPerService: &limit},
+		"":          {LimitPerService: &limit},
+	}
+	err := dto.Validate()
+	assert.NotNil(t, err)
+	assert.Equal(t, "service_overrides[]: the key must be namespace#service, or the service name of a service "+
+		"without a namespace; "+
+		"service_overrides[#payment]: the key must be namespace#service, or the service name of a service "+
+		"without a namespace; "+
+		"service_overrides[platform#]: the key must be namespace#service, or the service name of a service "+
+		"without a namespace", err.Error())
+}
+
+func TestValidateNegativeEntityKeyTTL(t *testing.T) {
+	dto := buildValidConfig()
+	dto.EntityKeyTTLMinutes = -1
+	assert.NotNil(t, dto.Validate())
+
+	dto.EntityKeyTTLMinutes = 0
+	dto.MaxEntitiesPerThresholdRequest = -1
+	assert.NotNil(t, dto.Validate())
+}
+
+func TestValidateNegativeConfigRefresh(t *testing.T) {
+	dto := buildValidConfig()
+	dto.ConfigRefreshIntervalSeconds = -1
+	assert.NotNil(t, dto.Validate())
+
+	dto.ConfigRefreshIntervalSeconds = 60
+	dto.ConfigRefreshJitterSeconds = -1
+	assert.NotNil(t, dto.Validate())
+}
+
+func TestValidateAssertsServerRetry(t *testing.T) {
+	dto := buildValidConfig()
+	dto.AssertsServerRetry = &AssertsRetryConfig{MaxAttempts: 0}
+	err := dto.Validate()
+	assert.NotNil(t, err)
+	assert.Equal(t, "asserts_server_retry.max_attempts: 0 must be at least 1", err.Error())
+
+	dto.AssertsServerRetry.MaxAttempts = 3
+	assert.Nil(t, dto.Validate())
+}
+
+func TestValidateReportsAllProblemsOfSections(t *testing.T) {
+	dto := buildValidConfig()
+	dto.AssertsServer = &AssertsServerConfig{
+		Endpoint:       "https://chief.app.dev.asserts.ai",
+		TimeoutSeconds: -1,
+		TLS:            &TLSClientConfig{KeyFile: "client.key"},
+		Auth:           &AssertsAuthConfig{OAuth2: &OAuth2ClientCredentialsConfig{TokenURL: "http://idp/token"}},
+	}
+	dto.AssertsServerRetry = &AssertsRetryConfig{MaxAttempts: 0, MaxBackoffSeconds: -1}
+	dto.ThresholdProvider = &ThresholdProviderConfig{Type: ThresholdProviderPrometheus}
+	err := dto.Validate()
+	assert.NotNil(t, err)
+	assert.Equal(t, "asserts_server.timeout_seconds: -1 must not be negative; "+
+		"asserts_server.tls.cert_file: not set, the cert_file and key_file must be set together; "+
+		"asserts_server.auth.oauth2.client_id: not set; "+
+		"asserts_server.auth.oauth2.client_secret: not set, nor client_secret_file; "+
+		"asserts_server_retry.max_attempts: 0 must be at least 1; "+
+		"asserts_server_retry.max_backoff_seconds: -1 must not be negative; "+
+		"threshold_provider.endpoint: not set, it is required by the prometheus provider; "+
+		"threshold_provider.query: not set, it is required by the prometheus provider", err.Error())
 }
@@ -0,0 +1,92 @@
+package assertsprocessor
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A problem with a setting of the config
+type ValidationError struct {
+	// The path of the setting by its config keys, e.g. span_attributes[1].attr_configs[0].rules[2].regex
+	path    string
+	message string
+	error
+}
+
+func (v ValidationError) Error() string {
+	if v.path == "" {
+		return v.message
+	}
+	return v.path + ": " + v.message
+}
+
+// All the problems found in a config, in the order of the settings
+type ValidationErrors []ValidationError
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, 0, len(errs))
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Collects the problems found in a config, so that all of them are reported together
+type configValidator struct {
+	errors ValidationErrors
+}
+
+func (v *configValidator) addf(path string, format string, args ...interface{}) {
+	v.errors = append(v.errors, ValidationError{path: path, message: fmt.Sprintf(format, args...)})
+}
+
+// Adds the error of a setting that is validated on its own
+func (v *configValidator) add(path string, err error) {
+	if err == nil {
+		return
+	}
+	switch e := err.(type) {
+	case ValidationError:
+		e.path = joinPath(path, e.path)
+		v.errors = append(v.errors, e)
+	case ValidationErrors:
+		for _, nested := range e {
+			v.add(path, nested)
+		}
+	default:
+		v.errors = append(v.errors, ValidationError{path: path, message: err.Error(), error: err})
+	}
+}
+
+// A section of the config that collects its problems at the paths of its settings under the path of the section
+type configSection interface {
+	validateAt(v *configValidator, path string)
+}
+
+// Returns the problems of a section on its own, at the paths of its settings, or nil if no problem was found
+func validateSection(section configSection) error {
+	v := &configValidator{}
+	section.validateAt(v, "")
+	return v.result()
+}
+
+// Returns nil if no problem was found
+func (v *configValidator) result() error {
+	if len(v.errors) == 0 {
+		return nil
+	}
+	return v.errors
+}
+
+func joinPath(parent string, child string) string {
+	if parent == "" {
+		return child
+	}
+	if child == "" {
+		return parent
+	}
+	if strings.HasPrefix(child, "[") {
+		return parent + child
+	}
+	return parent + "." + child
+}
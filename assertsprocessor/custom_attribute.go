@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"go.opentelemetry.io/collector/pdata/ptrace"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -15,39 +16,108 @@ type CustomAttributeConfig struct {
 }
 
 func (cAC *CustomAttributeConfig) validate(targetAtt string, serviceKey string) error {
-	if cAC.RegExp == "" {
+	v := &configValidator{}
+	cAC.validateAt(v, "")
+	if err := v.result(); err != nil {
 		return ValidationError{
-			message: fmt.Sprintf("Invalid custom attribute config for target attribute: %s. and service key: %s,"+
-				"regex not specified for source_attributes: [%s], value_expr: %s", targetAtt, serviceKey,
-				strings.Join(cAC.SourceAttributes, "\", \""), cAC.Replacement),
+			message: fmt.Sprintf("Invalid custom attribute config for target attribute: %s and service key: %s: %v",
+				targetAtt, serviceKey, err),
+			error: err,
 		}
-	} else if len(cAC.SourceAttributes) == 0 {
-		return ValidationError{
-			message: fmt.Sprintf("Invalid custom attribute config for target attribute: %s. and service key: %s,"+
-				"source_attributes not specified for regex: %s, value_expr: %s", targetAtt, serviceKey,
-				cAC.RegExp, cAC.Replacement),
+	}
+	return nil
+}
+
+// Collects the problems of the rule, at the paths of its settings under the path of the rule
+func (cAC *CustomAttributeConfig) validateAt(v *configValidator, path string) {
+	if len(cAC.SourceAttributes) == 0 {
+		v.addf(joinPath(path, "source_attributes"), "not set")
+	}
+	for i, value := range cAC.SourceAttributes {
+		if value == "" {
+			v.addf(joinPath(path, fmt.Sprintf("source_attributes[%d]", i)), "empty attribute")
 		}
-	} else {
-		for _, value := range cAC.SourceAttributes {
-			if value == "" {
-				return ValidationError{
-					message: fmt.Sprintf("Invalid custom attribute config for target attribute: %s. and service key: %s,"+
-						"empty attribute in source_attributes: [%s], regex: %s, value_expr: %s", targetAtt, serviceKey,
-						strings.Join(cAC.SourceAttributes, "\", \""), cAC.RegExp, cAC.Replacement),
-				}
-			}
+	}
+	for i, spanKind := range cAC.SpanKinds {
+		if !isSpanKindName(spanKind) {
+			v.addf(joinPath(path, fmt.Sprintf("span_kinds[%d]", i)),
+				"unknown span kind %q, must be one of Unspecified, Internal, Server, Client, Producer or Consumer",
+				spanKind)
 		}
 	}
-	_, err := regexp.Compile(cAC.RegExp)
+	if cAC.RegExp == "" {
+		v.addf(joinPath(path, "regex"), "not set")
+		return
+	}
+	compiled, err := regexp.Compile(cAC.RegExp)
 	if err != nil {
-		return ValidationError{
-			message: fmt.Sprintf("Invalid custom attribute config for target attribute: %s. and service key: %s, "+
-				"Invalid regex in source_attributes: [%s] regex: %s, value_expr: %s: ", targetAtt, serviceKey,
-				strings.Join(cAC.SourceAttributes, "\", \""), cAC.RegExp, cAC.Replacement),
-			error: err,
+		v.errors = append(v.errors, ValidationError{
+			path:    joinPath(path, "regex"),
+			message: fmt.Sprintf("invalid regex %s: %v", cAC.RegExp, err),
+			error:   err,
+		})
+		return
+	}
+	for _, group := range groupReferences(cAC.Replacement) {
+		if number, err := strconv.Atoi(group); err == nil {
+			if number > compiled.NumSubexp() {
+				v.addf(joinPath(path, "value_expr"), "$%s refers to a group beyond the %d groups of regex %s",
+					group, compiled.NumSubexp(), cAC.RegExp)
+			}
+		} else if compiled.SubexpIndex(group) < 0 {
+			v.addf(joinPath(path, "value_expr"), "$%s refers to a group that regex %s does not name",
+				group, cAC.RegExp)
 		}
 	}
-	return nil
+}
+
+// The span kinds are matched by the names of ptrace.SpanKind
+func isSpanKindName(name string) bool {
+	for kind := ptrace.SpanKindUnspecified; kind <= ptrace.SpanKindConsumer; kind++ {
+		if kind.String() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the names of the groups that a value_expr refers to, as regexp.Regexp.Expand reads them: $name or
+// ${name}, where the name is a group number or a group name, and $$ is a literal $
+func groupReferences(template string) []string {
+	groups := make([]string, 0)
+	for i := 0; i < len(template); i++ {
+		if template[i] != '$' || i+1 == len(template) {
+			continue
+		}
+		i++
+		if template[i] == '$' {
+			continue
+		}
+		if template[i] == '{' {
+			end := strings.IndexByte(template[i:], '}')
+			if end < 0 {
+				break
+			}
+			if name := template[i+1 : i+end]; name != "" {
+				groups = append(groups, name)
+			}
+			i += end
+			continue
+		}
+		end := i
+		for end < len(template) && isGroupNameByte(template[end]) {
+			end++
+		}
+		if end > i {
+			groups = append(groups, template[i:end])
+			i = end - 1
+		}
+	}
+	return groups
+}
+
+func isGroupNameByte(b byte) bool {
+	return b == '_' || ('0' <= b && b <= '9') || ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z')
 }
 
 func (cAC *CustomAttributeConfig) compile() *customAttributeConfigCompiled {
@@ -239,3 +239,29 @@ func TestAddCustomAttribute_SpanMatches_RegexpMatch(t *testing.T) {
 
 	assert.Equal(t, "foo:bar", attrConfig.getCustomAttribute(&span))
 }
+
+func TestValidateSpanKindsAndGroupReferences(t *testing.T) {
+	attrConfig := CustomAttributeConfig{
+		SourceAttributes: []string{"http.url"},
+		SpanKinds:        []string{"Server", "Producer"},
+		RegExp:           "(.+)/(?P<id>[0-9]+)",
+		Replacement:      "$$1 ${1}:$id:$2",
+	}
+	assert.Nil(t, attrConfig.validate("target", "namespace#service"))
+
+	attrConfig.SpanKinds = []string{"server"}
+	assert.NotNil(t, attrConfig.validate("target", "namespace#service"))
+
+	attrConfig.SpanKinds = nil
+	attrConfig.Replacement = "$1:$3"
+	assert.NotNil(t, attrConfig.validate("target", "namespace#service"))
+
+	attrConfig.Replacement = "${name}"
+	assert.NotNil(t, attrConfig.validate("target", "namespace#service"))
+}
+
+func TestGroupReferences(t *testing.T) {
+	assert.Equal(t, []string{"1", "2"}, groupReferences("$1:$2"))
+	assert.Equal(t, []string{"1x", "name"}, groupReferences("$1x ${name}"))
+	assert.Equal(t, []string{}, groupReferences("$$1 $ ${ $"))
+}
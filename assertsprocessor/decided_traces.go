@@ -0,0 +1,55 @@
+package assertsprocessor
+
+import (
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+)
+
+// decidedTraces remembers the sampling decisions of the recent traces, so that the spans of a trace that
+// arrive after the trace was kept are passed on, and the spans of a trace that was dropped are dropped.
+// The least recently decided traces are forgotten once the capacity is reached
+type decidedTraces struct {
+	// The sample type of a kept trace, an empty string for a dropped trace
+	decisions *ttlcache.Cache[pcommon.TraceID, string]
+}
+
+func newDecidedTraces(config *Config) *decidedTraces {
+	return &decidedTraces{
+		decisions: ttlcache.New[pcommon.TraceID, string](
+			ttlcache.WithTTL[pcommon.TraceID, string](time.Second*time.Duration(config.DecidedTracesTTLSeconds)),
+			ttlcache.WithCapacity[pcommon.TraceID, string](uint64(config.DecidedTracesCacheSize)),
+			ttlcache.WithDisableTouchOnHit[pcommon.TraceID, string](),
+		),
+	}
+}
+
+func (dt *decidedTraces) keep(traceID pcommon.TraceID, sampleType string) {
+	dt.decisions.Set(traceID, sampleType, ttlcache.DefaultTTL)
+}
+
+// Records a trace as dropped, unless it has already been kept
+func (dt *decidedTraces) drop(traceID pcommon.TraceID) {
+	if item := dt.decisions.Get(traceID); item != nil && item.Value() != "" {
+		return
+	}
+	dt.decisions.Set(traceID, "", ttlcache.DefaultTTL)
+}
+
+// Returns the sample type of the trace if it was kept, and whether a decision was found
+func (dt *decidedTraces) lookup(traceID pcommon.TraceID) (string, bool) {
+	item := dt.decisions.Get(traceID)
+	if item == nil {
+		return "", false
+	}
+	return item.Value(), true
+}
+
+func (dt *decidedTraces) start() {
+	go dt.decisions.Start() // starts automatic expired item deletion
+}
+
+func (dt *decidedTraces) stop() {
+	dt.decisions.Stop()
+}
@@ -0,0 +1,152 @@
+package assertsprocessor
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/consumer/consumertest"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+)
+
+func TestDecidedTraces(t *testing.T) {
+	decided := newDecidedTraces(&Config{DecidedTracesCacheSize: 2, DecidedTracesTTLSeconds: 60})
+	kept := pcommon.TraceID([16]byte{1})
+	dropped := pcommon.TraceID([16]byte{2})
+	undecided := pcommon.TraceID([16]byte{3})
+
+	decided.keep(kept, AssertsTraceSampleTypeError)
+	decided.drop(dropped)
+	// A trace that was kept is not dropped later
+	decided.drop(kept)
+
+	sampleType, found := decided.lookup(kept)
+	assert.True(t, found)
+	assert.Equal(t, AssertsTraceSampleTypeError, sampleType)
+	sampleType, found = decided.lookup(dropped)
+	assert.True(t, found)
+	assert.Equal(t, "", sampleType)
+	_, found = decided.lookup(undecided)
+	assert.False(t, found)
+
+	// The oldest decision is forgotten once the capacity is reached
+	decided.keep(undecided, AssertsTraceSampleTypeSlow)
+	_, found = decided.lookup(kept)
+	assert.False(t, found)
+	assert.Equal(t, 2, decided.decisions.Len())
+}
+
+func TestDecidedTracesExpire(t *testing.T) {
+	decided := newDecidedTraces(&Config{DecidedTracesCacheSize: 2})
+	traceID := pcommon.TraceID([16]byte{1})
+	decided.decisions.Set(traceID, AssertsTraceSampleTypeSlow, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	_, found := decided.lookup(traceID)
+	assert.False(t, found)
+}
+
+func TestSamplerAppliesDecisionsToLateSpans(t *testing.T) {
+	sink := &consumertest.TracesSink{}
+	var s = sampler{
+		logger:             logger,
+		config:             &config,
+		thresholdHelper:    &th,
+		topTracesByService: &sync.Map{},
+		nextConsumer:       sink,
+		metrics:            buildMetrics(),
+		rwMutex:            &sync.RWMutex{},
+		decidedTraces:      newDecidedTraces(&Config{DecidedTracesCacheSize: 10, DecidedTracesTTLSeconds: 60}),
+	}
+	kept := pcommon.TraceID([16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+	dropped := pcommon.TraceID([16]byte{16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1})
+	s.decidedTraces.keep(kept, AssertsTraceSampleTypeSlow)
+	s.decidedTraces.drop(dropped)
+
+	s.sampleTraces(context.Background(), []*trace{buildPeerTrace(kept), buildPeerTrace(dropped)})
+	assert.Equal(t, 1, sink.SpanCount())
+	span := sink.AllTraces()[0].ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0)
+	assert.Equal(t, kept, span.TraceID())
+
+	// Neither trace is queued again
+	value, found := s.topTracesByService.Load("{env=dev, site=us-west-2}#Service#api-server")
+	assert.False(t, found, value)
+}
+
+func TestSamplerRecordsFlushedAndRateLimitedTraces(t *testing.T) {
+	now := time.Now()
+	var s = sampler{
+		logger:             logger,
+		config:             &config,
+		thresholdHelper:    &th,
+		topTracesByService: &sync.Map{},
+		nextConsumer:       &consumertest.TracesSink{},
+		metrics:            buildMetrics(),
+		rateLimiters:       traceRateLimiters{newTraceRateLimiter(&TraceRateLimit{TracesPerSecond: 1}, 1, now)},
+		rwMutex:            &sync.RWMutex{},
+		decidedTraces:      newDecidedTraces(&Config{DecidedTracesCacheSize: 10, DecidedTracesTTLSeconds: 60}),
+	}
+
+	ctx := context.Background()
+	errorSample := &Item{trace: buildPeerTrace(pcommon.TraceID([16]byte{1})), ctx: &ctx, sampleType: AssertsTraceSampleTypeError}
+	slowSample := &Item{trace: buildPeerTrace(pcommon.TraceID([16]byte{2})), ctx: &ctx, sampleType: AssertsTraceSampleTypeSlow}
+	sq := newServiceQueues(&config)
+	requestState := sq.getRequestState("/api-server/v4/rules")
+	requestState.errorQueue.push(errorSample)
+	requestState.slowQueue.push(slowSample)
+	s.topTracesByService.Store("api-server", sq)
+
+	s.flushTraces()
+
+	sampleType, found := s.decidedTraces.lookup(pcommon.TraceID([16]byte{1}))
+	assert.True(t, found)
+	assert.Equal(t, AssertsTraceSampleTypeError, sampleType)
+	sampleType, found = s.decidedTraces.lookup(pcommon.TraceID([16]byte{2}))
+	assert.True(t, found)
+	assert.Equal(t, "", sampleType)
+}
+
+func TestSamplerRecordsEvictedTraces(t *testing.T) {
+	var s = sampler{
+		logger:        logger,
+		config:        &config,
+		decidedTraces: newDecidedTraces(&Config{DecidedTracesCacheSize: 10, DecidedTracesTTLSeconds: 60}),
+	}
+	queue := NewTraceQueue(1)
+	ctx := context.Background()
+	faster := &Item{trace: buildPeerTrace(pcommon.TraceID([16]byte{1})), ctx: &ctx, latency: 1}
+	slower := &Item{trace: buildPeerTrace(pcommon.TraceID([16]byte{2})), ctx: &ctx, latency: 2}
+
+	s.enqueue(queue, faster)
+	s.enqueue(queue, slower)
+
+	sampleType, found := s.decidedTraces.lookup(pcommon.TraceID([16]byte{1}))
+	assert.True(t, found)
+	assert.Equal(t, "", sampleType)
+	_, found = s.decidedTraces.lookup(pcommon.TraceID([16]byte{2}))
+	assert.False(t, found)
+}
+
+func TestSamplerRecordsUnsampledNormalTraces(t *testing.T) {
+	var s = sampler{
+		logger:             logger,
+		config:             &config,
+		thresholdHelper:    &th,
+		topTracesByService: &sync.Map{},
+		metrics:            buildMetrics(),
+		rwMutex:            &sync.RWMutex{},
+		decidedTraces:      newDecidedTraces(&Config{DecidedTracesCacheSize: 10, DecidedTracesTTLSeconds: 60}),
+	}
+	sampled := pcommon.TraceID([16]byte{1})
+	notSampled := pcommon.TraceID([16]byte{2})
+
+	// A request is sampled once every few minutes, so only the first of the normal traces is sampled
+	s.sampleTraces(context.Background(), []*trace{buildPeerTrace(sampled), buildPeerTrace(notSampled)})
+
+	_, found := s.decidedTraces.lookup(sampled)
+	assert.False(t, found)
+	sampleType, found := s.decidedTraces.lookup(notSampled)
+	assert.True(t, found)
+	assert.Equal(t, "", sampleType)
+}
@@ -0,0 +1,249 @@
+package assertsprocessor
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// The diagnostics endpoints served along with the metrics. They show the state of the processor as JSON, to
+// the same requests as the config refresh endpoint
+const (
+	diagnosticsConfigPath          = "/debug/config"
+	diagnosticsSpanAttributesPath  = "/debug/span-attributes"
+	diagnosticsThresholdsPath      = "/debug/thresholds"
+	diagnosticsRequestContextsPath = "/debug/request-contexts"
+	diagnosticsQueuesPath          = "/debug/queues"
+
+	redactedValue = "<redacted>"
+)
+
+// The settings whose values are not shown, at any level of the config
+var secretSettings = map[string]bool{"password": true, "bearer_token": true, "api_key": true, "client_secret": true,
+	"token": true, "config_refresh_token": true}
+
+// The settings whose values are all not shown. Any header, like an api key header, may carry a credential
+var secretMaps = map[string]bool{"headers": true}
+
+func registerDiagnostics(exp *metricsExporter, cr *configRefresh, enricher *spanEnrichmentProcessorImpl,
+	th *thresholdHelper, mh *metricHelper, s *sampler) {
+	authorize := cr.authorizeRequest
+	exp.handle(diagnosticsConfigPath, diagnosticsHandler(authorize, func() any { return cr.effectiveConfig() }))
+	exp.handle(diagnosticsSpanAttributesPath, diagnosticsHandler(authorize, func() any {
+		return enricher.compiledRules()
+	}))
+	exp.handle(diagnosticsThresholdsPath, diagnosticsHandler(authorize, func() any { return th.cachedThresholds() }))
+	exp.handle(diagnosticsRequestContextsPath, diagnosticsHandler(authorize, func() any {
+		return knownRequestContextsDto{Metrics: mh.knownRequestContexts(), Sampling: s.knownRequestContexts()}
+	}))
+	exp.handle(diagnosticsQueuesPath, diagnosticsHandler(authorize, func() any { return s.queueSummary() }))
+}
+
+// Handles the authorized GET requests with the JSON of the state
+func diagnosticsHandler(authorize func(r *http.Request) bool, state func() any) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorize(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(state())
+	})
+}
+
+type effectiveConfigDto struct {
+	Version uint64         `json:"version"`
+	Source  string         `json:"source"`
+	Config  configSettings `json:"config"`
+	// The source of each setting, local for the settings of the collector config
+	Origins map[string]string `json:"origins"`
+}
+
+// Returns the config in use, with the secrets redacted
+func (cr *configRefresh) effectiveConfig() effectiveConfigDto {
+	cr.mutex.Lock()
+	// The listeners change the config while they hold the lock
+	settings, err := settingsOf(cr.config)
+	dto := effectiveConfigDto{Version: cr.version, Source: cr.activeSource, Config: settings}
+	body := cr.activeBody
+	cr.mutex.Unlock()
+	if err != nil {
+		return dto
+	}
+	redactSecrets(settings)
+
+	// YAML is a superset of JSON, so the documents of all the sources are read as YAML
+	var sourceSettings map[string]interface{}
+	_ = yaml.Unmarshal(body, &sourceSettings)
+	if dto.Source != activeConfigFile {
+		for _, key := range localOnlySettings {
+			delete(sourceSettings, key)
+		}
+	}
+	dto.Origins = make(map[string]string, len(settings))
+	for key := range settings {
+		dto.Origins[key] = activeConfigLocal
+		if _, found := sourceSettings[key]; found {
+			dto.Origins[key] = dto.Source
+		}
+	}
+	return dto
+}
+
+func redactSecrets(settings map[string]interface{}) {
+	for key, value := range settings {
+		switch typed := value.(type) {
+		case map[string]interface{}:
+			if secretMaps[strings.ToLower(key)] {
+				redactAll(typed)
+			} else {
+				redactSecrets(typed)
+			}
+		case string:
+			if secretSettings[strings.ToLower(key)] && typed != "" {
+				settings[key] = redactedValue
+			}
+		}
+	}
+}
+
+func redactAll(settings map[string]interface{}) {
+	for key, value := range settings {
+		if value != nil && value != "" {
+			settings[key] = redactedValue
+		}
+	}
+}
+
+type compiledRuleDto struct {
+	SpanKinds        []string `json:"span_kinds"`
+	SourceAttributes []string `json:"source_attributes"`
+	RegExp           string   `json:"regex"`
+	Replacement      string   `json:"value_expr"`
+}
+
+// Returns the compiled rules by target attribute and service key
+func (p *spanEnrichmentProcessorImpl) compiledRules() map[string]map[string][]compiledRuleDto {
+	p.configRWMutex.RLock()
+	defer p.configRWMutex.RUnlock()
+
+	rules := make(map[string]map[string][]compiledRuleDto, len(p.customAttributes))
+	for targetAtt, byServiceKey := range p.customAttributes {
+		rules[targetAtt] = make(map[string][]compiledRuleDto, len(byServiceKey))
+		for serviceKey, compiledRules := range byServiceKey {
+			for _, rule := range compiledRules {
+				rules[targetAtt][serviceKey] = append(rules[targetAtt][serviceKey], compiledRuleDto{
+					SpanKinds:        rule.spanKinds,
+					SourceAttributes: rule.sourceAttributes,
+					RegExp:           rule.regExp.String(),
+					Replacement:      rule.replacement,
+				})
+			}
+		}
+	}
+	return rules
+}
+
+type cachedThresholdsDto struct {
+	DefaultLatencyThreshold float64 `json:"default_latency_threshold"`
+	// The thresholds of the entities by entity key
+	Entities map[string][]*ThresholdDto `json:"entities"`
+}
+
+func (th *thresholdHelper) cachedThresholds() cachedThresholdsDto {
+	dto := cachedThresholdsDto{
+		DefaultLatencyThreshold: th.getDefaultThreshold(),
+		Entities:                map[string][]*ThresholdDto{},
+	}
+	th.thresholds.Range(func(entityKey string, thresholds map[string]*ThresholdDto) bool {
+		keys := make([]string, 0, len(thresholds))
+		for key := range thresholds {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			dto.Entities[entityKey] = append(dto.Entities[entityKey], thresholds[key])
+		}
+		return true
+	})
+	return dto
+}
+
+type knownRequestContextsDto struct {
+	// The request contexts for which metrics are captured, by service
+	Metrics map[string][]string `json:"metrics"`
+	// The request contexts for which normal traces are sampled, by service
+	Sampling map[string][]string `json:"sampling"`
+}
+
+func (p *metricHelper) knownRequestContexts() map[string][]string {
+	requestContexts := map[string][]string{}
+	p.requestContextsByService.Range(func(serviceKey string, cache *ttlcache.Cache[string, prometheus.Labels]) bool {
+		requestContexts[serviceKey] = sortedKeys(cache.Keys())
+		return true
+	})
+	return requestContexts
+}
+
+func (s *sampler) knownRequestContexts() map[string][]string {
+	requestContexts := map[string][]string{}
+	s.topTracesByService.Range(func(key any, value any) bool {
+		requestContexts[key.(string)] = sortedKeys(value.(*serviceQueues).getPeriodicSamplingStates().Keys())
+		return true
+	})
+	return requestContexts
+}
+
+func sortedKeys(keys []string) []string {
+	sort.Strings(keys)
+	return keys
+}
+
+type serviceQueuesDto struct {
+	Limits      serviceSamplingLimits `json:"limits"`
+	Requests    int                   `json:"requests"`
+	ErrorTraces int                   `json:"error_traces"`
+	SlowTraces  int                   `json:"slow_traces"`
+}
+
+type queueSummaryDto struct {
+	// The memory used by the queued traces
+	UsedBytes int64 `json:"used_bytes"`
+	// The traces waiting for the next flush, by service
+	Services map[string]serviceQueuesDto `json:"services"`
+}
+
+func (s *sampler) queueSummary() queueSummaryDto {
+	summary := queueSummaryDto{Services: map[string]serviceQueuesDto{}}
+	if s.memoryBudget != nil {
+		summary.UsedBytes = s.memoryBudget.getUsedBytes()
+	}
+	s.topTracesByService.Range(func(key any, value any) bool {
+		sq := value.(*serviceQueues)
+		dto := serviceQueuesDto{Limits: sq.getLimits()}
+		sq.rwMutex.RLock()
+		requestStates := sq.requestStates
+		sq.rwMutex.RUnlock()
+		requestStates.Range(func(_ any, state any) bool {
+			dto.Requests++
+			dto.ErrorTraces += state.(*traceSampler).errorQueue.size()
+			dto.SlowTraces += state.(*traceSampler).slowQueue.size()
+			return true
+		})
+		summary.Services[key.(string)] = dto
+		return true
+	})
+	return summary
+}
@@ -0,0 +1,178 @@
+package assertsprocessor
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/puzpuzpuz/xsync/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func buildDiagnosticsRequest(method string, remoteAddr string) *http.Request {
+	request := httptest.NewRequest(method, diagnosticsQueuesPath, nil)
+	request.RemoteAddr = remoteAddr
+	return request
+}
+
+func TestDiagnosticsHandler(t *testing.T) {
+	cr := configRefresh{logger: logger}
+	handler := diagnosticsHandler(cr.authorizeRequest, func() any { return map[string]int{"requests": 2} })
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, buildDiagnosticsRequest(http.MethodGet, "127.0.0.1:40000"))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"requests": 2}`, recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, buildDiagnosticsRequest(http.MethodPost, "127.0.0.1:40000"))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+}
+
+func TestDiagnosticsHandlerAuthorization(t *testing.T) {
+	state := func() any { return map[string]int{"requests": 2} }
+
+	// Without a token, only the requests from the loopback address are accepted
+	cr := configRefresh{logger: logger}
+	recorder := httptest.NewRecorder()
+	diagnosticsHandler(cr.authorizeRequest, state).ServeHTTP(recorder,
+		buildDiagnosticsRequest(http.MethodGet, "10.0.0.5:40000"))
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+	// With a token, the requests must have it
+	cr = configRefresh{logger: logger, refreshToken: "secret"}
+	recorder = httptest.NewRecorder()
+	diagnosticsHandler(cr.authorizeRequest, state).ServeHTTP(recorder,
+		buildDiagnosticsRequest(http.MethodGet, "127.0.0.1:40000"))
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	request := buildDiagnosticsRequest(http.MethodGet, "10.0.0.5:40000")
+	request.Header.Set("Authorization", "Bearer secret")
+	recorder = httptest.NewRecorder()
+	diagnosticsHandler(cr.authorizeRequest, state).ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	cr := configRefresh{
+		logger: logger,
+		config: &Config{
+			Env: "dev",
+			AssertsServer: &AssertsServerConfig{
+				Endpoint: "http://localhost:8030",
+				User:     "asserts",
+				Password: "secret",
+				Headers:  map[string]string{"X-Api-Key": "secret", "X-Tenant": "acme"},
+				Auth:     &AssertsAuthConfig{OAuth2: &OAuth2ClientCredentialsConfig{ClientSecret: "secret"}},
+			},
+			DefaultLatencyThreshold: 0.75,
+			ThresholdProvider: &ThresholdProviderConfig{
+				Type:    ThresholdProviderPrometheus,
+				Headers: map[string]string{"X-Scope-OrgID": "acme"},
+			},
+			ConfigSource: &ConfigSourceConfig{
+				Type:  ConfigSourceOpAMP,
+				OpAMP: &OpAMPConfig{Endpoint: "wss://opamp:4320", Headers: map[string]string{"Authorization": "Bearer secret"}},
+			},
+		},
+		version: 3,
+	}
+	cr.setActiveConfig(activeConfigAsserts,
+		[]byte(`{"sampling_latency_threshold_seconds": 0.75, "asserts_server": {"endpoint": "http://asserts-api:8030"}}`))
+
+	dto := cr.effectiveConfig()
+	assert.Equal(t, uint64(3), dto.Version)
+	assert.Equal(t, activeConfigAsserts, dto.Source)
+	assert.Equal(t, 0.75, dto.Config["sampling_latency_threshold_seconds"])
+	server := dto.Config["asserts_server"].(map[string]interface{})
+	assert.Equal(t, "http://localhost:8030", server["endpoint"])
+	assert.Equal(t, redactedValue, server["password"])
+	assert.Equal(t, map[string]interface{}{"X-Api-Key": redactedValue, "X-Tenant": redactedValue}, server["headers"])
+	oauth2 := server["auth"].(map[string]interface{})["oauth2"].(map[string]interface{})
+	assert.Equal(t, redactedValue, oauth2["client_secret"])
+	opamp := dto.Config["config_source"].(map[string]interface{})["opamp"].(map[string]interface{})
+	assert.Equal(t, redactedValue, opamp["headers"].(map[string]interface{})["Authorization"])
+	provider := dto.Config["threshold_provider"].(map[string]interface{})
+	assert.Equal(t, redactedValue, provider["headers"].(map[string]interface{})["X-Scope-OrgID"])
+
+	assert.Equal(t, activeConfigAsserts, dto.Origins["sampling_latency_threshold_seconds"])
+	// The Asserts API cannot change the connection settings
+	assert.Equal(t, activeConfigLocal, dto.Origins["asserts_server"])
+	assert.Equal(t, activeConfigLocal, dto.Origins["asserts_env"])
+}
+
+func TestCompiledRules(t *testing.T) {
+	processor, err := buildEnrichmentProcessor(logger, &Config{
+		SpanAttributes: []*SpanAttribute{{
+			AttributeName: "asserts.request.context",
+			AttributeConfigs: []*SpanAttributeConfig{{
+				Namespace: "asserts",
+				Service:   "api-server",
+				Rules: []*CustomAttributeConfig{{
+					SourceAttributes: []string{"http.url"},
+					RegExp:           "https?://.+?((/[^/?]+){1,3}).*",
+				}},
+			}},
+		}},
+	})
+	assert.Nil(t, err)
+
+	encoded, err := json.Marshal(processor.compiledRules())
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"asserts.request.context": {"asserts#api-server": [{
+		"span_kinds": ["Server"],
+		"source_attributes": ["http.url"],
+		"regex": "https?://.+?((/[^/?]+){1,3}).*",
+		"value_expr": "$1"
+	}]}}`, string(encoded))
+}
+
+func TestCachedThresholds(t *testing.T) {
+	th := thresholdHelper{
+		config:     &Config{DefaultLatencyThreshold: 0.5},
+		thresholds: xsync.NewMapOf[map[string]*ThresholdDto](),
+		rwMutex:    &sync.RWMutex{},
+	}
+	threshold := &ThresholdDto{RequestType: "inbound", RequestContext: "/cart", LatencyUpperBound: 1}
+	th.thresholds.Store("api-server", map[string]*ThresholdDto{"inbound#/cart": threshold})
+
+	dto := th.cachedThresholds()
+	assert.Equal(t, 0.5, dto.DefaultLatencyThreshold)
+	assert.Equal(t, []*ThresholdDto{threshold}, dto.Entities["api-server"])
+}
+
+func TestSamplerDiagnostics(t *testing.T) {
+	testConfig := &Config{
+		Env:                       "dev",
+		Site:                      "us-west-2",
+		LimitPerService:           10,
+		LimitPerRequestPerService: 2,
+		RequestContextCacheTTL:    60,
+	}
+	s := sampler{
+		logger:             logger,
+		config:             testConfig,
+		topTracesByService: &sync.Map{},
+		rwMutex:            &sync.RWMutex{},
+	}
+	cart := &traceSegment{
+		namespace:  "robot-shop",
+		service:    "cart",
+		requestKey: &RequestKey{entityKey: buildEntityKey(testConfig, "robot-shop", "cart")},
+	}
+	queues := s.getServiceQueues(cart)
+	queues.getPeriodicSamplingStates().Set("/cart", &periodicSamplingState{}, ttlcache.DefaultTTL)
+	queues.getRequestState("/cart").errorQueue.push(&Item{})
+	queues.getRequestState("/checkout")
+
+	serviceKey := cart.requestKey.entityKey.AsString()
+	assert.Equal(t, map[string][]string{serviceKey: {"/cart"}}, s.knownRequestContexts())
+	assert.Equal(t, serviceQueuesDto{
+		Limits:      serviceSamplingLimits{LimitPerService: 10, LimitPerRequestPerService: 2},
+		Requests:    2,
+		ErrorTraces: 1,
+	}, s.queueSummary().Services[serviceKey])
+}
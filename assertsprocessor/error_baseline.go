@@ -0,0 +1,167 @@
+package assertsprocessor
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/puzpuzpuz/xsync/v2"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+type ErrorBaselineConfig struct {
+	// The half-life of the rolling error rate, which follows the recent errors of a request
+	RollingHalfLifeMinutes float64 `mapstructure:"rolling_half_life_minutes" json:"rolling_half_life_minutes"`
+	// The half-life of the baseline error rate, which follows the usual errors of a request
+	BaselineHalfLifeMinutes float64 `mapstructure:"baseline_half_life_minutes" json:"baseline_half_life_minutes"`
+	// The errors are expected while the rolling error rate is at most these many times the baseline
+	Tolerance float64 `mapstructure:"tolerance" json:"tolerance"`
+	// The errors of a request are not expected until the baseline is learned from at least these many
+	// (decayed) requests
+	MinRequests int `mapstructure:"min_requests" json:"min_requests"`
+	// Limits the number of entity and request context combinations whose error rates are tracked.
+	// 10000 when not set
+	MaxSeries int `mapstructure:"max_series" json:"max_series"`
+}
+
+func (ec *ErrorBaselineConfig) maxSeries() int {
+	if ec.MaxSeries == 0 {
+		return defaultBaselineMaxSeries
+	}
+	return ec.MaxSeries
+}
+
+func (ec *ErrorBaselineConfig) validateAt(v *configValidator, path string) {
+	if ec.RollingHalfLifeMinutes <= 0 {
+		v.addf(joinPath(path, "rolling_half_life_minutes"), "%v must be positive", ec.RollingHalfLifeMinutes)
+	} else if ec.BaselineHalfLifeMinutes < ec.RollingHalfLifeMinutes {
+		v.addf(joinPath(path, "baseline_half_life_minutes"), "%v < rolling_half_life_minutes: %v",
+			ec.BaselineHalfLifeMinutes, ec.RollingHalfLifeMinutes)
+	}
+	if ec.Tolerance < 1 {
+		v.addf(joinPath(path, "tolerance"), "%v must be at least 1", ec.Tolerance)
+	}
+	if ec.MinRequests < 0 {
+		v.addf(joinPath(path, "min_requests"), "%d must not be negative", ec.MinRequests)
+	}
+	if ec.MaxSeries < 0 {
+		v.addf(joinPath(path, "max_series"), "%d must not be negative", ec.MaxSeries)
+	}
+}
+
+// decayingRate counts the requests and the errors with weights that decay exponentially with time
+type decayingRate struct {
+	halfLife  time.Duration
+	requests  float64
+	errors    float64
+	lastDecay time.Time
+}
+
+func (dr *decayingRate) add(isError bool, now time.Time) {
+	dr.decay(now)
+	dr.requests++
+	if isError {
+		dr.errors++
+	}
+}
+
+// Decays the counts at most once a second, as in the latency sketch
+func (dr *decayingRate) decay(now time.Time) {
+	elapsed := now.Sub(dr.lastDecay)
+	if elapsed < time.Second {
+		return
+	}
+	factor := math.Pow(0.5, float64(elapsed)/float64(dr.halfLife))
+	dr.requests *= factor
+	dr.errors *= factor
+	dr.lastDecay = now
+}
+
+func (dr *decayingRate) rate() float64 {
+	if dr.requests <= 0 {
+		return 0
+	}
+	return dr.errors / dr.requests
+}
+
+type errorRate struct {
+	entityKey string
+	rolling   *decayingRate
+	baseline  *decayingRate
+	mutex     sync.Mutex
+}
+
+// errorBaselines tracks the error rate of each entity and request context from the spans seen by the
+// processor. A short half-life rolling rate is compared with a long half-life baseline to tell the usual
+// errors of a request from an increase in its errors
+type errorBaselines struct {
+	config *Config
+	rates  *xsync.MapOf[string, *errorRate]
+	now    func() time.Time
+}
+
+func newErrorBaselines(config *Config) *errorBaselines {
+	return &errorBaselines{
+		config: config,
+		rates:  xsync.NewMapOf[*errorRate](),
+		now:    time.Now,
+	}
+}
+
+func (eb *errorBaselines) observe(namespace string, service string, span *ptrace.Span) {
+	requestType, request := getRequest(span)
+	entityKey := buildEntityKey(eb.config, namespace, service)
+	key := entityKey.AsString() + "#" + thresholdKey(requestType, request)
+	rate, found := eb.rates.Load(key)
+	if !found {
+		if eb.rates.Size() >= eb.config.ErrorBaseline.maxSeries() {
+			return
+		}
+		now := eb.now()
+		rate, _ = eb.rates.LoadOrStore(key, &errorRate{
+			entityKey: entityKey.AsString(),
+			rolling: &decayingRate{
+				halfLife:  time.Duration(eb.config.ErrorBaseline.RollingHalfLifeMinutes * float64(time.Minute)),
+				lastDecay: now,
+			},
+			baseline: &decayingRate{
+				halfLife:  time.Duration(eb.config.ErrorBaseline.BaselineHalfLifeMinutes * float64(time.Minute)),
+				lastDecay: now,
+			},
+		})
+	}
+	now := eb.now()
+	isError := spanHasError(span)
+	rate.mutex.Lock()
+	rate.rolling.add(isError, now)
+	rate.baseline.add(isError, now)
+	rate.mutex.Unlock()
+}
+
+// Forgets the error rates of the requests of the entity
+func (eb *errorBaselines) forget(entityKey string) {
+	eb.rates.Range(func(key string, rate *errorRate) bool {
+		if rate.entityKey == entityKey {
+			eb.rates.Delete(key)
+		}
+		return true
+	})
+}
+
+// Returns the rolling and the baseline error rates of the request. Returns false if there are too few
+// requests to tell
+func (eb *errorBaselines) getRates(entityKey EntityKeyDto, requestType string, request string) (float64, float64, bool) {
+	rate, found := eb.rates.Load(entityKey.AsString() + "#" + thresholdKey(requestType, request))
+	if !found {
+		return 0, 0, false
+	}
+	rate.mutex.Lock()
+	defer rate.mutex.Unlock()
+	now := eb.now()
+	rate.rolling.decay(now)
+	rate.baseline.decay(now)
+	if rate.baseline.requests < float64(eb.config.ErrorBaseline.MinRequests) || rate.baseline.requests == 0 {
+		return 0, 0, false
+	}
+	return rate.rolling.rate(), rate.baseline.rate(), true
+}
@@ -0,0 +1,179 @@
+package assertsprocessor
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/puzpuzpuz/xsync/v2"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+func buildErrorBaselineConfig() *Config {
+	return &Config{
+		Env:                       "dev",
+		Site:                      "us-west-2",
+		DefaultLatencyThreshold:   0.5,
+		LimitPerService:           2,
+		LimitPerRequestPerService: 5,
+		ErrorBaseline: &ErrorBaselineConfig{
+			RollingHalfLifeMinutes:  5,
+			BaselineHalfLifeMinutes: 360,
+			Tolerance:               2,
+			MinRequests:             100,
+			MaxSeries:               2,
+		},
+	}
+}
+
+// Observes the requests of which every failEvery'th request fails
+func observeRequests(helper *thresholdHelper, request string, count int, failEvery int) {
+	for i := 1; i <= count; i++ {
+		span := buildLatencySpan(request, 0.1)
+		if failEvery > 0 && i%failEvery == 0 {
+			span.Status().SetCode(ptrace.StatusCodeError)
+		}
+		helper.observeSpan("platform", "api-server", span)
+	}
+}
+
+func buildErrorBaselineHelper(cfg *Config) *thresholdHelper {
+	return &thresholdHelper{
+		logger:         logger,
+		config:         cfg,
+		entityKeys:     xsync.NewMapOf[EntityKeyDto](),
+		thresholds:     xsync.NewMapOf[map[string]*ThresholdDto](),
+		rwMutex:        &sync.RWMutex{},
+		errorBaselines: newErrorBaselines(cfg),
+	}
+}
+
+func TestDecayingRate(t *testing.T) {
+	now := time.Unix(1000, 0)
+	rate := &decayingRate{halfLife: time.Minute, lastDecay: now}
+	for i := 0; i < 100; i++ {
+		rate.add(i%10 == 0, now)
+	}
+	assert.InDelta(t, 0.1, rate.rate(), 1e-9)
+
+	// After a half-life, the new requests weigh twice as much as the old ones
+	now = now.Add(time.Minute)
+	for i := 0; i < 100; i++ {
+		rate.add(i%2 == 0, now)
+	}
+	assert.InDelta(t, 150, rate.requests, 1e-9)
+	assert.InDelta(t, 55.0/150, rate.rate(), 1e-9)
+}
+
+func TestErrorBaselinesGetRates(t *testing.T) {
+	cfg := buildErrorBaselineConfig()
+	helper := buildErrorBaselineHelper(cfg)
+	entityKey := buildEntityKey(cfg, "platform", "api-server")
+
+	observeRequests(helper, "/v1/rules", 99, 10)
+	_, _, found := helper.errorBaselines.getRates(entityKey, AssertsRequestTypeInbound, "/v1/rules")
+	assert.False(t, found)
+
+	observeRequests(helper, "/v1/rules", 1, 1)
+	rolling, baseline, found := helper.errorBaselines.getRates(entityKey, AssertsRequestTypeInbound, "/v1/rules")
+	assert.True(t, found)
+	assert.InDelta(t, 0.1, rolling, 1e-9)
+	assert.InDelta(t, 0.1, baseline, 1e-9)
+
+	// No more series than the limit
+	observeRequests(helper, "/v1/alerts", 1, 0)
+	observeRequests(helper, "/v1/users", 1, 0)
+	assert.Equal(t, 2, helper.errorBaselines.rates.Size())
+}
+
+func TestErrorBaselinesWithoutMaxSeries(t *testing.T) {
+	cfg := buildErrorBaselineConfig()
+	cfg.ErrorBaseline.MaxSeries = 0
+	assert.Nil(t, validateSection(cfg.ErrorBaseline))
+	helper := buildErrorBaselineHelper(cfg)
+	span := buildLatencySpan("/v1/rules", 0.1)
+
+	observeRequests(helper, "/v1/rules", 1000, 50)
+	observeRequests(helper, "/v1/alerts", 1, 0)
+	observeRequests(helper, "/v1/users", 1, 0)
+	assert.Equal(t, 3, helper.errorBaselines.rates.Size())
+	assert.True(t, helper.isErrorExpected("platform", "api-server", span))
+}
+
+func TestIsErrorExpected(t *testing.T) {
+	cfg := buildErrorBaselineConfig()
+	helper := buildErrorBaselineHelper(cfg)
+	now := time.Unix(1000, 0)
+	helper.errorBaselines.now = func() time.Time { return now }
+	span := buildLatencySpan("/v1/rules", 0.1)
+
+	// Unknown error rates
+	assert.False(t, helper.isErrorExpected("platform", "api-server", span))
+
+	observeRequests(helper, "/v1/rules", 1000, 50)
+	assert.True(t, helper.isErrorExpected("platform", "api-server", span))
+
+	// The rolling error rate rises well above the baseline
+	now = now.Add(time.Hour)
+	observeRequests(helper, "/v1/rules", 100, 2)
+	assert.False(t, helper.isErrorExpected("platform", "api-server", span))
+
+	// The error rate threshold from Asserts takes precedence over the baseline
+	entityKey := buildEntityKey(cfg, "platform", "api-server")
+	helper.thresholds.Store(entityKey.AsString(), map[string]*ThresholdDto{
+		"inbound#/v1/rules": {RequestType: "inbound", RequestContext: "/v1/rules", ErrorRateUpperBound: 0.6},
+	})
+	assert.True(t, helper.isErrorExpected("platform", "api-server", span))
+	// A threshold with only the error rate does not bound the latency
+	assert.Equal(t, 0.5, helper.getSpanThreshold("platform", "api-server", span))
+
+	helper.errorBaselines = nil
+	assert.False(t, helper.isErrorExpected("platform", "api-server", span))
+}
+
+func TestSampleTraceWithExpectedErrorSpan(t *testing.T) {
+	cfg := buildErrorBaselineConfig()
+	helper := buildErrorBaselineHelper(cfg)
+	observeRequests(helper, "/v1/rules", 1000, 50)
+	var s = sampler{
+		logger:             logger,
+		config:             cfg,
+		thresholdHelper:    helper,
+		topTracesByService: &sync.Map{},
+		metrics:            buildMetrics(),
+		rwMutex:            &sync.RWMutex{},
+	}
+
+	span := buildLatencySpan("/v1/rules", 0.1)
+	span.Status().SetCode(ptrace.StatusCodeError)
+	tr := newTrace(&traceSegment{
+		namespace: "platform",
+		service:   "api-server",
+		rootSpan:  span,
+	})
+	s.sampleTraces(context.Background(), []*trace{tr})
+
+	// The expected error is sampled as a normal trace
+	value, _ := s.topTracesByService.Load("{env=dev, namespace=platform, site=us-west-2}#Service#api-server")
+	requestState := value.(*serviceQueues).getRequestState("/v1/rules")
+	assert.Equal(t, 0, requestState.errorTraceCount())
+	assert.Equal(t, 1, requestState.slowTraceCount())
+	sampleType, _ := span.Attributes().Get(AssertsTraceSampleTypeAttribute)
+	assert.Equal(t, AssertsTraceSampleTypeNormal, sampleType.Str())
+	expected, _ := span.Attributes().Get(AssertsErrorExpectedAttribute)
+	assert.True(t, expected.Bool())
+}
+
+func TestValidateErrorBaseline(t *testing.T) {
+	errorConfig := buildErrorBaselineConfig().ErrorBaseline
+	assert.Nil(t, validateSection(errorConfig))
+
+	errorConfig.Tolerance = 0.5
+	assert.NotNil(t, validateSection(errorConfig))
+
+	errorConfig.Tolerance = 2
+	errorConfig.BaselineHalfLifeMinutes = 1
+	assert.NotNil(t, validateSection(errorConfig))
+}
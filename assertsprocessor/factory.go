@@ -2,6 +2,7 @@ package assertsprocessor
 
 import (
 	"context"
+	"fmt"
 	"github.com/puzpuzpuz/xsync/v2"
 	"sync"
 	"time"
@@ -31,8 +32,15 @@ func NewFactory() processor.Factory {
 
 func createDefaultConfig() component.Config {
 	return &Config{
-		AssertsServer: &map[string]string{
-			"endpoint": "https://chief.app.dev.asserts.ai",
+		AssertsServer: &AssertsServerConfig{
+			Endpoint: "https://chief.app.dev.asserts.ai",
+		},
+		AssertsServerRetry: &AssertsRetryConfig{
+			MaxAttempts:               3,
+			InitialBackoffMillis:      500,
+			MaxBackoffSeconds:         30,
+			CircuitBreakerFailures:    5,
+			CircuitBreakerOpenSeconds: 60,
 		},
 		SampleTraces:                   true,
 		LatencyHistogramBuckets:        []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 90, 120},
@@ -43,6 +51,12 @@ func createDefaultConfig() component.Config {
 		NormalSamplingFrequencyMinutes: 5,
 		PrometheusExporterPort:         9465,
 		TraceFlushFrequencySeconds:     30,
+		TraceQueueMemoryLimitMiB:       256,
+		DecidedTracesTTLSeconds:        300,
+		EntityKeyTTLMinutes:            60,
+		MaxEntitiesPerThresholdRequest: 100,
+		ConfigRefreshIntervalSeconds:   60,
+		ConfigRefreshJitterSeconds:     10,
 	}
 }
 
@@ -56,28 +70,70 @@ func newProcessor(logger *zap.Logger, buildInfo component.BuildInfo, ctx context
 	logger.Info("Creating assertsotelprocessor")
 	pConfig := config.(*Config)
 
-	restClient := restClientFactory(logger, pConfig)
+	restClient, err := restClientFactory(logger, pConfig)
+	if err != nil {
+		return nil, err
+	}
 
 	configRefresh := configRefresh{
 		config:           pConfig,
 		logger:           logger,
-		configSyncTicker: clock.FromContext(ctx).NewTicker(time.Minute),
+		configSyncTicker: clock.FromContext(ctx).NewTicker(pConfig.configSyncInterval()),
+		jitter:           time.Duration(pConfig.ConfigRefreshJitterSeconds) * time.Second,
+		refreshNow:       make(chan struct{}, 1),
 		stop:             make(chan bool),
 		restClient:       restClient,
+		cacheFile:        pConfig.ConfigCacheFile,
+		refreshToken:     pConfig.ConfigRefreshToken,
 	}
 
-	// First up, fetch the latest collector config from asserts api server
-	if newConfig, fetchError := configRefresh.fetchConfig(restClient); fetchError == nil {
-		// If config is fetched successfully from api server then for the following
-		// attributes it takes precedence over the local collector config
-		pConfig.CaptureMetrics = newConfig.CaptureMetrics
-		pConfig.CaptureAttributesInMetric = newConfig.CaptureAttributesInMetric
-		pConfig.DefaultLatencyThreshold = newConfig.DefaultLatencyThreshold
-		pConfig.CustomAttributeConfigs = newConfig.CustomAttributeConfigs
-		pConfig.SpanAttributes = newConfig.SpanAttributes
-		pConfig.IgnoreClientErrors = newConfig.IgnoreClientErrors
-		if len(newConfig.LatencyHistogramBuckets) > 0 {
-			pConfig.LatencyHistogramBuckets = newConfig.LatencyHistogramBuckets
+	if pConfig.configSourceType() == ConfigSourceFile {
+		// The config file takes the place of the config of the asserts api server, and must be valid
+		// to start with
+		configRefresh.fileSource, err = newFileConfigSource(logger, pConfig)
+		if err != nil {
+			return nil, err
+		}
+		newConfig, readError := configRefresh.fileSource.readIfChanged()
+		if readError != nil {
+			return nil, fmt.Errorf("invalid config file %s: %w", pConfig.ConfigSource.Path, readError)
+		}
+		*pConfig = *newConfig
+		configRefresh.setActiveConfig(activeConfigFile, configRefresh.fileSource.content)
+	} else if pConfig.configSourceType() == ConfigSourceOpAMP {
+		configRefresh.localSettings, err = settingsOf(pConfig)
+		if err != nil {
+			return nil, err
+		}
+		// The collector config is used until the OpAMP server delivers a remote config, after the processor starts
+		configRefresh.setActiveConfig(activeConfigLocal, nil)
+		configRefresh.opamp, err = newOpAMPAgent(logger, pConfig.ConfigSource.OpAMP, buildInfo, &configRefresh)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		configRefresh.localSettings, err = settingsOf(pConfig)
+		if err != nil {
+			return nil, err
+		}
+		// First up, fetch the latest collector config from asserts api server, or the cached config if the
+		// api server cannot be reached. Its settings take precedence over those of the local collector config.
+		// The calls authenticated by an auth extension wait for the processor to start
+		var newConfig *Config
+		if pConfig.assertsAuthenticator() != "" {
+			configRefresh.fetchOnStart = true
+			newConfig = configRefresh.loadInitialConfig()
+		} else {
+			newConfig = configRefresh.fetchInitialConfig(restClient)
+		}
+		if newConfig != nil {
+			*pConfig = *newConfig
+		}
+		if pConfig.configStreamed() && pConfig.AssertsServer != nil && pConfig.AssertsServer.Endpoint != "" {
+			configRefresh.stream, err = newConfigStream(logger, pConfig, configRefresh.requestRefresh)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
@@ -86,14 +142,20 @@ func newProcessor(logger *zap.Logger, buildInfo component.BuildInfo, ctx context
 		return nil, err
 	}
 
+	thresholdProvider, err := newThresholdProvider(logger, pConfig, restClient)
+	if err != nil {
+		return nil, err
+	}
 	thresholdsHelper := thresholdHelper{
 		config:              pConfig,
 		logger:              logger,
 		thresholdSyncTicker: clock.FromContext(ctx).NewTicker(time.Minute),
 		thresholds:          xsync.NewMapOf[map[string]*ThresholdDto](),
 		entityKeys:          xsync.NewMapOf[EntityKeyDto](),
+		lastSeen:            xsync.NewMapOf[int64](),
+		refreshNow:          make(chan struct{}, 1),
 		stop:                make(chan bool),
-		rc:                  restClient,
+		provider:            thresholdProvider,
 		rwMutex:             &sync.RWMutex{},
 	}
 
@@ -102,18 +164,51 @@ func newProcessor(logger *zap.Logger, buildInfo component.BuildInfo, ctx context
 	if err != nil {
 		return nil, err
 	}
+	err = metricsHelper.metrics.registerCollector(newThresholdCollector(&thresholdsHelper))
+	if err != nil {
+		return nil, err
+	}
+	err = configRefresh.registerMetrics(metricsHelper.metrics)
+	if err != nil {
+		return nil, err
+	}
+	if pConfig.LatencyBaseline != nil {
+		thresholdsHelper.baselines = newLatencyBaselines(pConfig)
+		err = metricsHelper.metrics.registerCollector(thresholdsHelper.baselines)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pConfig.ErrorBaseline != nil {
+		thresholdsHelper.errorBaselines = newErrorBaselines(pConfig)
+	}
 	traceSampler := sampler{
 		logger:             logger,
 		config:             pConfig,
 		thresholdHelper:    &thresholdsHelper,
 		topTracesByService: &sync.Map{},
 		traceFlushTicker:   clock.FromContext(ctx).NewTicker(time.Duration(pConfig.TraceFlushFrequencySeconds) * time.Second),
+		traceFlushReset:    make(chan struct{}, 1),
+		clock:              clock.FromContext(ctx),
 		nextConsumer:       nextConsumer,
 		stop:               make(chan bool),
 		metrics:            metricsHelper.metrics,
+		rateLimiters:       newTraceRateLimiters(pConfig, clock.FromContext(ctx).Now()),
+		priority:           newTracePriority(pConfig),
 		rwMutex:            &sync.RWMutex{},
 	}
 
+	// The queued traces are only sized when their memory is limited
+	if pConfig.TraceQueueMemoryLimitMiB > 0 {
+		traceSampler.memoryBudget = newTraceMemoryBudget(logger, pConfig, metricsHelper.metrics)
+	}
+	if pConfig.DecidedTracesCacheSize > 0 {
+		traceSampler.decidedTraces = newDecidedTraces(pConfig)
+	}
+	if pConfig.PeerSampling != nil {
+		traceSampler.peers = newPeerSampling(logger, pConfig.PeerSampling, traceSampler.sampleLocalTraces)
+	}
+
 	p := &assertsProcessorImpl{
 		logger:        logger,
 		config:        pConfig,
@@ -133,6 +228,12 @@ func newProcessor(logger *zap.Logger, buildInfo component.BuildInfo, ctx context
 	configRefresh.configListeners = listeners
 	p.configRefresh = &configRefresh
 
+	if configRefresh.getActiveSource() == activeConfigAsserts {
+		configRefresh.saveConfigCache(configRefresh.fetchedBody)
+	}
+	metricsHelper.exp.handle("/config/refresh", configRefresh.refreshHandler())
+	registerDiagnostics(metricsHelper.exp, &configRefresh, _spanEnrichmentProcessor, &thresholdsHelper, metricsHelper,
+		&traceSampler)
 	metricsHelper.startExporter()
 	return p, nil
 }
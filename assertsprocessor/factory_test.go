@@ -6,6 +6,8 @@ import (
 	"go.opentelemetry.io/collector/processor"
 	"go.uber.org/zap"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -38,6 +40,9 @@ func TestDefaultConfig(t *testing.T) {
 	assert.Equal(t, "", pConfig.Site)
 	assert.Equal(t, 100, pConfig.LimitPerService)
 	assert.Equal(t, float64(3), pConfig.DefaultLatencyThreshold)
+	// The opt-in features
+	assert.Equal(t, 0, pConfig.DecidedTracesCacheSize)
+	assert.Nil(t, pConfig.LatencyBaseline)
 }
 
 func TestCreateProcessorDefaultConfig(t *testing.T) {
@@ -83,6 +88,9 @@ func TestCreateProcessorDefaultConfig(t *testing.T) {
 	assert.NotNil(t, _assertsProcessor.sampler.traceFlushTicker)
 	assert.NotNil(t, _assertsProcessor.sampler.metrics)
 	assert.Equal(t, _assertsProcessor.metricBuilder.metrics, _assertsProcessor.sampler.metrics)
+	// The queued traces are not sized without a memory limit
+	assert.Nil(t, _assertsProcessor.sampler.memoryBudget)
+	assert.Nil(t, _assertsProcessor.sampler.decidedTraces)
 
 	// Threshold Helper
 	assert.Equal(t, config, *_assertsProcessor.sampler.thresholdHelper.config)
@@ -91,7 +99,7 @@ func TestCreateProcessorDefaultConfig(t *testing.T) {
 	assert.NotNil(t, _assertsProcessor.sampler.thresholdHelper.thresholds)
 	assert.NotNil(t, _assertsProcessor.sampler.thresholdHelper.stop)
 	assert.NotNil(t, _assertsProcessor.sampler.thresholdHelper.thresholdSyncTicker)
-	assert.NotNil(t, _assertsProcessor.sampler.thresholdHelper.rc)
+	assert.NotNil(t, _assertsProcessor.sampler.thresholdHelper.provider)
 	assert.NotNil(t, _assertsProcessor.sampler.thresholdHelper.rwMutex)
 
 	// Config Refresh
@@ -135,7 +143,7 @@ func TestCreateProcessorMergeFetchedConfig(t *testing.T) {
               "source_attributes": [
                 "attr1"
               ],
-              "regex": "+",
+              "regex": "(.+)",
               "replacement": "$1"
             }
           ]
@@ -164,7 +172,7 @@ func TestCreateProcessorMergeFetchedConfig(t *testing.T) {
                 "source_attributes": [
                   "attr1"
                 ],
-                "regex": "+",
+                "regex": "(.+)",
                 "replacement": "$1"
               }
             ]
@@ -182,10 +190,13 @@ func TestCreateProcessorMergeFetchedConfig(t *testing.T) {
     }`),
 		expectedErr: nil,
 	}
-	restClientFactory = func(logger *zap.Logger, pConfig *Config) restClient {
-		return mockClient
+	restClientFactory = func(logger *zap.Logger, pConfig *Config) (restClient, error) {
+		return mockClient, nil
 	}
 
+	pConfig := config
+	pConfig.LimitPerRequestPerService = 2
+	pConfig.RequestContextCacheTTL = 60
 	assert.False(t, config.CaptureMetrics)
 	assert.Nil(t, config.CustomAttributeConfigs)
 	assert.Nil(t, config.CaptureAttributesInMetric)
@@ -193,41 +204,133 @@ func TestCreateProcessorMergeFetchedConfig(t *testing.T) {
 	assert.Nil(t, config.LatencyHistogramBuckets)
 	assert.False(t, config.IgnoreClientErrors)
 
-	var _processorRef, err = factory.CreateTracesProcessor(ctx, createSettings, &config, nextConsumer)
-
-	assert.NotNil(t, err)
-	assert.Nil(t, _processorRef)
-
+	var _processorRef, err = factory.CreateTracesProcessor(ctx, createSettings, &pConfig, nextConsumer)
+	assert.Nil(t, err)
 	var _assertsProcessor = _processorRef.(*assertsProcessorImpl)
-	// Compilation of a bad regex will cause processor creation to fail in this test
-	assert.Nil(t, _assertsProcessor)
+	defer func() { _ = _assertsProcessor.metricBuilder.stopExporter() }()
+	assert.Equal(t, activeConfigAsserts, _assertsProcessor.configRefresh.getActiveSource())
 
 	assert.Equal(t, http.MethodGet, mockClient.expectedMethod)
 	assert.Equal(t, configApi, mockClient.expectedApi)
 	assert.Nil(t, mockClient.expectedPayload)
 
-	assert.True(t, config.CaptureMetrics)
-	assert.NotNil(t, config)
-	assert.True(t, config.CaptureMetrics)
-	assert.NotNil(t, config.CustomAttributeConfigs)
-	assert.Equal(t, 1, len(config.CustomAttributeConfigs))
-	assert.Equal(t, 2, len(config.CustomAttributeConfigs["asserts.request.context"]))
-	assert.Equal(t, 1, len(config.CustomAttributeConfigs["asserts.request.context"]["default"]))
-	assert.Equal(t, 1, len(config.CustomAttributeConfigs["asserts.request.context"]["asserts#api-server"]))
-	assert.Equal(t, 1, len(config.SpanAttributes))
-	assert.Equal(t, "asserts.request.context", config.SpanAttributes[0].AttributeName)
-	assert.Equal(t, 2, len(config.SpanAttributes[0].AttributeConfigs))
-	assert.Equal(t, "asserts", config.SpanAttributes[0].AttributeConfigs[0].Namespace)
-	assert.Equal(t, "api-server", config.SpanAttributes[0].AttributeConfigs[0].Service)
-	assert.Equal(t, 1, len(config.SpanAttributes[0].AttributeConfigs[0].Rules))
-	assert.Equal(t, "", config.SpanAttributes[0].AttributeConfigs[1].Namespace)
-	assert.Equal(t, "", config.SpanAttributes[0].AttributeConfigs[1].Service)
-	assert.Equal(t, 1, len(config.SpanAttributes[0].AttributeConfigs[1].Rules))
-	assert.NotNil(t, config.CaptureAttributesInMetric)
-	assert.Equal(t, 2, len(config.CaptureAttributesInMetric))
-	assert.Equal(t, "rpc.system", config.CaptureAttributesInMetric[0])
-	assert.Equal(t, "rpc.service", config.CaptureAttributesInMetric[1])
-	assert.Equal(t, 0.51, config.DefaultLatencyThreshold)
-	assert.Equal(t, []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 90, 120}, config.LatencyHistogramBuckets)
-	assert.True(t, config.IgnoreClientErrors)
+	assert.True(t, pConfig.CaptureMetrics)
+	assert.NotNil(t, pConfig)
+	assert.True(t, pConfig.CaptureMetrics)
+	assert.NotNil(t, pConfig.CustomAttributeConfigs)
+	assert.Equal(t, 1, len(pConfig.CustomAttributeConfigs))
+	assert.Equal(t, 2, len(pConfig.CustomAttributeConfigs["asserts.request.context"]))
+	assert.Equal(t, 1, len(pConfig.CustomAttributeConfigs["asserts.request.context"]["default"]))
+	assert.Equal(t, 1, len(pConfig.CustomAttributeConfigs["asserts.request.context"]["asserts#api-server"]))
+	assert.Equal(t, 1, len(pConfig.SpanAttributes))
+	assert.Equal(t, "asserts.request.context", pConfig.SpanAttributes[0].AttributeName)
+	assert.Equal(t, 2, len(pConfig.SpanAttributes[0].AttributeConfigs))
+	assert.Equal(t, "asserts", pConfig.SpanAttributes[0].AttributeConfigs[0].Namespace)
+	assert.Equal(t, "api-server", pConfig.SpanAttributes[0].AttributeConfigs[0].Service)
+	assert.Equal(t, 1, len(pConfig.SpanAttributes[0].AttributeConfigs[0].Rules))
+	assert.Equal(t, "", pConfig.SpanAttributes[0].AttributeConfigs[1].Namespace)
+	assert.Equal(t, "", pConfig.SpanAttributes[0].AttributeConfigs[1].Service)
+	assert.Equal(t, 1, len(pConfig.SpanAttributes[0].AttributeConfigs[1].Rules))
+	assert.NotNil(t, pConfig.CaptureAttributesInMetric)
+	assert.Equal(t, 2, len(pConfig.CaptureAttributesInMetric))
+	assert.Equal(t, "rpc.system", pConfig.CaptureAttributesInMetric[0])
+	assert.Equal(t, "rpc.service", pConfig.CaptureAttributesInMetric[1])
+	assert.Equal(t, 0.51, pConfig.DefaultLatencyThreshold)
+	assert.Equal(t, []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 90, 120}, pConfig.LatencyHistogramBuckets)
+	assert.True(t, pConfig.IgnoreClientErrors)
+}
+
+func TestCreateProcessorConfigFile(t *testing.T) {
+	factory := NewFactory()
+	ctx := context.Background()
+	var createSettings = processor.CreateSettings{
+		ID: component.NewIDWithName(component.DataTypeTraces, ""),
+	}
+	createSettings.Logger = logger
+	var nextConsumer consumer.Traces = dummyConsumer{}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	pConfig := Config{
+		Env:                        "dev",
+		Site:                       "us-west-2",
+		AssertsServer:              &AssertsServerConfig{Endpoint: "http://localhost:8030"},
+		DefaultLatencyThreshold:    0.5,
+		LimitPerService:            5,
+		LimitPerRequestPerService:  2,
+		RequestContextCacheTTL:     60,
+		PrometheusExporterPort:     9466,
+		TraceFlushFrequencySeconds: 30,
+		ConfigSource:               &ConfigSourceConfig{Type: ConfigSourceFile, Path: path},
+	}
+	_, err := factory.CreateTracesProcessor(ctx, createSettings, &pConfig, nextConsumer)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, os.WriteFile(path, []byte(`sampling_latency_threshold_seconds: 0.75`), 0600))
+	_processorRef, err := factory.CreateTracesProcessor(ctx, createSettings, &pConfig, nextConsumer)
+	assert.Nil(t, err)
+
+	var _assertsProcessor = _processorRef.(*assertsProcessorImpl)
+	assert.Equal(t, 0.75, pConfig.DefaultLatencyThreshold)
+	assert.Equal(t, "dev", pConfig.Env)
+	assert.NotNil(t, _assertsProcessor.configRefresh.fileSource)
+	_ = _assertsProcessor.metricBuilder.stopExporter()
+}
+
+func TestCreateProcessorOpAMPSource(t *testing.T) {
+	factory := NewFactory()
+	ctx := context.Background()
+	var createSettings = processor.CreateSettings{
+		ID: component.NewIDWithName(component.DataTypeTraces, ""),
+	}
+	createSettings.Logger = logger
+	var nextConsumer consumer.Traces = dummyConsumer{}
+
+	mockClient := &mockRestClient{}
+	restClientFactory = func(logger *zap.Logger, pConfig *Config) (restClient, error) {
+		return mockClient, nil
+	}
+	pConfig := buildValidConfig()
+	pConfig.PrometheusExporterPort = 9466
+	pConfig.ConfigSource = &ConfigSourceConfig{
+		Type:  ConfigSourceOpAMP,
+		OpAMP: &OpAMPConfig{Endpoint: "ws://localhost:4320/v1/opamp"},
+	}
+	_processorRef, err := factory.CreateTracesProcessor(ctx, createSettings, pConfig, nextConsumer)
+	assert.Nil(t, err)
+
+	var _assertsProcessor = _processorRef.(*assertsProcessorImpl)
+	// The config is not fetched from the Asserts API
+	assert.Equal(t, "", mockClient.expectedApi)
+	assert.NotNil(t, _assertsProcessor.configRefresh.opamp)
+	assert.Equal(t, activeConfigLocal, _assertsProcessor.configRefresh.getActiveSource())
+	_ = _assertsProcessor.metricBuilder.stopExporter()
+}
+
+func TestCreateProcessorStreamedConfig(t *testing.T) {
+	factory := NewFactory()
+	ctx := context.Background()
+	var createSettings = processor.CreateSettings{
+		ID: component.NewIDWithName(component.DataTypeTraces, ""),
+	}
+	createSettings.Logger = logger
+	var nextConsumer consumer.Traces = dummyConsumer{}
+
+	mockClient := &mockRestClient{expectedData: []byte(`{"sampling_latency_threshold_seconds": 0.75}`)}
+	restClientFactory = func(logger *zap.Logger, pConfig *Config) (restClient, error) {
+		return mockClient, nil
+	}
+	pConfig := buildValidConfig()
+	pConfig.PrometheusExporterPort = 9467
+	pConfig.AssertsServer = &AssertsServerConfig{Endpoint: "http://localhost:8030"}
+	pConfig.ConfigSource = &ConfigSourceConfig{Delivery: ConfigDeliverySSE}
+	_processorRef, err := factory.CreateTracesProcessor(ctx, createSettings, pConfig, nextConsumer)
+	assert.Nil(t, err)
+
+	var _assertsProcessor = _processorRef.(*assertsProcessorImpl)
+	// The initial config is fetched as with polling
+	assert.Equal(t, configApi, mockClient.expectedApi)
+	assert.Equal(t, 0.75, _assertsProcessor.configRefresh.config.DefaultLatencyThreshold)
+	assert.NotNil(t, _assertsProcessor.configRefresh.stream)
+	assert.Equal(t, ConfigDeliverySSE, _assertsProcessor.configRefresh.stream.delivery)
+	_ = _assertsProcessor.metricBuilder.stopExporter()
 }
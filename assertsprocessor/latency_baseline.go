@@ -0,0 +1,260 @@
+package assertsprocessor
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/puzpuzpuz/xsync/v2"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+const (
+	// The quantiles estimated by the sketch are within 1% of the true latency
+	sketchRelativeAccuracy = 0.01
+	// Latencies below a microsecond are counted as zero
+	minIndexableLatency = 1e-6
+	// The buckets whose decayed count drops below this are discarded
+	minBucketCount = 1e-3
+	// The limit on the series of a baseline whose max_series is not set
+	defaultBaselineMaxSeries = 10000
+)
+
+type LatencyBaselineConfig struct {
+	// The quantile of the learned latency distribution used as the slow threshold, e.g. 0.99
+	Quantile float64 `mapstructure:"quantile" json:"quantile"`
+	// The weight of an observation halves every half-life, so that the baseline follows the recent latencies
+	HalfLifeMinutes float64 `mapstructure:"half_life_minutes" json:"half_life_minutes"`
+	// The baseline is not used until it is learned from at least these many (decayed) observations
+	MinSamples int `mapstructure:"min_samples" json:"min_samples"`
+	// Limits the number of entity and request context combinations for which baselines are learned.
+	// 10000 when not set
+	MaxSeries int `mapstructure:"max_series" json:"max_series"`
+}
+
+func (lc *LatencyBaselineConfig) maxSeries() int {
+	if lc.MaxSeries == 0 {
+		return defaultBaselineMaxSeries
+	}
+	return lc.MaxSeries
+}
+
+func (lc *LatencyBaselineConfig) validateAt(v *configValidator, path string) {
+	if lc.Quantile <= 0 || lc.Quantile >= 1 {
+		v.addf(joinPath(path, "quantile"), "%v must be between 0 and 1", lc.Quantile)
+	}
+	if lc.HalfLifeMinutes <= 0 {
+		v.addf(joinPath(path, "half_life_minutes"), "%v must be positive", lc.HalfLifeMinutes)
+	}
+	if lc.MinSamples < 0 {
+		v.addf(joinPath(path, "min_samples"), "%d must not be negative", lc.MinSamples)
+	}
+	if lc.MaxSeries < 0 {
+		v.addf(joinPath(path, "max_series"), "%d must not be negative", lc.MaxSeries)
+	}
+}
+
+// latencySketch is a streaming quantile sketch with logarithmically sized buckets, as in DDSketch, whose
+// counts decay exponentially with time
+type latencySketch struct {
+	logGamma  float64
+	gamma     float64
+	halfLife  time.Duration
+	buckets   map[int]float64
+	indexes   []int // the indexes of the buckets in ascending order
+	zeroCount float64
+	count     float64
+	lastDecay time.Time
+}
+
+func newLatencySketch(halfLife time.Duration, now time.Time) *latencySketch {
+	gamma := (1 + sketchRelativeAccuracy) / (1 - sketchRelativeAccuracy)
+	return &latencySketch{
+		gamma:     gamma,
+		logGamma:  math.Log(gamma),
+		halfLife:  halfLife,
+		buckets:   map[int]float64{},
+		lastDecay: now,
+	}
+}
+
+func (ls *latencySketch) add(latency float64, now time.Time) {
+	ls.decay(now)
+	if latency <= minIndexableLatency {
+		ls.zeroCount++
+	} else {
+		index := int(math.Ceil(math.Log(latency) / ls.logGamma))
+		if _, found := ls.buckets[index]; !found {
+			position := sort.SearchInts(ls.indexes, index)
+			ls.indexes = append(ls.indexes, 0)
+			copy(ls.indexes[position+1:], ls.indexes[position:])
+			ls.indexes[position] = index
+		}
+		ls.buckets[index]++
+	}
+	ls.count++
+}
+
+// Decays the counts by the time elapsed since the last decay. The counts are decayed at most once a
+// second so that adding a latency is cheap
+func (ls *latencySketch) decay(now time.Time) {
+	elapsed := now.Sub(ls.lastDecay)
+	if elapsed < time.Second {
+		return
+	}
+	factor := math.Pow(0.5, float64(elapsed)/float64(ls.halfLife))
+	ls.count = 0
+	remaining := ls.indexes[:0]
+	for _, index := range ls.indexes {
+		if count := ls.buckets[index] * factor; count < minBucketCount {
+			delete(ls.buckets, index)
+		} else {
+			ls.buckets[index] = count
+			ls.count += count
+			remaining = append(remaining, index)
+		}
+	}
+	ls.indexes = remaining
+	ls.zeroCount *= factor
+	ls.count += ls.zeroCount
+	ls.lastDecay = now
+}
+
+func (ls *latencySketch) quantile(q float64) float64 {
+	if ls.count <= 0 {
+		return 0
+	}
+	rank := q * ls.count
+	cumulative := ls.zeroCount
+	if cumulative >= rank {
+		return 0
+	}
+	if len(ls.indexes) == 0 {
+		return 0
+	}
+	for _, index := range ls.indexes {
+		cumulative += ls.buckets[index]
+		if cumulative >= rank {
+			return ls.bucketValue(index)
+		}
+	}
+	return ls.bucketValue(ls.indexes[len(ls.indexes)-1])
+}
+
+// The value in the middle of the bucket, relative to the bucket bounds
+func (ls *latencySketch) bucketValue(index int) float64 {
+	return 2 * math.Pow(ls.gamma, float64(index)) / (ls.gamma + 1)
+}
+
+type latencyBaseline struct {
+	entityKey   string
+	namespace   string
+	service     string
+	requestType string
+	request     string
+	sketch      *latencySketch
+	mutex       sync.Mutex
+}
+
+// latencyBaselines learns the latency distribution of each entity and request context from the spans
+// seen by the processor. The learned quantile is the slow threshold of the requests that do not have a
+// threshold from Asserts
+type latencyBaselines struct {
+	config    *Config
+	baselines *xsync.MapOf[string, *latencyBaseline]
+	now       func() time.Time
+	desc      *prometheus.Desc
+}
+
+func newLatencyBaselines(config *Config) *latencyBaselines {
+	return &latencyBaselines{
+		config:    config,
+		baselines: xsync.NewMapOf[*latencyBaseline](),
+		now:       time.Now,
+		desc: prometheus.NewDesc("asserts_latency_baseline_seconds",
+			"Latency quantile learned from the spans of a request",
+			[]string{envLabel, siteLabel, namespaceLabel, serviceLabel,
+				applyPromConventions(AssertsRequestTypeAttribute), applyPromConventions(AssertsRequestContextAttribute),
+				"quantile"},
+			nil,
+		),
+	}
+}
+
+func (lb *latencyBaselines) observe(namespace string, service string, span *ptrace.Span) {
+	requestType, request := getRequest(span)
+	entityKey := buildEntityKey(lb.config, namespace, service)
+	key := entityKey.AsString() + "#" + thresholdKey(requestType, request)
+	baseline, found := lb.baselines.Load(key)
+	if !found {
+		if lb.baselines.Size() >= lb.config.LatencyBaseline.maxSeries() {
+			return
+		}
+		halfLife := time.Duration(lb.config.LatencyBaseline.HalfLifeMinutes * float64(time.Minute))
+		baseline, _ = lb.baselines.LoadOrStore(key, &latencyBaseline{
+			entityKey:   entityKey.AsString(),
+			namespace:   namespace,
+			service:     service,
+			requestType: requestType,
+			request:     request,
+			sketch:      newLatencySketch(halfLife, lb.now()),
+		})
+	}
+	baseline.mutex.Lock()
+	baseline.sketch.add(computeLatency(span), lb.now())
+	baseline.mutex.Unlock()
+}
+
+// Returns the learned threshold of the request. Returns false if there are too few observations
+func (lb *latencyBaselines) getThreshold(entityKey EntityKeyDto, requestType string, request string) (float64, bool) {
+	baseline, found := lb.baselines.Load(entityKey.AsString() + "#" + thresholdKey(requestType, request))
+	if !found {
+		return 0, false
+	}
+	baseline.mutex.Lock()
+	defer baseline.mutex.Unlock()
+	baseline.sketch.decay(lb.now())
+	if baseline.sketch.count < float64(lb.config.LatencyBaseline.MinSamples) || baseline.sketch.count == 0 {
+		return 0, false
+	}
+	return baseline.sketch.quantile(lb.config.LatencyBaseline.Quantile), true
+}
+
+// Forgets the baselines of the requests of the entity
+func (lb *latencyBaselines) forget(entityKey string) {
+	lb.baselines.Range(func(key string, baseline *latencyBaseline) bool {
+		if baseline.entityKey == entityKey {
+			lb.baselines.Delete(key)
+		}
+		return true
+	})
+}
+
+// Describe implements the prometheus.Collector interface
+func (lb *latencyBaselines) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lb.desc
+}
+
+// Collect implements the prometheus.Collector interface. The baselines that have decayed away are removed
+func (lb *latencyBaselines) Collect(ch chan<- prometheus.Metric) {
+	quantile := lb.config.LatencyBaseline.Quantile
+	lb.baselines.Range(func(key string, baseline *latencyBaseline) bool {
+		baseline.mutex.Lock()
+		baseline.sketch.decay(lb.now())
+		count := baseline.sketch.count
+		value := baseline.sketch.quantile(quantile)
+		baseline.mutex.Unlock()
+
+		if count < minBucketCount {
+			lb.baselines.Delete(key)
+		} else if count >= float64(lb.config.LatencyBaseline.MinSamples) {
+			ch <- prometheus.MustNewConstMetric(lb.desc, prometheus.GaugeValue, value,
+				lb.config.Env, lb.config.Site, baseline.namespace, baseline.service, baseline.requestType, baseline.request,
+				strconv.FormatFloat(quantile, 'f', -1, 64))
+		}
+		return true
+	})
+}
@@ -0,0 +1,192 @@
+package assertsprocessor
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/puzpuzpuz/xsync/v2"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+func buildLatencySpan(request string, latency float64) *ptrace.Span {
+	span := ptrace.NewSpan()
+	span.Attributes().PutStr(AssertsRequestTypeAttribute, AssertsRequestTypeInbound)
+	span.Attributes().PutStr(AssertsRequestContextAttribute, request)
+	span.SetStartTimestamp(1e9)
+	span.SetEndTimestamp(pcommon.Timestamp(1e9 + 1e9*latency))
+	return &span
+}
+
+func buildBaselineConfig() *Config {
+	return &Config{
+		Env:                     "dev",
+		Site:                    "us-west-2",
+		DefaultLatencyThreshold: 0.5,
+		LatencyBaseline: &LatencyBaselineConfig{
+			Quantile:        0.99,
+			HalfLifeMinutes: 60,
+			MinSamples:      100,
+			MaxSeries:       2,
+		},
+	}
+}
+
+func TestLatencySketchQuantile(t *testing.T) {
+	now := time.Unix(1000, 0)
+	sketch := newLatencySketch(time.Hour, now)
+	for i := 1; i <= 1000; i++ {
+		sketch.add(float64(i)/1000, now)
+	}
+	assert.InEpsilon(t, 0.5, sketch.quantile(0.5), sketchRelativeAccuracy)
+	assert.InEpsilon(t, 0.99, sketch.quantile(0.99), sketchRelativeAccuracy)
+	assert.InEpsilon(t, 1.0, sketch.quantile(1), sketchRelativeAccuracy)
+	assert.Equal(t, 0.0, newLatencySketch(time.Hour, now).quantile(0.99))
+}
+
+func TestLatencySketchDecay(t *testing.T) {
+	now := time.Unix(1000, 0)
+	sketch := newLatencySketch(time.Minute, now)
+	for i := 0; i < 100; i++ {
+		sketch.add(1, now)
+	}
+	// After a half-life, the new latencies weigh twice as much as the old ones
+	now = now.Add(time.Minute)
+	for i := 0; i < 100; i++ {
+		sketch.add(2, now)
+	}
+	assert.InDelta(t, 150, sketch.count, 1e-9)
+	assert.InEpsilon(t, 2, sketch.quantile(0.5), sketchRelativeAccuracy)
+
+	sketch.decay(now.Add(time.Hour))
+	assert.Equal(t, 0, len(sketch.buckets))
+}
+
+func TestLatencySketchKeepsBucketsSorted(t *testing.T) {
+	now := time.Unix(1000, 0)
+	sketch := newLatencySketch(time.Hour, now)
+	for _, latency := range []float64{2, 0.1, 1, 0.1, 0.5} {
+		sketch.add(latency, now)
+	}
+	assert.Equal(t, 4, len(sketch.indexes))
+	assert.True(t, sort.IntsAreSorted(sketch.indexes))
+	assert.InEpsilon(t, 0.1, sketch.quantile(0.2), sketchRelativeAccuracy)
+	assert.InEpsilon(t, 2, sketch.quantile(1), sketchRelativeAccuracy)
+}
+
+func TestLatencyBaselinesForget(t *testing.T) {
+	cfg := buildBaselineConfig()
+	baselines := newLatencyBaselines(cfg)
+	baselines.observe("platform", "api-server", buildLatencySpan("/v1/rules", 0.2))
+	baselines.observe("platform", "model-builder", buildLatencySpan("/v1/run", 0.2))
+
+	entityKey := buildEntityKey(cfg, "platform", "api-server")
+	baselines.forget(entityKey.AsString())
+	assert.Equal(t, 1, baselines.baselines.Size())
+	baselines.baselines.Range(func(key string, baseline *latencyBaseline) bool {
+		assert.Equal(t, "model-builder", baseline.service)
+		return true
+	})
+}
+
+func TestLatencyBaselinesGetThreshold(t *testing.T) {
+	cfg := buildBaselineConfig()
+	baselines := newLatencyBaselines(cfg)
+	entityKey := buildEntityKey(cfg, "platform", "api-server")
+
+	for i := 0; i < 99; i++ {
+		baselines.observe("platform", "api-server", buildLatencySpan("/v1/rules", 0.2))
+	}
+	_, found := baselines.getThreshold(entityKey, AssertsRequestTypeInbound, "/v1/rules")
+	assert.False(t, found)
+
+	baselines.observe("platform", "api-server", buildLatencySpan("/v1/rules", 0.2))
+	threshold, found := baselines.getThreshold(entityKey, AssertsRequestTypeInbound, "/v1/rules")
+	assert.True(t, found)
+	assert.InEpsilon(t, 0.2, threshold, sketchRelativeAccuracy)
+
+	// No more series than the limit
+	baselines.observe("platform", "api-server", buildLatencySpan("/v1/alerts", 0.2))
+	baselines.observe("platform", "api-server", buildLatencySpan("/v1/users", 0.2))
+	assert.Equal(t, 2, baselines.baselines.Size())
+}
+
+func TestLatencyBaselinesWithoutMaxSeries(t *testing.T) {
+	cfg := buildBaselineConfig()
+	cfg.LatencyBaseline.MaxSeries = 0
+	assert.Nil(t, validateSection(cfg.LatencyBaseline))
+	baselines := newLatencyBaselines(cfg)
+
+	baselines.observe("platform", "api-server", buildLatencySpan("/v1/rules", 0.2))
+	baselines.observe("platform", "api-server", buildLatencySpan("/v1/alerts", 0.2))
+	baselines.observe("platform", "api-server", buildLatencySpan("/v1/users", 0.2))
+	assert.Equal(t, 3, baselines.baselines.Size())
+	assert.Equal(t, defaultBaselineMaxSeries, cfg.LatencyBaseline.maxSeries())
+}
+
+func TestThresholdFallsBackToBaseline(t *testing.T) {
+	cfg := buildBaselineConfig()
+	cfg.LatencyBaseline.MinSamples = 1
+	helper := thresholdHelper{
+		logger:     logger,
+		config:     cfg,
+		entityKeys: xsync.NewMapOf[EntityKeyDto](),
+		thresholds: xsync.NewMapOf[map[string]*ThresholdDto](),
+		rwMutex:    &sync.RWMutex{},
+		baselines:  newLatencyBaselines(cfg),
+	}
+	helper.observeSpan("platform", "api-server", buildLatencySpan("/v1/rules", 2))
+	helper.observeSpan("platform", "api-server", buildLatencySpan("/v1/alerts", 2))
+
+	assert.InEpsilon(t, 2, helper.getThreshold("platform", "api-server", AssertsRequestTypeInbound, "/v1/rules"), sketchRelativeAccuracy)
+	assert.Equal(t, 0.5, helper.getThreshold("platform", "api-server", AssertsRequestTypeInbound, "/v1/users"))
+
+	// The thresholds from Asserts take precedence
+	entityKey := buildEntityKey(cfg, "platform", "api-server")
+	helper.thresholds.Store(entityKey.AsString(), map[string]*ThresholdDto{
+		"inbound#/v1/rules": {RequestType: "inbound", RequestContext: "/v1/rules", LatencyUpperBound: 1},
+	})
+	assert.Equal(t, 1.0, helper.getThreshold("platform", "api-server", AssertsRequestTypeInbound, "/v1/rules"))
+	assert.InEpsilon(t, 2, helper.getThreshold("platform", "api-server", AssertsRequestTypeInbound, "/v1/alerts"), sketchRelativeAccuracy)
+}
+
+func TestLatencyBaselinesCollect(t *testing.T) {
+	cfg := buildBaselineConfig()
+	cfg.LatencyBaseline.MinSamples = 1
+	baselines := newLatencyBaselines(cfg)
+	now := time.Unix(1000, 0)
+	baselines.now = func() time.Time { return now }
+	baselines.observe("platform", "api-server", buildLatencySpan("/v1/rules", 1))
+
+	registry := prometheus.NewRegistry()
+	assert.Nil(t, registry.Register(baselines))
+	assert.Equal(t, 1, testutil.CollectAndCount(baselines, "asserts_latency_baseline_seconds"))
+
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+	metric := families[0].GetMetric()[0]
+	assert.InEpsilon(t, 1, metric.GetGauge().GetValue(), sketchRelativeAccuracy)
+	labels := map[string]string{}
+	for _, label := range metric.GetLabel() {
+		labels[label.GetName()] = label.GetValue()
+	}
+	assert.Equal(t, map[string]string{
+		envLabel:                  "dev",
+		siteLabel:                 "us-west-2",
+		namespaceLabel:            "platform",
+		serviceLabel:              "api-server",
+		"asserts_request_type":    "inbound",
+		"asserts_request_context": "/v1/rules",
+		"quantile":                "0.99",
+	}, labels)
+
+	// The baseline is removed once it has decayed away
+	now = now.Add(24 * time.Hour)
+	assert.Equal(t, 0, testutil.CollectAndCount(baselines))
+	assert.Equal(t, 0, baselines.baselines.Size())
+}
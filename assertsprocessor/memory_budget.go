@@ -0,0 +1,114 @@
+package assertsprocessor
+
+import (
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/zap"
+	"sync"
+)
+
+// traceMemoryBudget caps the memory held by the samples queued across all the services. When the
+// budget is exceeded, the lowest priority samples are evicted irrespective of the service they belong to
+type traceMemoryBudget struct {
+	logger    *zap.Logger
+	limit     int64 // in bytes. No limit when zero
+	usedBytes int64
+	queues    map[*TraceQueue]struct{}
+	sizer     ptrace.ProtoMarshaler
+	metrics   *metrics
+	mutex     *sync.Mutex
+}
+
+func newTraceMemoryBudget(logger *zap.Logger, config *Config, metrics *metrics) *traceMemoryBudget {
+	return &traceMemoryBudget{
+		logger:  logger,
+		limit:   int64(config.TraceQueueMemoryLimitMiB) * 1024 * 1024,
+		queues:  map[*TraceQueue]struct{}{},
+		metrics: metrics,
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// Pushes the item into the queue if the item fits in the budget, evicting lower priority items from any of
+// the queues if needed. The item's spans must already be detached from the batch they arrived in. Returns
+// the items that were evicted, or the item itself if it did not make it into the queue
+func (mb *traceMemoryBudget) push(queue *TraceQueue, item *Item, detached *ptrace.Traces) []*Item {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	item.size = int64(mb.sizer.TracesSize(*detached))
+	item.score = queue.scorer(item)
+	evicted := make([]*Item, 0)
+	for mb.limit > 0 && mb.usedBytes+item.size > mb.limit {
+		lowestQueue, lowest := mb.lowestPriorityItem()
+		if lowest == nil || lowest.score >= item.score {
+			mb.logger.Debug("Dropping trace as the trace queue memory limit is reached",
+				zap.Int64("Limit", mb.limit),
+				zap.Int64("Size", item.size),
+			)
+			return append(evicted, item)
+		}
+		if lowestQueue.remove(lowest) {
+			mb.usedBytes -= lowest.size
+			evicted = append(evicted, lowest)
+		}
+	}
+
+	dropped := queue.push(item)
+	if dropped != item {
+		mb.usedBytes += item.size
+		mb.queues[queue] = struct{}{}
+	}
+	if dropped != nil && dropped != item {
+		mb.usedBytes -= dropped.size
+	}
+	if dropped != nil {
+		evicted = append(evicted, dropped)
+	}
+	mb.recordUsage()
+	return evicted
+}
+
+func (mb *traceMemoryBudget) lowestPriorityItem() (*TraceQueue, *Item) {
+	var lowestQueue *TraceQueue
+	var lowest *Item
+	for queue := range mb.queues {
+		item := queue.peek()
+		if item == nil {
+			delete(mb.queues, queue)
+			continue
+		}
+		if lowest == nil || item.score < lowest.score {
+			lowestQueue, lowest = queue, item
+		}
+	}
+	return lowestQueue, lowest
+}
+
+// Releases the memory held by the items of a queue that has been flushed
+func (mb *traceMemoryBudget) release(queue *TraceQueue) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	if _, found := mb.queues[queue]; !found {
+		return
+	}
+	queue.mutex.Lock()
+	for _, item := range queue.priorityQueue {
+		mb.usedBytes -= item.size
+	}
+	queue.mutex.Unlock()
+	delete(mb.queues, queue)
+	mb.recordUsage()
+}
+
+func (mb *traceMemoryBudget) getUsedBytes() int64 {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	return mb.usedBytes
+}
+
+func (mb *traceMemoryBudget) recordUsage() {
+	if mb.metrics != nil {
+		mb.metrics.setQueuedTraceBytes(mb.usedBytes)
+	}
+}
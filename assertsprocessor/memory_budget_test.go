@@ -0,0 +1,83 @@
+package assertsprocessor
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	conventions "go.opentelemetry.io/collector/semconv/v1.6.1"
+	"testing"
+)
+
+func buildQueuedItem(service string, latency float64) (*Item, *ptrace.Traces) {
+	batch := ptrace.NewTraces()
+	resourceSpans := batch.ResourceSpans().AppendEmpty()
+	resourceSpans.Resource().Attributes().PutStr(conventions.AttributeServiceName, service)
+	rootSpan := resourceSpans.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+	rootSpan.SetName("GET /" + service)
+	rootSpan.SetTraceID([16]byte{1, 2, 3, 4, 5, 6, 7, 8, 1, 2, 3, 4, 5, 6, 7, 8})
+
+	ctx := context.Background()
+	item := &Item{
+		trace: newTrace(&traceSegment{
+			resourceSpans: &resourceSpans,
+			service:       service,
+			rootSpan:      &rootSpan,
+		}),
+		ctx:     &ctx,
+		latency: latency,
+	}
+	return item, item.trace.detach()
+}
+
+func TestMemoryBudgetTracksUsage(t *testing.T) {
+	budget := newTraceMemoryBudget(logger, &Config{TraceQueueMemoryLimitMiB: 1}, buildMetrics())
+	queue := NewTraceQueue(2)
+
+	item1, detached1 := buildQueuedItem("api-server", 1)
+	budget.push(queue, item1, detached1)
+	assert.Equal(t, 1, len(queue.priorityQueue))
+	assert.True(t, item1.size > 0)
+	assert.Equal(t, item1.size, budget.getUsedBytes())
+
+	item2, detached2 := buildQueuedItem("api-server", 2)
+	budget.push(queue, item2, detached2)
+	assert.Equal(t, item1.size+item2.size, budget.getUsedBytes())
+
+	// Queue limit evicts the lowest latency item
+	item3, detached3 := buildQueuedItem("api-server", 3)
+	budget.push(queue, item3, detached3)
+	assert.Equal(t, 2, len(queue.priorityQueue))
+	assert.Equal(t, item2.size+item3.size, budget.getUsedBytes())
+
+	budget.release(queue)
+	assert.Equal(t, int64(0), budget.getUsedBytes())
+}
+
+func TestMemoryBudgetEvictsAcrossServices(t *testing.T) {
+	item1, detached1 := buildQueuedItem("api-server", 1)
+	item2, detached2 := buildQueuedItem("payment", 2)
+	item3, detached3 := buildQueuedItem("cart", 3)
+
+	// Room for two items only
+	sizer := ptrace.ProtoMarshaler{}
+	budget := newTraceMemoryBudget(logger, &Config{}, buildMetrics())
+	budget.limit = int64(sizer.TracesSize(*detached1) + sizer.TracesSize(*detached2) + 1)
+
+	apiServerQueue := NewTraceQueue(5)
+	paymentQueue := NewTraceQueue(5)
+	cartQueue := NewTraceQueue(5)
+	assert.Equal(t, 0, len(budget.push(apiServerQueue, item1, detached1)))
+	assert.Equal(t, 0, len(budget.push(paymentQueue, item2, detached2)))
+	assert.Equal(t, []*Item{item1}, budget.push(cartQueue, item3, detached3))
+
+	assert.Equal(t, 0, len(apiServerQueue.priorityQueue))
+	assert.Equal(t, 1, len(paymentQueue.priorityQueue))
+	assert.Equal(t, 1, len(cartQueue.priorityQueue))
+	assert.Equal(t, item2.size+item3.size, budget.getUsedBytes())
+
+	// A lower priority item does not evict anything
+	item4, detached4 := buildQueuedItem("api-server", 0.5)
+	assert.Equal(t, []*Item{item4}, budget.push(apiServerQueue, item4, detached4))
+	assert.Equal(t, 0, len(apiServerQueue.priorityQueue))
+	assert.Equal(t, item2.size+item3.size, budget.getUsedBytes())
+}
@@ -35,8 +35,14 @@ type metricHelper struct {
 	// limit cardinality of request contexts for which metrics are captured
 	requestContextsByService *xsync.MapOf[string, *ttlcache.Cache[string, prometheus.Labels]]
 	ttl                      time.Duration
-	// guard access to config.CaptureAttributesInMetric and latencyHistogram
+	limitPerService          int
+	// guard access to config.CaptureAttributesInMetric, latencyHistogram and the request context limits
 	rwMutex *sync.RWMutex
+	// The config in use before the last update, to roll it back
+	previousCaptureAttributesInMetric []string
+	previousLatencyHistogramBuckets   []float64
+	previousTTL                       time.Duration
+	previousLimitPerService           int
 }
 
 func newMetricHelper(logger *zap.Logger, config *Config, buildInfo component.BuildInfo) *metricHelper {
@@ -54,6 +60,7 @@ func newMetricHelper(logger *zap.Logger, config *Config, buildInfo component.Bui
 		logger:                   logger,
 		config:                   config,
 		ttl:                      time.Minute * time.Duration(config.RequestContextCacheTTL),
+		limitPerService:          config.LimitPerService,
 		metrics:                  metrics,
 		exp:                      exporter,
 		requestContextsByService: xsync.NewMapOf[*ttlcache.Cache[string, prometheus.Labels]](),
@@ -88,33 +95,14 @@ func (p *metricHelper) captureMetrics(span *ptrace.Span, namespace string, servi
 	attrValue, _ := span.Attributes().Get(AssertsRequestContextAttribute)
 	requestContext := attrValue.AsString()
 
+	ttl, limitPerService := p.getRequestContextLimits()
 	cache, _ := p.requestContextsByService.LoadOrCompute(serviceKey, func() *ttlcache.Cache[string, prometheus.Labels] {
-		cache := ttlcache.New[string, prometheus.Labels](
-			ttlcache.WithTTL[string, prometheus.Labels](p.ttl),
-			ttlcache.WithCapacity[string, prometheus.Labels](uint64(p.config.LimitPerService)),
-		)
-		cache.OnEviction(
-			func(ctx context.Context, reason ttlcache.EvictionReason, item *ttlcache.Item[string, prometheus.Labels]) {
-				p.logger.Info("Evicted request context from cache",
-					zap.String("service", serviceKey),
-					zap.String("request context", item.Key()),
-				)
-
-				deletedCount := p.metrics.latencyHistogram.DeletePartialMatch(item.Value())
-
-				p.logger.Info("Deleted stale metrics",
-					zap.Int("count", deletedCount),
-					zap.Any("having label values", item.Value()),
-				)
-			},
-		)
+		cache := p.newRequestContextCache(serviceKey, ttl, limitPerService)
 		p.logger.Debug("Created a cache of known request contexts for service - " + serviceKey)
-
-		go cache.Start() // starts automatic expired item deletion
 		return cache
 	})
 
-	if val := cache.Get(requestContext); cache.Len() < p.config.LimitPerService || val != nil {
+	if val := cache.Get(requestContext); cache.Len() < limitPerService || val != nil {
 		labels := p.buildLabels(namespace, service, span, resourceSpan)
 		if val == nil {
 			// build labels map that will be used as a key to delete stale
@@ -140,6 +128,68 @@ func (p *metricHelper) captureMetrics(span *ptrace.Span, namespace string, servi
 	}
 }
 
+func (p *metricHelper) getRequestContextLimits() (time.Duration, int) {
+	p.rwMutex.RLock()
+	defer p.rwMutex.RUnlock()
+	return p.ttl, p.limitPerService
+}
+
+// Returns a started cache of the known request contexts of a service. The metrics of a request context
+// are deleted when it is evicted
+func (p *metricHelper) newRequestContextCache(serviceKey string, ttl time.Duration,
+	limitPerService int) *ttlcache.Cache[string, prometheus.Labels] {
+	cache := ttlcache.New[string, prometheus.Labels](
+		ttlcache.WithTTL[string, prometheus.Labels](ttl),
+		ttlcache.WithCapacity[string, prometheus.Labels](uint64(limitPerService)),
+	)
+	cache.OnEviction(
+		func(ctx context.Context, reason ttlcache.EvictionReason, item *ttlcache.Item[string, prometheus.Labels]) {
+			p.logger.Info("Evicted request context from cache",
+				zap.String("service", serviceKey),
+				zap.String("request context", item.Key()),
+			)
+			p.deleteStaleMetrics(item.Value())
+		},
+	)
+	go cache.Start() // starts automatic expired item deletion
+	return cache
+}
+
+func (p *metricHelper) deleteStaleMetrics(labels prometheus.Labels) {
+	deletedCount := p.metrics.latencyHistogram.DeletePartialMatch(labels)
+
+	p.logger.Info("Deleted stale metrics",
+		zap.Int("count", deletedCount),
+		zap.Any("having label values", labels),
+	)
+}
+
+// Replaces the caches of the known request contexts with caches of the new expiry and limit. The request
+// contexts are retained up to the new limit, and the metrics of the others are deleted
+func (p *metricHelper) setRequestContextLimits(ttl time.Duration, limitPerService int) {
+	if p.ttl == ttl && p.limitPerService == limitPerService {
+		return
+	}
+	p.ttl, p.limitPerService = ttl, limitPerService
+	p.requestContextsByService.Range(func(serviceKey string, cache *ttlcache.Cache[string, prometheus.Labels]) bool {
+		resized := p.newRequestContextCache(serviceKey, ttl, limitPerService)
+		for requestContext, item := range cache.Items() {
+			if resized.Len() < limitPerService {
+				resized.Set(requestContext, item.Value(), ttlcache.DefaultTTL)
+			} else {
+				p.deleteStaleMetrics(item.Value())
+			}
+		}
+		p.requestContextsByService.Store(serviceKey, resized)
+		cache.Stop()
+		return true
+	})
+	p.logger.Info("Updated config RequestContextCacheTTL and LimitPerService of the metrics",
+		zap.Duration("RequestContextCacheTTL", ttl),
+		zap.Int("LimitPerService", limitPerService),
+	)
+}
+
 func (p *metricHelper) buildLabels(namespace string, service string, span *ptrace.Span,
 	resourceSpan *ptrace.ResourceSpans) prometheus.Labels {
 
@@ -197,7 +247,24 @@ func (p *metricHelper) isUpdated(currConfig *Config, newConfig *Config) bool {
 	defer p.rwMutex.RUnlock()
 
 	return p.isCaptureAttributesInMetricUpdated(currConfig, newConfig) ||
-		p.isLatencyHistogramBucketsUpdated(currConfig, newConfig)
+		p.isLatencyHistogramBucketsUpdated(currConfig, newConfig) ||
+		p.isRequestContextLimitsUpdated(currConfig, newConfig)
+}
+
+func (p *metricHelper) isRequestContextLimitsUpdated(currConfig *Config, newConfig *Config) bool {
+	updated := (newConfig.RequestContextCacheTTL > 0 && currConfig.RequestContextCacheTTL != newConfig.RequestContextCacheTTL) ||
+		(newConfig.LimitPerService > 0 && currConfig.LimitPerService != newConfig.LimitPerService)
+	if updated {
+		p.logger.Info("Change detected in config RequestContextCacheTTL or LimitPerService",
+			zap.Int("Current RequestContextCacheTTL", currConfig.RequestContextCacheTTL),
+			zap.Int("New RequestContextCacheTTL", newConfig.RequestContextCacheTTL),
+			zap.Int("Current LimitPerService", currConfig.LimitPerService),
+			zap.Int("New LimitPerService", newConfig.LimitPerService),
+		)
+	} else {
+		p.logger.Debug("No change detected in config RequestContextCacheTTL and LimitPerService")
+	}
+	return updated
 }
 
 func (p *metricHelper) isCaptureAttributesInMetricUpdated(currConfig *Config, newConfig *Config) bool {
@@ -227,10 +294,72 @@ func (p *metricHelper) isLatencyHistogramBucketsUpdated(currConfig *Config, newC
 	return updated
 }
 
+// Checks that the latency histogram can be registered with the new labels and buckets
+func (p *metricHelper) prepareUpdate(newConfig *Config) error {
+	p.rwMutex.RLock()
+	buckets := p.config.LatencyHistogramBuckets
+	p.rwMutex.RUnlock()
+	if len(newConfig.LatencyHistogramBuckets) > 0 {
+		buckets = newConfig.LatencyHistogramBuckets
+	}
+	v := &configValidator{}
+	validateLatencyHistogramBuckets(v, buckets)
+	if err := v.result(); err != nil {
+		return err
+	}
+	histogram := newLatencyHistogram(latencyHistogramLabels(newConfig.CaptureAttributesInMetric), buckets)
+	return prometheus.NewRegistry().Register(histogram)
+}
+
 func (p *metricHelper) onUpdate(newConfig *Config) error {
 	p.rwMutex.Lock()
 	defer p.rwMutex.Unlock()
 
+	currConfigCaptureAttributesInMetric := p.config.CaptureAttributesInMetric
+	currConfigLatencyHistogramBuckets := p.config.LatencyHistogramBuckets
+	buckets := currConfigLatencyHistogramBuckets
+	if len(newConfig.LatencyHistogramBuckets) > 0 {
+		buckets = newConfig.LatencyHistogramBuckets
+	}
+	// The exporter is restarted only when the latency histogram changes
+	if !reflect.DeepEqual(currConfigCaptureAttributesInMetric, newConfig.CaptureAttributesInMetric) ||
+		!reflect.DeepEqual(currConfigLatencyHistogramBuckets, buckets) {
+		if err := p.applyConfig(newConfig.CaptureAttributesInMetric, buckets); err != nil {
+			return err
+		}
+	}
+	p.previousCaptureAttributesInMetric = currConfigCaptureAttributesInMetric
+	p.previousLatencyHistogramBuckets = currConfigLatencyHistogramBuckets
+	p.previousTTL, p.previousLimitPerService = p.ttl, p.limitPerService
+
+	ttl, limitPerService := p.ttl, p.limitPerService
+	if newConfig.RequestContextCacheTTL > 0 {
+		ttl = time.Minute * time.Duration(newConfig.RequestContextCacheTTL)
+	}
+	if newConfig.LimitPerService > 0 {
+		limitPerService = newConfig.LimitPerService
+	}
+	p.setRequestContextLimits(ttl, limitPerService)
+	return nil
+}
+
+func (p *metricHelper) rollbackUpdate() {
+	p.rwMutex.Lock()
+	defer p.rwMutex.Unlock()
+
+	if !reflect.DeepEqual(p.config.CaptureAttributesInMetric, p.previousCaptureAttributesInMetric) ||
+		!reflect.DeepEqual(p.config.LatencyHistogramBuckets, p.previousLatencyHistogramBuckets) {
+		err := p.applyConfig(p.previousCaptureAttributesInMetric, p.previousLatencyHistogramBuckets)
+		if err != nil {
+			p.logger.Error("Error rolling back config CaptureAttributesInMetric and LatencyHistogramBuckets", zap.Error(err))
+		}
+	}
+	p.setRequestContextLimits(p.previousTTL, p.previousLimitPerService)
+}
+
+// Registers the latency histogram with the attributes and buckets and restarts the exporter. Reverts to
+// the attributes and buckets in use if the histogram cannot be registered
+func (p *metricHelper) applyConfig(captureAttributesInMetric []string, buckets []float64) error {
 	// This is a bit tricky! We cannot simply register the metric again with different labels
 	// We have to throw away the existing prometheus registry, shutdown the prometheus exporter
 	// and redo all of that work again
@@ -239,17 +368,15 @@ func (p *metricHelper) onUpdate(newConfig *Config) error {
 		currConfigCaptureAttributesInMetric := p.config.CaptureAttributesInMetric
 		currConfigLatencyHistogramBuckets := p.config.LatencyHistogramBuckets
 		// use new config
-		p.config.CaptureAttributesInMetric = newConfig.CaptureAttributesInMetric
-		if len(newConfig.LatencyHistogramBuckets) > 0 {
-			p.config.LatencyHistogramBuckets = newConfig.LatencyHistogramBuckets
-		}
+		p.config.CaptureAttributesInMetric = captureAttributesInMetric
+		p.config.LatencyHistogramBuckets = buckets
 
 		// create new prometheus registry and register metrics
 		err = p.registerMetrics()
 		if err == nil {
 			p.logger.Info("Updated config",
-				zap.Any("CaptureAttributesInMetric", newConfig.CaptureAttributesInMetric),
-				zap.Any("LatencyHistogramBuckets", newConfig.LatencyHistogramBuckets),
+				zap.Any("CaptureAttributesInMetric", captureAttributesInMetric),
+				zap.Any("LatencyHistogramBuckets", buckets),
 			)
 		} else {
 			p.logger.Error("Ignoring config CaptureAttributesInMetric and LatencyHistogramBuckets "+
@@ -232,4 +232,67 @@ func TestMetricHelperOnUpdate(t *testing.T) {
 	p.startExporter()
 
 	assert.Nil(t, p.onUpdate(newConfig))
+	_ = p.stopExporter()
+}
+
+func TestMetricHelperPrepareUpdate(t *testing.T) {
+	p := newMetricHelper(logger, &Config{LatencyHistogramBuckets: []float64{1, 2.5, 5, 10}}, buildInfo)
+
+	assert.Nil(t, p.prepareUpdate(&Config{CaptureAttributesInMetric: []string{"rpc.system"}}))
+	assert.Nil(t, p.prepareUpdate(&Config{LatencyHistogramBuckets: []float64{0.5, 1}}))
+	assert.NotNil(t, p.prepareUpdate(&Config{LatencyHistogramBuckets: []float64{1, 0.5}}))
+	// The label is already a label of the histogram
+	assert.NotNil(t, p.prepareUpdate(&Config{CaptureAttributesInMetric: []string{"namespace"}}))
+}
+
+func TestMetricHelperRollbackUpdate(t *testing.T) {
+	currConfig := &Config{
+		CaptureAttributesInMetric: []string{"rpc.system"},
+		LatencyHistogramBuckets:   []float64{1, 2.5, 5, 10},
+		PrometheusExporterPort:    9466,
+	}
+	p := newMetricHelper(logger, currConfig, buildInfo)
+	_ = p.registerMetrics()
+	p.startExporter()
+
+	assert.Nil(t, p.onUpdate(&Config{
+		CaptureAttributesInMetric: []string{"rpc.system", "rpc.method"},
+		LatencyHistogramBuckets:   []float64{1, 2.5, 5, 10, 25},
+	}))
+	p.rollbackUpdate()
+	assert.Equal(t, []string{"rpc.system"}, currConfig.CaptureAttributesInMetric)
+	assert.Equal(t, []float64{1, 2.5, 5, 10}, currConfig.LatencyHistogramBuckets)
+	_ = p.stopExporter()
+}
+
+func TestMetricHelperUpdateRequestContextLimits(t *testing.T) {
+	currConfig := &Config{
+		Env:                    "dev",
+		Site:                   "us-west-2",
+		LimitPerService:        3,
+		RequestContextCacheTTL: 60,
+	}
+	p := newMetricHelper(logger, currConfig, buildInfo)
+	_ = p.registerMetrics()
+	resourceSpans := ptrace.NewTraces().ResourceSpans().AppendEmpty()
+	testSpan := ptrace.NewSpan()
+	for _, requestContext := range []string{"/cart/#val1", "/cart/#val2", "/cart/#val3"} {
+		testSpan.Attributes().PutStr(AssertsRequestContextAttribute, requestContext)
+		p.captureMetrics(&testSpan, "robot-shop", "cart", &resourceSpans)
+	}
+
+	newConfig := &Config{LimitPerService: 2, RequestContextCacheTTL: 30}
+	assert.False(t, p.isUpdated(currConfig, currConfig))
+	assert.True(t, p.isUpdated(currConfig, newConfig))
+	assert.Nil(t, p.onUpdate(newConfig))
+	cache, _ := p.requestContextsByService.Load("robot-shop#cart")
+	assert.Equal(t, 2, cache.Len())
+	ttl, limitPerService := p.getRequestContextLimits()
+	assert.Equal(t, 30*time.Minute, ttl)
+	assert.Equal(t, 2, limitPerService)
+
+	p.rollbackUpdate()
+	ttl, limitPerService = p.getRequestContextLimits()
+	assert.Equal(t, time.Hour, ttl)
+	assert.Equal(t, 3, limitPerService)
 }
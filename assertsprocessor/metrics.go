@@ -18,7 +18,11 @@ type metrics struct {
 	sampledTraceCount  *prometheus.CounterVec
 	totalSpanCount     *prometheus.CounterVec
 	sampledSpanCount   *prometheus.CounterVec
+	rateLimitedCount   *prometheus.CounterVec
+	queuedTraceBytes   prometheus.Gauge
 	buildInfoMetric    prometheus.Gauge
+	// The collectors registered by the other components, which are registered again with a new registry
+	collectors []prometheus.Collector
 }
 
 func (m *metrics) registerMetrics(captureAttributesInMetric []string) error {
@@ -50,16 +54,39 @@ func (m *metrics) registerMetrics(captureAttributesInMetric []string) error {
 	if err != nil {
 		return err
 	}
+	// Create Counter for sampled traces dropped by the rate limits
+	m.rateLimitedCount, err = m.register("trace", "rate_limited_count_total", sampledTraceCountLabels, "Rate Limited Trace Counter")
+	if err != nil {
+		return err
+	}
+	// Create Gauge for the memory held by queued traces
+	err = m.registerQueuedTraceBytes()
+	if err != nil {
+		return err
+	}
 	// Create Build Info Gauge
 	err = m.registerBuildInfo()
 	if err != nil {
 		return err
 	}
 	m.buildInfoMetric.Set(1)
+	for _, collector := range m.collectors {
+		err = m.prometheusRegistry.Register(collector)
+		if err != nil {
+			return err
+		}
+	}
 
 	return m.registerLatencyHistogram(captureAttributesInMetric)
 }
 
+// Registers a collector with the current registry and with the registries created when the metrics are
+// registered again
+func (m *metrics) registerCollector(collector prometheus.Collector) error {
+	m.collectors = append(m.collectors, collector)
+	return m.prometheusRegistry.Register(collector)
+}
+
 func (m *metrics) register(subsystem string, name string, labels []string, msg string) (*prometheus.CounterVec, error) {
 	m.logger.Info("Registering "+msg+" with ", zap.String("labels", strings.Join(labels, ", ")))
 
@@ -77,6 +104,20 @@ func (m *metrics) register(subsystem string, name string, labels []string, msg s
 }
 
 func (m *metrics) registerLatencyHistogram(captureAttributesInMetric []string) error {
+	spanMetricLabels := latencyHistogramLabels(captureAttributesInMetric)
+	m.logger.Info("Registering Latency Histogram with ", zap.String("labels", strings.Join(spanMetricLabels, ", ")))
+
+	m.latencyHistogram = newLatencyHistogram(spanMetricLabels, m.config.LatencyHistogramBuckets)
+	err := m.prometheusRegistry.Register(m.latencyHistogram)
+	if err != nil {
+		m.logger.Fatal("Error registering Latency Histogram Metric Vector", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+func latencyHistogramLabels(captureAttributesInMetric []string) []string {
 	var spanMetricLabels = []string{envLabel, siteLabel, namespaceLabel, serviceLabel, spanKind, statusCode}
 
 	if captureAttributesInMetric != nil {
@@ -85,17 +126,29 @@ func (m *metrics) registerLatencyHistogram(captureAttributesInMetric []string) e
 		}
 	}
 	sort.Strings(spanMetricLabels)
-	m.logger.Info("Registering Latency Histogram with ", zap.String("labels", strings.Join(spanMetricLabels, ", ")))
+	return spanMetricLabels
+}
 
-	m.latencyHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+func newLatencyHistogram(labels []string, buckets []float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: "otel",
 		Subsystem: "span",
 		Name:      "latency_seconds",
-		Buckets:   m.config.LatencyHistogramBuckets,
-	}, spanMetricLabels)
-	err := m.prometheusRegistry.Register(m.latencyHistogram)
+		Buckets:   buckets,
+	}, labels)
+}
+
+func (m *metrics) registerQueuedTraceBytes() error {
+	m.logger.Info("Registering Queued Trace Bytes Gauge")
+
+	m.queuedTraceBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "asserts",
+		Subsystem: "trace",
+		Name:      "queued_bytes",
+	})
+	err := m.prometheusRegistry.Register(m.queuedTraceBytes)
 	if err != nil {
-		m.logger.Fatal("Error registering Latency Histogram Metric Vector", zap.Error(err))
+		m.logger.Fatal("Error registering Queued Trace Bytes Gauge", zap.Error(err))
 		return err
 	}
 
@@ -126,17 +179,25 @@ func (m *metrics) unregisterMetrics() {
 	m.sampledTraceCount.Reset()
 	m.totalSpanCount.Reset()
 	m.sampledSpanCount.Reset()
+	m.rateLimitedCount.Reset()
 
 	m.prometheusRegistry.Unregister(m.latencyHistogram)
 	m.prometheusRegistry.Unregister(m.totalTraceCount)
 	m.prometheusRegistry.Unregister(m.sampledTraceCount)
 	m.prometheusRegistry.Unregister(m.totalSpanCount)
 	m.prometheusRegistry.Unregister(m.sampledSpanCount)
+	m.prometheusRegistry.Unregister(m.rateLimitedCount)
+	m.prometheusRegistry.Unregister(m.queuedTraceBytes)
 	m.prometheusRegistry.Unregister(m.buildInfoMetric)
+	for _, collector := range m.collectors {
+		m.prometheusRegistry.Unregister(collector)
+	}
 }
 
+// The total counts are weighted by the adjusted counts of the traces sampled upstream, so that they
+// reflect the volume of traces before sampling
 func (m *metrics) incrTotalCounts(tr *trace) {
-	m.incrTotalTraceCount()
+	m.incrTotalTraceCount(traceAdjustedCount(tr))
 	m.incrTotalSpanCount(tr)
 }
 
@@ -145,12 +206,18 @@ func (m *metrics) incrSampledCounts(tr *trace, sampleType string) {
 	m.incrSampledSpanCount(tr)
 }
 
-func (m *metrics) incrTotalTraceCount() {
+func (m *metrics) setQueuedTraceBytes(bytes int64) {
+	if m.queuedTraceBytes != nil {
+		m.queuedTraceBytes.Set(float64(bytes))
+	}
+}
+
+func (m *metrics) incrTotalTraceCount(adjustedCount float64) {
 	sampledTraceCountLabels := map[string]string{
 		envLabel:  m.config.Env,
 		siteLabel: m.config.Site,
 	}
-	m.totalTraceCount.With(sampledTraceCountLabels).Inc()
+	m.totalTraceCount.With(sampledTraceCountLabels).Add(adjustedCount)
 }
 
 func (m *metrics) incrSampledTraceCount(sampleType string) {
@@ -162,8 +229,26 @@ func (m *metrics) incrSampledTraceCount(sampleType string) {
 	m.sampledTraceCount.With(sampledTraceCountLabels).Inc()
 }
 
+func (m *metrics) incrRateLimitedTraceCount(sampleType string) {
+	if m.rateLimitedCount == nil {
+		return
+	}
+	rateLimitedCountLabels := map[string]string{
+		envLabel:             m.config.Env,
+		siteLabel:            m.config.Site,
+		traceSampleTypeLabel: sampleType,
+	}
+	m.rateLimitedCount.With(rateLimitedCountLabels).Inc()
+}
+
 func (m *metrics) incrTotalSpanCount(tr *trace) {
-	m.incrSpanCount(tr, m.totalSpanCount)
+	for _, ts := range tr.segments {
+		var count float64
+		for _, span := range ts.getAllSpans() {
+			count += spanAdjustedCount(span)
+		}
+		m.totalSpanCount.With(m.spanCountLabels(ts)).Add(count)
+	}
 }
 
 func (m *metrics) incrSampledSpanCount(tr *trace) {
@@ -172,13 +257,16 @@ func (m *metrics) incrSampledSpanCount(tr *trace) {
 
 func (m *metrics) incrSpanCount(tr *trace, spanCounter *prometheus.CounterVec) {
 	for _, ts := range tr.segments {
-		spanCountLabels := map[string]string{
-			envLabel:       m.config.Env,
-			siteLabel:      m.config.Site,
-			namespaceLabel: ts.namespace,
-			serviceLabel:   ts.service,
-		}
 		count := float64(ts.getSpanCount())
-		spanCounter.With(spanCountLabels).Add(count)
+		spanCounter.With(m.spanCountLabels(ts)).Add(count)
+	}
+}
+
+func (m *metrics) spanCountLabels(ts *traceSegment) map[string]string {
+	return map[string]string{
+		envLabel:       m.config.Env,
+		siteLabel:      m.config.Site,
+		namespaceLabel: ts.namespace,
+		serviceLabel:   ts.service,
 	}
 }
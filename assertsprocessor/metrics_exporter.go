@@ -7,6 +7,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
+	"net"
 	"net/http"
 	"regexp"
 	"strconv"
@@ -17,6 +18,17 @@ type metricsExporter struct {
 	logger     *zap.Logger
 	config     *Config
 	httpServer *http.Server
+	listener   net.Listener
+	// The handlers served along with the metrics, by URL pattern
+	handlers map[string]http.Handler
+}
+
+// Serves the handler along with the metrics, from the next start of the exporter
+func (exp *metricsExporter) handle(pattern string, handler http.Handler) {
+	if exp.handlers == nil {
+		exp.handlers = map[string]http.Handler{}
+	}
+	exp.handlers[pattern] = handler
 }
 
 func (exp *metricsExporter) start(reg *prometheus.Registry) {
@@ -28,6 +40,9 @@ func (exp *metricsExporter) start(reg *prometheus.Registry) {
 		reg,
 		promhttp.HandlerOpts{},
 	))
+	for pattern, handler := range exp.handlers {
+		sm.Handle(pattern, handler)
+	}
 
 	exp.httpServer = &http.Server{
 		Handler:        sm,
@@ -44,9 +59,18 @@ func (exp *metricsExporter) start(reg *prometheus.Registry) {
 	))
 
 	exp.logger.Info("Starting Prometheus Exporter Listening", zap.Uint64("port", exp.config.PrometheusExporterPort))
+	// Bind the port before returning so that a stop followed by a start does not race
+	// with a listener that is still being set up in the background
+	listener, err := net.Listen("tcp", exp.httpServer.Addr)
+	if err != nil {
+		exp.logger.Fatal("Error starting Prometheus Exporter", zap.Error(err))
+		return
+	}
+	exp.listener = listener
 	go func() {
-		if err := exp.httpServer.ListenAndServe(); err != nil {
-			if errors.Is(err, http.ErrServerClosed) {
+		if err := exp.httpServer.Serve(listener); err != nil {
+			// The listener is closed by a stop that happens before Serve starts tracking it
+			if errors.Is(err, http.ErrServerClosed) || errors.Is(err, net.ErrClosed) {
 				exp.logger.Error("Prometheus Exporter is shutdown", zap.Error(err))
 			} else if err != nil {
 				exp.logger.Fatal("Error starting Prometheus Exporter", zap.Error(err))
@@ -57,5 +81,10 @@ func (exp *metricsExporter) start(reg *prometheus.Registry) {
 
 func (exp *metricsExporter) stop() error {
 	shutdownCtx := context.Background()
-	return exp.httpServer.Shutdown(shutdownCtx)
+	err := exp.httpServer.Shutdown(shutdownCtx)
+	// Shutdown does not close a listener that Serve has not started tracking yet
+	if exp.listener != nil {
+		_ = exp.listener.Close()
+	}
+	return err
 }
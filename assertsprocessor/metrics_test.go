@@ -2,7 +2,9 @@ package assertsprocessor
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/ptrace"
 	"go.uber.org/zap"
 	"testing"
 )
@@ -40,3 +42,41 @@ func TestUnregisterMetrics(t *testing.T) {
 	_ = reg.registerMetrics(attributes)
 	reg.unregisterMetrics()
 }
+
+func TestIncrTotalCountsUsesAdjustedCounts(t *testing.T) {
+	m := buildMetrics()
+	rootSpan := ptrace.NewSpan()
+	rootSpan.TraceState().FromRaw("ot=th:c")
+	childSpan := ptrace.NewSpan()
+	childSpan.TraceState().FromRaw("ot=p:1")
+	m.incrTotalCounts(newTrace(&traceSegment{
+		namespace:     "platform",
+		service:       "api-server",
+		rootSpan:      &rootSpan,
+		internalSpans: []*ptrace.Span{&childSpan},
+	}))
+
+	traceCount := m.totalTraceCount.With(map[string]string{envLabel: "dev", siteLabel: "us-west-2"})
+	assert.Equal(t, 4.0, testutil.ToFloat64(traceCount))
+	spanCount := m.totalSpanCount.With(map[string]string{
+		envLabel: "dev", siteLabel: "us-west-2", namespaceLabel: "platform", serviceLabel: "api-server",
+	})
+	assert.Equal(t, 6.0, testutil.ToFloat64(spanCount))
+}
+
+func TestRegisterCollectorSurvivesNewRegistry(t *testing.T) {
+	logger, _ := zap.NewProduction()
+	reg := &metrics{
+		logger:             logger,
+		config:             &Config{},
+		prometheusRegistry: prometheus.NewRegistry(),
+	}
+	assert.Nil(t, reg.registerMetrics(nil))
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge"})
+	assert.Nil(t, reg.registerCollector(gauge))
+
+	reg.unregisterMetrics()
+	assert.Nil(t, reg.registerMetrics(nil))
+	assert.False(t, reg.prometheusRegistry.Unregister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "other_gauge"})))
+	assert.True(t, reg.prometheusRegistry.Unregister(gauge))
+}
@@ -0,0 +1,300 @@
+package assertsprocessor
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/open-telemetry/opamp-go/client"
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+	"go.opentelemetry.io/collector/component"
+	conventions "go.opentelemetry.io/collector/semconv/v1.6.1"
+	"go.uber.org/zap"
+)
+
+// The non-identifying attribute of the agent description with the hash of the effective config
+const opampEffectiveConfigHashAttribute = "asserts.effective_config.hash"
+
+// The connection to an OpAMP server, which manages the collector as an agent
+type OpAMPConfig struct {
+	// ws:// or wss:// to connect over WebSocket, http:// or https:// to poll over HTTP
+	Endpoint string            `mapstructure:"endpoint" json:"endpoint"`
+	Headers  map[string]string `mapstructure:"headers" json:"headers"`
+	// The ULID that identifies the collector to the server. A new one is generated at each start if not set
+	InstanceUID string `mapstructure:"instance_uid" json:"instance_uid"`
+	// The key of the processor config in the config map of the remote config, "" for a single config
+	ConfigName string `mapstructure:"config_name" json:"config_name"`
+	// How often the server is polled over HTTP, 30 seconds by default
+	PollingIntervalSeconds int `mapstructure:"polling_interval_seconds" json:"polling_interval_seconds"`
+}
+
+func (oc *OpAMPConfig) validateAt(v *configValidator, path string) {
+	endpoint, err := url.Parse(oc.Endpoint)
+	if err != nil || oc.Endpoint == "" {
+		v.add(joinPath(path, "endpoint"),
+			ValidationError{message: fmt.Sprintf("invalid endpoint %q", oc.Endpoint), error: err})
+	} else {
+		switch endpoint.Scheme {
+		case "ws", "wss", "http", "https":
+		default:
+			v.addf(joinPath(path, "endpoint"), "unknown scheme %s, must be ws, wss, http or https", endpoint.Scheme)
+		}
+	}
+	if oc.InstanceUID != "" {
+		if _, err = ulid.ParseStrict(oc.InstanceUID); err != nil {
+			v.add(joinPath(path, "instance_uid"),
+				ValidationError{message: fmt.Sprintf("%s is not a ULID", oc.InstanceUID), error: err})
+		}
+	}
+	if oc.PollingIntervalSeconds < 0 {
+		v.addf(joinPath(path, "polling_interval_seconds"), "%d must not be negative", oc.PollingIntervalSeconds)
+	}
+}
+
+// opampAgent receives the processor config from an OpAMP server as a remote config, and applies it as the
+// config of the Asserts API is applied. It reports the status of each remote config, the effective config
+// and its hash, the health and the build of the collector back to the server
+type opampAgent struct {
+	logger      *zap.Logger
+	config      *OpAMPConfig
+	buildInfo   component.BuildInfo
+	instanceUID string
+	refresh     *configRefresh
+	client      client.OpAMPClient
+	startTime   time.Time
+	// The status of the remote config last received, so that a remote config is applied once
+	remoteConfigStatus *protobufs.RemoteConfigStatus
+	// Whether any remote config was received, as the first may come without a hash
+	remoteConfigReceived bool
+	// The errors of the last remote config applied and of the last connection to the server, reported as the health
+	applyError   string
+	connectError string
+	mutex        sync.Mutex
+}
+
+func newOpAMPAgent(logger *zap.Logger, config *OpAMPConfig, buildInfo component.BuildInfo,
+	cr *configRefresh) (*opampAgent, error) {
+
+	instanceUID := config.InstanceUID
+	if instanceUID == "" {
+		uid, err := ulid.New(ulid.Timestamp(time.Now()), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		instanceUID = uid.String()
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	var opampClient client.OpAMPClient
+	if endpoint.Scheme == "http" || endpoint.Scheme == "https" {
+		httpClient := client.NewHTTP(logger.Sugar())
+		if config.PollingIntervalSeconds > 0 {
+			httpClient.SetPollingInterval(time.Duration(config.PollingIntervalSeconds) * time.Second)
+		}
+		opampClient = httpClient
+	} else {
+		opampClient = client.NewWebSocket(logger.Sugar())
+	}
+	return &opampAgent{
+		logger:             logger,
+		config:             config,
+		buildInfo:          buildInfo,
+		instanceUID:        instanceUID,
+		refresh:            cr,
+		client:             opampClient,
+		remoteConfigStatus: &protobufs.RemoteConfigStatus{},
+	}, nil
+}
+
+func (a *opampAgent) start() error {
+	a.startTime = time.Now()
+	if err := a.client.SetAgentDescription(a.agentDescription()); err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	health := a.health()
+	a.mutex.Unlock()
+	if err := a.client.SetHealth(health); err != nil {
+		return err
+	}
+	header := http.Header{}
+	for name, value := range a.config.Headers {
+		header.Set(name, value)
+	}
+	a.logger.Info("Connecting to the OpAMP server", zap.String("Endpoint", a.config.Endpoint),
+		zap.String("Instance UID", a.instanceUID))
+	return a.client.Start(context.Background(), types.StartSettings{
+		OpAMPServerURL: a.config.Endpoint,
+		Header:         header,
+		InstanceUid:    a.instanceUID,
+		Callbacks: types.CallbacksStruct{
+			OnConnectFunc: func() {
+				a.logger.Info("Connected to the OpAMP server")
+				a.setConnectError("")
+			},
+			OnConnectFailedFunc: func(err error) {
+				a.logger.Warn("Error connecting to the OpAMP server", zap.Error(err))
+				a.setConnectError(err.Error())
+			},
+			OnErrorFunc: func(err *protobufs.ServerErrorResponse) {
+				a.logger.Error("Error response from the OpAMP server", zap.String("Message", err.GetErrorMessage()))
+				a.setConnectError(err.GetErrorMessage())
+			},
+			OnMessageFunc:          a.onMessage,
+			GetEffectiveConfigFunc: a.effectiveConfig,
+		},
+		Capabilities: protobufs.AgentCapabilities_AgentCapabilities_AcceptsRemoteConfig |
+			protobufs.AgentCapabilities_AgentCapabilities_ReportsRemoteConfig |
+			protobufs.AgentCapabilities_AgentCapabilities_ReportsEffectiveConfig |
+			protobufs.AgentCapabilities_AgentCapabilities_ReportsHealth,
+	})
+}
+
+func (a *opampAgent) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.client.Stop(ctx); err != nil {
+		a.logger.Debug("Error stopping the OpAMP client", zap.Error(err))
+	}
+}
+
+func (a *opampAgent) onMessage(ctx context.Context, msg *types.MessageData) {
+	if msg.RemoteConfig != nil {
+		a.applyRemoteConfig(ctx, msg.RemoteConfig)
+	}
+}
+
+// Applies the processor config of the remote config, and reports whether it was applied
+func (a *opampAgent) applyRemoteConfig(ctx context.Context, remoteConfig *protobufs.AgentRemoteConfig) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.remoteConfigReceived &&
+		bytes.Equal(remoteConfig.GetConfigHash(), a.remoteConfigStatus.GetLastRemoteConfigHash()) {
+		return
+	}
+	a.remoteConfigReceived = true
+
+	hash := remoteConfig.GetConfigHash()
+	if hash == nil {
+		// The client reports no status without a hash
+		hash = []byte{}
+	}
+	status := &protobufs.RemoteConfigStatus{
+		LastRemoteConfigHash: hash,
+		Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED,
+	}
+	var err error
+	if file, found := remoteConfig.GetConfig().GetConfigMap()[a.config.ConfigName]; found {
+		a.logger.Info("Received remote config from the OpAMP server")
+		err = a.refresh.applyRemoteDocument(activeConfigOpAMP, file.GetBody())
+	} else {
+		err = fmt.Errorf("the remote config has no config named %q", a.config.ConfigName)
+	}
+	a.applyError = ""
+	if err != nil {
+		a.logger.Error("Rejected the remote config of the OpAMP server", zap.Error(err))
+		status.Status = protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED
+		status.ErrorMessage = err.Error()
+		a.applyError = err.Error()
+	}
+	a.remoteConfigStatus = status
+	if err = a.client.SetRemoteConfigStatus(status); err != nil {
+		a.logger.Error("Error reporting the remote config status", zap.Error(err))
+	}
+	if err = a.client.SetHealth(a.health()); err != nil {
+		a.logger.Error("Error reporting the health", zap.Error(err))
+	}
+	if status.Status == protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED {
+		if err = a.client.SetAgentDescription(a.agentDescription()); err != nil {
+			a.logger.Error("Error reporting the agent description", zap.Error(err))
+		}
+		if err = a.client.UpdateEffectiveConfig(ctx); err != nil {
+			a.logger.Error("Error reporting the effective config", zap.Error(err))
+		}
+	}
+}
+
+// Reports the error of the last connection to the server when it changes
+func (a *opampAgent) setConnectError(connectError string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if connectError == a.connectError {
+		return
+	}
+	a.connectError = connectError
+	if err := a.client.SetHealth(a.health()); err != nil {
+		a.logger.Error("Error reporting the health", zap.Error(err))
+	}
+}
+
+// The agent is unhealthy while the last remote config is rejected or the server cannot be reached, though the
+// processor keeps running with the config in use. Called with the mutex held
+func (a *opampAgent) health() *protobufs.AgentHealth {
+	lastError := a.applyError
+	if lastError == "" {
+		lastError = a.connectError
+	}
+	return &protobufs.AgentHealth{
+		Healthy:           lastError == "",
+		StartTimeUnixNano: uint64(a.startTime.UnixNano()),
+		LastError:         lastError,
+	}
+}
+
+// Returns the config in use, with the secrets redacted, as JSON
+func (a *opampAgent) effectiveConfigBody() []byte {
+	body, err := json.Marshal(a.refresh.effectiveConfig().Config)
+	if err != nil {
+		a.logger.Error("Error marshalling the effective config", zap.Error(err))
+	}
+	return body
+}
+
+func (a *opampAgent) effectiveConfig(context.Context) (*protobufs.EffectiveConfig, error) {
+	return &protobufs.EffectiveConfig{
+		ConfigMap: &protobufs.AgentConfigMap{
+			ConfigMap: map[string]*protobufs.AgentConfigFile{
+				a.config.ConfigName: {Body: a.effectiveConfigBody(), ContentType: "application/json"},
+			},
+		},
+	}, nil
+}
+
+// Describes the collector by its build and instance, along with the host and the hash of the effective config
+func (a *opampAgent) agentDescription() *protobufs.AgentDescription {
+	hash := sha256.Sum256(a.effectiveConfigBody())
+	hostname, _ := os.Hostname()
+	return &protobufs.AgentDescription{
+		IdentifyingAttributes: []*protobufs.KeyValue{
+			stringKeyValue(conventions.AttributeServiceName, a.buildInfo.Command),
+			stringKeyValue(conventions.AttributeServiceVersion, a.buildInfo.Version),
+			stringKeyValue(conventions.AttributeServiceInstanceID, a.instanceUID),
+		},
+		NonIdentifyingAttributes: []*protobufs.KeyValue{
+			stringKeyValue(conventions.AttributeHostName, hostname),
+			stringKeyValue(conventions.AttributeOSType, runtime.GOOS),
+			stringKeyValue(opampEffectiveConfigHashAttribute, hex.EncodeToString(hash[:])),
+		},
+	}
+}
+
+func stringKeyValue(key string, value string) *protobufs.KeyValue {
+	return &protobufs.KeyValue{
+		Key:   key,
+		Value: &protobufs.AnyValue{Value: &protobufs.AnyValue_StringValue{StringValue: value}},
+	}
+}
@@ -0,0 +1,238 @@
+package assertsprocessor
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/client"
+	"github.com/open-telemetry/opamp-go/protobufs"
+	"github.com/open-telemetry/opamp-go/server"
+	"github.com/open-telemetry/opamp-go/server/types"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/component"
+)
+
+// A stand-in for an OpAMP server, which sends the remote config to the agent and keeps the last status
+// reported by the agent
+type mockOpAMPServer struct {
+	remoteConfig       *protobufs.AgentRemoteConfig
+	description        *protobufs.AgentDescription
+	health             *protobufs.AgentHealth
+	remoteConfigStatus *protobufs.RemoteConfigStatus
+	effectiveConfig    *protobufs.EffectiveConfig
+	mutex              sync.Mutex
+}
+
+func (ms *mockOpAMPServer) OnConnected(types.Connection) {}
+
+func (ms *mockOpAMPServer) OnConnectionClose(types.Connection) {}
+
+func (ms *mockOpAMPServer) OnMessage(_ types.Connection, message *protobufs.AgentToServer) *protobufs.ServerToAgent {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if message.AgentDescription != nil {
+		ms.description = message.AgentDescription
+	}
+	if message.Health != nil {
+		ms.health = message.Health
+	}
+	if message.RemoteConfigStatus != nil {
+		ms.remoteConfigStatus = message.RemoteConfigStatus
+	}
+	if message.EffectiveConfig != nil {
+		ms.effectiveConfig = message.EffectiveConfig
+	}
+	return &protobufs.ServerToAgent{InstanceUid: message.InstanceUid, RemoteConfig: ms.remoteConfig}
+}
+
+func (ms *mockOpAMPServer) getRemoteConfigStatus() *protobufs.RemoteConfigStatus {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return ms.remoteConfigStatus
+}
+
+func buildOpAMPServer(t *testing.T, ms *mockOpAMPServer) *httptest.Server {
+	handler, connContext, err := server.New(nil).Attach(server.Settings{
+		Callbacks: server.CallbacksStruct{
+			OnConnectingFunc: func(*http.Request) types.ConnectionResponse {
+				return types.ConnectionResponse{Accept: true, ConnectionCallbacks: ms}
+			},
+		},
+	})
+	assert.Nil(t, err)
+	opampServer := httptest.NewUnstartedServer(http.HandlerFunc(handler))
+	// The server looks up the connection of each request in its context
+	opampServer.Config.ConnContext = connContext
+	opampServer.Start()
+	return opampServer
+}
+
+func remoteConfigOf(body string, hash string) *protobufs.AgentRemoteConfig {
+	return &protobufs.AgentRemoteConfig{
+		Config: &protobufs.AgentConfigMap{
+			ConfigMap: map[string]*protobufs.AgentConfigFile{"": {Body: []byte(body), ContentType: "text/yaml"}},
+		},
+		ConfigHash: []byte(hash),
+	}
+}
+
+func buildOpAMPConfigRefresh(t *testing.T, endpoint string) (*configRefresh, *mockConfigListener) {
+	listener := &mockConfigListener{expectedIsUpdated: true}
+	cr := &configRefresh{
+		logger:          logger,
+		config:          buildValidConfig(),
+		localSettings:   buildValidLocalSettings(t),
+		stop:            make(chan bool),
+		configListeners: []configListener{listener},
+	}
+	var err error
+	cr.opamp, err = newOpAMPAgent(logger, &OpAMPConfig{Endpoint: endpoint, PollingIntervalSeconds: 1},
+		component.BuildInfo{Command: "otelcol-asserts", Version: "1.2.3"}, cr)
+	assert.Nil(t, err)
+	cr.opamp.client.(interface{ SetPollingInterval(time.Duration) }).SetPollingInterval(10 * time.Millisecond)
+	return cr, listener
+}
+
+// Reads the config in use while the OpAMP client may apply another
+func currentConfig(cr *configRefresh) *Config {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	return cr.config
+}
+
+func TestOpAMPAgentAppliesRemoteConfig(t *testing.T) {
+	ms := &mockOpAMPServer{remoteConfig: remoteConfigOf("sampling_latency_threshold_seconds: 0.75\n", "v1")}
+	opampServer := buildOpAMPServer(t, ms)
+	defer opampServer.Close()
+
+	cr, listener := buildOpAMPConfigRefresh(t, opampServer.URL+"/v1/opamp")
+	cr.startUpdates()
+	defer cr.stopUpdates()
+
+	assert.Eventually(t, func() bool {
+		status := ms.getRemoteConfigStatus()
+		return status != nil && status.Status == protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, listener.expectedOnUpdate)
+	assert.Equal(t, 0.75, currentConfig(cr).DefaultLatencyThreshold)
+	assert.Equal(t, activeConfigOpAMP, cr.getActiveSource())
+	assert.Equal(t, []byte("v1"), ms.getRemoteConfigStatus().LastRemoteConfigHash)
+
+	assert.Eventually(t, func() bool {
+		ms.mutex.Lock()
+		defer ms.mutex.Unlock()
+		return ms.effectiveConfig != nil && ms.description != nil && ms.health != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	assert.Contains(t, string(ms.effectiveConfig.ConfigMap.ConfigMap[""].Body), `"sampling_latency_threshold_seconds":0.75`)
+	assert.True(t, ms.health.Healthy)
+	attributes := map[string]string{}
+	for _, attribute := range append(ms.description.IdentifyingAttributes, ms.description.NonIdentifyingAttributes...) {
+		attributes[attribute.Key] = attribute.Value.GetStringValue()
+	}
+	assert.Equal(t, "otelcol-asserts", attributes["service.name"])
+	assert.Equal(t, "1.2.3", attributes["service.version"])
+	assert.Equal(t, cr.opamp.instanceUID, attributes["service.instance.id"])
+	assert.Len(t, attributes[opampEffectiveConfigHashAttribute], 64)
+}
+
+func TestOpAMPAgentRejectsInvalidRemoteConfig(t *testing.T) {
+	ms := &mockOpAMPServer{remoteConfig: remoteConfigOf("trace_rate_limit_per_service: 1\n", "v1")}
+	opampServer := buildOpAMPServer(t, ms)
+	defer opampServer.Close()
+
+	cr, listener := buildOpAMPConfigRefresh(t, opampServer.URL+"/v1/opamp")
+	cr.startUpdates()
+	defer cr.stopUpdates()
+
+	assert.Eventually(t, func() bool {
+		status := ms.getRemoteConfigStatus()
+		return status != nil && status.Status == protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, ms.getRemoteConfigStatus().ErrorMessage, "trace_rate_limit_per_service: 1 < ")
+	assert.False(t, listener.expectedOnUpdate)
+	assert.Equal(t, 100, currentConfig(cr).LimitPerService)
+	assert.Equal(t, "", cr.getActiveSource())
+
+	assert.Eventually(t, func() bool {
+		ms.mutex.Lock()
+		defer ms.mutex.Unlock()
+		return ms.health != nil && !ms.health.Healthy
+	}, 5*time.Second, 10*time.Millisecond)
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	assert.Contains(t, ms.health.LastError, "trace_rate_limit_per_service: 1 < ")
+}
+
+func TestOpAMPAgentAppliesRemoteConfigWithoutHash(t *testing.T) {
+	ms := &mockOpAMPServer{remoteConfig: remoteConfigOf("sampling_latency_threshold_seconds: 0.75\n", "")}
+	opampServer := buildOpAMPServer(t, ms)
+	defer opampServer.Close()
+
+	cr, listener := buildOpAMPConfigRefresh(t, opampServer.URL+"/v1/opamp")
+	cr.startUpdates()
+	defer cr.stopUpdates()
+
+	assert.Eventually(t, func() bool {
+		status := ms.getRemoteConfigStatus()
+		return status != nil && status.Status == protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, listener.expectedOnUpdate)
+	assert.Equal(t, 0.75, currentConfig(cr).DefaultLatencyThreshold)
+}
+
+func TestOpAMPAgentHealth(t *testing.T) {
+	agent := &opampAgent{logger: logger, client: client.NewHTTP(logger.Sugar())}
+	agent.setConnectError("connection refused")
+	health := agent.health()
+	assert.False(t, health.Healthy)
+	assert.Equal(t, "connection refused", health.LastError)
+
+	// The rejected remote config is reported before the connection error
+	agent.applyError = "invalid config"
+	assert.Equal(t, "invalid config", agent.health().LastError)
+
+	agent.applyError = ""
+	agent.setConnectError("")
+	assert.True(t, agent.health().Healthy)
+}
+
+func TestOpAMPEffectiveConfigRedactsHeaders(t *testing.T) {
+	config := buildValidConfig()
+	config.AssertsServer.Headers = map[string]string{"X-Api-Key": "secret"}
+	config.ConfigSource = &ConfigSourceConfig{
+		Type:  ConfigSourceOpAMP,
+		OpAMP: &OpAMPConfig{Endpoint: "wss://opamp:4320", Headers: map[string]string{"X-Agent-Token": "secret"}},
+	}
+	agent := &opampAgent{logger: logger, refresh: &configRefresh{logger: logger, config: config}}
+
+	body := agent.effectiveConfigBody()
+	assert.NotContains(t, string(body), "secret")
+	var settings configSettings
+	assert.Nil(t, json.Unmarshal(body, &settings))
+	server := settings["asserts_server"].(map[string]interface{})
+	assert.Equal(t, redactedValue, server["headers"].(map[string]interface{})["X-Api-Key"])
+	opamp := settings["config_source"].(map[string]interface{})["opamp"].(map[string]interface{})
+	assert.Equal(t, redactedValue, opamp["headers"].(map[string]interface{})["X-Agent-Token"])
+}
+
+func TestValidateOpAMPConfigSource(t *testing.T) {
+	source := &ConfigSourceConfig{Type: ConfigSourceOpAMP}
+	assert.NotNil(t, validateSection(source))
+
+	source.OpAMP = &OpAMPConfig{Endpoint: "wss://opamp.corp:4320/v1/opamp"}
+	assert.Nil(t, validateSection(source))
+
+	source.OpAMP.Endpoint = "tcp://opamp.corp:4320"
+	assert.NotNil(t, validateSection(source))
+
+	source.OpAMP = &OpAMPConfig{Endpoint: "http://opamp.corp:4320/v1/opamp", InstanceUID: "collector-0"}
+	err := validateSection(source)
+	assert.NotNil(t, err)
+	assert.Equal(t, "opamp.instance_uid: collector-0 is not a ULID", err.Error())
+}
@@ -0,0 +1,329 @@
+package assertsprocessor
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/zap"
+)
+
+const (
+	// The spans of a trace are forwarded to the replica that owns the trace, which makes the sampling decision
+	PeerSamplingModeForward = "forward"
+	// Every replica samples the spans it receives and broadcasts the ids of the traces it keeps, so that
+	// the other replicas keep the spans of those traces too
+	PeerSamplingModeBroadcast = "broadcast"
+
+	peerTracesPath      = "/v1/peer/traces"
+	peerDecisionsPath   = "/v1/peer/decisions"
+	peerMaxRequestBytes = 32 << 20
+	// The batches being forwarded at once. The batches beyond are sampled locally
+	peerMaxInflightForwards = 64
+)
+
+type PeerSamplingConfig struct {
+	// The endpoint at which the other replicas reach this replica, e.g. http://10.0.1.12:9467
+	Endpoint string `mapstructure:"endpoint" json:"endpoint"`
+	// The address on which this replica listens for its peers, e.g. :9467
+	ListenAddress string `mapstructure:"listen_address" json:"listen_address"`
+	// The endpoints of all the replicas, including this replica
+	Peers                 []string `mapstructure:"peers" json:"peers"`
+	Mode                  string   `mapstructure:"mode" json:"mode"`
+	RequestTimeoutSeconds int      `mapstructure:"request_timeout_seconds" json:"request_timeout_seconds"`
+	DecisionTTLSeconds    int      `mapstructure:"decision_ttl_seconds" json:"decision_ttl_seconds"`
+	// The token shared by the replicas, sent as a bearer token and required on the requests of the peers
+	Token string `mapstructure:"token" json:"token"`
+}
+
+func (pc *PeerSamplingConfig) validateAt(v *configValidator, path string) {
+	if pc.Mode != PeerSamplingModeForward && pc.Mode != PeerSamplingModeBroadcast {
+		v.addf(joinPath(path, "mode"), "invalid mode %q, expected %s or %s",
+			pc.Mode, PeerSamplingModeForward, PeerSamplingModeBroadcast)
+	}
+	if pc.Token == "" {
+		v.addf(joinPath(path, "token"), "not set, it is required to authenticate the peers")
+	}
+	for _, peer := range pc.Peers {
+		if peer == pc.Endpoint {
+			return
+		}
+	}
+	v.addf(joinPath(path, "endpoint"), "%q is not one of the peers", pc.Endpoint)
+}
+
+type peerDecisions struct {
+	Keep []string `json:"keep"`
+}
+
+// peerSampling lets the collector replicas behind a load balancer agree on the sampling decision of a
+// trace whose segments land on different replicas
+type peerSampling struct {
+	logger     *zap.Logger
+	config     *PeerSamplingConfig
+	httpClient *http.Client
+	httpServer *http.Server
+	listener   net.Listener
+	keptTraces *ttlcache.Cache[pcommon.TraceID, struct{}] // traces kept by the other replicas
+	inflight   chan struct{}                              // the forwards in progress
+	forwards   *sync.WaitGroup
+	// The largest request body accepted from a peer
+	maxRequestBytes int64
+	// Samples the traces that this replica owns
+	sampleTraces func(ctx context.Context, traces []*trace)
+}
+
+func newPeerSampling(logger *zap.Logger, config *PeerSamplingConfig,
+	sampleTraces func(ctx context.Context, traces []*trace)) *peerSampling {
+	timeout := time.Duration(config.RequestTimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ttl := time.Duration(config.DecisionTTLSeconds) * time.Second
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+	return &peerSampling{
+		logger:          logger,
+		config:          config,
+		httpClient:      &http.Client{Timeout: timeout},
+		keptTraces:      ttlcache.New[pcommon.TraceID, struct{}](ttlcache.WithTTL[pcommon.TraceID, struct{}](ttl)),
+		inflight:        make(chan struct{}, peerMaxInflightForwards),
+		forwards:        &sync.WaitGroup{},
+		sampleTraces:    sampleTraces,
+		maxRequestBytes: peerMaxRequestBytes,
+	}
+}
+
+// Returns the replica that owns the trace. Rendezvous hashing moves only the traces of a replica that
+// joins or leaves, and every replica with the same list of peers picks the same owner
+func (ps *peerSampling) owner(traceID pcommon.TraceID) string {
+	var owner string
+	var highest uint64
+	for _, peer := range ps.config.Peers {
+		hash := fnv.New64a()
+		_, _ = hash.Write(traceID[:])
+		_, _ = hash.Write([]byte(peer))
+		if weight := hash.Sum64(); owner == "" || weight > highest {
+			owner, highest = peer, weight
+		}
+	}
+	return owner
+}
+
+// Forwards the traces owned by the other replicas in the background and returns the traces to be sampled
+// by this replica. A trace that cannot be forwarded is sampled locally
+func (ps *peerSampling) forward(ctx context.Context, traces []*trace) []*trace {
+	if ps.config.Mode != PeerSamplingModeForward {
+		return traces
+	}
+	local := make([]*trace, 0, len(traces))
+	byOwner := map[string][]*trace{}
+	for _, tr := range traces {
+		traceID, found := tr.getTraceID()
+		owner := ps.owner(traceID)
+		if !found || owner == ps.config.Endpoint {
+			local = append(local, tr)
+		} else {
+			byOwner[owner] = append(byOwner[owner], tr)
+		}
+	}
+	for owner, owned := range byOwner {
+		// The spans are copied before returning, as the batch they arrived in is not ours to keep
+		batch := ptrace.NewTraces()
+		for _, tr := range owned {
+			buildTrace(tr).ResourceSpans().MoveAndAppendTo(batch.ResourceSpans())
+		}
+		select {
+		case ps.inflight <- struct{}{}:
+		default:
+			ps.logger.Warn("Too many traces being forwarded to peers. Sampling them locally",
+				zap.String("Peer", owner),
+				zap.Int("Traces", len(owned)),
+			)
+			local = append(local, owned...)
+			continue
+		}
+		ps.forwards.Add(1)
+		go func(owner string, batch ptrace.Traces, count int) {
+			defer ps.forwards.Done()
+			defer func() { <-ps.inflight }()
+			ps.send(detachedContext{ctx}, owner, batch, count)
+		}(owner, batch, len(owned))
+	}
+	return local
+}
+
+func (ps *peerSampling) send(ctx context.Context, peer string, batch ptrace.Traces, count int) {
+	marshaler := ptrace.ProtoMarshaler{}
+	body, err := marshaler.MarshalTraces(batch)
+	if err == nil {
+		err = ps.post(ctx, peer+peerTracesPath, "application/x-protobuf", body)
+	}
+	if err != nil {
+		ps.logger.Warn("Error forwarding traces to peer. Sampling them locally",
+			zap.String("Peer", peer),
+			zap.Int("Traces", count),
+			zap.Error(err),
+		)
+		ps.sampleTraces(ctx, convertToTraces(batch))
+	}
+}
+
+// Tells the other replicas about the traces kept by this replica
+func (ps *peerSampling) broadcastKept(traceIDs []pcommon.TraceID) {
+	if ps.config.Mode != PeerSamplingModeBroadcast || len(traceIDs) == 0 {
+		return
+	}
+	decisions := peerDecisions{Keep: make([]string, 0, len(traceIDs))}
+	for _, traceID := range traceIDs {
+		decisions.Keep = append(decisions.Keep, traceID.String())
+	}
+	body, err := json.Marshal(decisions)
+	if err != nil {
+		return
+	}
+	for _, peer := range ps.config.Peers {
+		if peer == ps.config.Endpoint {
+			continue
+		}
+		if err = ps.post(context.Background(), peer+peerDecisionsPath, "application/json", body); err != nil {
+			ps.logger.Warn("Error broadcasting sampling decisions to peer",
+				zap.String("Peer", peer),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+func (ps *peerSampling) post(ctx context.Context, url string, contentType string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+ps.config.Token)
+	response, err := ps.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, response.Body)
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer responded with status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// Returns true if another replica has kept the trace
+func (ps *peerSampling) isKept(traceID pcommon.TraceID) bool {
+	return ps.keptTraces.Get(traceID) != nil
+}
+
+func (ps *peerSampling) handler() http.Handler {
+	sm := http.NewServeMux()
+	sm.HandleFunc(peerTracesPath, ps.authenticated(ps.handleTraces))
+	sm.HandleFunc(peerDecisionsPath, ps.authenticated(ps.handleDecisions))
+	return sm
+}
+
+// Rejects the requests without the token of the peers, and limits the size of their bodies
+func (ps *peerSampling) authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	expected := []byte("Bearer " + ps.config.Token)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, ps.maxRequestBytes)
+		handler(w, r)
+	}
+}
+
+func (ps *peerSampling) handleTraces(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	unmarshaler := ptrace.ProtoUnmarshaler{}
+	traces, err := unmarshaler.UnmarshalTraces(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The sampled traces are queued beyond the request, so they keep its values but not its cancellation
+	ps.sampleTraces(detachedContext{r.Context()}, convertToTraces(traces))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (ps *peerSampling) handleDecisions(w http.ResponseWriter, r *http.Request) {
+	var decisions peerDecisions
+	if err := json.NewDecoder(r.Body).Decode(&decisions); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, encoded := range decisions.Keep {
+		var traceID pcommon.TraceID
+		decoded, err := hex.DecodeString(encoded)
+		if err != nil || len(decoded) != len(traceID) {
+			continue
+		}
+		copy(traceID[:], decoded)
+		ps.keptTraces.Set(traceID, struct{}{}, ttlcache.DefaultTTL)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (ps *peerSampling) start() error {
+	listener, err := net.Listen("tcp", ps.config.ListenAddress)
+	if err != nil {
+		return err
+	}
+	ps.listener = listener
+	ps.httpServer = &http.Server{
+		Handler:           ps.handler(),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	go ps.keptTraces.Start()
+	go func() {
+		if err := ps.httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			ps.logger.Error("Error serving peer sampling requests", zap.Error(err))
+		}
+	}()
+	ps.logger.Info("Listening for peer sampling requests", zap.String("Address", listener.Addr().String()))
+	return nil
+}
+
+func (ps *peerSampling) stop() error {
+	if ps.httpServer == nil {
+		return nil
+	}
+	ps.keptTraces.Stop()
+	err := ps.httpServer.Shutdown(context.Background())
+	ps.forwards.Wait()
+	return err
+}
+
+// A context with the values of its parent but without its deadline and cancellation
+type detachedContext struct {
+	parent context.Context
+}
+
+func (dc detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (dc detachedContext) Done() <-chan struct{}       { return nil }
+func (dc detachedContext) Err() error                  { return nil }
+func (dc detachedContext) Value(key any) any           { return dc.parent.Value(key) }
@@ -0,0 +1,240 @@
+package assertsprocessor
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/consumer/consumertest"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	conventions "go.opentelemetry.io/collector/semconv/v1.6.1"
+)
+
+func buildPeerTrace(traceID pcommon.TraceID) *trace {
+	batch := ptrace.NewTraces()
+	resourceSpans := batch.ResourceSpans().AppendEmpty()
+	resourceSpans.Resource().Attributes().PutStr(conventions.AttributeServiceName, "api-server")
+	rootSpan := resourceSpans.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+	rootSpan.SetTraceID(traceID)
+	rootSpan.SetSpanID([8]byte{1, 2, 3, 4, 5, 6, 7, 8})
+	rootSpan.SetName("GET /api-server")
+	return convertToTraces(batch)[0]
+}
+
+// A peer that records the traces forwarded to it
+type recordingPeer struct {
+	peers  *peerSampling
+	server *httptest.Server
+	traces []*trace
+	mutex  sync.Mutex
+}
+
+func newRecordingPeer(mode string) *recordingPeer {
+	peer := &recordingPeer{}
+	peer.peers = newPeerSampling(logger, &PeerSamplingConfig{Mode: mode, Token: "secret"}, func(ctx context.Context, traces []*trace) {
+		peer.mutex.Lock()
+		defer peer.mutex.Unlock()
+		peer.traces = append(peer.traces, traces...)
+	})
+	peer.server = httptest.NewServer(peer.peers.handler())
+	return peer
+}
+
+func (peer *recordingPeer) recorded() []*trace {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+	return append([]*trace{}, peer.traces...)
+}
+
+// Returns trace ids owned by each of the peers
+func traceIDsByOwner(ps *peerSampling) map[string][]pcommon.TraceID {
+	byOwner := map[string][]pcommon.TraceID{}
+	for i := 0; i < 64; i++ {
+		traceID := pcommon.TraceID([16]byte{byte(i), 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, byte(i)})
+		owner := ps.owner(traceID)
+		byOwner[owner] = append(byOwner[owner], traceID)
+	}
+	return byOwner
+}
+
+func TestPeerOwnerIsConsistent(t *testing.T) {
+	ps1 := newPeerSampling(logger, &PeerSamplingConfig{
+		Peers: []string{"http://collector-0:9467", "http://collector-1:9467", "http://collector-2:9467"},
+	}, nil)
+	ps2 := newPeerSampling(logger, &PeerSamplingConfig{
+		Peers: []string{"http://collector-2:9467", "http://collector-0:9467", "http://collector-1:9467"},
+	}, nil)
+
+	byOwner := traceIDsByOwner(ps1)
+	assert.Equal(t, 3, len(byOwner))
+	for owner, traceIDs := range byOwner {
+		for _, traceID := range traceIDs {
+			assert.Equal(t, owner, ps2.owner(traceID))
+		}
+	}
+}
+
+func TestPeerForward(t *testing.T) {
+	remote := newRecordingPeer(PeerSamplingModeForward)
+	defer remote.server.Close()
+
+	local := newPeerSampling(logger, &PeerSamplingConfig{
+		Endpoint: "http://localhost:1",
+		Peers:    []string{"http://localhost:1", remote.server.URL},
+		Mode:     PeerSamplingModeForward,
+		Token:    "secret",
+	}, nil)
+	byOwner := traceIDsByOwner(local)
+	ownedLocally := buildPeerTrace(byOwner["http://localhost:1"][0])
+	ownedRemotely := buildPeerTrace(byOwner[remote.server.URL][0])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sampleLocally := local.forward(ctx, []*trace{ownedLocally, ownedRemotely})
+	// The traces are forwarded after the batch is done with
+	cancel()
+	assert.Equal(t, []*trace{ownedLocally}, sampleLocally)
+
+	assert.Eventually(t, func() bool { return len(remote.recorded()) == 1 }, time.Second, time.Millisecond)
+	forwarded := remote.recorded()[0]
+	traceID, _ := forwarded.getTraceID()
+	assert.Equal(t, byOwner[remote.server.URL][0], traceID)
+	assert.Equal(t, "api-server", forwarded.segments[0].service)
+	assert.Equal(t, "GET /api-server", forwarded.segments[0].rootSpan.Name())
+	assert.Nil(t, local.stop())
+}
+
+func TestPeerForwardFailureSamplesLocally(t *testing.T) {
+	remote := newRecordingPeer(PeerSamplingModeForward)
+	remote.server.Close()
+
+	var sampledLocally []*trace
+	var mutex sync.Mutex
+	local := newPeerSampling(logger, &PeerSamplingConfig{
+		Endpoint: "http://localhost:1",
+		Peers:    []string{"http://localhost:1", remote.server.URL},
+		Mode:     PeerSamplingModeForward,
+		Token:    "secret",
+	}, func(ctx context.Context, traces []*trace) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sampledLocally = append(sampledLocally, traces...)
+	})
+	traceID := traceIDsByOwner(local)[remote.server.URL][0]
+
+	assert.Equal(t, 0, len(local.forward(context.Background(), []*trace{buildPeerTrace(traceID)})))
+	local.forwards.Wait()
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, 1, len(sampledLocally))
+	sampledTraceID, _ := sampledLocally[0].getTraceID()
+	assert.Equal(t, traceID, sampledTraceID)
+}
+
+func TestPeerForwardSamplesLocallyWhenBusy(t *testing.T) {
+	local := newPeerSampling(logger, &PeerSamplingConfig{
+		Endpoint: "http://localhost:1",
+		Peers:    []string{"http://localhost:1", "http://localhost:2"},
+		Mode:     PeerSamplingModeForward,
+		Token:    "secret",
+	}, nil)
+	for i := 0; i < peerMaxInflightForwards; i++ {
+		local.inflight <- struct{}{}
+	}
+	ownedRemotely := buildPeerTrace(traceIDsByOwner(local)["http://localhost:2"][0])
+
+	assert.Equal(t, []*trace{ownedRemotely}, local.forward(context.Background(), []*trace{ownedRemotely}))
+}
+
+func TestPeerRequestsAreAuthenticated(t *testing.T) {
+	remote := newRecordingPeer(PeerSamplingModeBroadcast)
+	defer remote.server.Close()
+	post := func(token string, body []byte) int {
+		req, _ := http.NewRequest(http.MethodPost, remote.server.URL+peerDecisionsPath, bytes.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		response, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		_ = response.Body.Close()
+		return response.StatusCode
+	}
+
+	body := []byte(`{"keep": ["0102030405060708090a0b0c0d0e0f10"]}`)
+	assert.Equal(t, http.StatusUnauthorized, post("", body))
+	assert.Equal(t, http.StatusUnauthorized, post("guess", body))
+	assert.Equal(t, http.StatusOK, post("secret", body))
+
+	remote.peers.maxRequestBytes = 16
+	assert.Equal(t, http.StatusBadRequest, post("secret", body))
+}
+
+func TestPeerBroadcastKept(t *testing.T) {
+	remote := newRecordingPeer(PeerSamplingModeBroadcast)
+	defer remote.server.Close()
+
+	local := newPeerSampling(logger, &PeerSamplingConfig{
+		Endpoint: "http://localhost:1",
+		Peers:    []string{"http://localhost:1", remote.server.URL},
+		Mode:     PeerSamplingModeBroadcast,
+		Token:    "secret",
+	}, nil)
+	kept := pcommon.TraceID([16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+	notKept := pcommon.TraceID([16]byte{16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1})
+
+	// Forwarding is a no-op in the broadcast mode
+	tr := buildPeerTrace(kept)
+	assert.Equal(t, []*trace{tr}, local.forward(context.Background(), []*trace{tr}))
+
+	local.broadcastKept([]pcommon.TraceID{kept})
+	assert.True(t, remote.peers.isKept(kept))
+	assert.False(t, remote.peers.isKept(notKept))
+	assert.False(t, local.isKept(kept))
+}
+
+func TestSamplerPassesOnTracesKeptByPeers(t *testing.T) {
+	sink := &consumertest.TracesSink{}
+	var s = sampler{
+		logger:             logger,
+		config:             &config,
+		thresholdHelper:    &th,
+		topTracesByService: &sync.Map{},
+		nextConsumer:       sink,
+		metrics:            buildMetrics(),
+		rwMutex:            &sync.RWMutex{},
+		peers: newPeerSampling(logger, &PeerSamplingConfig{
+			Endpoint: "http://localhost:1",
+			Peers:    []string{"http://localhost:1"},
+			Mode:     PeerSamplingModeBroadcast,
+		}, nil),
+	}
+	kept := pcommon.TraceID([16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+	s.peers.keptTraces.Set(kept, struct{}{}, 0)
+
+	s.sampleTraces(context.Background(), []*trace{buildPeerTrace(kept)})
+	assert.Equal(t, 1, sink.SpanCount())
+	assert.Equal(t, "GET /api-server", sink.AllTraces()[0].ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).Name())
+}
+
+func TestValidatePeerSampling(t *testing.T) {
+	peerConfig := &PeerSamplingConfig{
+		Endpoint: "http://collector-0:9467",
+		Peers:    []string{"http://collector-0:9467", "http://collector-1:9467"},
+		Mode:     "gossip",
+	}
+	assert.NotNil(t, validateSection(peerConfig))
+
+	peerConfig.Mode = PeerSamplingModeForward
+	assert.NotNil(t, validateSection(peerConfig))
+
+	peerConfig.Token = "secret"
+	assert.Nil(t, validateSection(peerConfig))
+
+	peerConfig.Endpoint = "http://collector-2:9467"
+	assert.NotNil(t, validateSection(peerConfig))
+}
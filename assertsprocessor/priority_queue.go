@@ -9,10 +9,13 @@ import (
 
 // An Item is something we manage in a latency queue.
 type Item struct {
-	trace      *trace // The value of the item; arbitrary.
-	ctx        *context.Context
-	latency    float64 // The latency of the item in the queue.
-	sampleType string  // The sample type (normal, slow or error) of the item in the queue
+	trace            *trace // The value of the item; arbitrary.
+	ctx              *context.Context
+	latency          float64 // The latency of the item in the queue.
+	latencyThreshold float64 // The latency threshold of the request when the item was queued.
+	score            float64 // The priority of the item in the queue, computed by the queue's traceScorer.
+	sampleType       string  // The sample type (normal, slow or error) of the item in the queue
+	size             int64   // The estimated size in bytes of the spans retained by the item
 	// The index is needed by update and is maintained by the heap.Interface methods.
 	index int // The index of the item in the heap.
 }
@@ -23,38 +26,77 @@ type PriorityQueue []*Item
 type TraceQueue struct {
 	priorityQueue PriorityQueue
 	maxSize       int
+	scorer        traceScorer
 	mutex         *sync.Mutex
 }
 
 func NewTraceQueue(maxSize int) *TraceQueue {
+	return newScoredTraceQueue(maxSize, latencyScorer)
+}
+
+func newScoredTraceQueue(maxSize int, scorer traceScorer) *TraceQueue {
 	traceQueue := TraceQueue{
 		priorityQueue: make(PriorityQueue, 0),
 		maxSize:       maxSize,
+		scorer:        scorer,
 		mutex:         &sync.Mutex{},
 	}
 	return &traceQueue
 }
 
-func (tq *TraceQueue) push(item *Item) {
+// Pushes the item into the queue. Returns the item that did not make it into the queue, which is
+// either the lowest priority item evicted to make room or the item itself. Returns nil if there was room
+func (tq *TraceQueue) push(item *Item) *Item {
 	tq.mutex.Lock()
 	defer tq.mutex.Unlock()
-	tq.pushUnsafe(item)
+	return tq.pushUnsafe(item)
 }
 
-func (tq *TraceQueue) pushUnsafe(item *Item) {
+func (tq *TraceQueue) pushUnsafe(item *Item) *Item {
+	item.score = tq.scorer(item)
 	// If limit reached, compare new item with
 	// existing item to see if it qualifies to be in the heap
 	if len(tq.priorityQueue) == tq.maxSize {
 		// Need to pop to compare
 		pop := heap.Pop(&tq.priorityQueue)
-		if pop.(*Item).latency > item.latency {
+		if pop.(*Item).score > item.score {
 			// If new item is lower priority, put the popped item back
 			// and return
 			heap.Push(&tq.priorityQueue, pop)
-			return
+			return item
 		}
+		heap.Push(&tq.priorityQueue, item)
+		return pop.(*Item)
 	}
 	heap.Push(&tq.priorityQueue, item)
+	return nil
+}
+
+func (tq *TraceQueue) size() int {
+	tq.mutex.Lock()
+	defer tq.mutex.Unlock()
+	return len(tq.priorityQueue)
+}
+
+// Returns the lowest priority item in the queue without removing it
+func (tq *TraceQueue) peek() *Item {
+	tq.mutex.Lock()
+	defer tq.mutex.Unlock()
+	if len(tq.priorityQueue) == 0 {
+		return nil
+	}
+	return tq.priorityQueue[0]
+}
+
+// Removes the item from the queue. Returns false if the item is no longer in the queue
+func (tq *TraceQueue) remove(item *Item) bool {
+	tq.mutex.Lock()
+	defer tq.mutex.Unlock()
+	if item.index < 0 || item.index >= len(tq.priorityQueue) || tq.priorityQueue[item.index] != item {
+		return false
+	}
+	heap.Remove(&tq.priorityQueue, item.index)
+	return true
 }
 
 func (tq *TraceQueue) pop() *Item {
@@ -68,8 +110,8 @@ func (tq *TraceQueue) pop() *Item {
 func (pq PriorityQueue) Len() int { return len(pq) }
 
 func (pq PriorityQueue) Less(i, j int) bool {
-	// We want Pop to give us the highest, not lowest, latency, so we use less than here.
-	return pq[i].latency < pq[j].latency
+	// Pop gives us the lowest score, which is the item to evict when the queue is full
+	return pq[i].score < pq[j].score
 }
 
 func (pq PriorityQueue) Swap(i, j int) {
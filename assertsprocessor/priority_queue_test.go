@@ -119,3 +119,32 @@ func TestRejection(t *testing.T) {
 	assert.Equal(t, &trace2, queueWrapper.priorityQueue[0].trace)
 	assert.Equal(t, 0.2, queueWrapper.priorityQueue[0].latency)
 }
+
+func TestPushReturnsDroppedItem(t *testing.T) {
+	queueWrapper := NewTraceQueue(1)
+
+	ctx := context.Background()
+	item1 := &Item{trace: &trace{}, ctx: &ctx, latency: 0.3}
+	item2 := &Item{trace: &trace{}, ctx: &ctx, latency: 0.2}
+	item3 := &Item{trace: &trace{}, ctx: &ctx, latency: 0.4}
+
+	assert.Nil(t, queueWrapper.push(item1))
+	assert.Equal(t, item2, queueWrapper.push(item2))
+	assert.Equal(t, item1, queueWrapper.push(item3))
+	assert.Equal(t, item3, queueWrapper.peek())
+}
+
+func TestRemove(t *testing.T) {
+	queueWrapper := NewTraceQueue(3)
+
+	ctx := context.Background()
+	item1 := &Item{trace: &trace{}, ctx: &ctx, latency: 0.3}
+	item2 := &Item{trace: &trace{}, ctx: &ctx, latency: 0.2}
+	queueWrapper.push(item1)
+	queueWrapper.push(item2)
+
+	assert.True(t, queueWrapper.remove(item2))
+	assert.False(t, queueWrapper.remove(item2))
+	assert.Equal(t, 1, len(queueWrapper.priorityQueue))
+	assert.Equal(t, item1, queueWrapper.peek())
+}
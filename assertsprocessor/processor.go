@@ -19,7 +19,13 @@ type assertsProcessorImpl struct {
 	metricBuilder *metricHelper
 	sampler       *sampler
 	configRefresh *configRefresh
-	rwMutex       *sync.RWMutex // guard access to config.CaptureMetrics
+	rwMutex       *sync.RWMutex // guard access to config.CaptureMetrics and config.SampleTraces
+	// Whether the processor and the sampler are started
+	started        bool
+	samplerStarted bool
+	// The config in use before the last update, to roll it back
+	previousCaptureMetrics bool
+	previousSampleTraces   bool
 }
 
 // Capabilities implements the consumer.Traces interface.
@@ -31,9 +37,24 @@ func (p *assertsProcessorImpl) Capabilities() consumer.Capabilities {
 // Start implements the component.Component interface.
 func (p *assertsProcessorImpl) Start(ctx context.Context, host component.Host) error {
 	p.logger.Info("consumer.Start callback")
+	// The auth extensions are started before the processors. When an auth extension authenticates the
+	// calls to Asserts, the config is fetched once the updates start below, and none is made before
+	if client, ok := p.configRefresh.restClient.(*assertsClient); ok {
+		if err := client.startAuthenticator(host); err != nil {
+			return err
+		}
+	}
+	if p.configRefresh.stream != nil {
+		if err := p.configRefresh.stream.startAuthenticator(host); err != nil {
+			return err
+		}
+	}
+	p.rwMutex.Lock()
+	p.started = true
 	if p.config.SampleTraces {
-		p.sampler.startProcessing()
+		p.startSampler()
 	}
+	p.rwMutex.Unlock()
 	p.configRefresh.startUpdates()
 	return nil
 }
@@ -41,9 +62,13 @@ func (p *assertsProcessorImpl) Start(ctx context.Context, host component.Host) e
 // Shutdown implements the component.Component interface
 func (p *assertsProcessorImpl) Shutdown(context.Context) error {
 	p.logger.Info("consumer.Shutdown")
-	if p.config.SampleTraces {
+	p.rwMutex.Lock()
+	if p.samplerStarted {
 		p.sampler.stopProcessing()
+		p.samplerStarted = false
 	}
+	p.started = false
+	p.rwMutex.Unlock()
 	p.configRefresh.stopUpdates()
 	return nil
 }
@@ -67,7 +92,7 @@ func (p *assertsProcessorImpl) consumeTraces(ctx context.Context, traces ptrace.
 			}
 		}
 	}
-	if p.config.SampleTraces {
+	if p.sampleTraces() {
 		p.sampler.sampleTraces(ctx, traceArray)
 	} else {
 		_ = p.nextConsumer.ConsumeTraces(ctx, traces)
@@ -82,6 +107,22 @@ func (p *assertsProcessorImpl) captureMetrics() bool {
 	return p.config.CaptureMetrics
 }
 
+func (p *assertsProcessorImpl) sampleTraces() bool {
+	p.rwMutex.RLock()
+	defer p.rwMutex.RUnlock()
+
+	return p.config.SampleTraces
+}
+
+// Starts the sampler the first time sampling is turned on. Once started, the sampler runs until the
+// processor is shut down, so that the samples already queued are flushed when sampling is turned off
+func (p *assertsProcessorImpl) startSampler() {
+	if p.started && !p.samplerStarted {
+		p.sampler.startProcessing()
+		p.samplerStarted = true
+	}
+}
+
 // configListener interface implementation
 func (p *assertsProcessorImpl) isUpdated(currConfig *Config, newConfig *Config) bool {
 	p.rwMutex.RLock()
@@ -96,16 +137,55 @@ func (p *assertsProcessorImpl) isUpdated(currConfig *Config, newConfig *Config)
 	} else {
 		p.logger.Debug("No change detected in config CaptureMetrics")
 	}
+	return p.isSampleTracesUpdated(currConfig, newConfig) || updated
+}
+
+func (p *assertsProcessorImpl) isSampleTracesUpdated(currConfig *Config, newConfig *Config) bool {
+	updated := currConfig.SampleTraces != newConfig.SampleTraces
+	if updated {
+		p.logger.Info("Change detected in config SampleTraces",
+			zap.Any("Current", currConfig.SampleTraces),
+			zap.Any("New", newConfig.SampleTraces),
+		)
+	} else {
+		p.logger.Debug("No change detected in config SampleTraces")
+	}
 	return updated
 }
 
+func (p *assertsProcessorImpl) prepareUpdate(_ *Config) error {
+	return nil
+}
+
 func (p *assertsProcessorImpl) onUpdate(newConfig *Config) error {
 	p.rwMutex.Lock()
 	defer p.rwMutex.Unlock()
 
-	p.config.CaptureMetrics = newConfig.CaptureMetrics
-	p.logger.Info("Updated config CaptureMetrics",
-		zap.Bool("New", p.config.CaptureMetrics),
+	p.previousCaptureMetrics = p.config.CaptureMetrics
+	p.previousSampleTraces = p.config.SampleTraces
+	p.applyConfig(newConfig.CaptureMetrics, newConfig.SampleTraces)
+	p.logger.Info("Updated config CaptureMetrics and SampleTraces",
+		zap.Bool("CaptureMetrics", p.config.CaptureMetrics),
+		zap.Bool("SampleTraces", p.config.SampleTraces),
 	)
 	return nil
 }
+
+func (p *assertsProcessorImpl) rollbackUpdate() {
+	p.rwMutex.Lock()
+	defer p.rwMutex.Unlock()
+
+	p.applyConfig(p.previousCaptureMetrics, p.previousSampleTraces)
+	p.logger.Info("Rolled back config CaptureMetrics and SampleTraces",
+		zap.Bool("CaptureMetrics", p.config.CaptureMetrics),
+		zap.Bool("SampleTraces", p.config.SampleTraces),
+	)
+}
+
+func (p *assertsProcessorImpl) applyConfig(captureMetrics bool, sampleTraces bool) {
+	p.config.CaptureMetrics = captureMetrics
+	p.config.SampleTraces = sampleTraces
+	if sampleTraces {
+		p.startSampler()
+	}
+}
@@ -18,7 +18,7 @@ import (
 var testConfig = Config{
 	Env:                            "dev",
 	Site:                           "us-west-2",
-	AssertsServer:                  &map[string]string{"endpoint": "http://localhost:8030"},
+	AssertsServer:                  &AssertsServerConfig{Endpoint: "http://localhost:8030"},
 	SampleTraces:                   true,
 	CaptureMetrics:                 true,
 	CaptureAttributesInMetric:      []string{"attribute"},
@@ -91,6 +91,7 @@ func TestConsumeTraces(t *testing.T) {
 			traceFlushTicker:   clock.FromContext(ctx).NewTicker(time.Minute),
 			thresholdHelper:    &_th,
 			metrics:            buildMetrics(),
+			rwMutex:            &sync.RWMutex{},
 		},
 		rwMutex: &sync.RWMutex{},
 	}
@@ -189,7 +190,7 @@ func createProcessor(cfg Config) assertsProcessorImpl {
 		entityKeys:          xsync.NewMapOf[EntityKeyDto](),
 		thresholds:          xsync.NewMapOf[map[string]*ThresholdDto](),
 		thresholdSyncTicker: clock.FromContext(ctx).NewTicker(time.Minute),
-		rc:                  &assertsClient{},
+		provider:            &assertsThresholdProvider{rc: &assertsClient{}},
 	}
 	configRefresh := configRefresh{
 		config:           &cfg,
@@ -211,7 +212,47 @@ func createProcessor(cfg Config) assertsProcessorImpl {
 			stop:               make(chan bool),
 			traceFlushTicker:   clock.FromContext(ctx).NewTicker(time.Minute),
 			thresholdHelper:    &_th,
+			rwMutex:            &sync.RWMutex{},
 		},
 		configRefresh: &configRefresh,
+		rwMutex:       &sync.RWMutex{},
 	}
 }
+
+func TestProcessorRollbackUpdate(t *testing.T) {
+	p := assertsProcessorImpl{
+		logger:  logger,
+		config:  &Config{CaptureMetrics: false},
+		rwMutex: &sync.RWMutex{},
+	}
+
+	assert.Nil(t, p.prepareUpdate(&Config{CaptureMetrics: true}))
+	assert.Nil(t, p.onUpdate(&Config{CaptureMetrics: true}))
+	assert.True(t, p.captureMetrics())
+	p.rollbackUpdate()
+	assert.False(t, p.captureMetrics())
+}
+
+func TestProcessorOnUpdateTurnsOnSampling(t *testing.T) {
+	ctx := context.Background()
+	samplingDisabled := testConfig
+	samplingDisabled.SampleTraces = false
+	p := createProcessor(samplingDisabled)
+	assert.Nil(t, p.Start(ctx, nil))
+	assert.False(t, p.samplerStarted)
+
+	newConfig := samplingDisabled
+	newConfig.SampleTraces = true
+	assert.True(t, p.isUpdated(p.config, &newConfig))
+	assert.Nil(t, p.onUpdate(&newConfig))
+	assert.True(t, p.sampleTraces())
+	assert.True(t, p.samplerStarted)
+
+	// The sampler keeps running to flush the queued samples
+	p.rollbackUpdate()
+	assert.False(t, p.sampleTraces())
+	assert.True(t, p.samplerStarted)
+
+	assert.Nil(t, p.Shutdown(ctx))
+	assert.False(t, p.samplerStarted)
+}
@@ -0,0 +1,254 @@
+package assertsprocessor
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/puzpuzpuz/xsync/v2"
+)
+
+type TraceRateLimit struct {
+	TracesPerSecond float64 `mapstructure:"traces_per_second" json:"traces_per_second"`
+	SpansPerSecond  float64 `mapstructure:"spans_per_second" json:"spans_per_second"`
+}
+
+// The per-tenant limiters, shared by the processors of the same asserts_tenant in the collector
+var tenantRateLimiters = xsync.NewMapOf[*traceRateLimiter]()
+
+// Sample types in the order in which they are allowed to use the rate limit
+var sampleTypesByPriority = []string{
+	AssertsTraceSampleTypeError, AssertsTraceSampleTypeSlow, AssertsTraceSampleTypeNormal,
+}
+
+type tokenBucket struct {
+	rate       float64 // tokens per second
+	capacity   float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+func newTokenBucket(rate float64, burstSeconds float64, now time.Time) *tokenBucket {
+	capacity := rate * math.Max(burstSeconds, 1)
+	return &tokenBucket{
+		rate:       rate,
+		capacity:   capacity,
+		tokens:     capacity,
+		lastRefill: now,
+	}
+}
+
+// Changes the rate and the burst of the bucket. The bucket keeps its tokens, up to the new capacity
+func (tb *tokenBucket) resize(rate float64, burstSeconds float64, now time.Time) {
+	tb.refill(now)
+	tb.rate = rate
+	tb.capacity = rate * math.Max(burstSeconds, 1)
+	tb.tokens = math.Min(tb.tokens, tb.capacity)
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(tb.lastRefill).Seconds()
+	if elapsed > 0 {
+		tb.tokens = math.Min(tb.capacity, tb.tokens+elapsed*tb.rate)
+		tb.lastRefill = now
+	}
+}
+
+// traceRateLimiter limits the number of traces and spans flushed per second. A nil bucket means no limit
+type traceRateLimiter struct {
+	traces *tokenBucket
+	spans  *tokenBucket
+	mutex  *sync.Mutex
+}
+
+func newTraceRateLimiter(limit *TraceRateLimit, burstSeconds float64, now time.Time) *traceRateLimiter {
+	limiter := &traceRateLimiter{mutex: &sync.Mutex{}}
+	limiter.update(limit, burstSeconds, now)
+	return limiter
+}
+
+// Applies the limit, keeping the tokens of the buckets that are still limited
+func (rl *traceRateLimiter) update(limit *TraceRateLimit, burstSeconds float64, now time.Time) {
+	rl.traces = updateTokenBucket(rl.traces, limit.TracesPerSecond, burstSeconds, now)
+	rl.spans = updateTokenBucket(rl.spans, limit.SpansPerSecond, burstSeconds, now)
+}
+
+func updateTokenBucket(tb *tokenBucket, rate float64, burstSeconds float64, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if tb == nil {
+		return newTokenBucket(rate, burstSeconds, now)
+	}
+	tb.resize(rate, burstSeconds, now)
+	return tb
+}
+
+// Changes the burst of the buckets, keeping their rates and tokens
+func (rl *traceRateLimiter) setBurstSeconds(burstSeconds float64, now time.Time) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	for _, tb := range []*tokenBucket{rl.traces, rl.spans} {
+		if tb != nil {
+			tb.resize(tb.rate, burstSeconds, now)
+		}
+	}
+}
+
+func (rl *traceRateLimiter) refill(now time.Time) {
+	if rl.traces != nil {
+		rl.traces.refill(now)
+	}
+	if rl.spans != nil {
+		rl.spans.refill(now)
+	}
+}
+
+func (rl *traceRateLimiter) canTake(spanCount int) bool {
+	return rl.hasTraceTokens() && (rl.spans == nil || rl.spans.tokens >= float64(spanCount))
+}
+
+func (rl *traceRateLimiter) take(spanCount int) {
+	if rl.traces != nil {
+		rl.traces.tokens -= 1
+	}
+	if rl.spans != nil {
+		rl.spans.tokens -= float64(spanCount)
+	}
+}
+
+func (rl *traceRateLimiter) hasTraceTokens() bool {
+	return rl.traces == nil || rl.traces.tokens >= 1
+}
+
+// The limiters that apply to the traces flushed by a processor instance, its own limiter and the limiter
+// of its tenant
+type traceRateLimiters []*traceRateLimiter
+
+func newTraceRateLimiters(config *Config, now time.Time) traceRateLimiters {
+	limiters := make(traceRateLimiters, 0)
+	burstSeconds := float64(config.TraceFlushFrequencySeconds)
+	if config.CollectorTraceRateLimit != nil {
+		limiters = append(limiters, newTraceRateLimiter(config.CollectorTraceRateLimit, burstSeconds, now))
+	}
+	if config.TenantTraceRateLimit != nil {
+		limiters = append(limiters, getTenantRateLimiter(config.AssertsTenant, config.TenantTraceRateLimit,
+			burstSeconds, now))
+	}
+	return limiters
+}
+
+// Returns the limiter shared by the processors of the tenant. A processor created later applies its limit
+// to the shared limiter, which keeps the tokens already used by the other processors
+func getTenantRateLimiter(tenant string, limit *TraceRateLimit, burstSeconds float64, now time.Time) *traceRateLimiter {
+	limiter, loaded := tenantRateLimiters.LoadOrCompute(tenant, func() *traceRateLimiter {
+		return newTraceRateLimiter(limit, burstSeconds, now)
+	})
+	if loaded {
+		limiter.mutex.Lock()
+		limiter.update(limit, burstSeconds, now)
+		limiter.mutex.Unlock()
+	}
+	return limiter
+}
+
+// Allows bursts of up to a flush worth of traces with a new flush frequency
+func (limiters traceRateLimiters) setBurstSeconds(burstSeconds float64, now time.Time) {
+	for _, limiter := range limiters {
+		limiter.setBurstSeconds(burstSeconds, now)
+	}
+}
+
+// The samples of a service that are ready to be flushed, grouped by sample type
+type serviceSamples struct {
+	entityKey string
+	byType    map[string][]*Item
+}
+
+func newServiceSamples(entityKey string) *serviceSamples {
+	return &serviceSamples{
+		entityKey: entityKey,
+		byType:    map[string][]*Item{},
+	}
+}
+
+func (ss *serviceSamples) add(item *Item) {
+	ss.byType[item.sampleType] = append(ss.byType[item.sampleType], item)
+}
+
+// Selects the samples that fit in the rate limits. Error samples are selected before slow samples, which in
+// turn are selected before normal samples. Within a sample type, the services take turns in picking their
+// highest priority sample so that a few busy services cannot use up the limit
+func (limiters traceRateLimiters) allocate(services []*serviceSamples, now time.Time) []*Item {
+	allowed := make([]*Item, 0)
+	if len(limiters) == 0 {
+		for _, ss := range services {
+			for _, sampleType := range sampleTypesByPriority {
+				allowed = append(allowed, ss.byType[sampleType]...)
+			}
+		}
+		return allowed
+	}
+
+	for _, limiter := range limiters {
+		limiter.mutex.Lock()
+		defer limiter.mutex.Unlock()
+		limiter.refill(now)
+	}
+	for _, sampleType := range sampleTypesByPriority {
+		candidates := make([][]*Item, 0, len(services))
+		for _, ss := range services {
+			items := append([]*Item{}, ss.byType[sampleType]...)
+			sort.SliceStable(items, func(i, j int) bool {
+				return items[i].score > items[j].score
+			})
+			candidates = append(candidates, items)
+		}
+		for turn := 0; ; turn++ {
+			pending := false
+			for _, items := range candidates {
+				if turn >= len(items) {
+					continue
+				}
+				pending = true
+				if !limiters.hasTraceTokens() {
+					return allowed
+				}
+				spanCount := items[turn].trace.getSpanCount()
+				if limiters.canTake(spanCount) {
+					limiters.take(spanCount)
+					allowed = append(allowed, items[turn])
+				}
+			}
+			if !pending {
+				break
+			}
+		}
+	}
+	return allowed
+}
+
+func (limiters traceRateLimiters) hasTraceTokens() bool {
+	for _, limiter := range limiters {
+		if !limiter.hasTraceTokens() {
+			return false
+		}
+	}
+	return true
+}
+
+func (limiters traceRateLimiters) canTake(spanCount int) bool {
+	for _, limiter := range limiters {
+		if !limiter.canTake(spanCount) {
+			return false
+		}
+	}
+	return true
+}
+
+func (limiters traceRateLimiters) take(spanCount int) {
+	for _, limiter := range limiters {
+		limiter.take(spanCount)
+	}
+}
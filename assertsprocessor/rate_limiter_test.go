@@ -0,0 +1,172 @@
+package assertsprocessor
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"testing"
+	"time"
+)
+
+func buildSample(sampleType string, score float64, spanCount int) *Item {
+	internalSpans := make([]*ptrace.Span, 0)
+	for i := 0; i < spanCount; i++ {
+		span := ptrace.NewSpan()
+		internalSpans = append(internalSpans, &span)
+	}
+	return &Item{
+		trace:      newTrace(&traceSegment{internalSpans: internalSpans}),
+		sampleType: sampleType,
+		score:      score,
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	now := time.Unix(1000, 0)
+	bucket := newTokenBucket(2, 5, now)
+	assert.Equal(t, float64(10), bucket.tokens)
+
+	bucket.tokens = 0
+	bucket.refill(now.Add(2 * time.Second))
+	assert.Equal(t, float64(4), bucket.tokens)
+
+	// Never more than the capacity
+	bucket.refill(now.Add(time.Minute))
+	assert.Equal(t, float64(10), bucket.tokens)
+}
+
+func TestAllocateWithoutLimits(t *testing.T) {
+	samples := newServiceSamples("api-server")
+	normal := buildSample(AssertsTraceSampleTypeNormal, 1, 1)
+	errorSample := buildSample(AssertsTraceSampleTypeError, 1, 1)
+	samples.add(normal)
+	samples.add(errorSample)
+
+	limiters := traceRateLimiters{}
+	assert.Equal(t, []*Item{errorSample, normal}, limiters.allocate([]*serviceSamples{samples}, time.Now()))
+}
+
+func TestAllocatePrioritisesErrors(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiters := traceRateLimiters{newTraceRateLimiter(&TraceRateLimit{TracesPerSecond: 2}, 1, now)}
+
+	samples := newServiceSamples("api-server")
+	normal := buildSample(AssertsTraceSampleTypeNormal, 10, 1)
+	slow := buildSample(AssertsTraceSampleTypeSlow, 5, 1)
+	errorSample := buildSample(AssertsTraceSampleTypeError, 1, 1)
+	samples.add(normal)
+	samples.add(slow)
+	samples.add(errorSample)
+
+	assert.Equal(t, []*Item{errorSample, slow}, limiters.allocate([]*serviceSamples{samples}, now))
+}
+
+func TestAllocateFairShareAcrossServices(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiters := traceRateLimiters{newTraceRateLimiter(&TraceRateLimit{TracesPerSecond: 3}, 1, now)}
+
+	busy := newServiceSamples("api-server")
+	busyItems := make([]*Item, 0)
+	for i := 0; i < 5; i++ {
+		item := buildSample(AssertsTraceSampleTypeError, float64(i), 1)
+		busyItems = append(busyItems, item)
+		busy.add(item)
+	}
+	quiet := newServiceSamples("payment")
+	quietItem := buildSample(AssertsTraceSampleTypeError, 0, 1)
+	quiet.add(quietItem)
+
+	allowed := limiters.allocate([]*serviceSamples{busy, quiet}, now)
+	assert.Equal(t, []*Item{busyItems[4], quietItem, busyItems[3]}, allowed)
+
+	// No tokens left until they are replenished
+	assert.Equal(t, 0, len(limiters.allocate([]*serviceSamples{quiet}, now)))
+	assert.Equal(t, 1, len(limiters.allocate([]*serviceSamples{quiet}, now.Add(time.Second/2))))
+}
+
+func TestAllocateSkipsTracesOverSpanLimit(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiters := traceRateLimiters{newTraceRateLimiter(&TraceRateLimit{SpansPerSecond: 10}, 1, now)}
+
+	samples := newServiceSamples("api-server")
+	large := buildSample(AssertsTraceSampleTypeSlow, 2, 12)
+	small := buildSample(AssertsTraceSampleTypeSlow, 1, 4)
+	samples.add(large)
+	samples.add(small)
+
+	assert.Equal(t, []*Item{small}, limiters.allocate([]*serviceSamples{samples}, now))
+}
+
+func TestAllocateAppliesAllLimiters(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiters := traceRateLimiters{
+		newTraceRateLimiter(&TraceRateLimit{TracesPerSecond: 10}, 1, now),
+		newTraceRateLimiter(&TraceRateLimit{TracesPerSecond: 1}, 1, now),
+	}
+
+	samples := newServiceSamples("api-server")
+	samples.add(buildSample(AssertsTraceSampleTypeSlow, 2, 1))
+	samples.add(buildSample(AssertsTraceSampleTypeSlow, 1, 1))
+
+	assert.Equal(t, 1, len(limiters.allocate([]*serviceSamples{samples}, now)))
+	assert.Equal(t, float64(9), limiters[0].traces.tokens)
+}
+
+func TestNewTraceRateLimitersPerProcessor(t *testing.T) {
+	now := time.Now()
+	cfg := &Config{
+		CollectorTraceRateLimit: &TraceRateLimit{TracesPerSecond: 100},
+	}
+	limiters1 := newTraceRateLimiters(cfg, now)
+	limiters2 := newTraceRateLimiters(&Config{CollectorTraceRateLimit: &TraceRateLimit{SpansPerSecond: 1000}}, now)
+
+	assert.Equal(t, 1, len(limiters1))
+	assert.NotNil(t, limiters1[0].traces)
+	assert.Nil(t, limiters1[0].spans)
+	// The limits of another processor do not change those of the first
+	assert.Nil(t, limiters2[0].traces)
+	assert.NotNil(t, limiters2[0].spans)
+	assert.NotNil(t, limiters1[0].traces)
+	assert.NotSame(t, limiters1[0], newTraceRateLimiters(cfg, now)[0])
+
+	assert.Equal(t, 0, len(newTraceRateLimiters(&Config{}, now)))
+}
+
+func TestNewTraceRateLimitersSharePerTenant(t *testing.T) {
+	now := time.Now()
+	cfg := &Config{
+		AssertsTenant:              "tenant-limiters",
+		TraceFlushFrequencySeconds: 10,
+		CollectorTraceRateLimit:    &TraceRateLimit{TracesPerSecond: 100},
+		TenantTraceRateLimit:       &TraceRateLimit{TracesPerSecond: 10},
+	}
+	limiters1 := newTraceRateLimiters(cfg, now)
+	assert.Equal(t, 2, len(limiters1))
+	limiters1[1].traces.tokens = 20
+
+	// The processors of the tenant share its limiter, which keeps its tokens when another processor is created
+	cfg.TenantTraceRateLimit = &TraceRateLimit{TracesPerSecond: 5, SpansPerSecond: 100}
+	limiters2 := newTraceRateLimiters(cfg, now)
+	assert.NotSame(t, limiters1[0], limiters2[0])
+	assert.Same(t, limiters1[1], limiters2[1])
+	assert.Equal(t, float64(5), limiters2[1].traces.rate)
+	assert.Equal(t, float64(20), limiters2[1].traces.tokens)
+	assert.Equal(t, float64(1000), limiters2[1].spans.tokens)
+
+	other := newTraceRateLimiters(&Config{AssertsTenant: "other", TenantTraceRateLimit: cfg.TenantTraceRateLimit}, now)
+	assert.NotSame(t, limiters1[1], other[0])
+}
+
+func TestTraceRateLimiterSetBurstSeconds(t *testing.T) {
+	now := time.Now()
+	limiter := newTraceRateLimiter(&TraceRateLimit{TracesPerSecond: 2}, 30, now)
+	limiter.traces.tokens = 50
+
+	limiter.setBurstSeconds(10, now)
+	assert.Equal(t, float64(20), limiter.traces.capacity)
+	assert.Equal(t, float64(20), limiter.traces.tokens)
+
+	limiter.traces.tokens = 5
+	limiter.setBurstSeconds(60, now)
+	assert.Equal(t, float64(120), limiter.traces.capacity)
+	assert.Equal(t, float64(5), limiter.traces.tokens)
+}
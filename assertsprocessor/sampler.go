@@ -3,8 +3,12 @@ package assertsprocessor
 import (
 	"context"
 	"github.com/jellydator/ttlcache/v3"
+	"go.opentelemetry.io/collector/pdata/pcommon"
 	"go.opentelemetry.io/collector/pdata/ptrace"
+	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/tilinna/clock"
 	"go.opentelemetry.io/collector/consumer"
@@ -16,11 +20,22 @@ const (
 	AssertsTraceSampleTypeNormal    = "normal"
 	AssertsTraceSampleTypeSlow      = "slow"
 	AssertsTraceSampleTypeError     = "error"
+	// The trace was kept by another collector replica
+	AssertsTraceSampleTypePeer = "peer"
+	// Set on the error spans whose errors are within the error rate threshold of their request
+	AssertsErrorExpectedAttribute = "asserts.error.expected"
 )
 
 type traceSampler struct {
 	slowQueue  *TraceQueue
 	errorQueue *TraceQueue
+	// The number of normal traces sampled by probability since the last flush
+	normalSampleCount atomic.Int32
+}
+
+// Counts a normal sample of the request. Returns false if the request has reached the limit
+func (tS *traceSampler) takeNormalSample(limit int) bool {
+	return int(tS.normalSampleCount.Add(1)) <= limit
 }
 
 func (tS *traceSampler) errorTraceCount() int {
@@ -37,95 +52,231 @@ type sampler struct {
 	thresholdHelper    *thresholdHelper
 	topTracesByService *sync.Map
 	traceFlushTicker   *clock.Ticker
-	nextConsumer       consumer.Traces
-	stop               chan bool
-	metrics            *metrics
-	rwMutex            *sync.RWMutex // guard access to config.IgnoreClientError
+	// Signals the flusher that the flush ticker was replaced
+	traceFlushReset chan struct{}
+	clock           clock.Clock
+	nextConsumer    consumer.Traces
+	stop            chan bool
+	metrics         *metrics
+	memoryBudget    *traceMemoryBudget
+	rateLimiters    traceRateLimiters
+	peers           *peerSampling
+	decidedTraces   *decidedTraces
+	priority        *tracePriority
+	rwMutex         *sync.RWMutex // guard access to the sampler settings of config
+	// The settings in use before the last update, to roll them back
+	previousSettings samplerSettings
 }
 
 func (s *sampler) startProcessing() {
 	s.thresholdHelper.startUpdates()
 	s.startTraceFlusher()
+	if s.decidedTraces != nil {
+		s.decidedTraces.start()
+	}
+	if s.peers != nil {
+		if err := s.peers.start(); err != nil {
+			s.logger.Error("Error listening for peer sampling requests", zap.Error(err))
+		}
+	}
 }
 
 func (s *sampler) stopProcessing() {
 	s.thresholdHelper.stopUpdates()
 	s.stopTraceFlusher()
+	if s.peers != nil {
+		_ = s.peers.stop()
+	}
+	if s.decidedTraces != nil {
+		s.decidedTraces.stop()
+	}
 }
 
 func (s *sampler) sampleTraces(ctx context.Context, traces []*trace) {
+	if s.peers != nil {
+		traces = s.peers.forward(ctx, traces)
+		traces = s.consumePeerKeptTraces(ctx, traces)
+	}
+	if s.decidedTraces != nil {
+		traces = s.consumeDecidedTraces(ctx, traces)
+	}
+	s.sampleLocalTraces(ctx, traces)
+}
+
+// Samples the traces owned by this replica
+func (s *sampler) sampleLocalTraces(ctx context.Context, traces []*trace) {
 	for _, tr := range traces {
-		sampled := false
-		for _, ts := range tr.segments {
-			if ts.getMainSpan() == nil {
-				continue
-			}
-			s.updateTrace(ts.namespace, ts.service, ts)
-			entityKeyString := ts.requestKey.entityKey.AsString()
-
-			// Get the trace queue for the entity and request
-			perService, _ := s.topTracesByService.LoadOrStore(entityKeyString, newServiceQueues(s.config))
-			request := ts.requestKey.request
-			requestState := perService.(*serviceQueues).getRequestState(request)
-			if requestState == nil {
-				s.logger.Warn("Too many requests in Entity. Dropping",
-					zap.String("Entity", entityKeyString),
-					zap.String("Request", request))
-				return
-			}
+		// Counted by the adjusted counts sampled upstream, before the threshold of a normal sample is recorded
+		s.metrics.incrTotalCounts(tr)
+		queue, item, ok := s.classifyTrace(ctx, tr)
+		// Queue the sample only after all its spans are tagged, as queueing copies the spans out of the batch
+		if queue != nil {
+			s.enqueue(queue, item)
+		}
+		if !ok {
+			return
+		}
+		if queue == nil && !s.captureNormalTraceSample(ctx, tr) {
+			s.recordDroppedTrace(tr)
+		}
+	}
+}
+
+// Passes on the traces kept by the other replicas and returns the remaining traces
+func (s *sampler) consumePeerKeptTraces(ctx context.Context, traces []*trace) []*trace {
+	remaining := make([]*trace, 0, len(traces))
+	for _, tr := range traces {
+		traceID, found := tr.getTraceID()
+		if !found || !s.peers.isKept(traceID) {
+			remaining = append(remaining, tr)
+			continue
+		}
+		s.metrics.incrTotalCounts(tr)
+		s.metrics.incrSampledCounts(tr, AssertsTraceSampleTypePeer)
+		_ = s.nextConsumer.ConsumeTraces(ctx, *buildTrace(tr))
+	}
+	return remaining
+}
+
+// Applies the earlier decisions of this collector to the spans of the traces that have already been kept or
+// dropped. Returns the traces that are yet to be decided
+func (s *sampler) consumeDecidedTraces(ctx context.Context, traces []*trace) []*trace {
+	undecided := make([]*trace, 0, len(traces))
+	for _, tr := range traces {
+		traceID, found := tr.getTraceID()
+		if !found {
+			undecided = append(undecided, tr)
+			continue
+		}
+		sampleType, decided := s.decidedTraces.lookup(traceID)
+		if !decided {
+			undecided = append(undecided, tr)
+			continue
+		}
+		s.metrics.incrTotalCounts(tr)
+		if sampleType == "" {
+			s.logger.Debug("Dropping late spans of a dropped trace", zap.String("traceId", traceID.String()))
+			continue
+		}
+		s.logger.Debug("Passing on late spans of a kept trace", zap.String("traceId", traceID.String()))
+		s.metrics.incrSampledCounts(tr, sampleType)
+		_ = s.nextConsumer.ConsumeTraces(ctx, *buildTrace(tr))
+	}
+	return undecided
+}
 
-			item := Item{
-				trace:   tr,
-				ctx:     &ctx,
-				latency: ts.latency,
+// Tags the error and slow spans of the trace and returns the queue into which the trace should be
+// sampled. Returns a nil queue if the trace is neither an error nor a slow trace. Returns false if the
+// request limit of a service is reached, in which case the remaining traces are not sampled
+func (s *sampler) classifyTrace(ctx context.Context, tr *trace) (*TraceQueue, *Item, bool) {
+	var queue *TraceQueue = nil
+	var queuedItem *Item = nil
+	for _, ts := range tr.segments {
+		if ts.getMainSpan() == nil {
+			continue
+		}
+		s.updateTrace(ts.namespace, ts.service, ts)
+		entityKeyString := ts.requestKey.entityKey.AsString()
+
+		// Get the trace queue for the entity and request
+		perService := s.getServiceQueues(ts)
+		request := ts.requestKey.request
+		requestState := perService.getRequestState(request)
+		if requestState == nil {
+			s.logger.Warn("Too many requests in Entity. Dropping",
+				zap.String("Entity", entityKeyString),
+				zap.String("Request", request))
+			return queue, queuedItem, false
+		}
+
+		item := s.newItem(ctx, tr, ts)
+		for _, span := range ts.getNonInternalSpans() {
+			s.thresholdHelper.observeSpan(ts.namespace, ts.service, span)
+			isError := spanHasError(span) && !s.ignoreErrorType(span)
+			// The expected errors are sampled at the normal cadence, tagged to tell them from the errors
+			// that the sampling missed
+			if isError && s.thresholdHelper.isErrorExpected(ts.namespace, ts.service, span) {
+				span.Attributes().PutBool(AssertsErrorExpectedAttribute, true)
+				isError = false
 			}
-			for _, span := range ts.getNonInternalSpans() {
-				if spanHasError(span) && !s.ignoreErrorType(span) {
-					s.logger.Debug("Capturing error trace",
-						zap.String("traceId", span.TraceID().String()),
-						zap.String("service", entityKeyString),
-						zap.String("request", request),
-						zap.Float64("latency", ts.latency))
-					span.Attributes().PutStr(AssertsTraceSampleTypeAttribute, AssertsTraceSampleTypeError)
-
-					if !sampled {
-						item.sampleType = AssertsTraceSampleTypeError
-						requestState.errorQueue.push(&item)
-						sampled = true
-					}
-				} else if s.spanIsSlow(span, ts) {
-					s.logger.Debug("Capturing slow trace",
-						zap.String("traceId", span.TraceID().String()),
-						zap.String("service", entityKeyString),
-						zap.String("request", request),
-						zap.Float64("latency", ts.latency))
-					span.Attributes().PutStr(AssertsTraceSampleTypeAttribute, AssertsTraceSampleTypeSlow)
-
-					if !sampled {
-						item.sampleType = AssertsTraceSampleTypeSlow
-						requestState.slowQueue.push(&item)
-						sampled = true
-					}
+			if isError {
+				s.logger.Debug("Capturing error trace",
+					zap.String("traceId", span.TraceID().String()),
+					zap.String("service", entityKeyString),
+					zap.String("request", request),
+					zap.Float64("latency", ts.latency))
+				span.Attributes().PutStr(AssertsTraceSampleTypeAttribute, AssertsTraceSampleTypeError)
+
+				if queue == nil {
+					item.sampleType = AssertsTraceSampleTypeError
+					queue, queuedItem = requestState.errorQueue, &item
+				}
+			} else if s.spanIsSlow(span, ts) {
+				s.logger.Debug("Capturing slow trace",
+					zap.String("traceId", span.TraceID().String()),
+					zap.String("service", entityKeyString),
+					zap.String("request", request),
+					zap.Float64("latency", ts.latency))
+				span.Attributes().PutStr(AssertsTraceSampleTypeAttribute, AssertsTraceSampleTypeSlow)
+
+				if queue == nil {
+					item.sampleType = AssertsTraceSampleTypeSlow
+					queue, queuedItem = requestState.slowQueue, &item
 				}
 			}
 		}
-		if !sampled {
-			sampled = s.captureNormalTraceSample(ctx, tr)
-		}
-		s.metrics.incrTotalCounts(tr)
+	}
+	return queue, queuedItem, true
+}
+
+// Copies the spans of the sampled trace out of the incoming batch and queues the trace. The traces that
+// do not make it into the queue, or are evicted from it, are recorded as dropped
+func (s *sampler) enqueue(queue *TraceQueue, item *Item) {
+	detached := item.trace.detach()
+	var dropped []*Item
+	if s.memoryBudget != nil {
+		dropped = s.memoryBudget.push(queue, item, detached)
+	} else if droppedItem := queue.push(item); droppedItem != nil {
+		dropped = []*Item{droppedItem}
+	}
+	for _, droppedItem := range dropped {
+		s.recordDropped(droppedItem)
+	}
+}
+
+func (s *sampler) recordDropped(item *Item) {
+	s.recordDroppedTrace(item.trace)
+}
+
+// Records the trace as dropped, so that its late spans are dropped too
+func (s *sampler) recordDroppedTrace(tr *trace) {
+	if s.decidedTraces == nil {
+		return
+	}
+	if traceID, found := tr.getTraceID(); found {
+		s.decidedTraces.drop(traceID)
 	}
 }
 
+// Returns the queue item of the trace segment. The latency threshold is only looked up for the composite score
+func (s *sampler) newItem(ctx context.Context, tr *trace, ts *traceSegment) Item {
+	item := Item{
+		trace:   tr,
+		ctx:     &ctx,
+		latency: ts.latency,
+	}
+	if s.priority.weighted() {
+		item.latencyThreshold = s.thresholdHelper.getSpanThreshold(ts.namespace, ts.service, ts.getMainSpan())
+	}
+	return item
+}
+
 func (s *sampler) captureNormalTraceSample(ctx context.Context, tr *trace) bool {
 	for _, ts := range tr.segments {
 		if ts.getMainSpan() == nil {
 			continue
 		}
-		item := Item{
-			trace:   tr,
-			ctx:     &ctx,
-			latency: ts.latency,
-		}
+		item := s.newItem(ctx, tr, ts)
 		if s.captureNormalSample(ts, &item) {
 			return true
 		}
@@ -138,13 +289,13 @@ func (s *sampler) captureNormalSample(ts *traceSegment, item *Item) bool {
 	// Capture healthy samples based on configured sampling rate
 	entityKeyString := ts.requestKey.entityKey.AsString()
 	request := ts.requestKey.request
-	entry, _ := s.topTracesByService.LoadOrStore(entityKeyString, newServiceQueues(s.config))
-	perService := entry.(*serviceQueues)
+	perService := s.getServiceQueues(ts)
+	limits := perService.getLimits()
 	requestState := perService.getRequestState(request)
-	samplingStates := perService.periodicSamplingStates
+	samplingStates := perService.getPeriodicSamplingStates()
 	samplingStateKV := samplingStates.Get(request)
 
-	if samplingStates.Len() < s.config.LimitPerService || samplingStateKV != nil {
+	if samplingStates.Len() < limits.LimitPerService || samplingStateKV != nil {
 		var samplingState *periodicSamplingState = nil
 		if samplingStateKV == nil {
 			samplingState = &periodicSamplingState{
@@ -159,7 +310,7 @@ func (s *sampler) captureNormalSample(ts *traceSegment, item *Item) bool {
 		} else {
 			samplingState = samplingStateKV.Value()
 		}
-		if samplingState.sample(s.config.NormalSamplingFrequencyMinutes) {
+		if requestState != nil && s.sampleNormalTrace(ts, item.trace, samplingState, requestState, limits) {
 			sampled = true
 			s.logger.Debug("Capturing normal trace",
 				zap.String("traceId", ts.getMainSpan().TraceID().String()),
@@ -170,7 +321,7 @@ func (s *sampler) captureNormalSample(ts *traceSegment, item *Item) bool {
 			// Capture request context as attribute and push to the latency queue to prioritize the healthy sample too
 			ts.getMainSpan().Attributes().PutStr(AssertsTraceSampleTypeAttribute, AssertsTraceSampleTypeNormal)
 			item.sampleType = AssertsTraceSampleTypeNormal
-			requestState.slowQueue.push(item)
+			s.enqueue(requestState.slowQueue, item)
 		}
 	} else {
 		s.logger.Warn("Too many request contexts. Normal traces won't be captured for",
@@ -181,6 +332,46 @@ func (s *sampler) captureNormalSample(ts *traceSegment, item *Item) bool {
 	return sampled
 }
 
+// Samples normal traces by the trace id when a sampling probability is configured, otherwise once every
+// few minutes per request context. The probabilistic samples of a request are limited to its per request
+// limit until the next flush. The threshold of a probabilistic sample is recorded in the tracestate
+func (s *sampler) sampleNormalTrace(ts *traceSegment, tr *trace, samplingState *periodicSamplingState,
+	requestState *traceSampler, limits serviceSamplingLimits) bool {
+	probability := s.normalSamplingProbability()
+	if probability <= 0 {
+		return samplingState.sample(limits.NormalSamplingFrequencyMinutes)
+	}
+	consistentSampler := newConsistentSampler(probability)
+	if !consistentSampler.sample(ts.getMainSpan()) || !requestState.takeNormalSample(limits.LimitPerRequestPerService) {
+		return false
+	}
+	for _, segment := range tr.segments {
+		consistentSampler.recordThreshold(segment.getAllSpans())
+	}
+	return true
+}
+
+func (s *sampler) normalSamplingProbability() float64 {
+	s.rwMutex.RLock()
+	defer s.rwMutex.RUnlock()
+
+	return s.config.NormalSamplingProbability
+}
+
+// Returns the queues of the segment's service, creating them with the service's sampling limits if needed
+func (s *sampler) getServiceQueues(ts *traceSegment) *serviceQueues {
+	entityKeyString := ts.requestKey.entityKey.AsString()
+	if entry, found := s.topTracesByService.Load(entityKeyString); found {
+		return entry.(*serviceQueues)
+	}
+	s.rwMutex.RLock()
+	defer s.rwMutex.RUnlock()
+	limits := s.config.getSamplingLimits(ts.namespace, ts.service)
+	entry, _ := s.topTracesByService.LoadOrStore(entityKeyString,
+		newServiceQueuesFor(s.config, ts.namespace, ts.service, limits, s.priority.score))
+	return entry.(*serviceQueues)
+}
+
 func (s *sampler) updateTrace(namespace string, service string, ts *traceSegment) {
 	entityKey := buildEntityKey(s.config, namespace, service)
 	attrValue, _ := ts.getMainSpan().Attributes().Get(AssertsRequestContextAttribute)
@@ -198,9 +389,7 @@ func (s *sampler) ignoreErrorType(span *ptrace.Span) bool {
 }
 
 func (s *sampler) spanIsSlow(span *ptrace.Span, ts *traceSegment) bool {
-	attrValue, _ := span.Attributes().Get(AssertsRequestContextAttribute)
-	request := attrValue.Str()
-	latencyThreshold := s.thresholdHelper.getThreshold(ts.namespace, ts.service, request)
+	latencyThreshold := s.thresholdHelper.getSpanThreshold(ts.namespace, ts.service, span)
 	latency := computeLatency(span)
 	if latency > latencyThreshold {
 		return true
@@ -219,62 +408,118 @@ func (s *sampler) startTraceFlusher() {
 			case <-s.stop:
 				s.logger.Info("Trace flush background routine stopped")
 				return
-			case <-s.traceFlushTicker.C:
-				s.topTracesByService.Range(func(key any, value any) bool {
-					var entityKey = key.(string)
-					var sq = value.(*serviceQueues)
-					var errorTraceCount = 0
-					var slowTraceCount = 0
-
-					sq.clearRequestStates().Range(func(key1 any, value1 any) bool {
-						var requestKey = key1.(string)
-						var _sampler = value1.(*traceSampler)
-
-						// Flush all the errors
-						if len(_sampler.errorQueue.priorityQueue) > 0 {
-							errorTraceCount += len(_sampler.errorQueue.priorityQueue)
-							s.logger.Debug("Flushing Error Traces for",
-								zap.String("Service", entityKey),
-								zap.String("Request", requestKey),
-								zap.Int("Count", len(_sampler.errorQueue.priorityQueue)))
-							for _, item := range _sampler.errorQueue.priorityQueue {
-								s.metrics.incrSampledCounts(item.trace, item.sampleType)
-								_ = (*s).nextConsumer.ConsumeTraces(*item.ctx, *buildTrace(item.trace))
-							}
-						}
-
-						// Flush all the isSlow traces
-						if len(_sampler.slowQueue.priorityQueue) > 0 {
-							slowTraceCount += len(_sampler.slowQueue.priorityQueue)
-							s.logger.Debug("Flushing Slow Traces for",
-								zap.String("Service", entityKey),
-								zap.String("Request", requestKey),
-								zap.Int("Count", len(_sampler.slowQueue.priorityQueue)))
-							for _, item := range _sampler.slowQueue.priorityQueue {
-								s.metrics.incrSampledCounts(item.trace, item.sampleType)
-								_ = (*s).nextConsumer.ConsumeTraces(*item.ctx, *buildTrace(item.trace))
-							}
-						}
-						return true
-					})
-					if errorTraceCount > 0 || slowTraceCount > 0 {
-						s.logger.Info("# of traces flushed for",
-							zap.String("Service", entityKey),
-							zap.Int("Error traces", errorTraceCount),
-							zap.Int("Slow traces", slowTraceCount),
-						)
-					} else {
-						s.logger.Info("No traces to flush for",
-							zap.String("Service", entityKey),
-						)
-					}
-					return true
-				})
+			case <-s.traceFlushReset:
+				s.logger.Info("Trace flush frequency updated")
+			case <-s.getTraceFlushTicker().C:
+				s.flushTraces()
 			}
 		}
 	}()
 }
 
+func (s *sampler) flushTraces() {
+	services := make([]*serviceSamples, 0)
+	flushedQueues := make([]*TraceQueue, 0)
+	s.topTracesByService.Range(func(key any, value any) bool {
+		var entityKey = key.(string)
+		var sq = value.(*serviceQueues)
+		var samples = newServiceSamples(entityKey)
+
+		sq.clearRequestStates().Range(func(key1 any, value1 any) bool {
+			var requestKey = key1.(string)
+			var _sampler = value1.(*traceSampler)
+
+			if len(_sampler.errorQueue.priorityQueue) > 0 {
+				s.logger.Debug("Flushing Error Traces for",
+					zap.String("Service", entityKey),
+					zap.String("Request", requestKey),
+					zap.Int("Count", len(_sampler.errorQueue.priorityQueue)))
+				for _, item := range _sampler.errorQueue.priorityQueue {
+					samples.add(item)
+				}
+			}
+
+			if len(_sampler.slowQueue.priorityQueue) > 0 {
+				s.logger.Debug("Flushing Slow Traces for",
+					zap.String("Service", entityKey),
+					zap.String("Request", requestKey),
+					zap.Int("Count", len(_sampler.slowQueue.priorityQueue)))
+				for _, item := range _sampler.slowQueue.priorityQueue {
+					samples.add(item)
+				}
+			}
+			flushedQueues = append(flushedQueues, _sampler.errorQueue, _sampler.slowQueue)
+			return true
+		})
+		services = append(services, samples)
+		return true
+	})
+
+	// Apply the rate limits across all the services
+	allowed := s.getRateLimiters().allocate(services, s.getClock().Now())
+	allowedSet := make(map[*Item]bool, len(allowed))
+	keptTraceIDs := make([]pcommon.TraceID, 0, len(allowed))
+	for _, item := range allowed {
+		allowedSet[item] = true
+		if traceID, found := item.trace.getTraceID(); found {
+			keptTraceIDs = append(keptTraceIDs, traceID)
+			if s.decidedTraces != nil {
+				s.decidedTraces.keep(traceID, item.sampleType)
+			}
+		}
+		item.recordScore()
+		s.metrics.incrSampledCounts(item.trace, item.sampleType)
+		_ = (*s).nextConsumer.ConsumeTraces(*item.ctx, *buildTrace(item.trace))
+	}
+	for _, queue := range flushedQueues {
+		s.releaseMemory(queue)
+	}
+	if s.peers != nil {
+		go s.peers.broadcastKept(keptTraceIDs)
+	}
+
+	for _, samples := range services {
+		var errorTraceCount = 0
+		var slowTraceCount = 0
+		var normalTraceCount = 0
+		var rateLimitedCount = 0
+		for sampleType, items := range samples.byType {
+			for _, item := range items {
+				if !allowedSet[item] {
+					s.recordDropped(item)
+					rateLimitedCount++
+					s.metrics.incrRateLimitedTraceCount(sampleType)
+				} else if sampleType == AssertsTraceSampleTypeError {
+					errorTraceCount++
+				} else if sampleType == AssertsTraceSampleTypeSlow {
+					slowTraceCount++
+				} else {
+					normalTraceCount++
+				}
+			}
+		}
+		if errorTraceCount > 0 || slowTraceCount > 0 || normalTraceCount > 0 || rateLimitedCount > 0 {
+			s.logger.Info("# of traces flushed for",
+				zap.String("Service", samples.entityKey),
+				zap.Int("Error traces", errorTraceCount),
+				zap.Int("Slow traces", slowTraceCount),
+				zap.Int("Normal traces", normalTraceCount),
+				zap.Int("Rate limited traces", rateLimitedCount),
+			)
+		} else {
+			s.logger.Info("No traces to flush for",
+				zap.String("Service", samples.entityKey),
+			)
+		}
+	}
+}
+
+func (s *sampler) releaseMemory(queue *TraceQueue) {
+	if s.memoryBudget != nil {
+		s.memoryBudget.release(queue)
+	}
+}
+
 func (s *sampler) ignoreClientErrors() bool {
 	s.rwMutex.RLock()
 	defer s.rwMutex.RUnlock()
@@ -282,30 +527,172 @@ func (s *sampler) ignoreClientErrors() bool {
 	return s.config.IgnoreClientErrors
 }
 
+// The settings of the sampler that a config update applies
+type samplerSettings struct {
+	IgnoreClientErrors             bool
+	LimitPerService                int
+	LimitPerRequestPerService      int
+	RequestContextCacheTTL         int
+	NormalSamplingFrequencyMinutes int
+	NormalSamplingProbability      float64
+	TraceFlushFrequencySeconds     int
+	ServiceOverrides               map[string]*ServiceSamplingOverride
+	TracePriorityWeights           *TracePriorityWeights
+}
+
+func samplerSettingsOf(config *Config) samplerSettings {
+	return samplerSettings{
+		IgnoreClientErrors:             config.IgnoreClientErrors,
+		LimitPerService:                config.LimitPerService,
+		LimitPerRequestPerService:      config.LimitPerRequestPerService,
+		RequestContextCacheTTL:         config.RequestContextCacheTTL,
+		NormalSamplingFrequencyMinutes: config.NormalSamplingFrequencyMinutes,
+		NormalSamplingProbability:      config.NormalSamplingProbability,
+		TraceFlushFrequencySeconds:     config.TraceFlushFrequencySeconds,
+		ServiceOverrides:               config.ServiceOverrides,
+		TracePriorityWeights:           config.TracePriorityWeights,
+	}
+}
+
+// Returns the settings with those of the new config. As with the latency histogram buckets, the limits,
+// frequencies, service overrides and priority weights that the new config does not set keep their current values
+func (settings samplerSettings) update(newConfig *Config) samplerSettings {
+	settings.IgnoreClientErrors = newConfig.IgnoreClientErrors
+	// A probability of 0 switches back to sampling once every few minutes
+	settings.NormalSamplingProbability = newConfig.NormalSamplingProbability
+	if newConfig.ServiceOverrides != nil {
+		settings.ServiceOverrides = newConfig.ServiceOverrides
+	}
+	if newConfig.TracePriorityWeights != nil {
+		settings.TracePriorityWeights = newConfig.TracePriorityWeights
+	}
+	if newConfig.LimitPerService > 0 {
+		settings.LimitPerService = newConfig.LimitPerService
+	}
+	if newConfig.LimitPerRequestPerService > 0 {
+		settings.LimitPerRequestPerService = newConfig.LimitPerRequestPerService
+	}
+	if newConfig.RequestContextCacheTTL > 0 {
+		settings.RequestContextCacheTTL = newConfig.RequestContextCacheTTL
+	}
+	if newConfig.NormalSamplingFrequencyMinutes > 0 {
+		settings.NormalSamplingFrequencyMinutes = newConfig.NormalSamplingFrequencyMinutes
+	}
+	if newConfig.TraceFlushFrequencySeconds > 0 {
+		settings.TraceFlushFrequencySeconds = newConfig.TraceFlushFrequencySeconds
+	}
+	return settings
+}
+
+func (settings samplerSettings) applyTo(config *Config) {
+	config.IgnoreClientErrors = settings.IgnoreClientErrors
+	config.LimitPerService = settings.LimitPerService
+	config.LimitPerRequestPerService = settings.LimitPerRequestPerService
+	config.RequestContextCacheTTL = settings.RequestContextCacheTTL
+	config.NormalSamplingFrequencyMinutes = settings.NormalSamplingFrequencyMinutes
+	config.NormalSamplingProbability = settings.NormalSamplingProbability
+	config.TraceFlushFrequencySeconds = settings.TraceFlushFrequencySeconds
+	config.ServiceOverrides = settings.ServiceOverrides
+	config.TracePriorityWeights = settings.TracePriorityWeights
+}
+
 // configListener interface implementation
 func (s *sampler) isUpdated(currConfig *Config, newConfig *Config) bool {
 	s.rwMutex.RLock()
 	defer s.rwMutex.RUnlock()
 
-	updated := currConfig.IgnoreClientErrors != newConfig.IgnoreClientErrors
+	current := samplerSettingsOf(currConfig)
+	latest := current.update(newConfig)
+	updated := !reflect.DeepEqual(current, latest)
 	if updated {
-		s.logger.Info("Change detected in config IgnoreClientErrors",
-			zap.Any("Current", currConfig.IgnoreClientErrors),
-			zap.Any("New", newConfig.IgnoreClientErrors),
+		s.logger.Info("Change detected in sampler config",
+			zap.Any("Current", current),
+			zap.Any("New", latest),
 		)
 	} else {
-		s.logger.Debug("No change detected in config IgnoreClientErrors")
+		s.logger.Debug("No change detected in sampler config")
 	}
 	return updated
 }
 
+// Checks the new limits and service overrides, along with the limits in use that they do not change
+func (s *sampler) prepareUpdate(newConfig *Config) error {
+	s.rwMutex.RLock()
+	candidate := *s.config
+	s.rwMutex.RUnlock()
+
+	samplerSettingsOf(&candidate).update(newConfig).applyTo(&candidate)
+	return candidate.validateSamplingLimits()
+}
+
 func (s *sampler) onUpdate(newConfig *Config) error {
 	s.rwMutex.Lock()
 	defer s.rwMutex.Unlock()
 
-	s.config.IgnoreClientErrors = newConfig.IgnoreClientErrors
-	s.logger.Info("Updated config IgnoreClientErrors",
-		zap.Bool("New", s.config.IgnoreClientErrors),
-	)
+	s.previousSettings = samplerSettingsOf(s.config)
+	s.applyConfig(s.previousSettings.update(newConfig))
+	s.logger.Info("Updated sampler config", zap.Any("Settings", samplerSettingsOf(s.config)))
 	return nil
 }
+
+func (s *sampler) rollbackUpdate() {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	s.applyConfig(s.previousSettings)
+	s.logger.Info("Rolled back sampler config", zap.Any("Settings", samplerSettingsOf(s.config)))
+}
+
+func (s *sampler) applyConfig(settings samplerSettings) {
+	flushFrequencyUpdated := s.config.TraceFlushFrequencySeconds != settings.TraceFlushFrequencySeconds
+	settings.applyTo(s.config)
+	if s.priority != nil {
+		// The queued traces keep their scores, the new traces are scored with the new weights
+		s.priority.setWeights(s.config.TracePriorityWeights)
+	}
+	// Apply the limits and overrides to the services already being sampled
+	s.topTracesByService.Range(func(key any, value any) bool {
+		sq := value.(*serviceQueues)
+		sq.setLimits(s.config.getSamplingLimits(sq.namespace, sq.service))
+		sq.setRequestContextTTL(time.Minute * time.Duration(s.config.RequestContextCacheTTL))
+		return true
+	})
+	if flushFrequencyUpdated {
+		s.resetTraceFlushTicker()
+	}
+}
+
+// Replaces the flush ticker with one of the configured frequency. The rate limiters allow bursts of up
+// to a flush worth of traces, so they are updated as well
+func (s *sampler) resetTraceFlushTicker() {
+	if s.traceFlushTicker != nil {
+		s.traceFlushTicker.Stop()
+	}
+	flushClock := s.getClock()
+	s.traceFlushTicker = flushClock.NewTicker(time.Duration(s.config.TraceFlushFrequencySeconds) * time.Second)
+	s.rateLimiters.setBurstSeconds(float64(s.config.TraceFlushFrequencySeconds), flushClock.Now())
+	// Wakes up the flusher, which waits on the previous ticker
+	select {
+	case s.traceFlushReset <- struct{}{}:
+	default:
+	}
+}
+
+func (s *sampler) getClock() clock.Clock {
+	if s.clock == nil {
+		return clock.Realtime()
+	}
+	return s.clock
+}
+
+func (s *sampler) getTraceFlushTicker() *clock.Ticker {
+	s.rwMutex.RLock()
+	defer s.rwMutex.RUnlock()
+	return s.traceFlushTicker
+}
+
+func (s *sampler) getRateLimiters() traceRateLimiters {
+	s.rwMutex.RLock()
+	defer s.rwMutex.RUnlock()
+	return s.rateLimiters
+}
@@ -9,8 +9,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/tilinna/clock"
+	"go.opentelemetry.io/collector/consumer/consumertest"
 	"go.opentelemetry.io/collector/pdata/ptrace"
 	conventions "go.opentelemetry.io/collector/semconv/v1.6.1"
 	"go.uber.org/zap"
@@ -20,7 +22,7 @@ var logger, _ = zap.NewProduction()
 var config = Config{
 	Env:                        "dev",
 	Site:                       "us-west-2",
-	AssertsServer:              &map[string]string{"endpoint": "http://localhost:8030"},
+	AssertsServer:              &AssertsServerConfig{Endpoint: "http://localhost:8030"},
 	DefaultLatencyThreshold:    0.5,
 	LimitPerService:            2,
 	LimitPerRequestPerService:  5,
@@ -451,6 +453,95 @@ func TestSampleNormalTrace(t *testing.T) {
 	})
 }
 
+func TestSampleNormalTraceByProbability(t *testing.T) {
+	cfg := config
+	cfg.NormalSamplingProbability = 0.5
+	var s = sampler{
+		logger:             logger,
+		config:             &cfg,
+		thresholdHelper:    &th,
+		topTracesByService: &sync.Map{},
+		metrics:            buildMetrics(),
+		rwMutex:            &sync.RWMutex{},
+	}
+
+	buildNormalTrace := func(traceID [16]byte) *trace {
+		testTrace := ptrace.NewTraces()
+		resourceSpans := testTrace.ResourceSpans().AppendEmpty()
+		rootSpan := resourceSpans.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+		rootSpan.SetTraceID(traceID)
+		rootSpan.Attributes().PutStr(AssertsRequestContextAttribute, "/api-server/v4/rules")
+		rootSpan.SetStartTimestamp(1e9)
+		rootSpan.SetEndTimestamp(1e9 + 4e8)
+		return newTrace(&traceSegment{
+			resourceSpans: &resourceSpans,
+			namespace:     "platform",
+			service:       "api-server",
+			rootSpan:      &rootSpan,
+		})
+	}
+
+	ctx := context.Background()
+	sampled := buildNormalTrace([16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0xc0, 0, 0, 0, 0, 0, 0})
+	dropped := buildNormalTrace([16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0x40, 0, 0, 0, 0, 0, 0})
+	s.sampleTraces(ctx, []*trace{dropped, sampled})
+
+	value, _ := s.topTracesByService.Load("{env=dev, namespace=platform, site=us-west-2}#Service#api-server")
+	requestState := value.(*serviceQueues).getRequestState("/api-server/v4/rules")
+	assert.Equal(t, 1, requestState.slowTraceCount())
+	item := requestState.slowQueue.priorityQueue[0]
+	assert.Equal(t, sampled, item.trace)
+	assert.Equal(t, "ot=th:8", item.trace.segments[0].rootSpan.TraceState().AsRaw())
+	assert.Equal(t, "", dropped.segments[0].rootSpan.TraceState().AsRaw())
+	// The traces not sampled upstream are counted once each, not by the threshold of the kept sample
+	traceCount := s.metrics.totalTraceCount.With(map[string]string{envLabel: "dev", siteLabel: "us-west-2"})
+	assert.Equal(t, 2.0, testutil.ToFloat64(traceCount))
+}
+
+func TestSampleNormalTraceByProbabilityLimitedPerRequest(t *testing.T) {
+	cfg := config
+	cfg.NormalSamplingProbability = 0.5
+	cfg.LimitPerRequestPerService = 1
+	var s = sampler{
+		logger:             logger,
+		config:             &cfg,
+		thresholdHelper:    &th,
+		topTracesByService: &sync.Map{},
+		metrics:            buildMetrics(),
+		rwMutex:            &sync.RWMutex{},
+	}
+
+	buildNormalTrace := func(randomness byte) *trace {
+		testTrace := ptrace.NewTraces()
+		resourceSpans := testTrace.ResourceSpans().AppendEmpty()
+		rootSpan := resourceSpans.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+		rootSpan.SetTraceID([16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, randomness, 0, 0, 0, 0, 0, 0})
+		rootSpan.Attributes().PutStr(AssertsRequestContextAttribute, "/api-server/v4/rules")
+		rootSpan.SetStartTimestamp(1e9)
+		rootSpan.SetEndTimestamp(1e9 + 4e8)
+		return newTrace(&traceSegment{
+			resourceSpans: &resourceSpans,
+			namespace:     "platform",
+			service:       "api-server",
+			rootSpan:      &rootSpan,
+		})
+	}
+
+	first, second := buildNormalTrace(0xc0), buildNormalTrace(0xd0)
+	s.sampleTraces(context.Background(), []*trace{first, second})
+
+	assert.Equal(t, "ot=th:8", first.segments[0].rootSpan.TraceState().AsRaw())
+	// The second trace is over the per request limit
+	assert.Equal(t, "", second.segments[0].rootSpan.TraceState().AsRaw())
+	value, _ := s.topTracesByService.Load("{env=dev, namespace=platform, site=us-west-2}#Service#api-server")
+	requestState := value.(*serviceQueues).getRequestState("/api-server/v4/rules")
+	assert.Equal(t, first, requestState.slowQueue.priorityQueue[0].trace)
+
+	// A config update switches back to sampling once every few minutes
+	assert.Nil(t, s.onUpdate(&Config{}))
+	assert.Equal(t, 0.0, s.normalSamplingProbability())
+}
+
 func TestWithNoRootTrace(t *testing.T) {
 	var s = sampler{
 		logger:             logger,
@@ -509,11 +600,12 @@ func TestTraceCardinalityLimit(t *testing.T) {
 	serviceQueue := value.(*serviceQueues)
 	assert.Equal(t, 1, serviceQueue.requestCount)
 
-	rootSpan.Attributes().PutStr(AssertsRequestContextAttribute, "/api-server/v2/rules")
+	// The queued trace refers to a copy of the spans, which is detached from the incoming batch
+	tr.segments[0].rootSpan.Attributes().PutStr(AssertsRequestContextAttribute, "/api-server/v2/rules")
 	s.sampleTraces(ctx, []*trace{tr})
 	assert.Equal(t, 2, serviceQueue.requestCount)
 
-	rootSpan.Attributes().PutStr(AssertsRequestContextAttribute, "/api-server/v3/rules")
+	tr.segments[0].rootSpan.Attributes().PutStr(AssertsRequestContextAttribute, "/api-server/v3/rules")
 	s.sampleTraces(ctx, []*trace{tr})
 	assert.Equal(t, 2, serviceQueue.requestCount)
 }
@@ -521,16 +613,15 @@ func TestTraceCardinalityLimit(t *testing.T) {
 func TestFlushTraces(t *testing.T) {
 	cache := sync.Map{}
 	ctx := context.Background()
-	dConsumer := dummyConsumer{
-		items: make([]*Item, 0),
-	}
+	sink := &consumertest.TracesSink{}
+	mockClock := clock.NewMock(time.Now())
 	var s = sampler{
 		logger:             logger,
 		config:             &config,
 		thresholdHelper:    &th,
 		topTracesByService: &cache,
-		traceFlushTicker:   clock.FromContext(ctx).NewTicker(time.Millisecond),
-		nextConsumer:       dConsumer,
+		traceFlushTicker:   mockClock.NewTicker(time.Minute),
+		nextConsumer:       sink,
 		stop:               make(chan bool, 5),
 		metrics:            buildMetrics(),
 		rwMutex:            &sync.RWMutex{},
@@ -627,8 +718,10 @@ func TestFlushTraces(t *testing.T) {
 	assert.Equal(t, []string{"/api-server/v4/rules"}, requests)
 
 	serviceNames = make([]string, 0)
-	go func() { s.startTraceFlusher() }()
-	time.Sleep(2 * time.Millisecond)
+	s.startTraceFlusher()
+	mockClock.Add(time.Minute)
+	// The request states are cleared before the traces are flushed
+	assert.Eventually(t, func() bool { return sink.SpanCount() == 3 }, time.Second, time.Millisecond)
 	s.topTracesByService.Range(func(key any, value any) bool {
 		stringKey := key.(string)
 		serviceNames = append(serviceNames, key.(string))
@@ -642,7 +735,6 @@ func TestFlushTraces(t *testing.T) {
 	assert.Equal(t, []string{"{env=dev, namespace=platform, site=us-west-2}#Service#api-server"}, serviceNames)
 	assert.Equal(t, []string{"/api-server/v4/rules"}, requests)
 	s.stopProcessing()
-	time.Sleep(1 * time.Millisecond)
 }
 
 func buildMetrics() *metrics {
@@ -700,14 +792,264 @@ func TestSamplerOnUpdate(t *testing.T) {
 		IgnoreClientErrors: true,
 	}
 
+	var s = sampler{
+		logger:             logger,
+		config:             currConfig,
+		topTracesByService: &sync.Map{},
+		rwMutex:            &sync.RWMutex{},
+	}
+
+	assert.False(t, s.ignoreClientErrors())
+	err := s.onUpdate(newConfig)
+	assert.Nil(t, err)
+	assert.True(t, s.ignoreClientErrors())
+}
+
+func TestSamplerIsUpdatedServiceOverrides(t *testing.T) {
+	limit := 10
+	currConfig := &Config{}
+	newConfig := &Config{
+		ServiceOverrides: map[string]*ServiceSamplingOverride{
+			"platform#payment": {LimitPerService: &limit},
+		},
+	}
+
 	var s = sampler{
 		logger:  logger,
 		config:  currConfig,
 		rwMutex: &sync.RWMutex{},
 	}
+	assert.False(t, s.isUpdated(newConfig, newConfig))
+	assert.True(t, s.isUpdated(currConfig, newConfig))
+	// A config without overrides keeps the current ones, an empty set clears them
+	assert.False(t, s.isUpdated(newConfig, currConfig))
+	assert.True(t, s.isUpdated(newConfig, &Config{ServiceOverrides: map[string]*ServiceSamplingOverride{}}))
+}
 
-	assert.False(t, s.ignoreClientErrors())
-	err := s.onUpdate(newConfig)
+func TestSamplerOnUpdateAppliesServiceOverrides(t *testing.T) {
+	currConfig := &Config{
+		LimitPerService:                2,
+		LimitPerRequestPerService:      2,
+		NormalSamplingFrequencyMinutes: 5,
+		RequestContextCacheTTL:         60,
+	}
+	var s = sampler{
+		logger:             logger,
+		config:             currConfig,
+		topTracesByService: &sync.Map{},
+		rwMutex:            &sync.RWMutex{},
+	}
+
+	payment := &traceSegment{
+		namespace:  "platform",
+		service:    "payment",
+		requestKey: &RequestKey{entityKey: buildEntityKey(currConfig, "platform", "payment")},
+	}
+	cart := &traceSegment{
+		namespace:  "platform",
+		service:    "cart",
+		requestKey: &RequestKey{entityKey: buildEntityKey(currConfig, "platform", "cart")},
+	}
+	paymentQueues := s.getServiceQueues(payment)
+	cartQueues := s.getServiceQueues(cart)
+	assert.Equal(t, 2, paymentQueues.getLimits().LimitPerService)
+
+	limitPerService, frequency := 20, 1
+	err := s.onUpdate(&Config{
+		ServiceOverrides: map[string]*ServiceSamplingOverride{
+			"platform#payment": {LimitPerService: &limitPerService, NormalSamplingFrequencyMinutes: &frequency},
+		},
+	})
 	assert.Nil(t, err)
+	assert.Same(t, paymentQueues, s.getServiceQueues(payment))
+	assert.Equal(t, serviceSamplingLimits{
+		LimitPerService:                20,
+		LimitPerRequestPerService:      2,
+		NormalSamplingFrequencyMinutes: 1,
+	}, paymentQueues.getLimits())
+	assert.Equal(t, serviceSamplingLimits{
+		LimitPerService:                2,
+		LimitPerRequestPerService:      2,
+		NormalSamplingFrequencyMinutes: 5,
+	}, cartQueues.getLimits())
+
+	// A remote config without overrides keeps them
+	assert.Nil(t, s.onUpdate(&Config{}))
+	assert.Equal(t, 20, paymentQueues.getLimits().LimitPerService)
+
+	assert.Nil(t, s.onUpdate(&Config{ServiceOverrides: map[string]*ServiceSamplingOverride{}}))
+	assert.Equal(t, 2, paymentQueues.getLimits().LimitPerService)
+}
+
+func TestFlushTracesRateLimited(t *testing.T) {
+	now := time.Now()
+	sink := &consumertest.TracesSink{}
+	var s = sampler{
+		clock:              clock.NewMock(now),
+		logger:             logger,
+		config:             &config,
+		thresholdHelper:    &th,
+		topTracesByService: &sync.Map{},
+		nextConsumer:       sink,
+		metrics:            buildMetrics(),
+		rateLimiters:       traceRateLimiters{newTraceRateLimiter(&TraceRateLimit{TracesPerSecond: 1}, 1, now)},
+		rwMutex:            &sync.RWMutex{},
+	}
+
+	ctx := context.Background()
+	sq := newServiceQueues(&config)
+	requestState := sq.getRequestState("/api-server/v4/rules")
+	slowSample := buildSample(AssertsTraceSampleTypeSlow, 2, 1)
+	slowSample.ctx = &ctx
+	errorSample := buildSample(AssertsTraceSampleTypeError, 1, 1)
+	errorSample.ctx = &ctx
+	errorSample.trace.segments[0].internalSpans[0].SetName("ErrorSpan")
+	requestState.slowQueue.push(slowSample)
+	requestState.errorQueue.push(errorSample)
+	s.topTracesByService.Store("api-server", sq)
+
+	s.flushTraces()
+
+	assert.Equal(t, 1, len(sink.AllTraces()))
+	assert.Equal(t, 0, sq.requestCount)
+	// Error samples are flushed before slow samples
+	assert.Equal(t, "ErrorSpan", sink.AllTraces()[0].ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).Name())
+	// No time passed on the clock of the sampler, so no token was refilled
+	assert.Equal(t, float64(0), s.rateLimiters[0].traces.tokens)
+}
+
+func TestSamplerPrepareAndRollbackUpdate(t *testing.T) {
+	currConfig := &Config{
+		LimitPerService:           10,
+		LimitPerRequestPerService: 2,
+	}
+	var s = sampler{
+		logger:             logger,
+		config:             currConfig,
+		topTracesByService: &sync.Map{},
+		rwMutex:            &sync.RWMutex{},
+	}
+
+	// The override is checked against the limits in use
+	tooLow := 1
+	assert.NotNil(t, s.prepareUpdate(&Config{
+		ServiceOverrides: map[string]*ServiceSamplingOverride{"platform#payment": {LimitPerService: &tooLow}},
+	}))
+
+	limit := 20
+	newConfig := &Config{
+		IgnoreClientErrors: true,
+		ServiceOverrides:   map[string]*ServiceSamplingOverride{"platform#payment": {LimitPerService: &limit}},
+	}
+	assert.Nil(t, s.prepareUpdate(newConfig))
+	assert.Nil(t, s.onUpdate(newConfig))
 	assert.True(t, s.ignoreClientErrors())
+	assert.Equal(t, 20, currConfig.getSamplingLimits("platform", "payment").LimitPerService)
+
+	s.rollbackUpdate()
+	assert.False(t, s.ignoreClientErrors())
+	assert.Equal(t, 10, currConfig.getSamplingLimits("platform", "payment").LimitPerService)
+}
+
+func TestSamplerOnUpdateAppliesPriorityWeights(t *testing.T) {
+	currConfig := &Config{
+		LimitPerService:           2,
+		LimitPerRequestPerService: 2,
+		RequestContextCacheTTL:    60,
+	}
+	var s = sampler{
+		logger:             logger,
+		config:             currConfig,
+		topTracesByService: &sync.Map{},
+		priority:           newTracePriority(currConfig),
+		rwMutex:            &sync.RWMutex{},
+	}
+	payment := &traceSegment{
+		namespace:  "platform",
+		service:    "payment",
+		requestKey: &RequestKey{entityKey: buildEntityKey(currConfig, "platform", "payment"), request: "/pay"},
+	}
+	queue := s.getServiceQueues(payment).getRequestState("/pay").slowQueue
+	item := &Item{trace: newTrace(payment), latency: 3, latencyThreshold: 2}
+	assert.Equal(t, 3.0, queue.scorer(item))
+
+	newConfig := &Config{TracePriorityWeights: &TracePriorityWeights{Latency: 1, Segments: 0.5}}
+	assert.True(t, s.isUpdated(currConfig, newConfig))
+	assert.Nil(t, s.onUpdate(newConfig))
+	// The queues already created score with the new weights
+	assert.Equal(t, 2.0, queue.scorer(item))
+
+	// A config without weights keeps them
+	assert.False(t, s.isUpdated(currConfig, &Config{}))
+	s.rollbackUpdate()
+	assert.Equal(t, 3.0, queue.scorer(item))
+}
+
+func TestSamplerOnUpdateAppliesLimitsAndFlushFrequency(t *testing.T) {
+	currConfig := &Config{
+		LimitPerService:                10,
+		LimitPerRequestPerService:      2,
+		NormalSamplingFrequencyMinutes: 5,
+		RequestContextCacheTTL:         60,
+		TraceFlushFrequencySeconds:     30,
+		CollectorTraceRateLimit:        &TraceRateLimit{TracesPerSecond: 1},
+	}
+	mockClock := clock.NewMock(time.Now())
+	flushTicker := mockClock.NewTicker(time.Minute)
+	limiters := newTraceRateLimiters(currConfig, mockClock.Now())
+	limiters[0].traces.tokens = 5
+	var s = sampler{
+		logger:             logger,
+		config:             currConfig,
+		topTracesByService: &sync.Map{},
+		traceFlushTicker:   flushTicker,
+		traceFlushReset:    make(chan struct{}, 1),
+		clock:              mockClock,
+		rateLimiters:       limiters,
+		rwMutex:            &sync.RWMutex{},
+	}
+	payment := &traceSegment{
+		namespace:  "platform",
+		service:    "payment",
+		requestKey: &RequestKey{entityKey: buildEntityKey(currConfig, "platform", "payment")},
+	}
+	paymentQueues := s.getServiceQueues(payment)
+
+	// The limits must allow the per request limit
+	assert.NotNil(t, s.prepareUpdate(&Config{LimitPerService: 1}))
+
+	newConfig := &Config{
+		LimitPerService:                20,
+		LimitPerRequestPerService:      4,
+		NormalSamplingFrequencyMinutes: 1,
+		RequestContextCacheTTL:         30,
+		TraceFlushFrequencySeconds:     10,
+	}
+	assert.True(t, s.isUpdated(currConfig, newConfig))
+	assert.Nil(t, s.prepareUpdate(newConfig))
+	assert.Nil(t, s.onUpdate(newConfig))
+	assert.Equal(t, serviceSamplingLimits{
+		LimitPerService:                20,
+		LimitPerRequestPerService:      4,
+		NormalSamplingFrequencyMinutes: 1,
+	}, paymentQueues.getLimits())
+	assert.Equal(t, 30, currConfig.RequestContextCacheTTL)
+	assert.NotSame(t, flushTicker, s.getTraceFlushTicker())
+	assert.Equal(t, 1, len(s.traceFlushReset))
+	// The rate limiter keeps its tokens, and allows bursts of the new flush frequency
+	assert.Same(t, limiters[0], s.getRateLimiters()[0])
+	assert.Equal(t, float64(5), limiters[0].traces.tokens)
+	assert.Equal(t, float64(10), limiters[0].traces.capacity)
+
+	// The limits that are not set are kept
+	assert.False(t, s.isUpdated(currConfig, &Config{}))
+
+	s.rollbackUpdate()
+	assert.Equal(t, serviceSamplingLimits{
+		LimitPerService:                10,
+		LimitPerRequestPerService:      2,
+		NormalSamplingFrequencyMinutes: 5,
+	}, paymentQueues.getLimits())
+	assert.Equal(t, 30, currConfig.TraceFlushFrequencySeconds)
+	s.getTraceFlushTicker().Stop()
 }
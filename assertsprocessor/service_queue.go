@@ -7,8 +7,48 @@ import (
 	"time"
 )
 
+// The sampling limits that apply to a service, after applying the service's overrides
+type serviceSamplingLimits struct {
+	LimitPerService                int `json:"trace_rate_limit_per_service"`
+	LimitPerRequestPerService      int `json:"trace_rate_limit_per_service_per_request"`
+	NormalSamplingFrequencyMinutes int `json:"normal_trace_sampling_rate_minutes"`
+}
+
+// Resolves the sampling limits of a service, applying the override keyed by its service key if any, namespace#service
+// or the service name of a service without a namespace
+func (config *Config) getSamplingLimits(namespace string, service string) serviceSamplingLimits {
+	limits := serviceSamplingLimits{
+		LimitPerService:                config.LimitPerService,
+		LimitPerRequestPerService:      config.LimitPerRequestPerService,
+		NormalSamplingFrequencyMinutes: config.NormalSamplingFrequencyMinutes,
+	}
+	return limits.override(config.ServiceOverrides[getServiceKey(namespace, service)])
+}
+
+// Returns the limits with the ones set by the override
+func (limits serviceSamplingLimits) override(override *ServiceSamplingOverride) serviceSamplingLimits {
+	if override == nil {
+		return limits
+	}
+	if override.LimitPerService != nil {
+		limits.LimitPerService = *override.LimitPerService
+	}
+	if override.LimitPerRequestPerService != nil {
+		limits.LimitPerRequestPerService = *override.LimitPerRequestPerService
+	}
+	if override.NormalSamplingFrequencyMinutes != nil {
+		limits.NormalSamplingFrequencyMinutes = *override.NormalSamplingFrequencyMinutes
+	}
+	return limits
+}
+
 type serviceQueues struct {
 	config                 *Config
+	namespace              string
+	service                string
+	limits                 serviceSamplingLimits
+	scorer                 traceScorer
+	requestContextTTL      time.Duration
 	requestStates          *sync.Map
 	periodicSamplingStates *ttlcache.Cache[string, *periodicSamplingState] // limit cardinality of request contexts for which traces are captured
 	requestCount           int
@@ -16,15 +56,74 @@ type serviceQueues struct {
 }
 
 func newServiceQueues(config *Config) *serviceQueues {
+	return newServiceQueuesFor(config, "", "", config.getSamplingLimits("", ""), latencyScorer)
+}
+
+func newServiceQueuesFor(config *Config, namespace string, service string, limits serviceSamplingLimits,
+	scorer traceScorer) *serviceQueues {
+	requestContextTTL := time.Minute * time.Duration(config.RequestContextCacheTTL)
 	return &serviceQueues{
-		config:        config,
-		requestStates: &sync.Map{},
-		periodicSamplingStates: ttlcache.New[string, *periodicSamplingState](
-			ttlcache.WithTTL[string, *periodicSamplingState](time.Minute*time.Duration(config.RequestContextCacheTTL)),
-			ttlcache.WithCapacity[string, *periodicSamplingState](uint64(config.LimitPerService)),
-		),
-		rwMutex: &sync.RWMutex{},
+		config:                 config,
+		namespace:              namespace,
+		service:                service,
+		limits:                 limits,
+		scorer:                 scorer,
+		requestContextTTL:      requestContextTTL,
+		requestStates:          &sync.Map{},
+		periodicSamplingStates: newPeriodicSamplingStates(requestContextTTL, limits.LimitPerService),
+		rwMutex:                &sync.RWMutex{},
+	}
+}
+
+func newPeriodicSamplingStates(ttl time.Duration, limitPerService int) *ttlcache.Cache[string, *periodicSamplingState] {
+	return ttlcache.New[string, *periodicSamplingState](
+		ttlcache.WithTTL[string, *periodicSamplingState](ttl),
+		ttlcache.WithCapacity[string, *periodicSamplingState](uint64(limitPerService)),
+	)
+}
+
+func (sq *serviceQueues) getLimits() serviceSamplingLimits {
+	sq.rwMutex.RLock()
+	defer sq.rwMutex.RUnlock()
+	return sq.limits
+}
+
+func (sq *serviceQueues) getPeriodicSamplingStates() *ttlcache.Cache[string, *periodicSamplingState] {
+	sq.rwMutex.RLock()
+	defer sq.rwMutex.RUnlock()
+	return sq.periodicSamplingStates
+}
+
+// Applies new limits to the service. The request queues pick up the per request limit when they are
+// recreated after the next flush. The known request contexts are retained up to the new limit
+func (sq *serviceQueues) setLimits(limits serviceSamplingLimits) {
+	sq.rwMutex.Lock()
+	defer sq.rwMutex.Unlock()
+	if sq.limits.LimitPerService != limits.LimitPerService {
+		sq.resizePeriodicSamplingStates(sq.requestContextTTL, limits.LimitPerService)
+	}
+	sq.limits = limits
+}
+
+// Applies a new expiry to the known request contexts, which are retained
+func (sq *serviceQueues) setRequestContextTTL(ttl time.Duration) {
+	sq.rwMutex.Lock()
+	defer sq.rwMutex.Unlock()
+	if sq.requestContextTTL != ttl {
+		sq.resizePeriodicSamplingStates(ttl, sq.limits.LimitPerService)
+		sq.requestContextTTL = ttl
+	}
+}
+
+func (sq *serviceQueues) resizePeriodicSamplingStates(ttl time.Duration, limitPerService int) {
+	resized := newPeriodicSamplingStates(ttl, limitPerService)
+	for request, item := range sq.periodicSamplingStates.Items() {
+		if resized.Len() >= limitPerService {
+			break
+		}
+		resized.Set(request, item.Value(), ttlcache.DefaultTTL)
 	}
+	sq.periodicSamplingStates = resized
 }
 
 func (sq *serviceQueues) clearRequestStates() *sync.Map {
@@ -54,11 +153,11 @@ func (sq *serviceQueues) getRequestState(request string) *traceSampler {
 			return entry.(*traceSampler)
 		}
 		currentSize := sq.requestCount
-		if currentSize < sq.config.LimitPerService {
-			perRequestLimit := int(math.Min(5, float64(sq.config.LimitPerRequestPerService)))
+		if currentSize < sq.limits.LimitPerService {
+			perRequestLimit := int(math.Min(5, float64(sq.limits.LimitPerRequestPerService)))
 			result = &traceSampler{
-				slowQueue:  NewTraceQueue(perRequestLimit),
-				errorQueue: NewTraceQueue(perRequestLimit),
+				slowQueue:  newScoredTraceQueue(perRequestLimit, sq.scorer),
+				errorQueue: newScoredTraceQueue(perRequestLimit, sq.scorer),
 			}
 			sq.requestStates.Store(request, result)
 			sq.requestCount = sq.requestCount + 1
@@ -70,6 +169,7 @@ func (sq *serviceQueues) getRequestState(request string) *traceSampler {
 func (sq *serviceQueues) hasRoom() bool {
 	sq.rwMutex.RLock()
 	currentSize := sq.requestCount
+	limit := sq.limits.LimitPerService
 	sq.rwMutex.RUnlock()
-	return currentSize < sq.config.LimitPerService
+	return currentSize < limit
 }
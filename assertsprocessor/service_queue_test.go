@@ -2,7 +2,9 @@ package assertsprocessor
 
 import (
 	"testing"
+	"time"
 
+	"github.com/jellydator/ttlcache/v3"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -80,3 +82,76 @@ func TestNewServiceQueues_Limit_Two(t *testing.T) {
 	assert.NotNil(t, queue)
 	assert.Equal(t, 2, sq.requestCount)
 }
+
+func TestGetSamplingLimits(t *testing.T) {
+	serviceLimit, requestLimit, frequency := 50, 10, 1
+	var testConfig = &Config{
+		LimitPerService:                5,
+		LimitPerRequestPerService:      2,
+		NormalSamplingFrequencyMinutes: 5,
+		ServiceOverrides: map[string]*ServiceSamplingOverride{
+			"platform#payment": {LimitPerService: &serviceLimit, LimitPerRequestPerService: &requestLimit},
+			"batch#cron":       {NormalSamplingFrequencyMinutes: &frequency},
+			"worker":           {LimitPerService: &serviceLimit},
+		},
+	}
+
+	assert.Equal(t, serviceSamplingLimits{
+		LimitPerService:                50,
+		LimitPerRequestPerService:      10,
+		NormalSamplingFrequencyMinutes: 5,
+	}, testConfig.getSamplingLimits("platform", "payment"))
+	assert.Equal(t, serviceSamplingLimits{
+		LimitPerService:                5,
+		LimitPerRequestPerService:      2,
+		NormalSamplingFrequencyMinutes: 1,
+	}, testConfig.getSamplingLimits("batch", "cron"))
+	defaultLimits := serviceSamplingLimits{
+		LimitPerService:                5,
+		LimitPerRequestPerService:      2,
+		NormalSamplingFrequencyMinutes: 5,
+	}
+	assert.Equal(t, defaultLimits, testConfig.getSamplingLimits("platform", "cart"))
+	assert.Equal(t, defaultLimits, testConfig.getSamplingLimits("batch", "report"))
+	// The overrides are keyed by the service key, the service name for a service without a namespace
+	assert.Equal(t, defaultLimits, testConfig.getSamplingLimits("", "payment"))
+	assert.Equal(t, 50, testConfig.getSamplingLimits("", "worker").LimitPerService)
+	assert.Equal(t, defaultLimits, testConfig.getSamplingLimits("batch", "worker"))
+}
+
+func TestServiceQueuesSetLimits(t *testing.T) {
+	var testConfig = &Config{
+		LimitPerService:           3,
+		LimitPerRequestPerService: 5,
+		RequestContextCacheTTL:    60,
+	}
+	var sq = newServiceQueues(testConfig)
+	for _, request := range []string{"/request1", "/request2", "/request3"} {
+		assert.NotNil(t, sq.getRequestState(request))
+		sq.getPeriodicSamplingStates().Set(request, &periodicSamplingState{}, ttlcache.DefaultTTL)
+	}
+	assert.Nil(t, sq.getRequestState("/request4"))
+
+	sq.setLimits(serviceSamplingLimits{LimitPerService: 2, LimitPerRequestPerService: 1})
+	assert.Equal(t, 2, sq.getPeriodicSamplingStates().Len())
+
+	sq.setLimits(serviceSamplingLimits{LimitPerService: 4, LimitPerRequestPerService: 1})
+	assert.Equal(t, 2, sq.getPeriodicSamplingStates().Len())
+	queue := sq.getRequestState("/request4")
+	assert.NotNil(t, queue)
+	assert.Equal(t, 1, queue.slowQueue.maxSize)
+}
+
+func TestServiceQueuesSetRequestContextTTL(t *testing.T) {
+	var sq = newServiceQueues(&Config{
+		LimitPerService:           3,
+		LimitPerRequestPerService: 1,
+		RequestContextCacheTTL:    60,
+	})
+	sq.getPeriodicSamplingStates().Set("/request1", &periodicSamplingState{}, ttlcache.DefaultTTL)
+
+	sq.setRequestContextTTL(30 * time.Minute)
+	states := sq.getPeriodicSamplingStates()
+	assert.Equal(t, 1, states.Len())
+	assert.Equal(t, 30*time.Minute, states.Get("/request1").TTL())
+}
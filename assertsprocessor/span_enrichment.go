@@ -24,7 +24,9 @@ type spanEnrichmentProcessor interface {
 type spanEnrichmentProcessorImpl struct {
 	logger           *zap.Logger
 	customAttributes map[string]map[string][]*customAttributeConfigCompiled
-	configRWMutex    sync.RWMutex
+	// The attributes in use before the last update, to roll it back
+	previousAttributes map[string]map[string][]*customAttributeConfigCompiled
+	configRWMutex      sync.RWMutex
 }
 
 func buildEnrichmentProcessor(logger *zap.Logger, config *Config) (*spanEnrichmentProcessorImpl, error) {
@@ -153,6 +155,16 @@ func (ep *spanEnrichmentProcessorImpl) isCustomAttributeConfigsUpdated(currConfi
 	return updated
 }
 
+func (ep *spanEnrichmentProcessorImpl) prepareUpdate(newConfig *Config) error {
+	var err error
+	if len(newConfig.SpanAttributes) > 0 {
+		_, err = compileSpanAttributes(ep.logger, newConfig)
+	} else {
+		_, err = compileCustomAttributes(ep.logger, newConfig)
+	}
+	return err
+}
+
 func (ep *spanEnrichmentProcessorImpl) onUpdate(newConfig *Config) error {
 	if len(newConfig.SpanAttributes) > 0 {
 		return ep.onSpanAttributesUpdate(newConfig)
@@ -167,9 +179,7 @@ func (ep *spanEnrichmentProcessorImpl) onSpanAttributesUpdate(newConfig *Config)
 		ep.logger.Info("Updated config SpanAttributes",
 			zap.Any("New", newConfig.SpanAttributes),
 		)
-		ep.configRWMutex.Lock()
-		ep.customAttributes = newAttributes
-		ep.configRWMutex.Unlock()
+		ep.setAttributes(newAttributes)
 	} else {
 		ep.logger.Error("Ignoring config RequestContextExps due to regex compilation error", zap.Error(err))
 	}
@@ -182,15 +192,27 @@ func (ep *spanEnrichmentProcessorImpl) onCustomAttributeConfigsUpdate(newConfig
 		ep.logger.Info("Updated config CustomAttributeConfigs",
 			zap.Any("New", newConfig.CustomAttributeConfigs),
 		)
-		ep.configRWMutex.Lock()
-		ep.customAttributes = newAttributes
-		ep.configRWMutex.Unlock()
+		ep.setAttributes(newAttributes)
 	} else {
 		ep.logger.Error("Ignoring config RequestContextExps due to regex compilation error", zap.Error(err))
 	}
 	return err
 }
 
+func (ep *spanEnrichmentProcessorImpl) setAttributes(newAttributes map[string]map[string][]*customAttributeConfigCompiled) {
+	ep.configRWMutex.Lock()
+	defer ep.configRWMutex.Unlock()
+	ep.previousAttributes = ep.customAttributes
+	ep.customAttributes = newAttributes
+}
+
+func (ep *spanEnrichmentProcessorImpl) rollbackUpdate() {
+	ep.configRWMutex.Lock()
+	defer ep.configRWMutex.Unlock()
+	ep.customAttributes = ep.previousAttributes
+	ep.logger.Info("Rolled back config SpanAttributes and CustomAttributeConfigs")
+}
+
 func (ep *spanEnrichmentProcessorImpl) enrichSpan(namespace string, service string, span *ptrace.Span) {
 	ep.addRequestType(span)
 	ep.configRWMutex.RLock()
@@ -606,3 +606,46 @@ func clearAssertsAttributes(span ptrace.Span) {
 	span.Attributes().Remove(AssertsRequestTypeAttribute)
 	span.Attributes().Remove(AssertsErrorTypeAttribute)
 }
+
+func TestPrepareAndRollbackUpdate(t *testing.T) {
+	config1 := &Config{
+		CustomAttributeConfigs: map[string]map[string][]*CustomAttributeConfig{
+			"asserts.request.context": {
+				"default": {&CustomAttributeConfig{
+					SourceAttributes: []string{"http.url"},
+					RegExp:           "https?://.+?((/[^/?]+){1,2}).*",
+					Replacement:      "$1",
+				}},
+			},
+		}}
+	config2 := &Config{
+		SpanAttributes: []*SpanAttribute{{
+			AttributeName: "asserts.request.context",
+			AttributeConfigs: []*SpanAttributeConfig{{
+				Rules: []*CustomAttributeConfig{{
+					SourceAttributes: []string{"http.url"},
+					RegExp:           "https?://.+?((/[^/?]+){1,3}).*",
+					Replacement:      "$1",
+				}},
+			}},
+		}}}
+	invalid := &Config{
+		SpanAttributes: []*SpanAttribute{{
+			AttributeName: "asserts.request.context",
+			AttributeConfigs: []*SpanAttributeConfig{{
+				Rules: []*CustomAttributeConfig{{SourceAttributes: []string{"http.url"}, RegExp: "+"}},
+			}},
+		}}}
+	processor, err := buildEnrichmentProcessor(logger, config1)
+	assert.Nil(t, err)
+	currCustomAttributes := processor.customAttributes
+
+	assert.NotNil(t, processor.prepareUpdate(invalid))
+	assert.Nil(t, processor.prepareUpdate(config2))
+	assert.Equal(t, currCustomAttributes, processor.customAttributes)
+
+	assert.Nil(t, processor.onUpdate(config2))
+	assert.NotEqual(t, currCustomAttributes, processor.customAttributes)
+	processor.rollbackUpdate()
+	assert.Equal(t, currCustomAttributes, processor.customAttributes)
+}
@@ -0,0 +1,59 @@
+package assertsprocessor
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// thresholdCollector publishes the latency thresholds of the entities seen by the processor, so that
+// they can be overlaid on the latency histograms. The thresholds of an entity are no longer published
+// once the entity expires
+type thresholdCollector struct {
+	th   *thresholdHelper
+	desc *prometheus.Desc
+}
+
+func newThresholdCollector(th *thresholdHelper) *thresholdCollector {
+	return &thresholdCollector{
+		th: th,
+		desc: prometheus.NewDesc("asserts_latency_threshold_seconds",
+			"Latency threshold above which a request is slow",
+			[]string{envLabel, siteLabel, namespaceLabel, serviceLabel,
+				applyPromConventions(AssertsRequestTypeAttribute), applyPromConventions(AssertsRequestContextAttribute),
+				"is_default"},
+			nil,
+		),
+	}
+}
+
+// Describe implements the prometheus.Collector interface
+func (tc *thresholdCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tc.desc
+}
+
+// Collect implements the prometheus.Collector interface. The thresholds from Asserts are published by
+// request type and context. The default threshold is published with empty request type and context for
+// the entities that do not have a threshold for any request
+func (tc *thresholdCollector) Collect(ch chan<- prometheus.Metric) {
+	defaultThreshold := tc.th.getDefaultThreshold()
+	tc.th.entityKeys.Range(func(key string, entityKey EntityKeyDto) bool {
+		thresholds, _ := tc.th.thresholds.Load(key)
+		for _, threshold := range thresholds {
+			if threshold.LatencyUpperBound > 0 {
+				tc.collect(ch, entityKey, threshold.RequestType, threshold.RequestContext, threshold.LatencyUpperBound, false)
+			}
+		}
+		if catchAll := thresholds[thresholdKey("", "")]; catchAll == nil || catchAll.LatencyUpperBound <= 0 {
+			tc.collect(ch, entityKey, "", "", defaultThreshold, true)
+		}
+		return true
+	})
+}
+
+func (tc *thresholdCollector) collect(ch chan<- prometheus.Metric, entityKey EntityKeyDto,
+	requestType string, request string, threshold float64, isDefault bool) {
+	ch <- prometheus.MustNewConstMetric(tc.desc, prometheus.GaugeValue, threshold,
+		entityKey.Scope["env"], entityKey.Scope["site"], entityKey.Scope["namespace"], entityKey.Name,
+		requestType, request, strconv.FormatBool(isDefault))
+}
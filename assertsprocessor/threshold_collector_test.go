@@ -0,0 +1,68 @@
+package assertsprocessor
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/puzpuzpuz/xsync/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThresholdCollectorCollect(t *testing.T) {
+	cfg := &Config{
+		Env:                     "dev",
+		Site:                    "us-west-2",
+		DefaultLatencyThreshold: 0.5,
+		EntityKeyTTLMinutes:     10,
+	}
+	helper := &thresholdHelper{
+		logger:     logger,
+		config:     cfg,
+		entityKeys: xsync.NewMapOf[EntityKeyDto](),
+		thresholds: xsync.NewMapOf[map[string]*ThresholdDto](),
+		lastSeen:   xsync.NewMapOf[int64](),
+		rwMutex:    &sync.RWMutex{},
+	}
+	helper.getThreshold("platform", "api-server", AssertsRequestTypeInbound, "/v1/rules")
+	helper.getThreshold("platform", "model-builder", AssertsRequestTypeInbound, "/v1/run")
+	apiServer := buildEntityKey(cfg, "platform", "api-server")
+	helper.thresholds.Store(apiServer.AsString(), map[string]*ThresholdDto{
+		"inbound#/v1/rules":  {RequestType: "inbound", RequestContext: "/v1/rules", LatencyUpperBound: 1},
+		"inbound#/v1/alerts": {RequestType: "inbound", RequestContext: "/v1/alerts", ErrorRateUpperBound: 0.1},
+	})
+
+	collector := newThresholdCollector(helper)
+	registry := prometheus.NewRegistry()
+	assert.Nil(t, registry.Register(collector))
+	assert.Equal(t, 3, testutil.CollectAndCount(collector, "asserts_latency_threshold_seconds"))
+
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+	values := map[string]float64{}
+	for _, metric := range families[0].GetMetric() {
+		labels := map[string]string{}
+		for _, label := range metric.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		assert.Equal(t, "dev", labels[envLabel])
+		assert.Equal(t, "us-west-2", labels[siteLabel])
+		assert.Equal(t, "platform", labels[namespaceLabel])
+		values[labels[serviceLabel]+"#"+labels["asserts_request_context"]+"#"+labels["is_default"]] = metric.GetGauge().GetValue()
+	}
+	assert.Equal(t, map[string]float64{
+		"api-server#/v1/rules#false": 1,
+		"api-server##true":           0.5,
+		"model-builder##true":        0.5,
+	}, values)
+
+	// The thresholds of an expired entity are no longer published
+	now := time.Now()
+	helper.expireEntityKeys(now)
+	helper.expireEntityKeys(now.Add(5 * time.Minute))
+	helper.getThreshold("platform", "api-server", AssertsRequestTypeInbound, "/v1/rules")
+	helper.expireEntityKeys(now.Add(14 * time.Minute))
+	assert.Equal(t, 2, testutil.CollectAndCount(collector))
+}
@@ -0,0 +1,375 @@
+package assertsprocessor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/config/confighttp"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ThresholdProviderAsserts    = "asserts"
+	ThresholdProviderFile       = "file"
+	ThresholdProviderPrometheus = "prometheus"
+
+	prometheusQueryApi = "/api/v1/query"
+	// The query responses larger than this are rejected
+	maxPrometheusResponseBytes = 64 << 20
+)
+
+type ThresholdProviderConfig struct {
+	// asserts, file or prometheus. The thresholds are fetched from Asserts by default
+	Type string `mapstructure:"type" json:"type"`
+	// The YAML or JSON file of the file provider. Its modification time is checked on every refresh of the
+	// thresholds, and the file is read again when it has changed
+	Path string `mapstructure:"path" json:"path"`
+	// The Prometheus compatible server of the prometheus provider, e.g. http://prometheus:9090
+	Endpoint string `mapstructure:"endpoint" json:"endpoint"`
+	// Optional. The TLS settings, the headers, such as Authorization or X-Scope-OrgID, and the basic auth
+	// credentials of the queries to the server
+	TLS      *TLSClientConfig  `mapstructure:"tls" json:"tls"`
+	Headers  map[string]string `mapstructure:"headers" json:"headers"`
+	User     string            `mapstructure:"user" json:"user"`
+	Password string            `mapstructure:"password" json:"password"`
+	// The instant query of the prometheus provider. Each series of the result is a threshold in seconds,
+	// labelled by namespace, service and optionally asserts_request_type and asserts_request_context
+	Query                 string `mapstructure:"query" json:"query"`
+	RequestTimeoutSeconds int    `mapstructure:"request_timeout_seconds" json:"request_timeout_seconds"`
+}
+
+func (pc *ThresholdProviderConfig) validateAt(v *configValidator, path string) {
+	switch pc.Type {
+	case "", ThresholdProviderAsserts:
+	case ThresholdProviderFile:
+		if pc.Path == "" {
+			v.addf(joinPath(path, "path"), "not set, it is required by the file provider")
+		}
+	case ThresholdProviderPrometheus:
+		if pc.Endpoint == "" {
+			v.addf(joinPath(path, "endpoint"), "not set, it is required by the prometheus provider")
+		}
+		if pc.Query == "" {
+			v.addf(joinPath(path, "query"), "not set, it is required by the prometheus provider")
+		}
+	default:
+		v.addf(joinPath(path, "type"), "unknown type %s, must be one of %s, %s or %s",
+			pc.Type, ThresholdProviderAsserts, ThresholdProviderFile, ThresholdProviderPrometheus)
+	}
+	if pc.TLS != nil {
+		pc.TLS.validateAt(v, joinPath(path, "tls"))
+	}
+	if pc.RequestTimeoutSeconds < 0 {
+		v.addf(joinPath(path, "request_timeout_seconds"), "%d must not be negative", pc.RequestTimeoutSeconds)
+	}
+}
+
+// Returns the type of the configured threshold provider
+func (config *Config) thresholdProviderType() string {
+	if config.ThresholdProvider == nil || config.ThresholdProvider.Type == "" {
+		return ThresholdProviderAsserts
+	}
+	return config.ThresholdProvider.Type
+}
+
+// thresholdProvider is the source of the latency thresholds of the entities
+type thresholdProvider interface {
+	getThresholds(entityKeys []EntityKeyDto) ([]ThresholdsDto, error)
+}
+
+func newThresholdProvider(logger *zap.Logger, config *Config, rc restClient) (thresholdProvider, error) {
+	switch config.thresholdProviderType() {
+	case ThresholdProviderFile:
+		return &fileThresholdProvider{
+			logger: logger,
+			config: config,
+			path:   config.ThresholdProvider.Path,
+		}, nil
+	case ThresholdProviderPrometheus:
+		client, err := config.ThresholdProvider.newHTTPClient()
+		if err != nil {
+			return nil, err
+		}
+		return &prometheusThresholdProvider{
+			logger:   logger,
+			config:   config,
+			endpoint: config.ThresholdProvider.Endpoint,
+			query:    config.ThresholdProvider.Query,
+			client:   client,
+		}, nil
+	default:
+		return &assertsThresholdProvider{logger: logger, rc: rc}, nil
+	}
+}
+
+// Builds the client of the prometheus provider
+func (pc *ThresholdProviderConfig) newHTTPClient() (*http.Client, error) {
+	settings := confighttp.HTTPClientSettings{
+		Endpoint: pc.Endpoint,
+		Timeout:  time.Duration(pc.RequestTimeoutSeconds) * time.Second,
+		// The headers are set here rather than by the collector, so that the next round tripper is the
+		// transport of the client
+		CustomRoundTripper: func(next http.RoundTripper) (http.RoundTripper, error) {
+			if transport, ok := next.(*http.Transport); ok && pc.TLS != nil {
+				if err := pc.TLS.trustCAFile(transport); err != nil {
+					return nil, err
+				}
+			}
+			return &authRoundTripper{
+				base: next,
+				authorize: func(req *http.Request) error {
+					for name, value := range pc.Headers {
+						req.Header.Set(name, value)
+					}
+					if pc.User != "" {
+						req.SetBasicAuth(pc.User, pc.Password)
+					}
+					return nil
+				},
+			}, nil
+		},
+	}
+	if settings.Timeout == 0 {
+		settings.Timeout = 5 * time.Second
+	}
+	if pc.TLS != nil {
+		settings.TLSSetting = pc.TLS.toTLSSetting()
+	}
+	// There is no auth extension to look up in the host
+	return settings.ToClient(nil, component.TelemetrySettings{})
+}
+
+// assertsThresholdProvider fetches the thresholds from the Asserts API
+type assertsThresholdProvider struct {
+	logger *zap.Logger
+	rc     restClient
+}
+
+func (ap *assertsThresholdProvider) getThresholds(entityKeys []EntityKeyDto) ([]ThresholdsDto, error) {
+	var thresholds []ThresholdsDto
+	body, err := ap.rc.invoke(http.MethodPost, latencyThresholdsApi, entityKeys)
+	if err == nil {
+		err = json.Unmarshal(body, &thresholds)
+		if err == nil {
+			ap.logger.Debug("",
+				zap.Any("Got thresholds", thresholds),
+			)
+		} else {
+			ap.logger.Error("Error unmarshalling thresholds", zap.Error(err))
+		}
+	}
+
+	return thresholds, err
+}
+
+// A threshold in the thresholds file. The request type and context are optional
+type fileThreshold struct {
+	Namespace      string  `yaml:"namespace"`
+	Service        string  `yaml:"service"`
+	RequestType    string  `yaml:"request_type"`
+	RequestContext string  `yaml:"request_context"`
+	LatencySeconds float64 `yaml:"latency_seconds"`
+	ErrorRate      float64 `yaml:"error_rate"`
+}
+
+type thresholdsFile struct {
+	Thresholds []fileThreshold `yaml:"thresholds"`
+}
+
+// fileThresholdProvider reads the thresholds from a local YAML or JSON file. The file is read again
+// whenever its modification time changes, and the last thresholds read are kept while the file is invalid.
+// The directory of the file is watched, so that the thresholds are read again as soon as the file changes
+type fileThresholdProvider struct {
+	logger   *zap.Logger
+	config   *Config
+	path     string
+	watcher  *fsnotify.Watcher
+	modTime  time.Time
+	byEntity map[string]*ThresholdsDto
+	mutex    sync.Mutex
+}
+
+// Calls onChange for each change in the directory of the file, until the provider is closed
+func (fp *fileThresholdProvider) watch(onChange func()) error {
+	watcher, err := watchFileDir(fp.logger, fp.path, onChange)
+	if err != nil {
+		return err
+	}
+	fp.watcher = watcher
+	return nil
+}
+
+func (fp *fileThresholdProvider) close() {
+	if fp.watcher != nil {
+		_ = fp.watcher.Close()
+	}
+}
+
+func (fp *fileThresholdProvider) getThresholds(entityKeys []EntityKeyDto) ([]ThresholdsDto, error) {
+	fp.mutex.Lock()
+	defer fp.mutex.Unlock()
+
+	info, err := os.Stat(fp.path)
+	if err != nil {
+		fp.logger.Error("Error reading thresholds file", zap.String("Path", fp.path), zap.Error(err))
+		return nil, err
+	}
+	if fp.byEntity == nil || !info.ModTime().Equal(fp.modTime) {
+		byEntity, err := fp.read()
+		if err != nil {
+			fp.logger.Error("Error reading thresholds file", zap.String("Path", fp.path), zap.Error(err))
+			return nil, err
+		}
+		fp.byEntity, fp.modTime = byEntity, info.ModTime()
+		fp.logger.Info("Read thresholds file", zap.String("Path", fp.path), zap.Int("Services", len(byEntity)))
+	}
+	return selectThresholds(fp.byEntity, entityKeys), nil
+}
+
+func (fp *fileThresholdProvider) read() (map[string]*ThresholdsDto, error) {
+	content, err := os.ReadFile(fp.path)
+	if err != nil {
+		return nil, err
+	}
+	// JSON is valid YAML
+	var file thresholdsFile
+	if err = yaml.Unmarshal(content, &file); err != nil {
+		return nil, err
+	}
+	byEntity := map[string]*ThresholdsDto{}
+	for i, threshold := range file.Thresholds {
+		if threshold.Service == "" || threshold.LatencySeconds < 0 || threshold.ErrorRate < 0 {
+			return nil, fmt.Errorf("thresholds[%d]: service is required and the thresholds must not be negative", i)
+		}
+		addThreshold(byEntity, buildEntityKey(fp.config, threshold.Namespace, threshold.Service), ThresholdDto{
+			RequestType:         threshold.RequestType,
+			RequestContext:      threshold.RequestContext,
+			LatencyUpperBound:   threshold.LatencySeconds,
+			ErrorRateUpperBound: threshold.ErrorRate,
+		})
+	}
+	return byEntity, nil
+}
+
+type prometheusQueryResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+			Value  []any             `json:"value"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// prometheusThresholdProvider runs an instant query, such as a histogram_quantile of the latency
+// histogram by service and request, against a Prometheus compatible query API. The query returns the
+// thresholds of all the services, so it is run once per refresh for all the entity keys
+type prometheusThresholdProvider struct {
+	logger   *zap.Logger
+	config   *Config
+	endpoint string
+	query    string
+	client   *http.Client
+}
+
+func (pp *prometheusThresholdProvider) getThresholds(entityKeys []EntityKeyDto) ([]ThresholdsDto, error) {
+	response, err := pp.client.Get(pp.endpoint + prometheusQueryApi + "?query=" + url.QueryEscape(pp.query))
+	if err != nil {
+		pp.logger.Error("Failed to query thresholds", zap.String("Endpoint", pp.endpoint), zap.Error(err))
+		return nil, err
+	}
+	defer func() { _ = response.Body.Close() }()
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxPrometheusResponseBytes+1))
+	if err == nil && len(body) > maxPrometheusResponseBytes {
+		err = fmt.Errorf("threshold query response exceeds %d bytes", maxPrometheusResponseBytes)
+	}
+	if err != nil {
+		pp.logger.Error("Error reading query response", zap.String("Endpoint", pp.endpoint), zap.Error(err))
+		return nil, err
+	}
+
+	var queryResponse prometheusQueryResponse
+	if err = json.Unmarshal(body, &queryResponse); err != nil {
+		pp.logger.Error("Error unmarshalling query response", zap.Int("Status code", response.StatusCode), zap.Error(err))
+		return nil, err
+	}
+	if queryResponse.Status != "success" {
+		err = errors.New(queryResponse.Error)
+		pp.logger.Error("Threshold query failed", zap.Int("Status code", response.StatusCode), zap.Error(err))
+		return nil, err
+	}
+	if queryResponse.Data.ResultType != "vector" {
+		return nil, fmt.Errorf("threshold query returned a %s instead of a vector", queryResponse.Data.ResultType)
+	}
+
+	byEntity := map[string]*ThresholdsDto{}
+	for _, sample := range queryResponse.Data.Result {
+		metric := sample.Metric
+		// Skip the series of the other environments, if the query is not already scoped to this one
+		if env, found := metric[envLabel]; found && env != pp.config.Env {
+			continue
+		}
+		if site, found := metric[siteLabel]; found && site != pp.config.Site {
+			continue
+		}
+		value, ok := parseSampleValue(sample.Value)
+		if !ok || metric[serviceLabel] == "" {
+			continue
+		}
+		addThreshold(byEntity, buildEntityKey(pp.config, metric[namespaceLabel], metric[serviceLabel]), ThresholdDto{
+			RequestType:       metric[applyPromConventions(AssertsRequestTypeAttribute)],
+			RequestContext:    metric[applyPromConventions(AssertsRequestContextAttribute)],
+			LatencyUpperBound: value,
+		})
+	}
+	return selectThresholds(byEntity, entityKeys), nil
+}
+
+// Parses the value of a sample, encoded as [timestamp, "value"]. Only positive thresholds are valid
+func parseSampleValue(value []any) (float64, bool) {
+	if len(value) != 2 {
+		return 0, false
+	}
+	encoded, ok := value[1].(string)
+	if !ok {
+		return 0, false
+	}
+	parsed, err := strconv.ParseFloat(encoded, 64)
+	if err != nil || math.IsNaN(parsed) || math.IsInf(parsed, 0) || parsed <= 0 {
+		return 0, false
+	}
+	return parsed, true
+}
+
+func addThreshold(byEntity map[string]*ThresholdsDto, entityKey EntityKeyDto, threshold ThresholdDto) {
+	key := entityKey.AsString()
+	if byEntity[key] == nil {
+		byEntity[key] = &ThresholdsDto{EntityKey: entityKey}
+	}
+	byEntity[key].LatencyThresholds = append(byEntity[key].LatencyThresholds, threshold)
+}
+
+// Returns the thresholds of the requested entities
+func selectThresholds(byEntity map[string]*ThresholdsDto, entityKeys []EntityKeyDto) []ThresholdsDto {
+	thresholds := make([]ThresholdsDto, 0, len(entityKeys))
+	for _, entityKey := range entityKeys {
+		if entityThresholds := byEntity[entityKey.AsString()]; entityThresholds != nil {
+			thresholds = append(thresholds, *entityThresholds)
+		}
+	}
+	return thresholds
+}
@@ -0,0 +1,257 @@
+package assertsprocessor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/puzpuzpuz/xsync/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/tilinna/clock"
+)
+
+func TestFileThresholdProvider(t *testing.T) {
+	cfg := &Config{Env: "dev", Site: "us-west-2"}
+	path := filepath.Join(t.TempDir(), "thresholds.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(`
+thresholds:
+  - namespace: platform
+    service: api-server
+    request_type: inbound
+    request_context: /v1/rules
+    latency_seconds: 0.25
+  - namespace: platform
+    service: api-server
+    latency_seconds: 1
+    error_rate: 0.05
+  - namespace: platform
+    service: model-builder
+    latency_seconds: 2
+`), 0600))
+	provider, err := newThresholdProvider(logger, &Config{
+		Env:               "dev",
+		Site:              "us-west-2",
+		ThresholdProvider: &ThresholdProviderConfig{Type: ThresholdProviderFile, Path: path},
+	}, nil)
+	assert.Nil(t, err)
+
+	apiServer := buildEntityKey(cfg, "platform", "api-server")
+	thresholds, err := provider.getThresholds([]EntityKeyDto{apiServer})
+	assert.Nil(t, err)
+	assert.Equal(t, []ThresholdsDto{{
+		EntityKey: apiServer,
+		LatencyThresholds: []ThresholdDto{
+			{RequestType: "inbound", RequestContext: "/v1/rules", LatencyUpperBound: 0.25},
+			{LatencyUpperBound: 1, ErrorRateUpperBound: 0.05},
+		},
+	}}, thresholds)
+
+	// The file is read again when it changes, JSON being valid YAML
+	assert.Nil(t, os.WriteFile(path, []byte(`{"thresholds": [
+		{"namespace": "platform", "service": "api-server", "latency_seconds": 3}
+	]}`), 0600))
+	assert.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	thresholds, err = provider.getThresholds([]EntityKeyDto{apiServer, buildEntityKey(cfg, "platform", "model-builder")})
+	assert.Nil(t, err)
+	assert.Equal(t, []ThresholdsDto{{
+		EntityKey:         apiServer,
+		LatencyThresholds: []ThresholdDto{{LatencyUpperBound: 3}},
+	}}, thresholds)
+
+	assert.Nil(t, os.WriteFile(path, []byte(`thresholds: [{"service": "api-server", "latency_seconds": -1}]`), 0600))
+	assert.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute)))
+	_, err = provider.getThresholds([]EntityKeyDto{apiServer})
+	assert.NotNil(t, err)
+}
+
+func TestPrometheusThresholdProvider(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, prometheusQueryApi, r.URL.Path)
+		user, password, _ := r.BasicAuth()
+		assert.Equal(t, "asserts", user)
+		assert.Equal(t, "secret", password)
+		assert.Equal(t, "platform", r.Header.Get("X-Scope-OrgID"))
+		query = r.URL.Query().Get("query")
+		_, _ = w.Write([]byte(`{
+			"status": "success",
+			"data": {
+				"resultType": "vector",
+				"result": [
+					{"metric": {"namespace": "platform", "service": "api-server", "asserts_request_type": "inbound",
+						"asserts_request_context": "/v1/rules"}, "value": [1700000000, "0.75"]},
+					{"metric": {"namespace": "platform", "service": "api-server", "asserts_request_type": "inbound",
+						"asserts_request_context": "/v1/alerts"}, "value": [1700000000, "NaN"]},
+					{"metric": {"asserts_env": "prod", "namespace": "platform", "service": "api-server"},
+						"value": [1700000000, "5"]}
+				]
+			}
+		}`))
+	}))
+	defer server.Close()
+
+	cfg := &Config{
+		Env:  "dev",
+		Site: "us-west-2",
+		ThresholdProvider: &ThresholdProviderConfig{
+			Type:     ThresholdProviderPrometheus,
+			Endpoint: server.URL,
+			Headers:  map[string]string{"X-Scope-OrgID": "platform"},
+			User:     "asserts",
+			Password: "secret",
+			Query:    `histogram_quantile(0.99, sum by (namespace, service, le) (rate(otel_span_latency_seconds_bucket[1h])))`,
+		},
+	}
+	apiServer := buildEntityKey(cfg, "platform", "api-server")
+	provider, err := newThresholdProvider(logger, cfg, nil)
+	assert.Nil(t, err)
+	thresholds, err := provider.getThresholds([]EntityKeyDto{apiServer})
+	assert.Nil(t, err)
+	assert.Equal(t, cfg.ThresholdProvider.Query, query)
+	assert.Equal(t, []ThresholdsDto{{
+		EntityKey: apiServer,
+		LatencyThresholds: []ThresholdDto{
+			{RequestType: "inbound", RequestContext: "/v1/rules", LatencyUpperBound: 0.75},
+		},
+	}}, thresholds)
+}
+
+func TestPrometheusThresholdProviderQueryError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"status": "error", "errorType": "bad_data", "error": "parse error"}`))
+	}))
+	defer server.Close()
+
+	provider, err := newThresholdProvider(logger, &Config{
+		ThresholdProvider: &ThresholdProviderConfig{Type: ThresholdProviderPrometheus, Endpoint: server.URL, Query: "up"},
+	}, nil)
+	assert.Nil(t, err)
+	_, err = provider.getThresholds(nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, "parse error", err.Error())
+}
+
+func TestUpdateThresholdsRemovesMissingEntities(t *testing.T) {
+	cfg := &Config{Env: "dev", Site: "us-west-2", DefaultLatencyThreshold: 0.5}
+	path := filepath.Join(t.TempDir(), "thresholds.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(`thresholds: [{"namespace": "platform", "service": "api-server", "latency_seconds": 3}]`), 0600))
+	cfg.ThresholdProvider = &ThresholdProviderConfig{Type: ThresholdProviderFile, Path: path}
+	provider, err := newThresholdProvider(logger, cfg, nil)
+	assert.Nil(t, err)
+	helper := &thresholdHelper{
+		logger:     logger,
+		config:     cfg,
+		entityKeys: xsync.NewMapOf[EntityKeyDto](),
+		thresholds: xsync.NewMapOf[map[string]*ThresholdDto](),
+		rwMutex:    &sync.RWMutex{},
+		provider:   provider,
+	}
+	apiServer := buildEntityKey(cfg, "platform", "api-server")
+	helper.entityKeys.Store(apiServer.AsString(), apiServer)
+
+	helper.updateThresholds([]EntityKeyDto{apiServer})
+	assert.Equal(t, 3.0, helper.getThreshold("platform", "api-server", AssertsRequestTypeInbound, "/v1/rules"))
+
+	assert.Nil(t, os.WriteFile(path, []byte(`thresholds: []`), 0600))
+	assert.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	helper.updateThresholds([]EntityKeyDto{apiServer})
+	assert.Equal(t, 0.5, helper.getThreshold("platform", "api-server", AssertsRequestTypeInbound, "/v1/rules"))
+}
+
+func TestValidateThresholdProvider(t *testing.T) {
+	assert.Nil(t, validateSection(&ThresholdProviderConfig{}))
+	assert.NotNil(t, validateSection(&ThresholdProviderConfig{Type: "consul"}))
+	assert.NotNil(t, validateSection(&ThresholdProviderConfig{Type: ThresholdProviderFile}))
+	assert.Nil(t, validateSection(&ThresholdProviderConfig{Type: ThresholdProviderFile, Path: "thresholds.yaml"}))
+	assert.NotNil(t, validateSection(&ThresholdProviderConfig{Type: ThresholdProviderPrometheus, Endpoint: "http://prometheus:9090"}))
+	err := validateSection(&ThresholdProviderConfig{
+		Type:     ThresholdProviderPrometheus,
+		Endpoint: "https://prometheus:9090",
+		Query:    "up",
+		TLS:      &TLSClientConfig{CertFile: "client.crt"},
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, "tls.key_file: not set, the cert_file and key_file must be set together", err.Error())
+}
+
+func TestFileThresholdProviderWatch(t *testing.T) {
+	cfg := &Config{Env: "dev", Site: "us-west-2", DefaultLatencyThreshold: 0.5, AssertsServer: &AssertsServerConfig{}}
+	path := filepath.Join(t.TempDir(), "thresholds.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(`thresholds: []`), 0600))
+	cfg.ThresholdProvider = &ThresholdProviderConfig{Type: ThresholdProviderFile, Path: path}
+	provider, err := newThresholdProvider(logger, cfg, nil)
+	assert.Nil(t, err)
+	helper := &thresholdHelper{
+		logger:     logger,
+		config:     cfg,
+		entityKeys: xsync.NewMapOf[EntityKeyDto](),
+		thresholds: xsync.NewMapOf[map[string]*ThresholdDto](),
+		lastSeen:   xsync.NewMapOf[int64](),
+		rwMutex:    &sync.RWMutex{},
+		provider:   provider,
+		// The thresholds are not synced during the test
+		thresholdSyncTicker: clock.NewMock(time.Now()).NewTicker(time.Minute),
+		refreshNow:          make(chan struct{}, 1),
+		stop:                make(chan bool),
+	}
+	apiServer := buildEntityKey(cfg, "platform", "api-server")
+	helper.entityKeys.Store(apiServer.AsString(), apiServer)
+	helper.startUpdates()
+	defer helper.stopUpdates()
+
+	// The change of the file is read right away
+	assert.Nil(t, os.WriteFile(path, []byte(`thresholds: [{"namespace": "platform", "service": "api-server", "latency_seconds": 3}]`), 0600))
+	assert.Eventually(t, func() bool {
+		return helper.getThreshold("platform", "api-server", AssertsRequestTypeInbound, "/v1/rules") == 3.0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPrometheusThresholdProviderQueriesOncePerRefresh(t *testing.T) {
+	var queryCount atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queryCount.Add(1)
+		_, _ = w.Write([]byte(`{"status": "success", "data": {"resultType": "vector", "result": [
+			{"metric": {"namespace": "platform", "service": "api-server"}, "value": [1700000000, "2"]},
+			{"metric": {"namespace": "platform", "service": "model-builder"}, "value": [1700000000, "3"]}
+		]}}`))
+	}))
+	defer server.Close()
+
+	cfg := &Config{
+		Env:                            "dev",
+		Site:                           "us-west-2",
+		DefaultLatencyThreshold:        0.5,
+		MaxEntitiesPerThresholdRequest: 1,
+		ThresholdProvider:              &ThresholdProviderConfig{Type: ThresholdProviderPrometheus, Endpoint: server.URL, Query: "up"},
+	}
+	provider, err := newThresholdProvider(logger, cfg, nil)
+	assert.Nil(t, err)
+	helper := &thresholdHelper{
+		logger:     logger,
+		config:     cfg,
+		entityKeys: xsync.NewMapOf[EntityKeyDto](),
+		thresholds: xsync.NewMapOf[map[string]*ThresholdDto](),
+		rwMutex:    &sync.RWMutex{},
+		provider:   provider,
+	}
+	entityKeys := []EntityKeyDto{
+		buildEntityKey(cfg, "platform", "api-server"),
+		buildEntityKey(cfg, "platform", "model-builder"),
+	}
+	for _, entityKey := range entityKeys {
+		helper.entityKeys.Store(entityKey.AsString(), entityKey)
+	}
+
+	for _, chunk := range helper.chunkEntityKeys(entityKeys) {
+		helper.updateThresholds(chunk)
+	}
+	assert.Equal(t, int32(1), queryCount.Load())
+	assert.Equal(t, 2.0, helper.getThreshold("platform", "api-server", AssertsRequestTypeInbound, "/v1/rules"))
+	assert.Equal(t, 3.0, helper.getThreshold("platform", "model-builder", AssertsRequestTypeInbound, "/v1/run"))
+}
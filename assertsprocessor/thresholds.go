@@ -1,18 +1,24 @@
 package assertsprocessor
 
 import (
-	"encoding/json"
+	"fmt"
 	"github.com/puzpuzpuz/xsync/v2"
 	"github.com/tilinna/clock"
+	"go.opentelemetry.io/collector/pdata/ptrace"
 	"go.uber.org/zap"
-	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type ThresholdDto struct {
 	RequestType       string  `json:"requestType"`
 	RequestContext    string  `json:"requestContext"`
 	LatencyUpperBound float64 `json:"upperThreshold"`
+	// Optional. The error rate above which the errors of the request are not expected. Asserts versions
+	// that do not return errorRateUpperThreshold leave it 0, and the learned error baseline is used instead
+	ErrorRateUpperBound float64 `json:"errorRateUpperThreshold,omitempty"`
 }
 
 type ThresholdsDto struct {
@@ -21,30 +27,116 @@ type ThresholdsDto struct {
 }
 
 type thresholdHelper struct {
+	// The unix time of the last expiry of the entities, at which the entities are marked seen. Accessed
+	// atomically and kept first in the struct for the 64-bit alignment
+	seenAt              int64
 	config              *Config
 	logger              *zap.Logger
 	thresholds          *xsync.MapOf[string, map[string]*ThresholdDto]
 	thresholdSyncTicker *clock.Ticker
 	entityKeys          *xsync.MapOf[string, EntityKeyDto]
+	lastSeen            *xsync.MapOf[string, int64] // unix time at which a span of the entity was last seen
+	refreshNow          chan struct{}               // requests the thresholds when the thresholds file changes
 	stop                chan bool
-	rc                  restClient
-	rwMutex             *sync.RWMutex // guard access to config.DefaultLatencyThreshold
+	provider            thresholdProvider
+	baselines           *latencyBaselines // nil when the baselines are not learned
+	errorBaselines      *errorBaselines   // nil when the error rates are not tracked
+	rwMutex             *sync.RWMutex     // guard access to config.DefaultLatencyThreshold
+	// The config in use before the last update, to roll it back
+	previousDefaultLatencyThreshold float64
 }
 
-func (th *thresholdHelper) getThreshold(ns string, service string, request string) float64 {
+// Returns the latency threshold of the request. The thresholds from Asserts are looked up in the order
+//
+//	request type and context
+//	request type, for any context of the type
+//	any request of the entity
+//
+// failing which the baseline learned from the spans or the default threshold is used
+func (th *thresholdHelper) getThreshold(ns string, service string, requestType string, request string) float64 {
 	var entityKey = buildEntityKey(th.config, ns, service)
 	th.entityKeys.LoadOrStore(entityKey.AsString(), entityKey)
+	th.markSeen(entityKey.AsString())
 	var thresholds, _ = th.thresholds.Load(entityKey.AsString())
 
-	thresholdFound := th.getDefaultThreshold()
-	if thresholds != nil {
-		if thresholds[request] != nil {
-			thresholdFound = thresholds[request].LatencyUpperBound
-		} else if thresholds[""] != nil {
-			thresholdFound = thresholds[""].LatencyUpperBound
+	if threshold := lookupThreshold(thresholds, requestType, request, func(dto *ThresholdDto) bool {
+		// A threshold that has only the error rate does not bound the latency
+		return dto.LatencyUpperBound > 0 || dto.ErrorRateUpperBound <= 0
+	}); threshold != nil {
+		return threshold.LatencyUpperBound
+	}
+	// Fall back to the baseline learned from the spans before the default threshold
+	if th.baselines != nil {
+		if baseline, found := th.baselines.getThreshold(entityKey, requestType, request); found {
+			return baseline
 		}
 	}
-	return thresholdFound
+	return th.getDefaultThreshold()
+}
+
+// Returns the latency threshold of the request of the span
+func (th *thresholdHelper) getSpanThreshold(ns string, service string, span *ptrace.Span) float64 {
+	requestType, request := getRequest(span)
+	return th.getThreshold(ns, service, requestType, request)
+}
+
+// Returns true if the error of the span is expected, i.e. the rolling error rate of its request is within
+// the error rate threshold from Asserts or, failing which, within the tolerance of the learned baseline.
+// The errors are not expected while the error rates are unknown
+func (th *thresholdHelper) isErrorExpected(ns string, service string, span *ptrace.Span) bool {
+	if th.errorBaselines == nil {
+		return false
+	}
+	requestType, request := getRequest(span)
+	entityKey := buildEntityKey(th.config, ns, service)
+	rolling, baseline, found := th.errorBaselines.getRates(entityKey, requestType, request)
+	if !found {
+		return false
+	}
+	thresholds, _ := th.thresholds.Load(entityKey.AsString())
+	if threshold := lookupThreshold(thresholds, requestType, request, func(dto *ThresholdDto) bool {
+		return dto.ErrorRateUpperBound > 0
+	}); threshold != nil {
+		return rolling <= threshold.ErrorRateUpperBound
+	}
+	return rolling <= baseline*th.config.ErrorBaseline.Tolerance
+}
+
+// Learns the latency and the error rate baselines from the span
+func (th *thresholdHelper) observeSpan(ns string, service string, span *ptrace.Span) {
+	if th.baselines != nil {
+		th.baselines.observe(ns, service, span)
+	}
+	if th.errorBaselines != nil {
+		th.errorBaselines.observe(ns, service, span)
+	}
+}
+
+// Returns the most specific threshold of the request that matches the filter. The exact match
+// comes first, then the wildcard of the request type and then the wildcard of the entity
+func lookupThreshold(thresholds map[string]*ThresholdDto, requestType string, request string,
+	filter func(dto *ThresholdDto) bool) *ThresholdDto {
+	for _, key := range []string{
+		thresholdKey(requestType, request),
+		thresholdKey(requestType, ""),
+		thresholdKey("", ""),
+	} {
+		if threshold := thresholds[key]; threshold != nil && filter(threshold) {
+			return threshold
+		}
+	}
+	return nil
+}
+
+// The thresholds of an entity are keyed by the request type and the request context
+func thresholdKey(requestType string, request string) string {
+	return requestType + "#" + request
+}
+
+func getRequest(span *ptrace.Span) (string, string) {
+	requestType, _ := span.Attributes().Get(AssertsRequestTypeAttribute)
+	request, _ := span.Attributes().Get(AssertsRequestContextAttribute)
+	return requestType.Str(), request.Str()
 }
 
 func (th *thresholdHelper) getDefaultThreshold() float64 {
@@ -55,12 +147,21 @@ func (th *thresholdHelper) getDefaultThreshold() float64 {
 }
 
 func (th *thresholdHelper) stopUpdates() {
+	if fp, ok := th.provider.(*fileThresholdProvider); ok {
+		fp.close()
+	}
 	go func() { th.stop <- true }()
 }
 
 func (th *thresholdHelper) startUpdates() {
-	endPoint := (*(*th.config).AssertsServer)["endpoint"]
-	if endPoint != "" {
+	endPoint := th.config.AssertsServer.Endpoint
+	if endPoint != "" || th.config.thresholdProviderType() != ThresholdProviderAsserts {
+		if fp, ok := th.provider.(*fileThresholdProvider); ok {
+			if err := fp.watch(th.requestRefresh); err != nil {
+				th.logger.Warn("Cannot watch the thresholds file, it is read at each threshold sync instead",
+					zap.String("Path", fp.path), zap.Error(err))
+			}
+		}
 		go func() {
 			for {
 				select {
@@ -68,57 +169,144 @@ func (th *thresholdHelper) startUpdates() {
 					th.logger.Info("Stopping threshold updates")
 					return
 				case <-th.thresholdSyncTicker.C:
-					entityKeys := make([]EntityKeyDto, 0)
-					th.entityKeys.Range(func(key string, entityKey EntityKeyDto) bool {
-						entityKeys = append(entityKeys, entityKey)
-						return true
-					})
-					if len(entityKeys) > 0 {
-						th.logger.Info("Fetching thresholds for",
-							zap.Any("Services", entityKeys),
-						)
-						th.updateThresholdsAsync(entityKeys)
-					} else {
-						th.logger.Info("Skip fetching thresholds as no service has reported a Trace")
-					}
+					th.expireEntityKeys(time.Now())
+					th.fetchThresholds()
+				case <-th.refreshNow:
+					th.fetchThresholds()
 				}
 			}
 		}()
 	}
 }
 
+// Requests the thresholds ahead of the next sync. The requests made meanwhile are coalesced
+func (th *thresholdHelper) requestRefresh() {
+	select {
+	case th.refreshNow <- struct{}{}:
+	default:
+	}
+}
+
+// Fetches the thresholds of the entities seen
+func (th *thresholdHelper) fetchThresholds() {
+	entityKeys := make([]EntityKeyDto, 0)
+	th.entityKeys.Range(func(key string, entityKey EntityKeyDto) bool {
+		entityKeys = append(entityKeys, entityKey)
+		return true
+	})
+	if len(entityKeys) > 0 {
+		th.logger.Info("Fetching thresholds for",
+			zap.Any("Services", entityKeys),
+		)
+		th.updateThresholdsAsync(entityKeys)
+	} else {
+		th.logger.Info("Skip fetching thresholds as no service has reported a Trace")
+	}
+}
+
 func (th *thresholdHelper) updateThresholdsAsync(entityKeys []EntityKeyDto) bool {
 	go func() {
-		thresholdsDtos, err := th.getThresholds(entityKeys)
-		if err == nil {
-			for _, thresholdsDto := range thresholdsDtos {
-				var entityKey = thresholdsDto.EntityKey.AsString()
-				var thresholds = map[string]*ThresholdDto{}
-				for i, threshold := range thresholdsDto.LatencyThresholds {
-					thresholds[threshold.RequestContext] = &thresholdsDto.LatencyThresholds[i]
-				}
-				th.thresholds.Store(entityKey, thresholds)
-			}
+		for _, chunk := range th.chunkEntityKeys(entityKeys) {
+			th.updateThresholds(chunk)
 		}
 	}()
 	return true
 }
 
-func (th *thresholdHelper) getThresholds(entityKeys []EntityKeyDto) ([]ThresholdsDto, error) {
-	var thresholds []ThresholdsDto
-	body, err := th.rc.invoke(http.MethodPost, latencyThresholdsApi, entityKeys)
+// Splits the entity keys into chunks of at most the configured number of entities per request to Asserts.
+// The other providers read the thresholds of all the entities at once, so their keys are not split
+func (th *thresholdHelper) chunkEntityKeys(entityKeys []EntityKeyDto) [][]EntityKeyDto {
+	chunkSize := th.config.MaxEntitiesPerThresholdRequest
+	if chunkSize <= 0 || len(entityKeys) <= chunkSize || th.config.thresholdProviderType() != ThresholdProviderAsserts {
+		return [][]EntityKeyDto{entityKeys}
+	}
+	sort.Slice(entityKeys, func(i, j int) bool {
+		return entityKeys[i].AsString() < entityKeys[j].AsString()
+	})
+	chunks := make([][]EntityKeyDto, 0, (len(entityKeys)+chunkSize-1)/chunkSize)
+	for start := 0; start < len(entityKeys); start += chunkSize {
+		end := start + chunkSize
+		if end > len(entityKeys) {
+			end = len(entityKeys)
+		}
+		chunks = append(chunks, entityKeys[start:end])
+	}
+	return chunks
+}
+
+func (th *thresholdHelper) updateThresholds(entityKeys []EntityKeyDto) {
+	thresholdsDtos, err := th.provider.getThresholds(entityKeys)
 	if err == nil {
-		err = json.Unmarshal(body, &thresholds)
-		if err == nil {
-			th.logger.Debug("",
-				zap.Any("Got thresholds", thresholds),
-			)
-		} else {
-			th.logger.Error("Error unmarshalling thresholds", zap.Error(err))
+		fetched := map[string]bool{}
+		for _, thresholdsDto := range thresholdsDtos {
+			var entityKey = thresholdsDto.EntityKey.AsString()
+			var thresholds = map[string]*ThresholdDto{}
+			for i, threshold := range thresholdsDto.LatencyThresholds {
+				thresholds[thresholdKey(threshold.RequestType, threshold.RequestContext)] = &thresholdsDto.LatencyThresholds[i]
+			}
+			// The entity may have expired while its thresholds were being fetched
+			if _, found := th.entityKeys.Load(entityKey); found {
+				th.thresholds.Store(entityKey, thresholds)
+				fetched[entityKey] = true
+			}
 		}
+		// The entities without thresholds, such as those removed from a thresholds file, use the defaults
+		for _, entityKey := range entityKeys {
+			if !fetched[entityKey.AsString()] {
+				th.thresholds.Delete(entityKey.AsString())
+			}
+		}
+	}
+}
+
+// Marks the entity as seen at the time of the last expiry rather than reading the clock for every span.
+// An entity is thus seen with the precision of the threshold sync interval
+func (th *thresholdHelper) markSeen(entityKey string) {
+	seenAt := atomic.LoadInt64(&th.seenAt)
+	// Until the first expiry, which marks all the entities seen
+	if th.lastSeen == nil || seenAt == 0 {
+		return
+	}
+	if lastSeen, found := th.lastSeen.Load(entityKey); !found || lastSeen < seenAt {
+		th.lastSeen.Store(entityKey, seenAt)
 	}
+}
 
-	return thresholds, err
+// Forgets the entities whose spans have not been seen for the configured TTL, along with their thresholds
+// and baselines
+func (th *thresholdHelper) expireEntityKeys(now time.Time) {
+	ttl := time.Duration(th.config.EntityKeyTTLMinutes) * time.Minute
+	if th.lastSeen == nil || ttl <= 0 {
+		return
+	}
+	atomic.StoreInt64(&th.seenAt, now.Unix())
+	expired := make([]string, 0)
+	th.entityKeys.Range(func(key string, entityKey EntityKeyDto) bool {
+		lastSeen, found := th.lastSeen.Load(key)
+		if !found {
+			th.lastSeen.Store(key, now.Unix())
+		} else if now.Sub(time.Unix(lastSeen, 0)) > ttl {
+			expired = append(expired, key)
+		}
+		return true
+	})
+	for _, key := range expired {
+		th.entityKeys.Delete(key)
+		th.thresholds.Delete(key)
+		th.lastSeen.Delete(key)
+		if th.baselines != nil {
+			th.baselines.forget(key)
+		}
+		if th.errorBaselines != nil {
+			th.errorBaselines.forget(key)
+		}
+	}
+	if len(expired) > 0 {
+		th.logger.Info("Expired entities not seen recently",
+			zap.Strings("Entities", expired),
+			zap.Duration("TTL", ttl),
+		)
+	}
 }
 
 // configListener interface implementation
@@ -138,13 +326,33 @@ func (th *thresholdHelper) isUpdated(currConfig *Config, newConfig *Config) bool
 	return updated
 }
 
+func (th *thresholdHelper) prepareUpdate(newConfig *Config) error {
+	if newConfig.DefaultLatencyThreshold < 0 {
+		return ValidationError{
+			message: fmt.Sprintf("DefaultLatencyThreshold: %v must not be negative", newConfig.DefaultLatencyThreshold),
+		}
+	}
+	return nil
+}
+
 func (th *thresholdHelper) onUpdate(newConfig *Config) error {
 	th.rwMutex.Lock()
 	defer th.rwMutex.Unlock()
 
+	th.previousDefaultLatencyThreshold = th.config.DefaultLatencyThreshold
 	th.config.DefaultLatencyThreshold = newConfig.DefaultLatencyThreshold
 	th.logger.Info("Updated config DefaultLatencyThreshold",
 		zap.Float64("New", th.config.DefaultLatencyThreshold),
 	)
 	return nil
 }
+
+func (th *thresholdHelper) rollbackUpdate() {
+	th.rwMutex.Lock()
+	defer th.rwMutex.Unlock()
+
+	th.config.DefaultLatencyThreshold = th.previousDefaultLatencyThreshold
+	th.logger.Info("Rolled back config DefaultLatencyThreshold",
+		zap.Float64("Current", th.config.DefaultLatencyThreshold),
+	)
+}
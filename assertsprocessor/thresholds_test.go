@@ -18,7 +18,7 @@ func TestGetThresholdDefaultThreshold(t *testing.T) {
 		config: &Config{
 			Env:                     "dev",
 			Site:                    "us-west-2",
-			AssertsServer:           &map[string]string{"endpoint": "http://localhost:8030"},
+			AssertsServer:           &AssertsServerConfig{Endpoint: "http://localhost:8030"},
 			DefaultLatencyThreshold: 0.5,
 		},
 		thresholds: xsync.NewMapOf[map[string]*ThresholdDto](),
@@ -31,7 +31,7 @@ func TestGetThresholdDefaultThreshold(t *testing.T) {
 			"env": "dev", "site": "us-west-2", "namespace": "platform",
 		},
 	}
-	assert.Equal(t, 0.5, th.getThreshold("platform", "api-server", "123"))
+	assert.Equal(t, 0.5, th.getThreshold("platform", "api-server", "inbound", "123"))
 	th.entityKeys.Range(func(key string, entityKey EntityKeyDto) bool {
 		assert.Equal(t, dto.AsString(), key)
 		assert.Equal(t, dto, entityKey)
@@ -46,7 +46,7 @@ func TestGetRequestThresholdFound(t *testing.T) {
 		config: &Config{
 			Env:                     "dev",
 			Site:                    "us-west-2",
-			AssertsServer:           &map[string]string{"endpoint": "http://localhost:8030"},
+			AssertsServer:           &AssertsServerConfig{Endpoint: "http://localhost:8030"},
 			DefaultLatencyThreshold: 0.5,
 		},
 		thresholds: xsync.NewMapOf[map[string]*ThresholdDto](),
@@ -64,17 +64,18 @@ func TestGetRequestThresholdFound(t *testing.T) {
 	byRequest := map[string]*ThresholdDto{}
 	th.thresholds.Store(dto.AsString(), byRequest)
 
-	byRequest["/v1/latency-thresholds"] = &ThresholdDto{
+	byRequest["inbound#/v1/latency-thresholds"] = &ThresholdDto{
+		RequestType:       "inbound",
 		RequestContext:    "/v1/latency-thresholds",
 		LatencyUpperBound: 1,
 	}
 
-	byRequest[""] = &ThresholdDto{
+	byRequest["#"] = &ThresholdDto{
 		RequestContext:    "",
 		LatencyUpperBound: 2,
 	}
 
-	assert.Equal(t, float64(1), th.getThreshold("platform", "api-server", "/v1/latency-thresholds"))
+	assert.Equal(t, float64(1), th.getThreshold("platform", "api-server", "inbound", "/v1/latency-thresholds"))
 }
 
 func TestGetServiceDefaultThresholdFound(t *testing.T) {
@@ -84,7 +85,7 @@ func TestGetServiceDefaultThresholdFound(t *testing.T) {
 		config: &Config{
 			Env:                     "dev",
 			Site:                    "us-west-2",
-			AssertsServer:           &map[string]string{"endpoint": "http://localhost:8030"},
+			AssertsServer:           &AssertsServerConfig{Endpoint: "http://localhost:8030"},
 			DefaultLatencyThreshold: 0.5,
 		},
 		thresholds: xsync.NewMapOf[map[string]*ThresholdDto](),
@@ -102,12 +103,57 @@ func TestGetServiceDefaultThresholdFound(t *testing.T) {
 	byRequest := map[string]*ThresholdDto{}
 	th.thresholds.Store(dto.AsString(), byRequest)
 
-	byRequest[""] = &ThresholdDto{
+	byRequest["#"] = &ThresholdDto{
 		RequestContext:    "",
 		LatencyUpperBound: 1,
 	}
 
-	assert.Equal(t, float64(1), th.getThreshold("platform", "api-server", "/v1/latency-thresholds"))
+	assert.Equal(t, float64(1), th.getThreshold("platform", "api-server", "inbound", "/v1/latency-thresholds"))
+}
+
+func TestGetThresholdByRequestType(t *testing.T) {
+	logger, _ := zap.NewProduction()
+	var th = thresholdHelper{
+		logger: logger,
+		config: &Config{
+			Env:                     "dev",
+			Site:                    "us-west-2",
+			AssertsServer:           &AssertsServerConfig{Endpoint: "http://localhost:8030"},
+			DefaultLatencyThreshold: 0.5,
+		},
+		thresholds: xsync.NewMapOf[map[string]*ThresholdDto](),
+		entityKeys: xsync.NewMapOf[EntityKeyDto](),
+		rwMutex:    &sync.RWMutex{},
+	}
+
+	dto := EntityKeyDto{
+		Type: "Service", Name: "api-server", Scope: map[string]string{
+			"env": "dev", "site": "us-west-2", "namespace": "platform",
+		},
+	}
+	th.thresholds.Store(dto.AsString(), map[string]*ThresholdDto{
+		"inbound#/v1/rules":  {RequestType: "inbound", RequestContext: "/v1/rules", LatencyUpperBound: 1},
+		"outbound#/v1/rules": {RequestType: "outbound", RequestContext: "/v1/rules", LatencyUpperBound: 2},
+		"#/v1/alerts":        {RequestContext: "/v1/alerts", LatencyUpperBound: 3},
+		"outbound#":          {RequestType: "outbound", LatencyUpperBound: 4},
+	})
+
+	// Exact match
+	assert.Equal(t, float64(1), th.getThreshold("platform", "api-server", "inbound", "/v1/rules"))
+	assert.Equal(t, float64(2), th.getThreshold("platform", "api-server", "outbound", "/v1/rules"))
+	// A threshold without a request type matches no request
+	assert.Equal(t, float64(4), th.getThreshold("platform", "api-server", "outbound", "/v1/alerts"))
+	assert.Equal(t, 0.5, th.getThreshold("platform", "api-server", "inbound", "/v1/alerts"))
+	// Request type wildcard
+	assert.Equal(t, float64(4), th.getThreshold("platform", "api-server", "outbound", "/v1/users"))
+	// Default
+	assert.Equal(t, 0.5, th.getThreshold("platform", "api-server", "inbound", "/v1/users"))
+
+	th.thresholds.Store(dto.AsString(), map[string]*ThresholdDto{
+		"#": {LatencyUpperBound: 5},
+	})
+	// Entity wildcard
+	assert.Equal(t, float64(5), th.getThreshold("platform", "api-server", "inbound", "/v1/users"))
 }
 
 func TestStopUpdates(t *testing.T) {
@@ -117,7 +163,7 @@ func TestStopUpdates(t *testing.T) {
 		config: &Config{
 			Env:                     "dev",
 			Site:                    "us-west-2",
-			AssertsServer:           &map[string]string{"endpoint": "http://localhost:8030"},
+			AssertsServer:           &AssertsServerConfig{Endpoint: "http://localhost:8030"},
 			DefaultLatencyThreshold: 0.5,
 		},
 		thresholds: xsync.NewMapOf[map[string]*ThresholdDto](),
@@ -134,10 +180,10 @@ func TestUpdateThresholds(t *testing.T) {
 	config := &Config{
 		Env:  "dev",
 		Site: "us-west-2",
-		AssertsServer: &map[string]string{
-			"endpoint": "http://localhost:8030",
-			"user":     "user",
-			"password": "password",
+		AssertsServer: &AssertsServerConfig{
+			Endpoint: "http://localhost:8030",
+			User:     "user",
+			Password: "password",
 		},
 		DefaultLatencyThreshold: 0.5,
 	}
@@ -192,7 +238,7 @@ func TestUpdateThresholds(t *testing.T) {
 		entityKeys:          xsync.NewMapOf[EntityKeyDto](),
 		stop:                make(chan bool),
 		thresholdSyncTicker: clock.FromContext(ctx).NewTicker(10 * time.Millisecond),
-		rc:                  &mockClient,
+		provider:            &assertsThresholdProvider{logger: logger, rc: &mockClient},
 	}
 	entityKey1 := EntityKeyDto{
 		Type: "Service", Name: "api-server", Scope: map[string]string{
@@ -222,23 +268,23 @@ func TestUpdateThresholds(t *testing.T) {
 	assert.NotNil(t, thresholds)
 
 	assert.Equal(t, 2, len(thresholds))
-	assert.NotNil(t, thresholds["/v4/rules"])
-	assert.Equal(t, "inbound", thresholds["/v4/rules"].RequestType)
-	assert.Equal(t, "/v4/rules", thresholds["/v4/rules"].RequestContext)
-	assert.Equal(t, 0.25, thresholds["/v4/rules"].LatencyUpperBound)
-	assert.NotNil(t, thresholds["/v1/assertions"])
-	assert.Equal(t, "inbound", thresholds["/v1/assertions"].RequestType)
-	assert.Equal(t, "/v1/assertions", thresholds["/v1/assertions"].RequestContext)
-	assert.Equal(t, 0.5, thresholds["/v1/assertions"].LatencyUpperBound)
+	assert.NotNil(t, thresholds["inbound#/v4/rules"])
+	assert.Equal(t, "inbound", thresholds["inbound#/v4/rules"].RequestType)
+	assert.Equal(t, "/v4/rules", thresholds["inbound#/v4/rules"].RequestContext)
+	assert.Equal(t, 0.25, thresholds["inbound#/v4/rules"].LatencyUpperBound)
+	assert.NotNil(t, thresholds["inbound#/v1/assertions"])
+	assert.Equal(t, "inbound", thresholds["inbound#/v1/assertions"].RequestType)
+	assert.Equal(t, "/v1/assertions", thresholds["inbound#/v1/assertions"].RequestContext)
+	assert.Equal(t, 0.5, thresholds["inbound#/v1/assertions"].LatencyUpperBound)
 
 	thresholds, _ = th.thresholds.Load(entityKey2.AsString())
 	assert.NotNil(t, thresholds)
 
 	assert.Equal(t, 1, len(thresholds))
-	assert.NotNil(t, thresholds["run"])
-	assert.Equal(t, "method", thresholds["run"].RequestType)
-	assert.Equal(t, "run", thresholds["run"].RequestContext)
-	assert.Equal(t, 1.5, thresholds["run"].LatencyUpperBound)
+	assert.NotNil(t, thresholds["method#run"])
+	assert.Equal(t, "method", thresholds["method#run"].RequestType)
+	assert.Equal(t, "run", thresholds["method#run"].RequestContext)
+	assert.Equal(t, 1.5, thresholds["method#run"].LatencyUpperBound)
 }
 
 func TestUpdateThresholdsUnmarshalError(t *testing.T) {
@@ -247,10 +293,10 @@ func TestUpdateThresholdsUnmarshalError(t *testing.T) {
 	config := &Config{
 		Env:  "dev",
 		Site: "us-west-2",
-		AssertsServer: &map[string]string{
-			"endpoint": "http://localhost:8030",
-			"user":     "user",
-			"password": "password",
+		AssertsServer: &AssertsServerConfig{
+			Endpoint: "http://localhost:8030",
+			User:     "user",
+			Password: "password",
 		},
 		DefaultLatencyThreshold: 0.5,
 	}
@@ -261,10 +307,10 @@ func TestUpdateThresholdsUnmarshalError(t *testing.T) {
 		entityKeys:          xsync.NewMapOf[EntityKeyDto](),
 		stop:                make(chan bool),
 		thresholdSyncTicker: clock.FromContext(ctx).NewTicker(1 * time.Millisecond),
-		rc: &mockRestClient{
+		provider: &assertsThresholdProvider{logger: logger, rc: &mockRestClient{
 			expectedData: []byte(`invalid json`),
 			expectedErr:  nil,
-		},
+		}},
 	}
 	entityKey := EntityKeyDto{
 		Type: "Service", Name: "api-server", Scope: map[string]string{
@@ -284,6 +330,79 @@ func TestUpdateThresholdsUnmarshalError(t *testing.T) {
 	assert.Nil(t, thresholds)
 }
 
+func TestExpireEntityKeys(t *testing.T) {
+	logger, _ := zap.NewProduction()
+	var th = thresholdHelper{
+		logger: logger,
+		config: &Config{
+			Env:                     "dev",
+			Site:                    "us-west-2",
+			DefaultLatencyThreshold: 0.5,
+			EntityKeyTTLMinutes:     10,
+		},
+		thresholds: xsync.NewMapOf[map[string]*ThresholdDto](),
+		entityKeys: xsync.NewMapOf[EntityKeyDto](),
+		lastSeen:   xsync.NewMapOf[int64](),
+		rwMutex:    &sync.RWMutex{},
+	}
+	th.config.LatencyBaseline = &LatencyBaselineConfig{Quantile: 0.99, HalfLifeMinutes: 60, MinSamples: 1, MaxSeries: 10}
+	th.config.ErrorBaseline = &ErrorBaselineConfig{RollingHalfLifeMinutes: 5, BaselineHalfLifeMinutes: 60, Tolerance: 2, MinRequests: 1, MaxSeries: 10}
+	th.baselines = newLatencyBaselines(th.config)
+	th.errorBaselines = newErrorBaselines(th.config)
+	th.observeSpan("platform", "model-builder", buildLatencySpan("/v1/run", 1))
+	th.getThreshold("platform", "api-server", AssertsRequestTypeInbound, "/v1/rules")
+	th.getThreshold("platform", "model-builder", AssertsRequestTypeInbound, "/v1/run")
+	apiServer := buildEntityKey(th.config, "platform", "api-server")
+	modelBuilder := buildEntityKey(th.config, "platform", "model-builder")
+	th.thresholds.Store(apiServer.AsString(), map[string]*ThresholdDto{})
+	th.thresholds.Store(modelBuilder.AsString(), map[string]*ThresholdDto{})
+
+	now := time.Now()
+	th.expireEntityKeys(now)
+	th.expireEntityKeys(now.Add(5 * time.Minute))
+	assert.Equal(t, 2, th.entityKeys.Size())
+
+	// Only the api-server has been seen since, at the time of the last expiry
+	th.getThreshold("platform", "api-server", AssertsRequestTypeInbound, "/v1/rules")
+	seenAt, _ := th.lastSeen.Load(apiServer.AsString())
+	assert.Equal(t, now.Add(5*time.Minute).Unix(), seenAt)
+	th.expireEntityKeys(now.Add(11 * time.Minute))
+	assert.Equal(t, 1, th.entityKeys.Size())
+	_, found := th.entityKeys.Load(apiServer.AsString())
+	assert.True(t, found)
+	_, found = th.thresholds.Load(modelBuilder.AsString())
+	assert.False(t, found)
+	_, found = th.lastSeen.Load(modelBuilder.AsString())
+	assert.False(t, found)
+	assert.Equal(t, 0, th.baselines.baselines.Size())
+	assert.Equal(t, 0, th.errorBaselines.rates.Size())
+
+	// Entities never expire without a TTL
+	th.config.EntityKeyTTLMinutes = 0
+	th.expireEntityKeys(now.Add(time.Hour))
+	assert.Equal(t, 1, th.entityKeys.Size())
+}
+
+func TestChunkEntityKeys(t *testing.T) {
+	config := &Config{Env: "dev", Site: "us-west-2", MaxEntitiesPerThresholdRequest: 2}
+	var th = thresholdHelper{config: config}
+	entityKeys := []EntityKeyDto{
+		buildEntityKey(config, "platform", "model-builder"),
+		buildEntityKey(config, "platform", "api-server"),
+		buildEntityKey(config, "platform", "alertmanager"),
+	}
+
+	chunks := th.chunkEntityKeys(entityKeys)
+	assert.Equal(t, 2, len(chunks))
+	assert.Equal(t, 2, len(chunks[0]))
+	assert.Equal(t, 1, len(chunks[1]))
+	assert.Equal(t, "alertmanager", chunks[0][0].Name)
+	assert.Equal(t, "model-builder", chunks[1][0].Name)
+
+	config.MaxEntitiesPerThresholdRequest = 0
+	assert.Equal(t, 1, len(th.chunkEntityKeys(entityKeys)))
+}
+
 func TestThresholdsIsUpdated(t *testing.T) {
 	currConfig := &Config{
 		DefaultLatencyThreshold: 0.5,
@@ -322,3 +441,18 @@ func TestThresholdsOnUpdate(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, .51, th.getDefaultThreshold())
 }
+
+func TestThresholdsPrepareAndRollbackUpdate(t *testing.T) {
+	var th = thresholdHelper{
+		logger:  logger,
+		config:  &Config{DefaultLatencyThreshold: 0.5},
+		rwMutex: &sync.RWMutex{},
+	}
+
+	assert.NotNil(t, th.prepareUpdate(&Config{DefaultLatencyThreshold: -1}))
+	assert.Nil(t, th.prepareUpdate(&Config{DefaultLatencyThreshold: 0.75}))
+	assert.Nil(t, th.onUpdate(&Config{DefaultLatencyThreshold: 0.75}))
+	assert.Equal(t, .75, th.getDefaultThreshold())
+	th.rollbackUpdate()
+	assert.Equal(t, .5, th.getDefaultThreshold())
+}
@@ -1,6 +1,9 @@
 package assertsprocessor
 
-import "go.opentelemetry.io/collector/pdata/ptrace"
+import (
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
 
 type trace struct {
 	segments []*traceSegment
@@ -34,6 +37,12 @@ func (ts *traceSegment) getNonInternalSpans() []*ptrace.Span {
 	return ts.nonInternalSpans
 }
 
+func (ts *traceSegment) getAllSpans() []*ptrace.Span {
+	spans := make([]*ptrace.Span, 0, ts.getSpanCount())
+	spans = append(spans, ts.getNonInternalSpans()...)
+	return append(spans, ts.internalSpans...)
+}
+
 func (ts *traceSegment) getMainSpan() *ptrace.Span {
 	// A distributed trace will have only one root span. Trace fragments that come from a downstream service
 	// will not have a root span. In such a scenario, use the first entry or exit span as the main span
@@ -51,6 +60,61 @@ func (ts *traceSegment) getSpanCount() int {
 	return count
 }
 
+func (tr *trace) getSpanCount() int {
+	count := 0
+	for _, ts := range tr.segments {
+		count += ts.getSpanCount()
+	}
+	return count
+}
+
+// Returns the id of the trace from its first span. Returns false if the trace has no spans
+func (tr *trace) getTraceID() (pcommon.TraceID, bool) {
+	for _, ts := range tr.segments {
+		if span := ts.getMainSpan(); span != nil {
+			return span.TraceID(), true
+		}
+		for _, span := range ts.internalSpans {
+			return span.TraceID(), true
+		}
+	}
+	return pcommon.NewTraceIDEmpty(), false
+}
+
+// Copies the spans of the trace out of the batch they arrived in, so that a queued trace does not
+// keep the whole batch in memory. Returns the copy, which the segments of the trace now refer to
+func (tr *trace) detach() *ptrace.Traces {
+	detached := ptrace.NewTraces()
+	for _, ts := range tr.segments {
+		rs := detached.ResourceSpans().AppendEmpty()
+		if ts.resourceSpans != nil {
+			ts.resourceSpans.Resource().CopyTo(rs.Resource())
+		}
+		spans := rs.ScopeSpans().AppendEmpty().Spans()
+		copySpan := func(span *ptrace.Span) *ptrace.Span {
+			copied := spans.AppendEmpty()
+			span.CopyTo(copied)
+			return &copied
+		}
+
+		ts.resourceSpans = &rs
+		if ts.rootSpan != nil {
+			ts.rootSpan = copySpan(ts.rootSpan)
+		}
+		for j, span := range ts.entrySpans {
+			ts.entrySpans[j] = copySpan(span)
+		}
+		for j, span := range ts.exitSpans {
+			ts.exitSpans[j] = copySpan(span)
+		}
+		for j, span := range ts.internalSpans {
+			ts.internalSpans[j] = copySpan(span)
+		}
+		ts.nonInternalSpans = nil
+	}
+	return &detached
+}
+
 func newTrace(traceSegments ...*traceSegment) *trace {
 	return &trace{
 		segments: traceSegments,
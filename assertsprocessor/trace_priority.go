@@ -0,0 +1,117 @@
+package assertsprocessor
+
+import (
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"sync/atomic"
+)
+
+const (
+	AssertsTraceSamplePriorityAttribute = "asserts.sample.priority"
+)
+
+// Span attributes that indicate a request was retried. Both the current and the
+// legacy semantic convention names are recognised
+var retryAttributes = []string{"http.request.resend_count", "http.resend_count"}
+
+type TracePriorityWeights struct {
+	Latency  float64 `mapstructure:"latency" json:"latency"`
+	Segments float64 `mapstructure:"segments" json:"segments"`
+	Spans    float64 `mapstructure:"spans" json:"spans"`
+	Errors   float64 `mapstructure:"errors" json:"errors"`
+	Retries  float64 `mapstructure:"retries" json:"retries"`
+}
+
+// A traceScorer computes the priority of an Item in a TraceQueue. When a queue is full
+// the item with the lowest score is evicted first
+type traceScorer func(item *Item) float64
+
+func latencyScorer(item *Item) float64 {
+	return item.latency
+}
+
+// The weights of the composite score, which a config update replaces while traces are being queued.
+// A nil tracePriority scores the traces by latency alone
+type tracePriority struct {
+	weights atomic.Pointer[TracePriorityWeights]
+}
+
+func newTracePriority(config *Config) *tracePriority {
+	priority := &tracePriority{}
+	priority.setWeights(config.TracePriorityWeights)
+	return priority
+}
+
+func (tp *tracePriority) setWeights(weights *TracePriorityWeights) {
+	if weights != nil {
+		weightsCopy := *weights
+		weights = &weightsCopy
+	}
+	tp.weights.Store(weights)
+}
+
+// Returns true if the traces are scored by the composite score, which needs the latency threshold
+func (tp *tracePriority) weighted() bool {
+	return tp != nil && tp.weights.Load() != nil
+}
+
+func (tp *tracePriority) score(item *Item) float64 {
+	if tp == nil {
+		return latencyScorer(item)
+	}
+	weights := tp.weights.Load()
+	if weights == nil {
+		return latencyScorer(item)
+	}
+	return compositeScore(weights, item)
+}
+
+// Combines the latency relative to the latency threshold with the shape of the trace.
+// A trace that crosses more services, has more spans, errors or retries is more useful
+// for troubleshooting than a trace of similar latency that touched a single service.
+// The latency of an item without a threshold does not add to the score
+func compositeScore(weights *TracePriorityWeights, item *Item) float64 {
+	score := 0.0
+	if item.latencyThreshold > 0 {
+		score = weights.Latency * item.latency / item.latencyThreshold
+	}
+	if item.trace == nil {
+		return score
+	}
+
+	spanCount, errorCount, retryCount := 0, 0, 0
+	for _, ts := range item.trace.segments {
+		for _, span := range ts.getAllSpans() {
+			spanCount++
+			if spanHasError(span) {
+				errorCount++
+			}
+			if spanIsRetry(span) {
+				retryCount++
+			}
+		}
+	}
+	score += weights.Segments * float64(len(item.trace.segments))
+	score += weights.Spans * float64(spanCount)
+	score += weights.Errors * float64(errorCount)
+	score += weights.Retries * float64(retryCount)
+	return score
+}
+
+func spanIsRetry(span *ptrace.Span) bool {
+	for _, attr := range retryAttributes {
+		value, found := span.Attributes().Get(attr)
+		if found && value.Int() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Records the score with which the item won its place in the queue on the main span of each segment
+func (item *Item) recordScore() {
+	for _, ts := range item.trace.segments {
+		if mainSpan := ts.getMainSpan(); mainSpan != nil {
+			mainSpan.Attributes().PutDouble(AssertsTraceSamplePriorityAttribute, item.score)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package assertsprocessor
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"testing"
+)
+
+func TestTracePriorityDefaultsToLatency(t *testing.T) {
+	priority := newTracePriority(&Config{})
+	assert.False(t, priority.weighted())
+	assert.Equal(t, 0.7, priority.score(&Item{latency: 0.7, latencyThreshold: 0.5}))
+
+	var noPriority *tracePriority
+	assert.False(t, noPriority.weighted())
+	assert.Equal(t, 0.7, noPriority.score(&Item{latency: 0.7}))
+}
+
+func TestTracePrioritySetWeights(t *testing.T) {
+	priority := newTracePriority(&Config{})
+	item := &Item{latency: 3, latencyThreshold: 2}
+
+	weights := &TracePriorityWeights{Latency: 2}
+	priority.setWeights(weights)
+	assert.True(t, priority.weighted())
+	assert.Equal(t, 3.0, priority.score(item))
+	// The weights in use are a copy
+	weights.Latency = 4
+	assert.Equal(t, 3.0, priority.score(item))
+
+	priority.setWeights(nil)
+	assert.False(t, priority.weighted())
+	assert.Equal(t, 3.0, priority.score(&Item{latency: 3}))
+}
+
+func TestCompositeScore(t *testing.T) {
+	rootSpan := ptrace.NewSpan()
+	rootSpan.Status().SetCode(ptrace.StatusCodeError)
+	exitSpan := ptrace.NewSpan()
+	exitSpan.Attributes().PutInt("http.resend_count", 2)
+	internalSpan := ptrace.NewSpan()
+	downstreamSpan := ptrace.NewSpan()
+
+	tr := newTrace(
+		&traceSegment{
+			namespace:     "platform",
+			service:       "api-server",
+			rootSpan:      &rootSpan,
+			exitSpans:     []*ptrace.Span{&exitSpan},
+			internalSpans: []*ptrace.Span{&internalSpan},
+		},
+		&traceSegment{
+			namespace:  "platform",
+			service:    "payment",
+			entrySpans: []*ptrace.Span{&downstreamSpan},
+		},
+	)
+
+	weights := &TracePriorityWeights{
+		Latency:  1,
+		Segments: 0.1,
+		Spans:    0.01,
+		Errors:   0.5,
+		Retries:  0.25,
+	}
+	item := &Item{trace: tr, latency: 3, latencyThreshold: 2}
+	assert.InDelta(t, 1.5+0.2+0.04+0.5+0.25, compositeScore(weights, item), 1e-9)
+}
+
+func TestCompositeScoreWithoutThreshold(t *testing.T) {
+	weights := &TracePriorityWeights{Latency: 2, Segments: 1}
+	tr := newTrace(&traceSegment{service: "api-server"})
+	assert.Equal(t, 1.0, compositeScore(weights, &Item{trace: tr, latency: 1.5}))
+}
+
+func TestCompositeScorerPrefersRicherTrace(t *testing.T) {
+	priority := newTracePriority(&Config{
+		TracePriorityWeights: &TracePriorityWeights{
+			Latency:  1,
+			Segments: 0.5,
+		},
+	})
+	queue := newScoredTraceQueue(1, priority.score)
+
+	ctx := context.Background()
+	singleService := newTrace(&traceSegment{service: "api-server"})
+	queue.push(&Item{trace: singleService, ctx: &ctx, latency: 3.1, latencyThreshold: 3})
+
+	segments := make([]*traceSegment, 0)
+	for _, service := range []string{"api-server", "payment", "cart", "catalogue"} {
+		segments = append(segments, &traceSegment{service: service})
+	}
+	multiService := newTrace(segments...)
+	queue.push(&Item{trace: multiService, ctx: &ctx, latency: 2.9, latencyThreshold: 3})
+
+	assert.Equal(t, 1, len(queue.priorityQueue))
+	assert.Equal(t, multiService, queue.priorityQueue[0].trace)
+}
+
+func TestRecordScore(t *testing.T) {
+	rootSpan := ptrace.NewSpan()
+	entrySpan := ptrace.NewSpan()
+	item := &Item{
+		trace: newTrace(
+			&traceSegment{service: "api-server", rootSpan: &rootSpan},
+			&traceSegment{service: "payment", entrySpans: []*ptrace.Span{&entrySpan}},
+			&traceSegment{service: "cart"},
+		),
+		score: 1.25,
+	}
+
+	item.recordScore()
+
+	value, found := rootSpan.Attributes().Get(AssertsTraceSamplePriorityAttribute)
+	assert.True(t, found)
+	assert.Equal(t, 1.25, value.Double())
+	value, found = entrySpan.Attributes().Get(AssertsTraceSamplePriorityAttribute)
+	assert.True(t, found)
+	assert.Equal(t, 1.25, value.Double())
+}
@@ -3,6 +3,7 @@ package assertsprocessor
 import (
 	"github.com/stretchr/testify/assert"
 	"go.opentelemetry.io/collector/pdata/ptrace"
+	conventions "go.opentelemetry.io/collector/semconv/v1.6.1"
 	"testing"
 )
 
@@ -77,3 +78,50 @@ func TestGetSpanCount(t *testing.T) {
 	assert.Equal(t, 4, ts3.getSpanCount())
 	assert.Equal(t, 0, ts4.getSpanCount())
 }
+
+func TestDetachCopiesSpansOutOfBatch(t *testing.T) {
+	item, detached := buildQueuedItem("api-server", 1)
+	ts := item.trace.segments[0]
+
+	assert.Equal(t, 1, detached.ResourceSpans().Len())
+	assert.Equal(t, "GET /api-server", ts.rootSpan.Name())
+	serviceName, _ := ts.resourceSpans.Resource().Attributes().Get(conventions.AttributeServiceName)
+	assert.Equal(t, "api-server", serviceName.Str())
+
+	ts.rootSpan.Attributes().PutStr("copied", "true")
+	copiedSpan := detached.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0)
+	_, found := copiedSpan.Attributes().Get("copied")
+	assert.True(t, found)
+}
+
+func TestDetachKeepsEachSpanInItsRole(t *testing.T) {
+	batch := ptrace.NewTraces()
+	resourceSpans := batch.ResourceSpans().AppendEmpty()
+	spans := resourceSpans.ScopeSpans().AppendEmpty().Spans()
+	// The spans arrive in an order different from their roles
+	internalSpan := spans.AppendEmpty()
+	internalSpan.SetName("internal")
+	exitSpan := spans.AppendEmpty()
+	exitSpan.SetName("exit")
+	entrySpan := spans.AppendEmpty()
+	entrySpan.SetName("entry")
+
+	ts := &traceSegment{
+		resourceSpans: &resourceSpans,
+		entrySpans:    []*ptrace.Span{&entrySpan},
+		exitSpans:     []*ptrace.Span{&exitSpan},
+		internalSpans: []*ptrace.Span{&internalSpan},
+	}
+	assert.Equal(t, "entry", ts.getMainSpan().Name())
+	detached := newTrace(ts).detach()
+
+	assert.Equal(t, 3, detached.SpanCount())
+	assert.Equal(t, "entry", ts.entrySpans[0].Name())
+	assert.Equal(t, "exit", ts.exitSpans[0].Name())
+	assert.Equal(t, "internal", ts.internalSpans[0].Name())
+	assert.Equal(t, "entry", ts.getMainSpan().Name())
+
+	// The segment refers to the copy
+	ts.exitSpans[0].SetName("copied")
+	assert.Equal(t, "exit", exitSpan.Name())
+}
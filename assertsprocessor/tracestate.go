@@ -0,0 +1,226 @@
+package assertsprocessor
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+// The OpenTelemetry entry in the W3C tracestate, e.g. ot=th:c;rv:8a3f2c0d9e1b47. The sampling threshold th
+// is a 56-bit rejection threshold encoded as up to 14 hex digits with the trailing zeros removed. A span is
+// sampled when its 56-bit randomness is not below the threshold. Spans from older SDKs carry the
+// power-of-two p value instead, the base 2 logarithm of the adjusted count
+const (
+	otelTraceStateKey       = "ot"
+	traceStateThresholdKey  = "th"
+	traceStateRandomnessKey = "rv"
+	traceStatePValueKey     = "p"
+	maxThreshold            = uint64(1) << 56
+	thresholdHexDigits      = 14
+	zeroAdjustedCountP      = 63
+	maxSamplingPValue       = 56
+	otelTraceStateField     = ";"
+)
+
+type otelTraceState struct {
+	threshold    uint64
+	hasThreshold bool
+	randomness   uint64
+	hasRandom    bool
+	pValue       int
+	hasPValue    bool
+	fields       []string // the other fields of the ot entry, retained when writing the tracestate
+	otherEntries []string // the tracestate entries of the other vendors
+}
+
+func parseTraceState(raw string) *otelTraceState {
+	state := &otelTraceState{}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.HasPrefix(entry, otelTraceStateKey+"=") {
+			state.otherEntries = append(state.otherEntries, entry)
+			continue
+		}
+		for _, field := range strings.Split(strings.TrimPrefix(entry, otelTraceStateKey+"="), otelTraceStateField) {
+			key, value, found := strings.Cut(field, ":")
+			if !found {
+				continue
+			}
+			switch key {
+			case traceStateThresholdKey:
+				if threshold, ok := parseThreshold(value); ok {
+					state.threshold, state.hasThreshold = threshold, true
+				}
+			case traceStateRandomnessKey:
+				if randomness, err := strconv.ParseUint(value, 16, 64); err == nil && len(value) == thresholdHexDigits {
+					state.randomness, state.hasRandom = randomness, true
+				}
+			case traceStatePValueKey:
+				if p, err := strconv.Atoi(value); err == nil && p >= 0 && p <= zeroAdjustedCountP {
+					state.pValue, state.hasPValue = p, true
+				}
+			default:
+				state.fields = append(state.fields, field)
+			}
+		}
+	}
+	return state
+}
+
+func parseThreshold(value string) (uint64, bool) {
+	if value == "" || len(value) > thresholdHexDigits {
+		return 0, false
+	}
+	threshold, err := strconv.ParseUint(value, 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	return threshold << (4 * (thresholdHexDigits - len(value))), true
+}
+
+// Encodes the threshold in up to 14 hex digits. A threshold that rejects every span does not fit, and is
+// encoded as the highest threshold instead
+func formatThreshold(threshold uint64) string {
+	if threshold == 0 {
+		return "0"
+	}
+	if threshold >= maxThreshold {
+		threshold = maxThreshold - 1
+	}
+	encoded := strconv.FormatUint(threshold, 16)
+	encoded = strings.Repeat("0", thresholdHexDigits-len(encoded)) + encoded
+	return strings.TrimRight(encoded, "0")
+}
+
+// Converts a sampling probability to the rejection threshold
+func probabilityToThreshold(probability float64) uint64 {
+	if probability >= 1 {
+		return 0
+	}
+	if probability <= 0 {
+		return maxThreshold
+	}
+	return maxThreshold - uint64(math.Round(probability*float64(maxThreshold)))
+}
+
+// Returns the threshold with which the span was sampled upstream, zero when it was not sampled upstream
+func (state *otelTraceState) upstreamThreshold() uint64 {
+	if state.hasThreshold {
+		return state.threshold
+	}
+	if state.hasPValue && state.pValue <= maxSamplingPValue {
+		return maxThreshold - maxThreshold>>state.pValue
+	}
+	return 0
+}
+
+// Returns the number of spans in the population that the sampled span represents
+func (state *otelTraceState) adjustedCount() float64 {
+	if state.hasThreshold {
+		if state.threshold >= maxThreshold {
+			return 0
+		}
+		return float64(maxThreshold) / float64(maxThreshold-state.threshold)
+	}
+	if state.hasPValue {
+		if state.pValue == zeroAdjustedCountP {
+			return 0
+		}
+		return math.Pow(2, float64(state.pValue))
+	}
+	return 1
+}
+
+// The explicit randomness value takes precedence over the least significant 56 bits of the trace id
+func (state *otelTraceState) randomnessOf(span *ptrace.Span) uint64 {
+	if state.hasRandom {
+		return state.randomness
+	}
+	traceID := span.TraceID()
+	var randomness uint64
+	for _, b := range traceID[9:] {
+		randomness = randomness<<8 | uint64(b)
+	}
+	return randomness
+}
+
+func (state *otelTraceState) String() string {
+	fields := make([]string, 0, len(state.fields)+2)
+	if state.hasThreshold {
+		fields = append(fields, traceStateThresholdKey+":"+formatThreshold(state.threshold))
+	} else if state.hasPValue {
+		fields = append(fields, traceStatePValueKey+":"+strconv.Itoa(state.pValue))
+	}
+	if state.hasRandom {
+		randomness := strconv.FormatUint(state.randomness, 16)
+		fields = append(fields, traceStateRandomnessKey+":"+strings.Repeat("0", thresholdHexDigits-len(randomness))+randomness)
+	}
+	fields = append(fields, state.fields...)
+
+	entries := make([]string, 0, len(state.otherEntries)+1)
+	if len(fields) > 0 {
+		// The entry of the vendor that last modified the tracestate goes first
+		entries = append(entries, otelTraceStateKey+"="+strings.Join(fields, otelTraceStateField))
+	}
+	return strings.Join(append(entries, state.otherEntries...), ",")
+}
+
+// consistentSampler samples traces by their trace id randomness so that the decision for a trace is the
+// same in every collector and SDK that samples the trace with the same or a lower probability
+type consistentSampler struct {
+	threshold uint64
+}
+
+func newConsistentSampler(probability float64) *consistentSampler {
+	return &consistentSampler{threshold: probabilityToThreshold(probability)}
+}
+
+// Returns true if the span is to be sampled. The span's tracestate is not modified
+func (cs *consistentSampler) sample(span *ptrace.Span) bool {
+	state := parseTraceState(span.TraceState().AsRaw())
+	return state.randomnessOf(span) >= cs.effectiveThreshold(state)
+}
+
+// Records the threshold with which the spans were sampled so that the downstream consumers can compute
+// the adjusted counts
+func (cs *consistentSampler) recordThreshold(spans []*ptrace.Span) {
+	for _, span := range spans {
+		state := parseTraceState(span.TraceState().AsRaw())
+		state.threshold, state.hasThreshold = cs.effectiveThreshold(state), true
+		state.hasPValue = false
+		span.TraceState().FromRaw(state.String())
+	}
+}
+
+// The spans sampled upstream with a lower probability are kept at that probability
+func (cs *consistentSampler) effectiveThreshold(state *otelTraceState) uint64 {
+	upstream := state.upstreamThreshold()
+	if upstream > cs.threshold {
+		return upstream
+	}
+	return cs.threshold
+}
+
+// Returns the adjusted count of the trace. All the spans of a consistently sampled trace carry the same
+// threshold, so the main span of the first segment represents the trace
+func traceAdjustedCount(tr *trace) float64 {
+	for _, ts := range tr.segments {
+		if span := ts.getMainSpan(); span != nil {
+			return spanAdjustedCount(span)
+		}
+	}
+	return 1
+}
+
+func spanAdjustedCount(span *ptrace.Span) float64 {
+	raw := span.TraceState().AsRaw()
+	if raw == "" {
+		return 1
+	}
+	return parseTraceState(raw).adjustedCount()
+}
@@ -0,0 +1,92 @@
+package assertsprocessor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+func TestParseTraceState(t *testing.T) {
+	state := parseTraceState("ot=th:c;rv:8a3f2c0d9e1b47;foo:bar,vendor=value")
+	assert.True(t, state.hasThreshold)
+	assert.Equal(t, uint64(0xc0000000000000), state.threshold)
+	assert.True(t, state.hasRandom)
+	assert.Equal(t, uint64(0x8a3f2c0d9e1b47), state.randomness)
+	assert.Equal(t, []string{"foo:bar"}, state.fields)
+	assert.Equal(t, []string{"vendor=value"}, state.otherEntries)
+	assert.Equal(t, 4.0, state.adjustedCount())
+	assert.Equal(t, "ot=th:c;rv:8a3f2c0d9e1b47;foo:bar,vendor=value", state.String())
+}
+
+func TestParseTraceStatePValue(t *testing.T) {
+	state := parseTraceState("ot=p:3;r:5")
+	assert.False(t, state.hasThreshold)
+	assert.True(t, state.hasPValue)
+	assert.Equal(t, 8.0, state.adjustedCount())
+	assert.Equal(t, uint64(0xe0000000000000), state.upstreamThreshold())
+
+	assert.Equal(t, 0.0, parseTraceState("ot=p:63").adjustedCount())
+	assert.Equal(t, 1.0, parseTraceState("vendor=value").adjustedCount())
+	assert.Equal(t, 1.0, parseTraceState("ot=th:xyz").adjustedCount())
+}
+
+func TestFormatThreshold(t *testing.T) {
+	assert.Equal(t, "0", formatThreshold(0))
+	assert.Equal(t, "8", formatThreshold(probabilityToThreshold(0.5)))
+	assert.Equal(t, "c", formatThreshold(probabilityToThreshold(0.25)))
+	assert.Equal(t, uint64(0), probabilityToThreshold(1))
+	assert.Equal(t, maxThreshold, probabilityToThreshold(0))
+	// A threshold that rejects every span is encoded as the highest threshold
+	assert.Equal(t, "ffffffffffffff", formatThreshold(maxThreshold))
+	assert.Equal(t, "ffffffffffffff", formatThreshold(maxThreshold-1))
+}
+
+func TestConsistentSamplerUsesTraceIdRandomness(t *testing.T) {
+	cs := newConsistentSampler(0.5)
+
+	span := ptrace.NewSpan()
+	span.SetTraceID([16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0x80, 0, 0, 0, 0, 0, 0})
+	assert.True(t, cs.sample(&span))
+
+	span.SetTraceID([16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	assert.False(t, cs.sample(&span))
+
+	// The explicit randomness takes precedence over the trace id
+	span.TraceState().FromRaw("ot=rv:90000000000000")
+	assert.True(t, cs.sample(&span))
+}
+
+func TestConsistentSamplerKeepsLowerUpstreamProbability(t *testing.T) {
+	cs := newConsistentSampler(0.5)
+
+	span := ptrace.NewSpan()
+	span.TraceState().FromRaw("ot=th:c;rv:b0000000000000,vendor=value")
+	assert.False(t, cs.sample(&span))
+
+	span.TraceState().FromRaw("ot=th:c;rv:d0000000000000,vendor=value")
+	assert.True(t, cs.sample(&span))
+	cs.recordThreshold([]*ptrace.Span{&span})
+	assert.Equal(t, "ot=th:c;rv:d0000000000000,vendor=value", span.TraceState().AsRaw())
+}
+
+func TestConsistentSamplerRecordsThreshold(t *testing.T) {
+	cs := newConsistentSampler(0.25)
+
+	span1 := ptrace.NewSpan()
+	span2 := ptrace.NewSpan()
+	span2.TraceState().FromRaw("ot=p:1,vendor=value")
+	cs.recordThreshold([]*ptrace.Span{&span1, &span2})
+
+	assert.Equal(t, "ot=th:c", span1.TraceState().AsRaw())
+	assert.Equal(t, "ot=th:c,vendor=value", span2.TraceState().AsRaw())
+	assert.Equal(t, 4.0, spanAdjustedCount(&span1))
+}
+
+func TestTraceAdjustedCount(t *testing.T) {
+	rootSpan := ptrace.NewSpan()
+	rootSpan.TraceState().FromRaw("ot=th:8")
+	tr := newTrace(&traceSegment{}, &traceSegment{rootSpan: &rootSpan})
+	assert.Equal(t, 2.0, traceAdjustedCount(tr))
+	assert.Equal(t, 1.0, traceAdjustedCount(newTrace(&traceSegment{})))
+}
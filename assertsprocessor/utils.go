@@ -110,7 +110,9 @@ func buildTrace(tr *trace) *ptrace.Traces {
 	newTrace := ptrace.NewTraces()
 	for _, ts := range tr.segments {
 		rs := newTrace.ResourceSpans().AppendEmpty()
-		ts.resourceSpans.Resource().CopyTo(rs.Resource())
+		if ts.resourceSpans != nil {
+			ts.resourceSpans.Resource().CopyTo(rs.Resource())
+		}
 		ils := rs.ScopeSpans().AppendEmpty()
 
 		spans := ts.getNonInternalSpans()